@@ -1,9 +1,13 @@
 package rose
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 )
 
 type AppResult struct {
@@ -11,6 +15,11 @@ type AppResult struct {
 	Method string `json:"method"`
 	Status string `json:"status"`
 	Reason string `json:"reason"`
+	// the error of an after hook, the operation is done although it is set
+	HookError string `json:"hookError,omitempty"`
+	// the error of a capped collection that could not drop its oldest blocks after the write, the write is done
+	// although it is set and the blocks are dropped by the next write
+	CapError string `json:"capError,omitempty"`
 }
 
 type readBySingleResult struct {
@@ -29,11 +38,66 @@ type BulkAppResult struct {
 	Method string `json:"method"`
 	Status string `json:"status"`
 	Reason string `json:"reason"`
+	// the first error of an after hook, the documents are written although it is set
+	HookError string `json:"hookError,omitempty"`
+	// the error of a capped collection that could not drop its oldest blocks after the write, the documents are
+	// written although it is set and the blocks are dropped by the next write
+	CapError string `json:"capError,omitempty"`
+}
+
+// CollectionStats describes the size and state of a collection as returned by Stats
+type CollectionStats struct {
+	Name string `json:"name"`
+	Documents int `json:"documents"`
+	Blocks int `json:"blocks"`
+	// tombstones are lines of deleted or replaced documents that stay in a block until it is defragmented or compacted.
+	// Only blocks that have tombstones are listed
+	Tombstones map[uint16]int `json:"tombstones"`
+	TotalTombstones int `json:"totalTombstones"`
+	// size of all block files
+	TotalBytes int64 `json:"totalBytes"`
+	// size of the lines that hold documents
+	LiveBytes int64 `json:"liveBytes"`
+	// part of TotalBytes that is taken by tombstones, from 0 to 1
+	Fragmentation float64 `json:"fragmentation"`
+	Indexes []IndexInfo `json:"indexes"`
+	// approximate number of bytes that all indexes hold in memory
+	IndexBytes uint64 `json:"indexBytes"`
+	// number of balancer workers that run queries on this collection
+	Workers int `json:"workers"`
+	// options that the collection was created with
+	Options CollectionOptions `json:"options"`
+}
+
+// IndexInfo describes an index of a collection as returned by ListIndexes
+type IndexInfo struct {
+	Name string `json:"name"`
+	Fields []IndexField `json:"fields"`
+	// data types of the fields, separated by a comma for compound indexes
+	Type string `json:"type"`
+	Options IndexOptions `json:"options"`
+	Entries int `json:"entries"`
+	// approximate number of bytes that the index entries hold in memory
+	MemoryBytes uint64 `json:"memoryBytes"`
+	// an index that is still being built is not used by ReadBy and queries
+	Complete bool `json:"complete"`
+	// part of the saved blocks that the index holds, from 0 to 1
+	Progress float64 `json:"progress"`
+	BuildError string `json:"buildError,omitempty"`
 }
 
 type Rose struct {
 	Databases map[string]*db
 	fsIndexHandler *indexFsHandler
+	// operations on documents and indexes hold it for reading, operations that open or close collections for writing
+	collLock sync.RWMutex
+	compactor *compactor
+	compactorLock sync.Mutex
+	reaper *reaper
+	reaperLock sync.Mutex
+	// locked until Shutdown so that no other process opens the same data directory
+	dataDir string
+	hooks hookRegistry
 }
 
 func New(output bool) (*Rose, Error) {
@@ -41,40 +105,177 @@ func New(output bool) (*Rose, Error) {
 }
 
 /**
-Creates a new index, not on the database level, but in the filesystem (.rose_db/indexes.rose). Then later, when the application is booted up,
-the booter takes the index information and creates the index in memory. That is why, after adding any new indexes, a reboot should be done
-so that the indexes are written into memory from the database.
+Creates a new index, both in the filesystem (.rose_db/indexes.rose) and in memory. If the collection already holds documents, the index
+is built from them in the background, one block at a time, while writes continue and keep the index up to date. Until the build is complete,
+ReadBy on the index returns an error with IndexBuildingCode and queries do not use it. Build progress is reported by ListIndexes.
 
 If an index that is already created is given, this function silently skips the index, and does not add it. Uniqueness is determined by collection
 name and field name.
 
 If the collection that the index is written for does not exists, this function returns an error.
+
+A unique index (IndexOptions.Unique) is built from the existing documents right away. If existing documents already hold
+duplicate values, the index is not created and the returned error lists every conflict. After that, Write, BulkWrite and Replace
+that would duplicate a value are rejected with DuplicateKeyCode.
+
+A TTL index (IndexOptions.TTL) on a date or date_time field expires documents IndexOptions.ExpireAfter seconds after the
+date of the field, or at the date itself if ExpireAfter is 0. Expired documents are hidden from Read, ReadBy and Query and
+deleted by the reaper, see StartReaper.
+ */
+func (a *Rose) NewIndex(collName string, fieldName string, dType indexDataType, options ...IndexOptions) Error {
+	return a.newIndex(collName, []IndexField{{Name: fieldName, DataType: dType}}, options)
+}
+
+/**
+Creates an index over an ordered list of fields. The index is named after its fields, separated by a comma, e.i. "tenantId,status".
+ReadBy and queries can use any prefix of the fields, which means that an index on tenantId and status is used for lookups on
+tenantId alone and on tenantId and status together, but not for lookups on status alone.
+
+Everything else works the same as NewIndex.
  */
-func (a *Rose) NewIndex(collName string, fieldName string, dType indexDataType) Error {
+func (a *Rose) NewCompoundIndex(collName string, fields []IndexField, options ...IndexOptions) Error {
+	if len(fields) == 0 {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, "Validation error. Compound index must have at least one field")
+	}
+
+	for _, f := range fields {
+		if strings.Contains(f.Name, ",") {
+			return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Index field name '%s' cannot contain a comma", f.Name))
+		}
+	}
+
+	return a.newIndex(collName, fields, options)
+}
+
+func (a *Rose) newIndex(collName string, fields []IndexField, options []IndexOptions) Error {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
 	db, ok := a.Databases[collName]
 
 	if !ok {
 		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid index request. Collection %s does not exist", collName))
 	}
 
-	if err := a.fsIndexHandler.Add(fsIndex{
-		Name:    collName,
-		Field:    fieldName,
-		DataType: dType,
-	}); err != nil {
+	opts := IndexOptions{}
+	if len(options) > 0 {
+		opts = options[0]
+	}
+
+	fsi := newFsIndex(collName, fields, opts)
+
+	if err := fsi.validate(); err != nil {
+		return err
+	}
+
+	if fsi.Options.Unique {
+		if err := db.createUniqueFieldIndex(fields, fsi.Options); err != nil {
+			return err
+		}
+	}
+
+	if err := a.fsIndexHandler.Add(fsi); err != nil {
+		return err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	_, exists := db.FieldIndex[indexName(fields)]
+
+	// unique indexes are already built and an existing index only registers its fields
+	idx := db.createFieldIndex(fields, fsi.Options)
+
+	if exists {
+		return nil
+	}
+
+	if len(db.PrimaryIndex) == 0 {
+		idx.Complete = true
+
+		return nil
+	}
+
+	// blocks are listed under the same lock that creates the index, so documents in blocks created later are indexed by writes
+	blocks, err := listBlocks(fmt.Sprintf("%s/%s", roseDbDir(), collName))
+
+	if err != nil {
+		db.dropFieldIndex(indexName(fields))
+
 		return err
 	}
 
-	if !hasString(db.FieldIndexKeys, fieldName) {
-		db.FieldIndexKeys = append(db.FieldIndexKeys, fieldName)
+	idx.TotalBlocks = len(blocks)
+
+	db.indexBuilds.Add(1)
+	go db.buildFieldIndex(idx, blocks)
+
+	return nil
+}
+
+/**
+Drops an index. The index is removed from .rose_db/indexes.rose and its entries are released from memory. The name
+of an index is its field name, or the field names separated by a comma for a compound index, as returned by ListIndexes.
+
+Returns an error with IndexNotExistsCode if the collection does not have this index.
+ */
+func (a *Rose) DropIndex(collName string, name string) Error {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
+	db, ok := a.Databases[collName]
+
+	if !ok {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid index request. Collection %s does not exist", collName))
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	if _, ok := db.FieldIndex[name]; !ok {
+		return newError(ValidationMasterErrorCode, IndexNotExistsCode, fmt.Sprintf("Invalid index request. Index '%s' does not exist in collection %s", name, collName))
+	}
+
+	if err := a.fsIndexHandler.Remove(collName, name); err != nil {
+		return err
 	}
 
-	db.createFieldIndex(fieldName, dType)
+	db.dropFieldIndex(name)
 
 	return nil
 }
 
-func (a *Rose) NewCollection(name string) Error {
+/**
+Returns every index of a collection, sorted by name.
+ */
+func (a *Rose) ListIndexes(collName string) ([]IndexInfo, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
+	db, ok := a.Databases[collName]
+
+	if !ok {
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid index request. Collection %s does not exist", collName))
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.indexInfos(), nil
+}
+
+/**
+Creates a collection. If the collection already exists, this function silently skips it and its options are not changed.
+
+A capped collection (CollectionOptions.MaxDocuments or MaxBytes) keeps only its newest documents. Since IDs fill the blocks of
+a collection in order, a write that fills the cap with newer documents drops the oldest blocks entirely, which is cheaper
+than deleting documents one by one. The newest MaxDocuments documents or MaxBytes bytes are always kept, the collection
+holds at most one block more than its cap. Options are saved in .rose_db/collections.rose.
+ */
+func (a *Rose) NewCollection(name string, options ...CollectionOptions) Error {
+	a.collLock.Lock()
+	defer a.collLock.Unlock()
+
 	collDir := fmt.Sprintf("%s/%s", roseDbDir(), name)
 
 	_, err := os.Stat(collDir)
@@ -83,6 +284,15 @@ func (a *Rose) NewCollection(name string) Error {
 		return nil
 	}
 
+	opts := CollectionOptions{}
+	if len(options) > 0 {
+		opts = options[0]
+	}
+
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
 	if err := os.Mkdir(collDir, 0755); err != nil {
 		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to create collection directory with underlying error: %s", err.Error()))
 	}
@@ -100,31 +310,367 @@ func (a *Rose) NewCollection(name string) Error {
 		return e
 	}
 
-	w, dErr := newFsDriver(collDir, writeDriver)
+	saved, oErr := loadCollectionOptions(name)
 
-	if dErr != nil {
-		return dErr
+	if oErr != nil {
+		return oErr
 	}
 
-	r, dErr := newFsDriver(collDir, updateDriver)
+	// options of a collection that was removed without DropCollection are not kept
+	if opts.isCapped() || saved.isCapped() {
+		if err := updateCollectionOptions(func(saved map[string]CollectionOptions) {
+			delete(saved, name)
 
-	if dErr != nil {
-		return dErr
+			if opts.isCapped() {
+				saved[name] = opts
+			}
+		}); err != nil {
+			return err
+		}
 	}
 
-	d, dErr := newFsDriver(collDir, updateDriver)
+	d, dErr := openDatabase(name)
 
 	if dErr != nil {
 		return dErr
 	}
 
-	a.Databases[name] = newDb(
-		w,
-		r,
-		d,
-		name,
-		1,
-	)
+	a.Databases[name] = d
+
+	return nil
+}
+
+/**
+Returns statistics of a collection. Live bytes are counted by reading every block, so this is not a cheap call on large collections.
+ */
+func (a *Rose) Stats(collName string) (*CollectionStats, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
+	db, ok := a.Databases[collName]
+
+	if !ok {
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid stats request. Collection %s does not exist", collName))
+	}
+
+	return db.stats()
+}
+
+/**
+Compacts a collection. Every block that holds deleted or replaced documents is rewritten without them into a temporary file
+that replaces the block only when it is completely written, so a crash during compaction leaves the block intact. The block
+is locked only while it is rewritten, other operations on the collection go on between blocks.
+ */
+func (a *Rose) Compact(collName string) (*CompactResult, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
+	db, ok := a.Databases[collName]
+
+	if !ok {
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid compact request. Collection %s does not exist", collName))
+	}
+
+	return db.compact(0)
+}
+
+/**
+Starts a background compactor that checks every collection in the given interval and compacts the blocks in which deleted
+and replaced documents make at least MinTombstoneRatio of all lines. It runs until StopCompactor or Shutdown is called.
+ */
+func (a *Rose) StartCompactor(opts CompactorOptions) Error {
+	if opts.Interval <= 0 {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, "Invalid compactor options. Interval must be greater than 0")
+	}
+
+	if opts.MinTombstoneRatio <= 0 || opts.MinTombstoneRatio > 1 {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid compactor options. MinTombstoneRatio must be greater than 0 and at most 1, %g given", opts.MinTombstoneRatio))
+	}
+
+	a.compactorLock.Lock()
+	defer a.compactorLock.Unlock()
+
+	if a.compactor != nil {
+		return newError(GenericMasterErrorCode, AppInvalidUsageCode, "Invalid compactor request. Compactor is already running")
+	}
+
+	c := &compactor{stop: make(chan bool)}
+	c.done.Add(1)
+
+	go c.run(a, opts)
+
+	a.compactor = c
+
+	return nil
+}
+
+// StopCompactor stops the background compactor and waits for the compaction that is running to finish. It does nothing if the compactor is not running
+func (a *Rose) StopCompactor() {
+	a.compactorLock.Lock()
+	defer a.compactorLock.Unlock()
+
+	if a.compactor == nil {
+		return
+	}
+
+	close(a.compactor.stop)
+	a.compactor.done.Wait()
+
+	a.compactor = nil
+}
+
+// ListCollections returns the names of all collections, sorted
+func (a *Rose) ListCollections() []string {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
+	names := make([]string, 0, len(a.Databases))
+	for name := range a.Databases {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+/**
+Drops a collection with all of its documents and indexes. Operations that are running on the collection are finished first,
+then its drivers, balancer workers and index builds are stopped, its indexes are removed from .rose_db/indexes.rose,
+its schema from .rose_db/schemas.rose and its directory and change log are removed.
+ */
+func (a *Rose) DropCollection(name string) Error {
+	a.collLock.Lock()
+	defer a.collLock.Unlock()
+
+	db, ok := a.Databases[name]
+
+	if !ok {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid drop request. Collection %s does not exist", name))
+	}
+
+	// a closed collection cannot be used, even if removing it fails
+	delete(a.Databases, name)
+
+	if err := shutdownErrors(db.Shutdown()); err != nil {
+		return err
+	}
+
+	if err := a.fsIndexHandler.RemoveCollection(name); err != nil {
+		return err
+	}
+
+	if err := removeSchema(name); err != nil {
+		return err
+	}
+
+	if err := removeCollectionOptions(name); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(fmt.Sprintf("%s/%s", roseDbDir(), name)); err != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to remove collection directory with underlying error: %s", err.Error()))
+	}
+
+	if err := os.RemoveAll(changeLogDir(name)); err != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to remove change log directory with underlying error: %s", err.Error()))
+	}
+
+	return nil
+}
+
+/**
+Renames a collection. The collection is closed, its directory, indexes and schema are moved to the new name and it is loaded again
+under the new name, together with its indexes. If a step fails, the steps before it are undone and the collection is loaded
+again under its old name.
+ */
+func (a *Rose) RenameCollection(name string, newName string) Error {
+	a.collLock.Lock()
+	defer a.collLock.Unlock()
+
+	db, ok := a.Databases[name]
+
+	if !ok {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid rename request. Collection %s does not exist", name))
+	}
+
+	if newName == "" || newName == "." || newName == ".." || strings.ContainsAny(newName, "/\\") {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid rename request. Collection name '%s' is not a valid directory name", newName))
+	}
+
+	if _, ok := a.Databases[newName]; ok {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid rename request. Collection %s already exists", newName))
+	}
+
+	delete(a.Databases, name)
+
+	if err := shutdownErrors(db.Shutdown()); err != nil {
+		// the collection is opened again with whatever is on disk
+		_ = a.reopenCollection(name)
+
+		return err
+	}
+
+	collDir := fmt.Sprintf("%s/%s", roseDbDir(), name)
+	newCollDir := fmt.Sprintf("%s/%s", roseDbDir(), newName)
+
+	// every step that is done is undone in reverse order if a later one fails, so the collection stays under its old name
+	undo := make([]func(), 0)
+	rollback := func(err Error) Error {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+
+		// a step that could not be undone leaves the blocks under the new name
+		if _, e := os.Stat(collDir); e != nil {
+			_ = a.reopenCollection(newName)
+
+			return err
+		}
+
+		_ = a.reopenCollection(name)
+
+		return err
+	}
+
+	if e := os.Rename(collDir, newCollDir); e != nil {
+		return rollback(newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to rename collection directory with underlying error: %s", e.Error())))
+	}
+
+	undo = append(undo, func() {
+		_ = os.Rename(newCollDir, collDir)
+	})
+
+	if err := a.fsIndexHandler.RenameCollection(name, newName); err != nil {
+		return rollback(err)
+	}
+
+	undo = append(undo, func() {
+		_ = a.fsIndexHandler.RenameCollection(newName, name)
+	})
+
+	if err := renameSchema(name, newName); err != nil {
+		return rollback(err)
+	}
+
+	undo = append(undo, func() {
+		_ = renameSchema(newName, name)
+	})
+
+	if err := renameCollectionOptions(name, newName); err != nil {
+		return rollback(err)
+	}
+
+	undo = append(undo, func() {
+		_ = renameCollectionOptions(newName, name)
+	})
+
+	// revisions continue under the new name. A log that was left under the new name is not of this collection, it is
+	// moved aside and removed only once the log of this collection took its place
+	staleLogDir := fmt.Sprintf("%s.stale", changeLogDir(newName))
+	_ = os.RemoveAll(staleLogDir)
+
+	if e := os.Rename(changeLogDir(newName), staleLogDir); e != nil && !os.IsNotExist(e) {
+		return rollback(newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to rename change log directory with underlying error: %s", e.Error())))
+	}
+
+	undo = append(undo, func() {
+		_ = os.Rename(staleLogDir, changeLogDir(newName))
+	})
+
+	if e := os.Rename(changeLogDir(name), changeLogDir(newName)); e != nil && !os.IsNotExist(e) {
+		return rollback(newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to rename change log directory with underlying error: %s", e.Error())))
+	}
+
+	undo = append(undo, func() {
+		_ = os.Rename(changeLogDir(newName), changeLogDir(name))
+	})
+
+	if err := a.reopenCollection(newName); err != nil {
+		return rollback(err)
+	}
+
+	_ = os.RemoveAll(staleLogDir)
+
+	return nil
+}
+
+/**
+Removes every document of a collection. Indexes are kept and hold no entries afterwards. Like DropCollection, the collection
+is closed first and then opened again with a single empty block. IDs start from 1 again.
+
+The change log is kept and watchers receive a delete change for every truncated document, so that a watcher that
+resumes after the truncate does not take the documents written with the same IDs afterwards for the old ones.
+ */
+func (a *Rose) TruncateCollection(name string) Error {
+	a.collLock.Lock()
+	defer a.collLock.Unlock()
+
+	db, ok := a.Databases[name]
+
+	if !ok {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid truncate request. Collection %s does not exist", name))
+	}
+
+	db.Lock()
+	ids := make([]int, 0, len(db.PrimaryIndex))
+	for id := range db.PrimaryIndex {
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+
+	changes := make([]ChangeEvent, 0, len(ids))
+	for _, id := range ids {
+		changes = append(changes, ChangeEvent{Type: DeleteChange, ID: id})
+	}
+
+	db.logChanges(changes...)
+	db.Unlock()
+
+	delete(a.Databases, name)
+
+	if err := shutdownErrors(db.Shutdown()); err != nil {
+		return err
+	}
+
+	collDir := fmt.Sprintf("%s/%s", roseDbDir(), name)
+	blocks, err := listBlocks(collDir)
+
+	if err != nil {
+		return err
+	}
+
+	for _, blockId := range blocks {
+		if blockId == 0 {
+			continue
+		}
+
+		if e := os.Remove(roseBlockFile(blockId, collDir)); e != nil {
+			return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to remove block file with underlying error: %s", e.Error()))
+		}
+	}
+
+	if e := os.Truncate(roseBlockFile(0, collDir), 0); e != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to truncate block file with underlying error: %s", e.Error()))
+	}
+
+	return a.reopenCollection(name)
+}
+
+// opens a collection and loads its documents and indexes the same way as on boot. The caller must hold collLock for writing
+func (a *Rose) reopenCollection(name string) Error {
+	d, err := openDatabase(name)
+
+	if err != nil {
+		return err
+	}
+
+	if err := loadAllIndexes(map[string]*db{name: d}); err != nil {
+		return err
+	}
+
+	a.Databases[name] = d
 
 	return nil
 }
@@ -138,13 +684,34 @@ func (a *Rose) Write(m WriteMetadata) (*AppResult, Error) {
 		return nil, err
 	}
 
+	if !a.hooks.has(m.CollectionName, beforeWriteHook, afterWriteHook) {
+		return a.write(m, nil)
+	}
+
+	e := &HookEvent{Collection: m.CollectionName, Type: InsertChange}
+	res, err := a.write(m, a.hooks.beforeWrite(e))
+
+	if err != nil {
+		return nil, err
+	}
+
+	e.ID = res.ID
+	res.HookError = a.hooks.runAfter(afterWriteHook, e)
+
+	return res, nil
+}
+
+func (a *Rose) write(m WriteMetadata, hooks lockedHooks) (*AppResult, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
 	db, ok := a.Databases[m.CollectionName]
 
 	if !ok {
 		return nil, newError(GenericMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid write request. Collection %s does not exist", m.CollectionName))
 	}
 
-	_, ID, err := db.Write(m.Data)
+	_, ID, capErr, err := db.Write(m.Data, hooks)
 
 	if err != nil {
 		return nil, err
@@ -154,10 +721,47 @@ func (a *Rose) Write(m WriteMetadata) (*AppResult, Error) {
 		ID:   ID,
 		Method: WriteMethodType,
 		Status: OkResultStatus,
+		CapError: capErr,
 	}, nil
 }
 
+/**
+Writes every document of m.Data. With write hooks, the before hooks of every document run before any of them
+is written and the after hooks run once all of them are written. The after hooks of every document run even if
+the ones of a document before it fail, HookError holds the first error.
+*/
 func (a *Rose) BulkWrite(m BulkWriteMetadata) (*BulkAppResult, Error) {
+	if !a.hooks.has(m.CollectionName, beforeWriteHook, afterWriteHook) {
+		return a.bulkWrite(m, nil)
+	}
+
+	events := make([]*HookEvent, 0, len(m.Data))
+	res, err := a.bulkWrite(m, func(old json.RawMessage, data interface{}) (interface{}, Error) {
+		e := &HookEvent{Collection: m.CollectionName, Type: InsertChange}
+		events = append(events, e)
+
+		return a.hooks.beforeWrite(e)(old, data)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, id := range writtenIds(res.WrittenIDs) {
+		events[i].ID = id
+
+		if hookErr := a.hooks.runAfter(afterWriteHook, events[i]); hookErr != "" && res.HookError == "" {
+			res.HookError = hookErr
+		}
+	}
+
+	return res, nil
+}
+
+func (a *Rose) bulkWrite(m BulkWriteMetadata, hooks lockedHooks) (*BulkAppResult, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
 	db, ok := a.Databases[m.CollectionName]
 
 	if !ok {
@@ -165,7 +769,7 @@ func (a *Rose) BulkWrite(m BulkWriteMetadata) (*BulkAppResult, Error) {
 	}
 
 	// save the entry under idx into memory
-	_, written, err := db.BulkWrite(m.Data)
+	_, written, capErr, err := db.BulkWrite(m.Data, hooks)
 
 	if err != nil {
 		return nil, err
@@ -175,6 +779,7 @@ func (a *Rose) BulkWrite(m BulkWriteMetadata) (*BulkAppResult, Error) {
 		WrittenIDs: written,
 		Method: BulkWriteMethodType,
 		Status: OkResultStatus,
+		CapError: capErr,
 	}, nil
 }
 
@@ -183,6 +788,9 @@ func (a *Rose) Read(m ReadMetadata) (*AppResult, Error) {
 		return nil, err
 	}
 
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
 	db, ok := a.Databases[m.CollectionName]
 
 	if !ok {
@@ -212,6 +820,9 @@ func (a *Rose) Read(m ReadMetadata) (*AppResult, Error) {
 }
 
 func (a *Rose) ReadBy(m ReadByMetadata) (*AppReadResult, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
 	db, ok := a.Databases[m.CollectionName]
 
 	if !ok {
@@ -257,13 +868,34 @@ func (a *Rose) Delete(m DeleteMetadata) (*AppResult, Error) {
 		return nil, err
 	}
 
+	if !a.hooks.has(m.CollectionName, beforeDeleteHook, afterDeleteHook) {
+		return a.delete(m, nil)
+	}
+
+	e := &HookEvent{Collection: m.CollectionName, Type: DeleteChange, ID: m.ID}
+	res, err := a.delete(m, a.hooks.beforeDelete(e))
+
+	// hooks do not run for a document that does not exist
+	if err != nil || res.Status != DeletedResultStatus {
+		return res, err
+	}
+
+	res.HookError = a.hooks.runAfter(afterDeleteHook, e)
+
+	return res, nil
+}
+
+func (a *Rose) delete(m DeleteMetadata, hooks lockedHooks) (*AppResult, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
 	db, ok := a.Databases[m.CollectionName]
 
 	if !ok {
 		return nil, newError(GenericMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid read request. Collection %s does not exist", m.CollectionName))
 	}
 
-	res, err := db.Delete(m.ID)
+	res, err := db.Delete(m.ID, hooks)
 
 	if err != nil {
 		return nil, err
@@ -294,25 +926,52 @@ func (a *Rose) Replace(m ReplaceMetadata) (*AppResult, Error) {
 		return nil, err
 	}
 
+	if !a.hooks.has(m.CollectionName, beforeWriteHook, afterWriteHook) {
+		res, _, err := a.replace(m, nil)
+
+		return res, err
+	}
+
+	e := &HookEvent{Collection: m.CollectionName, Type: ReplaceChange, ID: m.ID}
+	res, found, err := a.replace(m, a.hooks.beforeWrite(e))
+
+	// hooks do not run for a document that does not exist
+	if err != nil || !found {
+		return res, err
+	}
+
+	res.HookError = a.hooks.runAfter(afterWriteHook, e)
+
+	return res, nil
+}
+
+func (a *Rose) replace(m ReplaceMetadata, hooks lockedHooks) (*AppResult, bool, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
 	db, ok := a.Databases[m.CollectionName]
 
 	if !ok {
-		return nil, newError(GenericMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid read request. Collection %s does not exist", m.CollectionName))
+		return nil, false, newError(GenericMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid read request. Collection %s does not exist", m.CollectionName))
 	}
 
-	err := db.Replace(m.ID, m.Data)
+	found, capErr, err := db.Replace(m.ID, m.Data, hooks)
 
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	return &AppResult{
 		Method: ReplaceMethodType,
 		Status: ReplacedResultStatus,
-	}, nil
+		CapError: capErr,
+	}, found, nil
 }
 
 func (a *Rose) Query(qb *queryBuilder) ([]QueryResult, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
 	db, ok := a.Databases[qb.query.collName]
 
 	if !ok {
@@ -322,7 +981,31 @@ func (a *Rose) Query(qb *queryBuilder) ([]QueryResult, Error) {
 	return db.Query(qb.query)
 }
 
+/**
+Returns how a query would be executed without running it: whether it uses an index and which one, or how many blocks
+are scanned. A query that Query would reject with an error, e.i. a matches condition without a text index, is rejected
+with the same error.
+*/
+func (a *Rose) Explain(qb *queryBuilder) (*QueryExplanation, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
+	db, ok := a.Databases[qb.query.collName]
+
+	if !ok {
+		return nil, newError(GenericMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid explain request. Collection %s does not exist", qb.query.collName))
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.explain(qb.query)
+}
+
 func (a *Rose) Size() (uint64, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
 	var size uint64
 	colls, err := ioutil.ReadDir(roseDbDir())
 
@@ -346,26 +1029,40 @@ func (a *Rose) Size() (uint64, Error) {
 }
 
 func (a *Rose) Shutdown() Error {
+	// the compactor and the reaper hold collLock while they run so they are stopped before collLock is taken
+	a.StopCompactor()
+	a.StopReaper()
+
+	a.collLock.Lock()
+	defer a.collLock.Unlock()
+
 	if err := a.fsIndexHandler.Close(); err != nil {
 		return err
 	}
 
 	for _, db := range a.Databases {
-		errors := db.Shutdown()
-		msg := ""
-
-		for _, e := range errors {
-			if e != nil {
-				msg += e.Error() + "\n"
-			}
+		if err := shutdownErrors(db.Shutdown()); err != nil {
+			return err
 		}
+	}
 
-		if msg != "" {
-			base := fmt.Sprintf("Shutdown failed with these errors:\n%s", msg)
+	return unlockDataDir(a.dataDir)
+}
+
+func shutdownErrors(errors [3]Error) Error {
+	msg := ""
 
-			return newError(SystemMasterErrorCode, ShutdownFailureCode, base)
+	for _, e := range errors {
+		if e != nil {
+			msg += e.Error() + "\n"
 		}
 	}
 
+	if msg != "" {
+		base := fmt.Sprintf("Shutdown failed with these errors:\n%s", msg)
+
+		return newError(SystemMasterErrorCode, ShutdownFailureCode, base)
+	}
+
 	return nil
 }
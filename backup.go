@@ -0,0 +1,770 @@
+package rose
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the file that describes a backup. It is written last, a directory without it is not a complete backup
+const backupManifestFile = "manifest.json"
+// a restore that is verified and only needs its directories to be swapped in, see finishRestore()
+const restorePendingFile = "restore.pending"
+
+type BackupManifest struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Collections []BackupCollection `json:"collections"`
+	// sha256 of indexes.rose in the backup
+	IndexesChecksum string `json:"indexesChecksum"`
+	// sha256 of schemas.rose in the backup, empty if no collection has a schema
+	SchemasChecksum string `json:"schemasChecksum,omitempty"`
+}
+
+type BackupCollection struct {
+	Name string `json:"name"`
+	Documents int `json:"documents"`
+	Blocks []BackupBlock `json:"blocks"`
+	// change log files of the collection, so that watchers can resume after a restore. A backup without them
+	// restores the collection with an empty change log that starts again at revision 1
+	Changes []BackupBlock `json:"changes,omitempty"`
+	// options of a capped collection, see NewCollection
+	Options *CollectionOptions `json:"options,omitempty"`
+}
+
+type BackupBlock struct {
+	Name string `json:"name"`
+	Size int64 `json:"size"`
+	// sha256 of the block
+	Checksum string `json:"checksum"`
+}
+
+/**
+Creates a backup of every collection with their indexes, schemas, options and change logs in destDir while Rose keeps running.
+Reads and writes of a collection wait while it is copied, so every collection is backed up as it was at a single point in time.
+Other collections are not affected.
+
+destDir must not exist or must be empty. It has the same layout as .rose_db with a manifest.json that holds a checksum
+of every file. The manifest is written last, so a backup that was cancelled with ctx or failed is never mistaken for a
+complete one; in that case everything written into destDir is removed.
+*/
+func (a *Rose) Backup(ctx context.Context, destDir string) (*BackupManifest, Error) {
+	if err := prepareBackupDir(destDir); err != nil {
+		return nil, err
+	}
+
+	manifest, err := a.backup(ctx, destDir)
+
+	if err != nil {
+		removeBackup(destDir)
+
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func (a *Rose) backup(ctx context.Context, destDir string) (*BackupManifest, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
+	manifest := &BackupManifest{
+		CreatedAt: time.Now().UTC(),
+		Collections: make([]BackupCollection, 0),
+	}
+
+	names := make([]string, 0, len(a.Databases))
+	for name := range a.Databases {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	indexes := ""
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return nil, newError(GenericMasterErrorCode, AppInvalidUsageCode, fmt.Sprintf("Backup cancelled with underlying message: %s", ctx.Err().Error()))
+		}
+
+		coll, content, err := a.backupCollection(ctx, a.Databases[name], destDir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		manifest.Collections = append(manifest.Collections, *coll)
+		indexes += content
+	}
+
+	checksum, err := writeBackupFile(fmt.Sprintf("%s/indexes.rose", destDir), []uint8(indexes))
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifest.IndexesChecksum = checksum
+
+	schemas, err := collectionSchemas(names)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(schemas) > 0 {
+		b, e := json.Marshal(schemas)
+
+		if e != nil {
+			return nil, newError(SystemMasterErrorCode, DataConversionCode, fmt.Sprintf("Unable to back up schemas with underlying message: %s", e.Error()))
+		}
+
+		if manifest.SchemasChecksum, err = writeBackupFile(fmt.Sprintf("%s/schemas.rose", destDir), b); err != nil {
+			return nil, err
+		}
+	}
+
+	b, e := json.Marshal(manifest)
+
+	if e != nil {
+		return nil, newError(SystemMasterErrorCode, DataConversionCode, fmt.Sprintf("Unable to create backup manifest with underlying message: %s", e.Error()))
+	}
+
+	if _, err := writeBackupFile(fmt.Sprintf("%s/%s", destDir, backupManifestFile), b); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// copies every block and the change log of a collection and returns its indexes.rose lines. Reads and writes of the collection wait until it is copied
+func (a *Rose) backupCollection(ctx context.Context, d *db, destDir string) (*BackupCollection, string, Error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	srcDir := fmt.Sprintf("%s/%s", roseDbDir(), d.Name)
+	dstDir := fmt.Sprintf("%s/db/%s", destDir, d.Name)
+
+	if e := os.MkdirAll(dstDir, os.ModePerm); e != nil {
+		return nil, "", newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to create backup directory %s with underlying message: %s", dstDir, e.Error()))
+	}
+
+	blocks, err := listBlocks(srcDir)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	coll := &BackupCollection{
+		Name: d.Name,
+		Documents: len(d.PrimaryIndex),
+		Blocks: make([]BackupBlock, 0, len(blocks)),
+	}
+
+	if d.options.isCapped() {
+		options := d.options
+		coll.Options = &options
+	}
+
+	for _, blockId := range blocks {
+		if ctx.Err() != nil {
+			return nil, "", newError(GenericMasterErrorCode, AppInvalidUsageCode, fmt.Sprintf("Backup cancelled with underlying message: %s", ctx.Err().Error()))
+		}
+
+		block, err := copyBlockFile(roseBlockFile(blockId, srcDir), roseBlockFile(blockId, dstDir))
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		coll.Blocks = append(coll.Blocks, *block)
+	}
+
+	changes, err := backupChangeLog(d, fmt.Sprintf("%s/%s/%s", destDir, changesDir, d.Name))
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	coll.Changes = changes
+
+	content, err := a.fsIndexHandler.CollectionContent(d.Name)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return coll, content, nil
+}
+
+// copies the change log files of a collection, the older one first. The lock of the collection must be held
+func backupChangeLog(d *db, dstDir string) ([]BackupBlock, Error) {
+	changes := make([]BackupBlock, 0)
+
+	if d.changes == nil {
+		return changes, nil
+	}
+
+	// the log is moved to changes.old.rose while it is appended to
+	d.changes.Lock()
+	defer d.changes.Unlock()
+
+	if e := os.MkdirAll(dstDir, os.ModePerm); e != nil {
+		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to create backup directory %s with underlying message: %s", dstDir, e.Error()))
+	}
+
+	for _, name := range []string{oldChangeLogFile, changeLogFile} {
+		src := fmt.Sprintf("%s/%s", d.changes.dir, name)
+
+		if _, e := os.Stat(src); os.IsNotExist(e) {
+			continue
+		}
+
+		file, err := copyBlockFile(src, fmt.Sprintf("%s/%s", dstDir, name))
+
+		if err != nil {
+			return nil, err
+		}
+
+		changes = append(changes, *file)
+	}
+
+	return changes, nil
+}
+
+/**
+Restores a backup created with Rose.Backup into the data directory. Rose must not be running while the backup is restored,
+Restore returns an error if the data directory is opened by another process or by a Rose in this one. Create Rose with New() afterwards.
+
+Change logs are restored with the collections, so watchers can resume from a revision that the backup holds. Collections of
+a backup without change logs start with an empty one.
+
+Every file of the backup is checked against the checksums in its manifest and every block is read to check that it is not
+corrupted. The backup is then copied next to the current database and checked again. Only then is the current database
+replaced with it. If the process stops while the database is replaced, the replacement is finished on the next boot.
+*/
+func Restore(srcDir string) Error {
+	manifest, err := VerifyBackup(srcDir)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := createDbIfNotExists(false); err != nil {
+		return err
+	}
+
+	dir, err := lockDataDirExclusively()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = unlockDataDir(dir)
+	}()
+
+	stagingDir := fmt.Sprintf("%s.restore", roseDbDir())
+	stagingChanges := fmt.Sprintf("%s.restore", roseChangesDir())
+	stagingIndexes := fmt.Sprintf("%s.restore", roseIndexLocation())
+	stagingSchemas := fmt.Sprintf("%s.restore", roseSchemaLocation())
+	stagingOptions := fmt.Sprintf("%s.restore", roseCollectionsLocation())
+
+	// left by a restore that stopped before it was verified
+	for _, staging := range []string{stagingDir, stagingChanges} {
+		if e := os.RemoveAll(staging); e != nil {
+			return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to remove %s with underlying message: %s", staging, e.Error()))
+		}
+	}
+
+	if err := copyBackup(srcDir, manifest, stagingDir, stagingChanges, stagingIndexes); err != nil {
+		_ = os.RemoveAll(stagingDir)
+		_ = os.RemoveAll(stagingChanges)
+		_ = os.Remove(stagingIndexes)
+
+		return err
+	}
+
+	if err := verifyBackupFiles(stagingDir, stagingChanges, stagingIndexes, manifest); err != nil {
+		_ = os.RemoveAll(stagingDir)
+		_ = os.RemoveAll(stagingChanges)
+		_ = os.Remove(stagingIndexes)
+
+		return err
+	}
+
+	// the restored collections have the schemas of the backup, none if it has no schemas.rose
+	if err := copyBackupSchemas(srcDir, manifest, stagingSchemas); err != nil {
+		_ = os.RemoveAll(stagingDir)
+		_ = os.RemoveAll(stagingChanges)
+		_ = os.Remove(stagingIndexes)
+		_ = os.Remove(stagingSchemas)
+
+		return err
+	}
+
+	// the restored collections have the options of the backup
+	if err := writeBackupOptions(manifest, stagingOptions); err != nil {
+		_ = os.RemoveAll(stagingDir)
+		_ = os.RemoveAll(stagingChanges)
+		_ = os.Remove(stagingIndexes)
+		_ = os.Remove(stagingSchemas)
+		_ = os.Remove(stagingOptions)
+
+		return err
+	}
+
+	// from here on, the restore is finished even if the process stops
+	if _, err := writeBackupFile(fmt.Sprintf("%s/%s", roseDir(), restorePendingFile), []uint8(srcDir)); err != nil {
+		return err
+	}
+
+	return finishRestore()
+}
+
+/**
+VerifyBackup checks that a backup is complete and not corrupted and returns its manifest. The size and checksum of
+every file must match the manifest and every collection must hold as many documents as when it was backed up. Names of
+collections and files in the manifest must not lead out of the backup.
+*/
+func VerifyBackup(srcDir string) (*BackupManifest, Error) {
+	b, e := ioutil.ReadFile(fmt.Sprintf("%s/%s", srcDir, backupManifestFile))
+
+	if e != nil {
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid backup %s. Unable to read its %s, the backup is either incomplete or not a backup: %s", srcDir, backupManifestFile, e.Error()))
+	}
+
+	manifest := &BackupManifest{}
+	if e := json.Unmarshal(b, manifest); e != nil {
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid backup %s. Malformed %s: %s", srcDir, backupManifestFile, e.Error()))
+	}
+
+	if err := verifyBackupFiles(fmt.Sprintf("%s/db", srcDir), fmt.Sprintf("%s/%s", srcDir, changesDir), fmt.Sprintf("%s/indexes.rose", srcDir), manifest); err != nil {
+		return nil, err
+	}
+
+	if _, err := verifyBackupSchemas(fmt.Sprintf("%s/schemas.rose", srcDir), manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func verifyBackupFiles(dbDir string, logsDir string, indexesFile string, manifest *BackupManifest) Error {
+	if err := verifyBackupNames(manifest); err != nil {
+		return err
+	}
+
+	for _, coll := range manifest.Collections {
+		documents := 0
+
+		for _, block := range coll.Blocks {
+			fileName := fmt.Sprintf("%s/%s/%s", dbDir, coll.Name, block.Name)
+			checksum, size, live, err := verifyBlockFile(fileName)
+
+			if err != nil {
+				return err
+			}
+
+			if size != block.Size || checksum != block.Checksum {
+				return newError(DbIntegrityMasterErrorCode, BlockCorruptedCode, fmt.Sprintf("Invalid backup. Block %s does not match the backup manifest", fileName))
+			}
+
+			documents += live
+		}
+
+		if documents != coll.Documents {
+			return newError(DbIntegrityMasterErrorCode, BlockCorruptedCode, fmt.Sprintf("Invalid backup. Collection %s holds %d documents but %d were backed up", coll.Name, documents, coll.Documents))
+		}
+
+		for _, file := range coll.Changes {
+			fileName := fmt.Sprintf("%s/%s/%s", logsDir, coll.Name, file.Name)
+			b, e := ioutil.ReadFile(fileName)
+
+			if e != nil {
+				return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Invalid backup. Unable to read change log %s: %s", fileName, e.Error()))
+			}
+
+			if int64(len(b)) != file.Size || checksumOf(b) != file.Checksum {
+				return newError(DbIntegrityMasterErrorCode, BlockCorruptedCode, fmt.Sprintf("Invalid backup. Change log %s does not match the backup manifest", fileName))
+			}
+		}
+	}
+
+	b, e := ioutil.ReadFile(indexesFile)
+
+	if e != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Invalid backup. Unable to read %s: %s", indexesFile, e.Error()))
+	}
+
+	if checksumOf(b) != manifest.IndexesChecksum {
+		return newError(DbIntegrityMasterErrorCode, MalformedIndexCode, fmt.Sprintf("Invalid backup. %s does not match the backup manifest", indexesFile))
+	}
+
+	if err := (&indexFsHandler{}).init(b); err != nil {
+		return newError(DbIntegrityMasterErrorCode, MalformedIndexCode, fmt.Sprintf("Invalid backup. %s is malformed: %s", indexesFile, err.Error()))
+	}
+
+	return nil
+}
+
+// names of the manifest are joined to paths, so a name must not hold a path separator or '..'
+func verifyBackupNames(manifest *BackupManifest) Error {
+	invalid := func(name string) bool {
+		return name == "" || strings.Contains(name, "..") || strings.ContainsRune(name, '/') || strings.ContainsRune(name, os.PathSeparator)
+	}
+
+	for _, coll := range manifest.Collections {
+		if invalid(coll.Name) {
+			return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid backup. Collection name '%s' in the backup manifest is not a valid name", coll.Name))
+		}
+
+		for _, block := range coll.Blocks {
+			if invalid(block.Name) {
+				return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid backup. Block name '%s' of collection %s in the backup manifest is not a valid name", block.Name, coll.Name))
+			}
+		}
+
+		for _, file := range coll.Changes {
+			if file.Name != changeLogFile && file.Name != oldChangeLogFile {
+				return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid backup. Change log name '%s' of collection %s in the backup manifest is not a valid name", file.Name, coll.Name))
+			}
+		}
+	}
+
+	return nil
+}
+
+// reads a block and returns its checksum, size and number of documents
+func verifyBlockFile(fileName string) (string, int64, int, Error) {
+	b, e := ioutil.ReadFile(fileName)
+
+	if e != nil {
+		return "", 0, 0, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Invalid backup. Unable to read block %s: %s", fileName, e.Error()))
+	}
+
+	file, err := createFile(fileName, os.O_RDONLY)
+
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	defer file.Close()
+
+	reader := NewLineReader(file)
+
+	live := 0
+	for {
+		_, val, err := reader.Read()
+
+		if err != nil && err.GetCode() == EOFCode {
+			break
+		}
+
+		if err != nil || val == nil {
+			return "", 0, 0, newError(DbIntegrityMasterErrorCode, BlockCorruptedCode, fmt.Sprintf("Invalid backup. Block %s is corrupted", fileName))
+		}
+
+		live++
+	}
+
+	return checksumOf(b), int64(len(b)), live, nil
+}
+
+// copies the files of a backup into the directories and the index file that will replace the current ones
+func copyBackup(srcDir string, manifest *BackupManifest, dbDir string, logsDir string, indexesFile string) Error {
+	for _, coll := range manifest.Collections {
+		dstDir := fmt.Sprintf("%s/%s", dbDir, coll.Name)
+
+		if e := os.MkdirAll(dstDir, os.ModePerm); e != nil {
+			return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to create directory %s with underlying message: %s", dstDir, e.Error()))
+		}
+
+		for _, block := range coll.Blocks {
+			src := fmt.Sprintf("%s/db/%s/%s", srcDir, coll.Name, block.Name)
+
+			if _, err := copyBlockFile(src, fmt.Sprintf("%s/%s", dstDir, block.Name)); err != nil {
+				return err
+			}
+		}
+
+		// every collection gets a change log directory, an empty one if the backup has no change log
+		logDir := fmt.Sprintf("%s/%s", logsDir, coll.Name)
+
+		if e := os.MkdirAll(logDir, os.ModePerm); e != nil {
+			return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to create directory %s with underlying message: %s", logDir, e.Error()))
+		}
+
+		for _, file := range coll.Changes {
+			src := fmt.Sprintf("%s/%s/%s/%s", srcDir, changesDir, coll.Name, file.Name)
+
+			if _, err := copyBlockFile(src, fmt.Sprintf("%s/%s", logDir, file.Name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	b, e := ioutil.ReadFile(fmt.Sprintf("%s/indexes.rose", srcDir))
+
+	if e != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to read %s/indexes.rose with underlying message: %s", srcDir, e.Error()))
+	}
+
+	_, err := writeBackupFile(indexesFile, b)
+
+	return err
+}
+
+// checks schemas.rose of a backup against its manifest and returns its content, {} for a backup without schemas
+func verifyBackupSchemas(schemasFile string, manifest *BackupManifest) ([]uint8, Error) {
+	if manifest.SchemasChecksum == "" {
+		return []uint8("{}"), nil
+	}
+
+	b, e := ioutil.ReadFile(schemasFile)
+
+	if e != nil {
+		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Invalid backup. Unable to read %s: %s", schemasFile, e.Error()))
+	}
+
+	if checksumOf(b) != manifest.SchemasChecksum {
+		return nil, newError(DbIntegrityMasterErrorCode, MalformedIndexCode, fmt.Sprintf("Invalid backup. %s does not match the backup manifest", schemasFile))
+	}
+
+	schemas, err := readSchemasFile(schemasFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for name, schema := range schemas {
+		if _, err := compileSchema(schema); err != nil {
+			return nil, newError(DbIntegrityMasterErrorCode, MalformedIndexCode, fmt.Sprintf("Invalid backup. Schema of collection %s in %s is invalid: %s", name, schemasFile, err.Error()))
+		}
+	}
+
+	return b, nil
+}
+
+// writes the options of the capped collections in a backup into a collections.rose
+func writeBackupOptions(manifest *BackupManifest, optionsFile string) Error {
+	options := make(map[string]CollectionOptions)
+	for _, coll := range manifest.Collections {
+		if coll.Options != nil {
+			options[coll.Name] = *coll.Options
+		}
+	}
+
+	b, e := json.Marshal(options)
+
+	if e != nil {
+		return newError(SystemMasterErrorCode, DataConversionCode, fmt.Sprintf("Unable to restore collection options with underlying message: %s", e.Error()))
+	}
+
+	_, err := writeBackupFile(optionsFile, b)
+
+	return err
+}
+
+func copyBackupSchemas(srcDir string, manifest *BackupManifest, schemasFile string) Error {
+	b, err := verifyBackupSchemas(fmt.Sprintf("%s/schemas.rose", srcDir), manifest)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = writeBackupFile(schemasFile, b)
+
+	return err
+}
+
+/**
+Swaps a verified restore in place of the current database. Every step can be repeated, so if the process stops while
+the database is swapped, calling this function again on boot finishes the restore.
+*/
+func finishRestore() Error {
+	pending := fmt.Sprintf("%s/%s", roseDir(), restorePendingFile)
+
+	if _, e := os.Stat(pending); os.IsNotExist(e) {
+		return nil
+	}
+
+	dbDir := roseDbDir()
+	stagingDir := fmt.Sprintf("%s.restore", dbDir)
+	oldDir := fmt.Sprintf("%s.old", dbDir)
+	logsDir := roseChangesDir()
+	stagingChanges := fmt.Sprintf("%s.restore", logsDir)
+	oldChanges := fmt.Sprintf("%s.old", logsDir)
+	stagingIndexes := fmt.Sprintf("%s.restore", roseIndexLocation())
+	stagingSchemas := fmt.Sprintf("%s.restore", roseSchemaLocation())
+	stagingOptions := fmt.Sprintf("%s.restore", roseCollectionsLocation())
+
+	fsErr := func(e error) Error {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to finish restoring the database. Restore will be finished on the next boot. Underlying message: %s", e.Error()))
+	}
+
+	if _, e := os.Stat(stagingDir); e == nil {
+		if e := os.RemoveAll(oldDir); e != nil {
+			return fsErr(e)
+		}
+
+		if _, e := os.Stat(dbDir); e == nil {
+			if e := os.Rename(dbDir, oldDir); e != nil {
+				return fsErr(e)
+			}
+		}
+
+		if e := os.Rename(stagingDir, dbDir); e != nil {
+			return fsErr(e)
+		}
+	}
+
+	if _, e := os.Stat(stagingChanges); e == nil {
+		if e := os.RemoveAll(oldChanges); e != nil {
+			return fsErr(e)
+		}
+
+		if _, e := os.Stat(logsDir); e == nil {
+			if e := os.Rename(logsDir, oldChanges); e != nil {
+				return fsErr(e)
+			}
+		}
+
+		if e := os.Rename(stagingChanges, logsDir); e != nil {
+			return fsErr(e)
+		}
+	}
+
+	if _, e := os.Stat(stagingIndexes); e == nil {
+		if e := os.Rename(stagingIndexes, roseIndexLocation()); e != nil {
+			return fsErr(e)
+		}
+	}
+
+	if _, e := os.Stat(stagingSchemas); e == nil {
+		if e := os.Rename(stagingSchemas, roseSchemaLocation()); e != nil {
+			return fsErr(e)
+		}
+	}
+
+	if _, e := os.Stat(stagingOptions); e == nil {
+		if e := os.Rename(stagingOptions, roseCollectionsLocation()); e != nil {
+			return fsErr(e)
+		}
+	}
+
+	if e := os.RemoveAll(oldDir); e != nil {
+		return fsErr(e)
+	}
+
+	if e := os.RemoveAll(oldChanges); e != nil {
+		return fsErr(e)
+	}
+
+	if e := os.Remove(pending); e != nil {
+		return fsErr(e)
+	}
+
+	return nil
+}
+
+func prepareBackupDir(destDir string) Error {
+	files, e := ioutil.ReadDir(destDir)
+
+	if e != nil && !os.IsNotExist(e) {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Invalid backup directory %s: %s", destDir, e.Error()))
+	}
+
+	if len(files) != 0 {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid backup directory %s. Directory must be empty or must not exist", destDir))
+	}
+
+	if e := os.MkdirAll(fmt.Sprintf("%s/db", destDir), os.ModePerm); e != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to create backup directory %s with underlying message: %s", destDir, e.Error()))
+	}
+
+	return nil
+}
+
+// removes everything that a failed backup wrote. The directory itself is kept since it could have existed before
+func removeBackup(destDir string) {
+	_ = os.Remove(fmt.Sprintf("%s/%s", destDir, backupManifestFile))
+	_ = os.Remove(fmt.Sprintf("%s/indexes.rose", destDir))
+	_ = os.Remove(fmt.Sprintf("%s/schemas.rose", destDir))
+	_ = os.RemoveAll(fmt.Sprintf("%s/db", destDir))
+	_ = os.RemoveAll(fmt.Sprintf("%s/%s", destDir, changesDir))
+}
+
+// copies a block, syncs the copy and returns its size and checksum
+func copyBlockFile(src string, dst string) (*BackupBlock, Error) {
+	in, err := createFile(src, os.O_RDONLY)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer in.Close()
+
+	out, err := createFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	size, e := io.Copy(io.MultiWriter(out, hash), in)
+
+	if e != nil {
+		_ = out.Close()
+
+		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to copy %s to %s with underlying message: %s", src, dst, e.Error()))
+	}
+
+	if err := closeFile(out); err != nil {
+		return nil, err
+	}
+
+	info, e := in.Stat()
+
+	if e != nil {
+		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to stat %s with underlying message: %s", src, e.Error()))
+	}
+
+	return &BackupBlock{
+		Name: info.Name(),
+		Size: size,
+		Checksum: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// writes and syncs a file and returns its checksum
+func writeBackupFile(fileName string, b []uint8) (string, Error) {
+	f, err := createFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+
+	if err != nil {
+		return "", err
+	}
+
+	if _, e := f.Write(b); e != nil {
+		_ = f.Close()
+
+		return "", newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to write %s with underlying message: %s", fileName, e.Error()))
+	}
+
+	if err := closeFile(f); err != nil {
+		return "", err
+	}
+
+	return checksumOf(b), nil
+}
+
+func checksumOf(b []uint8) string {
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])
+}
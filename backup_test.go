@@ -0,0 +1,386 @@
+package rose
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+var _ = GinkgoDescribe("Backup tests", func() {
+	GinkgoIt("Should backup the database while writes keep flowing and restore it", func() {
+		// Restore refuses a data directory that a Rose of another spec left open
+		dataDir, e := ioutil.TempDir("", "rose_backup_data")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dataDir)
+
+		defer func() {
+			SetDataDir("")
+			_ = os.RemoveAll(dataDir)
+		}()
+
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "backup_coll")
+		busyColl := testCreateCollection(a, "busy_coll")
+
+		err := a.NewIndex(collName, "email", stringIndexType)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		for i := 0; i < 50; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		for i := 1; i <= 5; i++ {
+			testSingleDelete(DeleteMetadata{CollectionName: collName, ID: i}, a)
+		}
+
+		stop := make(chan bool)
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					_, err := a.Write(WriteMetadata{CollectionName: busyColl, Data: testAsJsonInterface(TestUser{Email: "busy@gmail.com"})})
+					gomega.Expect(err).To(gomega.BeNil())
+				}
+			}
+		}()
+
+		dir, e := ioutil.TempDir("", "rose_backup")
+		gomega.Expect(e).To(gomega.BeNil())
+		defer os.RemoveAll(dir)
+
+		manifest, err := a.Backup(context.Background(), dir)
+
+		close(stop)
+		wg.Wait()
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(manifest.Collections)).To(gomega.Equal(2))
+		gomega.Expect(manifest.Collections[0].Name).To(gomega.Equal(collName))
+		gomega.Expect(manifest.Collections[0].Documents).To(gomega.Equal(45))
+		gomega.Expect(manifest.Collections[1].Name).To(gomega.Equal(busyColl))
+
+		busyDocuments := manifest.Collections[1].Documents
+
+		verified, err := VerifyBackup(dir)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(verified.Collections).To(gomega.Equal(manifest.Collections))
+
+		_, err = a.Backup(context.Background(), dir)
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal(fmt.Sprintf("Invalid backup directory %s. Directory must be empty or must not exist", dir)))
+
+		// changes after the backup are not restored
+		for i := 0; i < 10; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "after@gmail.com"})}, a)
+		}
+
+		err = a.NewCollection("after_backup")
+		gomega.Expect(err).To(gomega.BeNil())
+
+		// a Rose that is open in this process uses the data directory
+		err = Restore(dir)
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(AppInvalidUsageCode))
+		gomega.Expect(a.ListCollections()).To(gomega.ContainElement("after_backup"))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		err = Restore(dir)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		a = testCreateRose(false)
+
+		gomega.Expect(a.ListCollections()).To(gomega.Equal([]string{collName, busyColl}))
+
+		stats, err := a.Stats(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(stats.Documents).To(gomega.Equal(45))
+		gomega.Expect(len(stats.Indexes)).To(gomega.Equal(1))
+
+		stats, err = a.Stats(busyColl)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(stats.Documents).To(gomega.Equal(busyDocuments))
+
+		res, err := a.ReadBy(ReadByMetadata{
+			CollectionName: collName,
+			Field:          "email",
+			Value:          "20@gmail.com",
+			DataType:       stringIndexType,
+		})
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(res.Data)).To(gomega.Equal(1))
+		gomega.Expect(res.Data[0].ID).To(gomega.Equal(21))
+
+		// the change log is restored as it was, 50 inserts and 5 deletes
+		w, err := a.Watch(context.Background(), collName, WatchOptions{After: 50})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		change, err := w.Next()
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(change.Revision).To(gomega.Equal(uint64(51)))
+		gomega.Expect(change.Type).To(gomega.Equal(DeleteChange))
+		gomega.Expect(change.ID).To(gomega.Equal(1))
+
+		w.Close()
+
+		_, err = a.Watch(context.Background(), collName, WatchOptions{After: 56})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should not restore a corrupted or incomplete backup", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "corrupted_coll")
+
+		for i := 0; i < 10; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		dir, e := ioutil.TempDir("", "rose_backup")
+		gomega.Expect(e).To(gomega.BeNil())
+		defer os.RemoveAll(dir)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := a.Backup(ctx, dir)
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Backup cancelled with underlying message: context canceled"))
+
+		files, e := ioutil.ReadDir(dir)
+		gomega.Expect(e).To(gomega.BeNil())
+		gomega.Expect(files).To(gomega.BeEmpty())
+
+		_, err = VerifyBackup(dir)
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+
+		_, err = a.Backup(context.Background(), dir)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "after@gmail.com"})}, a)
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		block := fmt.Sprintf("%s/db/%s/block_0.rose", dir, collName)
+		b, e := ioutil.ReadFile(block)
+		gomega.Expect(e).To(gomega.BeNil())
+
+		b[len(b)-3] = 'x'
+		gomega.Expect(ioutil.WriteFile(block, b, 0666)).To(gomega.BeNil())
+
+		err = Restore(dir)
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal(fmt.Sprintf("Invalid backup. Block %s does not match the backup manifest", block)))
+
+		// the current database is untouched
+		a = testCreateRose(false)
+
+		stats, err := a.Stats(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(stats.Documents).To(gomega.Equal(11))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should finish a verified restore on boot", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "pending_coll")
+
+		for i := 0; i < 10; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		dir, e := ioutil.TempDir("", "rose_backup")
+		gomega.Expect(e).To(gomega.BeNil())
+		defer os.RemoveAll(dir)
+
+		manifest, err := a.Backup(context.Background(), dir)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 1}, a)
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		// a restore that stopped after the current database was moved away
+		err = copyBackup(dir, manifest, fmt.Sprintf("%s.restore", roseDbDir()), fmt.Sprintf("%s.restore", roseChangesDir()), fmt.Sprintf("%s.restore", roseIndexLocation()))
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(os.Rename(roseDbDir(), fmt.Sprintf("%s.old", roseDbDir()))).To(gomega.BeNil())
+		gomega.Expect(ioutil.WriteFile(fmt.Sprintf("%s/%s", roseDir(), restorePendingFile), []uint8(dir), 0666)).To(gomega.BeNil())
+
+		a = testCreateRose(false)
+
+		stats, err := a.Stats(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(stats.Documents).To(gomega.Equal(10))
+
+		_, statErr := os.Stat(fmt.Sprintf("%s.old", roseDbDir()))
+		gomega.Expect(os.IsNotExist(statErr)).To(gomega.BeTrue())
+
+		_, statErr = os.Stat(fmt.Sprintf("%s/%s", roseDir(), restorePendingFile))
+		gomega.Expect(os.IsNotExist(statErr)).To(gomega.BeTrue())
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should not restore a backup whose manifest names lead out of the backup", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "escaping_coll")
+
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "escaping@gmail.com"})}, a)
+
+		dir, e := ioutil.TempDir("", "rose_backup")
+		gomega.Expect(e).To(gomega.BeNil())
+		defer os.RemoveAll(dir)
+
+		manifest, err := a.Backup(context.Background(), dir)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		for _, change := range []func(m *BackupManifest){
+			func(m *BackupManifest) { m.Collections[0].Name = "../escaping_coll" },
+			func(m *BackupManifest) { m.Collections[0].Name = ".." },
+			func(m *BackupManifest) { m.Collections[0].Blocks[0].Name = "../../block_0.rose" },
+			func(m *BackupManifest) { m.Collections[0].Changes[0].Name = "../changes.rose" },
+		} {
+			escaping := *manifest
+			escaping.Collections = []BackupCollection{manifest.Collections[0]}
+			escaping.Collections[0].Blocks = append([]BackupBlock{}, manifest.Collections[0].Blocks...)
+			escaping.Collections[0].Changes = append([]BackupBlock{}, manifest.Collections[0].Changes...)
+			change(&escaping)
+
+			b, e := json.Marshal(escaping)
+			gomega.Expect(e).To(gomega.BeNil())
+			gomega.Expect(ioutil.WriteFile(fmt.Sprintf("%s/%s", dir, backupManifestFile), b, 0666)).To(gomega.BeNil())
+
+			_, err = VerifyBackup(dir)
+			gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+			gomega.Expect(err.GetCode()).To(gomega.Equal(InvalidUserSuppliedDataCode))
+
+			err = Restore(dir)
+			gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+			gomega.Expect(err.GetCode()).To(gomega.Equal(InvalidUserSuppliedDataCode))
+		}
+
+		a = testCreateRose(false)
+
+		stats, err := a.Stats(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(stats.Documents).To(gomega.Equal(1))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should back up every index of collections whose names end one another", func() {
+		dataDir, e := ioutil.TempDir("", "rose_backup_indexes")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dataDir)
+
+		defer func() {
+			SetDataDir("")
+			_ = os.RemoveAll(dataDir)
+		}()
+
+		a := testCreateRose(false)
+		users := testCreateCollection(a, "users")
+		admins := testCreateCollection(a, "admin_users")
+
+		for _, collName := range []string{admins, users, users} {
+			gomega.Expect(a.NewIndex(collName, "email", stringIndexType, IndexOptions{Unique: true})).To(gomega.BeNil())
+		}
+
+		dir, e := ioutil.TempDir("", "rose_backup")
+		gomega.Expect(e).To(gomega.BeNil())
+		defer os.RemoveAll(dir)
+
+		_, err := a.Backup(context.Background(), dir)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		b, e := ioutil.ReadFile(fmt.Sprintf("%s/indexes.rose", dir))
+		gomega.Expect(e).To(gomega.BeNil())
+		gomega.Expect(strings.Count(string(b), "\n")).To(gomega.Equal(2))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+
+		gomega.Expect(Restore(dir)).To(gomega.BeNil())
+
+		a = testCreateRose(false)
+
+		for _, collName := range []string{users, admins} {
+			indexes, err := a.ListIndexes(collName)
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(len(indexes)).To(gomega.Equal(1))
+			gomega.Expect(indexes[0].Options.Unique).To(gomega.BeTrue())
+		}
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+	})
+})
@@ -8,6 +8,10 @@ import (
 type QueryResult struct {
 	ID int
 	Data []uint8
+	// BM25 score of a query with the matches operator. Results of such a query are sorted by score, highest first
+	Score float64
+	// distance in meters from the center of the first near condition of a query. Results of such a query are sorted by distance, closest first
+	Distance float64
 }
 
 type balancer struct {
@@ -120,11 +124,12 @@ func (b *balancer) Push(item *balancerRequest) ([]QueryResult, Error) {
 
 	close(responses)
 
+	// a nil *dbError is not a nil Error
 	if err != nil {
-		queryResults = make([]QueryResult, 0)
+		return make([]QueryResult, 0), err
 	}
 
-	return queryResults[0:], err
+	return queryResults, nil
 }
 
 func (b *balancer) Close() {
@@ -96,4 +96,31 @@ func BenchmarkAppBulkInsertHundredThousand(b *testing.B) {
 
 		testRemoveFileSystemDb(roseDir())
 	}
-}
\ No newline at end of file
+}
+// removes the first entries of an index, which are the ones that cost the most to move. The time per operation
+// is about the same for every size of the index
+func benchmarkFieldIndexRemove(b *testing.B, size int) {
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+
+		fi := newFieldIndex([]IndexField{{Name: "num", DataType: intIndexType}}, IndexOptions{})
+
+		for id := 1; id <= size; id++ {
+			fi.Add(id, int64(id), id, 0)
+		}
+
+		b.StartTimer()
+
+		for id := 1; id <= 1000; id++ {
+			fi.Remove(id)
+		}
+	}
+}
+
+func BenchmarkFieldIndexRemoveTenThousand(b *testing.B) {
+	benchmarkFieldIndexRemove(b, 10000)
+}
+
+func BenchmarkFieldIndexRemoveOneMillion(b *testing.B) {
+	benchmarkFieldIndexRemove(b, 1000000)
+}
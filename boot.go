@@ -3,6 +3,8 @@ package rose
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
 )
 
 func createDatabases() (map[string]*db, Error) {
@@ -17,68 +19,103 @@ func createDatabases() (map[string]*db, Error) {
 	collections := make(map[string]*db)
 
 	for _, d := range stats {
-		collName := d.Name()
-		driverDir := fmt.Sprintf("%s/%s", roseDbDir(), collName)
-
-		files, err := ioutil.ReadDir(driverDir)
+		m, err := openDatabase(d.Name())
 
 		if err != nil {
-			return nil, newError(SystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to read collection directory. This is system error and Rose cannot boot: %s", err.Error()))
+			return nil, err
 		}
 
-		var blocksNum uint16
-		for _, f := range files {
-			if !f.IsDir() {
-				blocksNum++
+		collections[d.Name()] = m
+	}
+
+	return collections, nil
+}
+
+// opens the drivers of a collection. Documents and indexes are loaded into it with loadAllIndexes()
+func openDatabase(collName string) (*db, Error) {
+	driverDir := fmt.Sprintf("%s/%s", roseDbDir(), collName)
+
+	files, err := ioutil.ReadDir(driverDir)
+
+	if err != nil {
+		return nil, newError(SystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to read collection directory. This is system error and Rose cannot boot: %s", err.Error()))
+	}
+
+	var blocksNum uint16
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		if _, ok := blockIdFromFileName(f.Name()); ok {
+			blocksNum++
+		} else if strings.HasSuffix(f.Name(), ".tmp") {
+			// a block rewrite that did not finish, the block it was written for is intact
+			if e := os.Remove(fmt.Sprintf("%s/%s", driverDir, f.Name())); e != nil {
+				return nil, newError(SystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to remove unfinished block rewrite %s. This is system error and Rose cannot boot: %s", f.Name(), e.Error()))
 			}
 		}
+	}
 
-		w, dErr := newFsDriver(driverDir, writeDriver)
+	w, dErr := newFsDriver(driverDir, writeDriver)
 
-		if dErr != nil {
-			return nil, dErr
-		}
+	if dErr != nil {
+		return nil, dErr
+	}
 
-		r, dErr := newFsDriver(driverDir, updateDriver)
+	r, dErr := newFsDriver(driverDir, updateDriver)
 
-		if dErr != nil {
-			return nil, dErr
-		}
+	if dErr != nil {
+		return nil, dErr
+	}
 
-		d, dErr := newFsDriver(driverDir, updateDriver)
+	d, dErr := newFsDriver(driverDir, updateDriver)
 
-		if dErr != nil {
-			return nil, dErr
-		}
+	if dErr != nil {
+		return nil, dErr
+	}
 
-		m := newDb(
-			w,
-			r,
-			d,
-			collName,
-			blocksNum,
-		)
+	changes, cErr := openChangeLog(changeLogDir(collName))
 
-		collections[collName] = m
+	if cErr != nil {
+		return nil, cErr
 	}
 
-	return collections, nil
-}
+	schema, sErr := loadSchema(collName)
 
-func boot(output bool) (*Rose, Error) {
-	if output {
-		fmt.Println("")
-		fmt.Println("=============")
-		fmt.Println("")
+	if sErr != nil {
+		return nil, sErr
 	}
 
-	_, err := createDbIfNotExists(output)
+	options, oErr := loadCollectionOptions(collName)
 
-	if err != nil {
+	if oErr != nil {
+		return nil, oErr
+	}
+
+	db := newDb(
+		w,
+		r,
+		d,
+		collName,
+		blocksNum,
+	)
+
+	db.changes = changes
+	db.schema = schema
+	db.options = options
+
+	return db, nil
+}
+
+// opens every collection in the data directory. The caller must hold the data directory lock
+func open(output bool) (*Rose, Error) {
+	// a restore that was verified but stopped while it replaced the database
+	if err := finishRestore(); err != nil {
 		return nil, err
 	}
 
-	err = createIndexLocationIfNotExists()
+	err := createIndexLocationIfNotExists()
 
 	if err != nil {
 		return nil, err
@@ -105,6 +142,44 @@ func boot(output bool) (*Rose, Error) {
 		return nil, err
 	}
 
+	return r, nil
+}
+
+func boot(output bool) (*Rose, Error) {
+	if output {
+		fmt.Println("")
+		fmt.Println("=============")
+		fmt.Println("")
+	}
+
+	_, err := createDbIfNotExists(output)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := lockDataDir()
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := open(output)
+
+	if err != nil {
+		_ = unlockDataDir(dir)
+
+		return nil, err
+	}
+
+	r.dataDir = dir
+
+	if err := r.StartReaper(ReaperOptions{Interval: defaultReapInterval}); err != nil {
+		_ = r.Shutdown()
+
+		return nil, err
+	}
+
 	if output {
 		fmt.Println("=============")
 		fmt.Println("")
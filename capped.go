@@ -0,0 +1,219 @@
+package rose
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// CollectionOptions are optional collection properties given to NewCollection. A collection with a cap is a capped collection
+type CollectionOptions struct {
+	// a capped collection keeps at least its newest MaxDocuments documents and drops the blocks that hold older ones
+	MaxDocuments int `json:"maxDocuments,omitempty"`
+	// a capped collection keeps at least the newest MaxBytes bytes of block files and drops the blocks that are older
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+}
+
+func (o CollectionOptions) isCapped() bool {
+	return o.MaxDocuments > 0 || o.MaxBytes > 0
+}
+
+func (o CollectionOptions) validate() Error {
+	if o.MaxDocuments < 0 {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid collection options. MaxDocuments cannot be negative, %d given", o.MaxDocuments))
+	}
+
+	if o.MaxBytes < 0 {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid collection options. MaxBytes cannot be negative, %d given", o.MaxBytes))
+	}
+
+	return nil
+}
+
+// returns true if the documents and bytes of the newest blocks already fill the cap
+func (o CollectionOptions) filled(documents int, size int64) bool {
+	return (o.MaxDocuments > 0 && documents >= o.MaxDocuments) || (o.MaxBytes > 0 && size >= o.MaxBytes)
+}
+
+func roseCollectionsLocation() string {
+	return fmt.Sprintf("%s/%s", roseDir(), "collections.rose")
+}
+
+// collections.rose holds a JSON object with the options of every collection that has them
+func readCollectionOptions() (map[string]CollectionOptions, Error) {
+	return readCollectionOptionsFile(roseCollectionsLocation())
+}
+
+func readCollectionOptionsFile(location string) (map[string]CollectionOptions, Error) {
+	options := make(map[string]CollectionOptions)
+
+	b, e := ioutil.ReadFile(location)
+
+	if os.IsNotExist(e) {
+		return options, nil
+	}
+
+	if e != nil {
+		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to read %s: %s", location, e.Error()))
+	}
+
+	if e := json.Unmarshal(b, &options); e != nil {
+		return nil, newError(DbIntegrityMasterErrorCode, MalformedIndexCode, fmt.Sprintf("Unable to read %s. The file is malformed: %s", location, e.Error()))
+	}
+
+	return options, nil
+}
+
+// rewrites collections.rose with the changes of fn. The caller must hold collLock for writing
+func updateCollectionOptions(fn func(options map[string]CollectionOptions)) Error {
+	options, err := readCollectionOptions()
+
+	if err != nil {
+		return err
+	}
+
+	fn(options)
+
+	b, e := json.Marshal(options)
+
+	if e != nil {
+		return newError(SystemMasterErrorCode, DataConversionCode, fmt.Sprintf("Unable to save collection options: %s", e.Error()))
+	}
+
+	return replaceFile(roseCollectionsLocation(), b)
+}
+
+func removeCollectionOptions(collName string) Error {
+	return updateCollectionOptions(func(options map[string]CollectionOptions) {
+		delete(options, collName)
+	})
+}
+
+func renameCollectionOptions(collName string, newName string) Error {
+	return updateCollectionOptions(func(options map[string]CollectionOptions) {
+		delete(options, newName)
+
+		if o, ok := options[collName]; ok {
+			options[newName] = o
+			delete(options, collName)
+		}
+	})
+}
+
+// the saved options of a collection, empty if it has none
+func loadCollectionOptions(collName string) (CollectionOptions, Error) {
+	options, err := readCollectionOptions()
+
+	if err != nil {
+		return CollectionOptions{}, err
+	}
+
+	return options[collName], nil
+}
+
+/**
+Drops the oldest blocks of a capped collection that only hold documents past its cap. Counted from the newest block,
+a block is dropped when the blocks after it already hold MaxDocuments documents or MaxBytes bytes, so the newest
+documents within the cap are always kept and the collection holds at most one block more than its cap. A dropped block
+is truncated and its documents are removed from every index at once instead of being deleted one by one. Watchers
+receive a delete change for every dropped document, hooks do not run. The caller must hold the lock
+
+Documents are counted with liveDocs and only the blocks within the cap are read, so a write does not read the whole
+collection.
+*/
+func (d *db) enforceCap() Error {
+	// the newest block is never dropped
+	if !d.options.isCapped() || len(d.liveDocs) < 2 {
+		return nil
+	}
+
+	blocks := make([]int, 0, len(d.liveDocs))
+	for blockId := range d.liveDocs {
+		blocks = append(blocks, int(blockId))
+	}
+
+	sort.Ints(blocks)
+
+	collDir := fmt.Sprintf("%s/%s", roseDbDir(), d.Name)
+
+	documents := 0
+	var size int64
+	// every block up to and including this one is dropped
+	last := -1
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if d.options.filled(documents, size) {
+			last = i
+
+			break
+		}
+
+		blockId := uint16(blocks[i])
+		documents += d.liveDocs[blockId]
+
+		if d.options.MaxBytes > 0 {
+			stat, e := os.Stat(roseBlockFile(blockId, collDir))
+
+			if e != nil {
+				return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to read the size of a block of capped collection %s: %s", d.Name, e.Error()))
+			}
+
+			size += stat.Size()
+		}
+	}
+
+	if last < 0 {
+		return nil
+	}
+
+	for i := 0; i <= last; i++ {
+		if err := d.dropBlock(uint16(blocks[i])); err != nil {
+			return err
+		}
+	}
+
+	return d.reloadDrivers()
+}
+
+// enforces the cap after a write that is already done, so a failure does not fail the write. Its message is returned
+// to be reported apart from the write, the blocks past the cap are dropped by the next write. The caller must hold the lock
+func (d *db) enforceCapAfterWrite() string {
+	if err := d.enforceCap(); err != nil {
+		return err.Error()
+	}
+
+	return ""
+}
+
+// truncates a block and removes the documents in it from every index. The caller must hold the lock
+func (d *db) dropBlock(blockId uint16) Error {
+	if e := os.Truncate(roseBlockFile(blockId, fmt.Sprintf("%s/%s", roseDbDir(), d.Name)), 0); e != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to drop a block of capped collection %s: %s", d.Name, e.Error()))
+	}
+
+	// the IDs of a block are the ones from its first ID up to the first ID of the next block
+	changes := make([]ChangeEvent, 0, d.liveDocs[blockId])
+	for id := int(blockId) * blockMark; id < (int(blockId) + 1) * blockMark; id++ {
+		if _, ok := d.PrimaryIndex[id]; !ok {
+			continue
+		}
+
+		delete(d.PrimaryIndex, id)
+
+		changes = append(changes, ChangeEvent{Type: DeleteChange, ID: id})
+	}
+
+	delete(d.liveDocs, blockId)
+
+	for _, fi := range d.FieldIndex {
+		fi.RemoveBlock(blockId)
+	}
+
+	// an empty block has nothing to defragment or compact
+	d.BlockTracker[blockId] = [3]uint16{}
+
+	d.logChanges(changes...)
+
+	return nil
+}
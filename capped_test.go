@@ -0,0 +1,224 @@
+package rose
+
+import (
+	"context"
+	"fmt"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+)
+
+func testCappedBulkWrite(a *Rose, collName string, from int, to int) {
+	data := make([]interface{}, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		data = append(data, testAsJsonInterface(TestUser{Type: "user", Email: fmt.Sprintf("%d@gmail.com", i)}))
+	}
+
+	_, err := a.BulkWrite(BulkWriteMetadata{CollectionName: collName, Data: data})
+	gomega.Expect(err).To(gomega.BeNil())
+}
+
+var _ = GinkgoDescribe("Capped collection tests", func() {
+	GinkgoIt("Should drop the oldest blocks of a capped collection and keep the newest documents", func() {
+		dir, e := ioutil.TempDir("", "rose_capped")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dir)
+
+		defer func() {
+			SetDataDir("")
+			_ = os.RemoveAll(dir)
+		}()
+
+		a := testCreateRose(false)
+
+		err := a.NewCollection("capped_coll", CollectionOptions{MaxDocuments: -1})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(InvalidUserSuppliedDataCode))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid collection options. MaxDocuments cannot be negative, -1 given"))
+
+		err = a.NewCollection("capped_coll", CollectionOptions{MaxBytes: -1})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid collection options. MaxBytes cannot be negative, -1 given"))
+
+		collName := "capped_coll"
+		gomega.Expect(a.NewCollection(collName, CollectionOptions{MaxDocuments: 3000})).To(gomega.BeNil())
+		gomega.Expect(a.NewIndex(collName, "email", stringIndexType)).To(gomega.BeNil())
+
+		// block_0 holds IDs up to 3306, block_1 holds the next 2999 which are not enough to drop block_0
+		testCappedBulkWrite(a, collName, 1, 6305)
+		gomega.Expect(len(a.Databases[collName].PrimaryIndex)).To(gomega.Equal(6305))
+
+		w, err := a.Watch(context.Background(), collName, WatchOptions{After: 6305})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		res := testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Type: "user", Email: "6306@gmail.com"})}, a)
+		gomega.Expect(res.ID).To(gomega.Equal(6306))
+
+		stats, err := a.Stats(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(stats.Documents).To(gomega.Equal(3000))
+		gomega.Expect(stats.Options.MaxDocuments).To(gomega.Equal(3000))
+
+		info, e := os.Stat(roseBlockFile(0, fmt.Sprintf("%s/%s", roseDbDir(), collName)))
+		gomega.Expect(e).To(gomega.BeNil())
+		gomega.Expect(info.Size()).To(gomega.Equal(int64(0)))
+
+		user := TestUser{}
+		read, err := a.Read(ReadMetadata{CollectionName: collName, ID: 3306, Data: &user})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(read.Status).To(gomega.Equal(NotFoundResultStatus))
+
+		testSingleRead(ReadMetadata{CollectionName: collName, ID: 3307, Data: &user}, a)
+		gomega.Expect(user.Email).To(gomega.Equal("3307@gmail.com"))
+
+		readBy, err := a.ReadBy(ReadByMetadata{CollectionName: collName, Field: "email", Value: "1@gmail.com", DataType: stringIndexType})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(readBy.Data).To(gomega.BeEmpty())
+
+		qb := NewQueryBuilder()
+		gomega.Expect(qb.If(collName, "type:string == #type", map[string]interface{}{"#type": "user"})).To(gomega.BeNil())
+
+		results, err := a.Query(qb)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(results)).To(gomega.Equal(3000))
+
+		// watchers receive the insert and a delete of every dropped document
+		gomega.Expect(testNextChange(w).ID).To(gomega.Equal(6306))
+
+		for id := 1; id <= 3306; id++ {
+			change := testNextChange(w)
+			gomega.Expect(change.Type).To(gomega.Equal(DeleteChange))
+			gomega.Expect(change.ID).To(gomega.Equal(id))
+		}
+
+		w.Close()
+
+		// a collection that exists keeps its options
+		gomega.Expect(a.NewCollection(collName, CollectionOptions{MaxDocuments: 10})).To(gomega.BeNil())
+
+		// options are kept after a restart and a rename
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+
+		a = testCreateRose(false)
+
+		gomega.Expect(a.RenameCollection(collName, "capped_renamed")).To(gomega.BeNil())
+		collName = "capped_renamed"
+
+		stats, err = a.Stats(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(stats.Documents).To(gomega.Equal(3000))
+		gomega.Expect(stats.Options.MaxDocuments).To(gomega.Equal(3000))
+
+		// documents of every block are counted again when the collection is loaded and counted down on deletes
+		gomega.Expect(a.Databases[collName].liveDocs).To(gomega.Equal(map[uint16]int{1: 3000}))
+
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 3307}, a)
+		gomega.Expect(a.Databases[collName].liveDocs).To(gomega.Equal(map[uint16]int{1: 2999}))
+
+		// a single byte is filled by any block, every block before the newest one is dropped
+		bytesColl := "capped_bytes"
+		gomega.Expect(a.NewCollection(bytesColl, CollectionOptions{MaxBytes: 1})).To(gomega.BeNil())
+
+		testCappedBulkWrite(a, bytesColl, 1, 3306)
+		gomega.Expect(len(a.Databases[bytesColl].PrimaryIndex)).To(gomega.Equal(3306))
+
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: bytesColl, Data: testAsJsonInterface(TestUser{Type: "user"})}, a)
+		gomega.Expect(len(a.Databases[bytesColl].PrimaryIndex)).To(gomega.Equal(1))
+
+		backupDir, e := ioutil.TempDir("", "rose_capped_backup")
+		gomega.Expect(e).To(gomega.BeNil())
+		defer os.RemoveAll(backupDir)
+
+		manifest, err := a.Backup(context.Background(), backupDir)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		for _, coll := range manifest.Collections {
+			gomega.Expect(coll.Options).To(gomega.Not(gomega.BeNil()))
+		}
+
+		// a dropped collection does not keep its options
+		gomega.Expect(a.DropCollection(bytesColl)).To(gomega.BeNil())
+		gomega.Expect(a.NewCollection(bytesColl)).To(gomega.BeNil())
+
+		stats, err = a.Stats(bytesColl)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(stats.Options.MaxBytes).To(gomega.Equal(int64(0)))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+
+		gomega.Expect(Restore(backupDir)).To(gomega.BeNil())
+
+		a = testCreateRose(false)
+
+		stats, err = a.Stats(bytesColl)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(stats.Options.MaxBytes).To(gomega.Equal(int64(1)))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+	})
+
+	GinkgoIt("Should count bulk written documents and keep writes of a capped collection that cannot drop its blocks", func() {
+		dir, e := ioutil.TempDir("", "rose_capped_failing")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dir)
+
+		defer func() {
+			SetDataDir("")
+			_ = os.RemoveAll(dir)
+		}()
+
+		a := testCreateRose(false)
+
+		collName := "capped_failing"
+		gomega.Expect(a.NewCollection(collName, CollectionOptions{MaxBytes: 1})).To(gomega.BeNil())
+
+		testCappedBulkWrite(a, collName, 1, 3306)
+		gomega.Expect(a.Databases[collName].liveDocs).To(gomega.Equal(map[uint16]int{0: 3306}))
+		gomega.Expect(a.Databases[collName].DocCount).To(gomega.Equal(map[uint16]int{0: 3306}))
+
+		// a block that cannot be truncated cannot be dropped
+		block := roseBlockFile(0, fmt.Sprintf("%s/%s", roseDbDir(), collName))
+		gomega.Expect(os.Rename(block, block + ".moved")).To(gomega.BeNil())
+		gomega.Expect(os.Mkdir(block, os.ModePerm)).To(gomega.BeNil())
+
+		res, err := a.Write(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Type: "user", Email: "3307@gmail.com"})})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(res.ID).To(gomega.Equal(3307))
+		gomega.Expect(res.CapError).To(gomega.ContainSubstring("Unable to drop a block of capped collection"))
+
+		bulk, err := a.BulkWrite(BulkWriteMetadata{CollectionName: collName, Data: []interface{}{testAsJsonInterface(TestUser{Type: "user", Email: "3308@gmail.com"})}})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(bulk.WrittenIDs).To(gomega.Equal("3308"))
+		gomega.Expect(bulk.CapError).To(gomega.Not(gomega.BeEmpty()))
+
+		user := TestUser{}
+		testSingleRead(ReadMetadata{CollectionName: collName, ID: 3307, Data: &user}, a)
+		gomega.Expect(user.Email).To(gomega.Equal("3307@gmail.com"))
+
+		gomega.Expect(a.Databases[collName].liveDocs).To(gomega.Equal(map[uint16]int{0: 3306, 1: 2}))
+
+		// the blocks past the cap are dropped by the next write
+		gomega.Expect(os.Remove(block)).To(gomega.BeNil())
+		gomega.Expect(os.Rename(block + ".moved", block)).To(gomega.BeNil())
+
+		res, err = a.Write(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Type: "user", Email: "3309@gmail.com"})})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(res.CapError).To(gomega.BeEmpty())
+
+		gomega.Expect(a.Databases[collName].liveDocs).To(gomega.Equal(map[uint16]int{1: 3}))
+		gomega.Expect(len(a.Databases[collName].PrimaryIndex)).To(gomega.Equal(3))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+	})
+})
@@ -0,0 +1,517 @@
+package rose
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/valyala/fastjson"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+type ChangeType string
+
+const InsertChange ChangeType = "insert"
+const ReplaceChange ChangeType = "replace"
+const DeleteChange ChangeType = "delete"
+
+// a change log that grows above this size is moved to changes.old.rose and a new one is started, so every
+// collection keeps between one and two of these sizes of changes for watchers to resume from
+var maxChangeLogSize int64 = 32 << 20
+
+// change logs are kept apart from the blocks, in changes/<coll> of the data directory
+const changesDir = "changes"
+const changeLogFile = "changes.rose"
+const oldChangeLogFile = "changes.old.rose"
+
+// ChangeEvent is a single write to a collection as returned by Watcher.Next
+type ChangeEvent struct {
+	// position of the change in the change log of the collection. Revisions only grow and can be given
+	// to WatchOptions.After to resume watching after this change
+	Revision uint64 `json:"revision"`
+	Collection string `json:"collection,omitempty"`
+	Type ChangeType `json:"type"`
+	ID int `json:"id"`
+	// the written document, empty for deletes
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type WatchOptions struct {
+	// revision of the last change that a consumer has seen. Zero starts with the changes that happen after Watch
+	After uint64
+	// only inserts and replaces of documents that match this query are returned, the same query as in
+	// NewQueryBuilder().If() without the matches operator. Deletes carry no document and are always returned
+	Query string
+	Params map[string]interface{}
+}
+
+/**
+Every write of a collection is appended to changes/<coll>/changes.rose as a line of JSON and numbered with a revision.
+Watchers read the file with their own cursor, so a watcher that does not read does not stop writes.
+*/
+type changeLog struct {
+	dir string
+	file *os.File
+	size int64
+	revision uint64
+	// increased when the log is moved to changes.old.rose
+	generation uint64
+	// closed and replaced on every append, watchers wait on it at the end of the log
+	notify chan struct{}
+	closed bool
+	sync.Mutex
+}
+
+/**
+Watcher returns the changes of a collection one by one. It ends when its context is done or the collection
+is closed; dropped, renamed, truncated or shut down. A consumer keeps the revision of the last change it has
+processed and gives it to WatchOptions.After to continue after a restart or after the watcher ended.
+*/
+type Watcher struct {
+	ctx context.Context
+	collName string
+	log *changeLog
+	stages map[int]*operatorStages
+	after uint64
+	// the first change read with a cursor must follow the cursor, otherwise changes were trimmed
+	checkCursor bool
+
+	file *os.File
+	reader *bufio.Reader
+	generation uint64
+	pending []uint8
+}
+
+/**
+Watches the inserts, replaces and deletes of a collection in the order they were made:
+
+	w, err := r.Watch(ctx, "users", rose.WatchOptions{After: lastRevision, Query: "type:string == #type", Params: params})
+	defer w.Close()
+
+	for {
+		change, err := w.Next()
+		...
+		lastRevision = change.Revision
+	}
+
+Changes are kept in the collection directory, so a watcher can resume with WatchOptions.After after a restart
+as long as the changes after its cursor have not been trimmed.
+*/
+func (a *Rose) Watch(ctx context.Context, collName string, options ...WatchOptions) (*Watcher, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
+	db, ok := a.Databases[collName]
+
+	if !ok {
+		return nil, newError(GenericMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid watch request. Collection %s does not exist", collName))
+	}
+
+	opts := WatchOptions{}
+	if len(options) > 0 {
+		opts = options[0]
+	}
+
+	var stages map[int]*operatorStages
+
+	if opts.Query != "" {
+		query, err := validateQuery(opts.Query, opts.Params)
+
+		if err != nil {
+			return nil, err
+		}
+
+		q := newSingleQuery(collName, query, opts.Params)
+
+		for node := q.opNode; node != nil; node = node.next {
+			if node.cond.comparisonType == textMatch {
+				return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, "Invalid watch request. Operator 'matches' needs a text index and cannot be used to watch changes")
+			}
+		}
+
+		stages = q.stages
+	}
+
+	return db.changes.watch(ctx, collName, stages, opts.After)
+}
+
+func changeLogDir(collName string) string {
+	return fmt.Sprintf("%s/%s", roseChangesDir(), collName)
+}
+
+func changeLogPath(dir string) string {
+	return fmt.Sprintf("%s/%s", dir, changeLogFile)
+}
+
+func oldChangeLogPath(dir string) string {
+	return fmt.Sprintf("%s/%s", dir, oldChangeLogFile)
+}
+
+/**
+Opens the change log of a collection directory and finds its last revision. A line that a crash left half written
+is cut off, its write was not acknowledged.
+*/
+func openChangeLog(dir string) (*changeLog, Error) {
+	if e := os.MkdirAll(dir, os.ModePerm); e != nil {
+		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to create change log directory %s with underlying message: %s", dir, e.Error()))
+	}
+
+	l := &changeLog{
+		dir: dir,
+		notify: make(chan struct{}),
+	}
+
+	b, e := readFileIfExists(changeLogPath(dir))
+
+	if e != nil {
+		return nil, e
+	}
+
+	if end := bytes.LastIndexByte(b, '\n') + 1; end != len(b) {
+		if err := os.Truncate(changeLogPath(dir), int64(end)); err != nil {
+			return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to repair change log %s: %s", changeLogPath(dir), err.Error()))
+		}
+
+		b = b[:end]
+	}
+
+	l.size = int64(len(b))
+
+	if len(b) == 0 {
+		if b, e = readFileIfExists(oldChangeLogPath(dir)); e != nil {
+			return nil, e
+		}
+	}
+
+	if rev, ok := lastRevision(b); ok {
+		l.revision = rev
+	}
+
+	file, err := createFile(changeLogPath(dir), os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+
+	if err != nil {
+		return nil, err
+	}
+
+	l.file = file
+
+	return l, nil
+}
+
+func readFileIfExists(path string) ([]uint8, Error) {
+	b, e := ioutil.ReadFile(path)
+
+	if e != nil && !os.IsNotExist(e) {
+		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to read change log %s: %s", path, e.Error()))
+	}
+
+	return b, nil
+}
+
+func lastRevision(b []uint8) (uint64, bool) {
+	lines := bytes.Split(bytes.TrimRight(b, "\n"), []uint8("\n"))
+
+	for i := len(lines) - 1; i >= 0; i-- {
+		var event ChangeEvent
+		if json.Unmarshal(lines[i], &event) == nil {
+			return event.Revision, true
+		}
+	}
+
+	return 0, false
+}
+
+/**
+Appends changes in the order they were made. The caller must hold the lock of the collection so that revisions
+follow the order of the writes. Changes that cannot be appended are returned as an error, their revisions are
+skipped anyway so that watchers that reach them end with ChangesTrimmedCode instead of missing them.
+*/
+func (l *changeLog) append(changes ...ChangeEvent) Error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	revision := l.revision + uint64(len(changes))
+	err := l.write(changes)
+
+	l.revision = revision
+
+	close(l.notify)
+	l.notify = make(chan struct{})
+
+	return err
+}
+
+// writes changes with the revisions that follow the last one. The lock must be held
+func (l *changeLog) write(changes []ChangeEvent) Error {
+	var buf bytes.Buffer
+	revision := l.revision
+
+	for _, c := range changes {
+		revision++
+		c.Revision = revision
+
+		b, e := json.Marshal(c)
+
+		if e != nil {
+			return newError(SystemMasterErrorCode, DataConversionCode, fmt.Sprintf("Unable to append change of document with ID %d to the change log: %s", c.ID, e.Error()))
+		}
+
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+
+	if l.size + int64(buf.Len()) > maxChangeLogSize && l.size > 0 {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, e := l.file.Write(buf.Bytes()); e != nil {
+		// a line that is written in part would be read as an invalid change
+		_ = l.file.Truncate(l.size)
+
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to append to change log %s: %s", changeLogPath(l.dir), e.Error()))
+	}
+
+	l.size += int64(buf.Len())
+
+	return nil
+}
+
+// moves the log to changes.old.rose and starts a new one. The lock must be held
+func (l *changeLog) rotate() Error {
+	if e := l.file.Close(); e != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to close change log %s: %s", changeLogPath(l.dir), e.Error()))
+	}
+
+	if e := os.Rename(changeLogPath(l.dir), oldChangeLogPath(l.dir)); e != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to move change log %s: %s", changeLogPath(l.dir), e.Error()))
+	}
+
+	file, err := createFile(changeLogPath(l.dir), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC)
+
+	if err != nil {
+		return err
+	}
+
+	l.file = file
+	l.size = 0
+	l.generation++
+
+	return nil
+}
+
+// ends every watcher once it has read the changes that are already in the log
+func (l *changeLog) close() Error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	l.closed = true
+	close(l.notify)
+
+	return closeFile(l.file)
+}
+
+/**
+Starts a watcher on the change log. Without a cursor it is positioned at the end of the log,
+with one at the start of the oldest log that is kept and skips the changes up to the cursor.
+*/
+func (l *changeLog) watch(ctx context.Context, collName string, stages map[int]*operatorStages, after uint64) (*Watcher, Error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if after > l.revision {
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid watch request. Revision %d is after the last change %d of collection %s", after, l.revision, collName))
+	}
+
+	w := &Watcher{
+		ctx: ctx,
+		collName: collName,
+		log: l,
+		stages: stages,
+		generation: l.generation,
+	}
+
+	path := changeLogPath(l.dir)
+
+	if after == 0 {
+		w.after = l.revision
+	} else {
+		w.after = after
+		w.checkCursor = true
+
+		if _, e := os.Stat(oldChangeLogPath(l.dir)); e == nil {
+			path = oldChangeLogPath(l.dir)
+			w.generation--
+		}
+	}
+
+	file, e := os.Open(path)
+
+	if e != nil {
+		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to open change log %s: %s", path, e.Error()))
+	}
+
+	if after == 0 {
+		if _, e := file.Seek(0, io.SeekEnd); e != nil {
+			_ = file.Close()
+
+			return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to read change log %s: %s", path, e.Error()))
+		}
+	}
+
+	w.file = file
+	w.reader = bufio.NewReader(file)
+
+	return w, nil
+}
+
+/**
+Returns the next change, waiting for one if the watcher has returned every change that was made. Returns an error
+with WatchClosedCode when the context is done or the collection is closed and with ChangesTrimmedCode when the
+changes after the cursor are no longer kept.
+*/
+func (w *Watcher) Next() (*ChangeEvent, Error) {
+	for {
+		// taken before reading so that a change appended after the end of the log was read is not missed
+		w.log.Lock()
+		notify, generation, closed := w.log.notify, w.log.generation, w.log.closed
+		w.log.Unlock()
+
+		event, err := w.readEvent()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if event != nil {
+			if event.Revision > w.after + 1 {
+				if w.checkCursor {
+					return nil, newError(GenericMasterErrorCode, ChangesTrimmedCode, fmt.Sprintf("Changes of collection %s after revision %d are no longer kept, the oldest kept change is %d", w.collName, w.after, event.Revision))
+				}
+
+				// revisions of changes that could not be appended are skipped
+				return nil, newError(GenericMasterErrorCode, ChangesTrimmedCode, fmt.Sprintf("Changes of collection %s after revision %d could not be saved, watch it again after revision %d", w.collName, w.after, event.Revision - 1))
+			}
+
+			w.checkCursor = false
+
+			if event.Revision <= w.after {
+				continue
+			}
+
+			w.after = event.Revision
+
+			if w.matches(event) {
+				return event, nil
+			}
+
+			continue
+		}
+
+		// every change in a log that was moved is read, the watcher continues with the next log
+		if w.generation != generation {
+			if err := w.nextLog(); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if closed {
+			return nil, newError(GenericMasterErrorCode, WatchClosedCode, fmt.Sprintf("Watch ended. Collection %s was closed, watch it again after revision %d", w.collName, w.after))
+		}
+
+		select {
+		case <-notify:
+		case <-w.ctx.Done():
+			return nil, newError(GenericMasterErrorCode, WatchClosedCode, fmt.Sprintf("Watch ended: %s", w.ctx.Err().Error()))
+		}
+	}
+}
+
+// revision of the last change that the watcher has read
+func (w *Watcher) Revision() uint64 {
+	return w.after
+}
+
+func (w *Watcher) Close() {
+	_ = w.file.Close()
+}
+
+// reads the next complete line of the log, nil at its end
+func (w *Watcher) readEvent() (*ChangeEvent, Error) {
+	line, e := w.reader.ReadBytes('\n')
+	w.pending = append(w.pending, line...)
+
+	if e == io.EOF {
+		return nil, nil
+	}
+
+	if e != nil {
+		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to read change log of collection %s: %s", w.collName, e.Error()))
+	}
+
+	line, w.pending = w.pending, nil
+
+	event := &ChangeEvent{}
+	if e := json.Unmarshal(line, event); e != nil {
+		return nil, newError(DbIntegrityMasterErrorCode, UnmarshalFailCode, fmt.Sprintf("Change log of collection %s holds an invalid change: %s", w.collName, e.Error()))
+	}
+
+	event.Collection = w.collName
+
+	return event, nil
+}
+
+func (w *Watcher) nextLog() Error {
+	w.log.Lock()
+	defer w.log.Unlock()
+
+	var path string
+
+	if w.log.generation == w.generation + 1 {
+		path = changeLogPath(w.log.dir)
+	} else if w.log.generation == w.generation + 2 {
+		path = oldChangeLogPath(w.log.dir)
+	} else {
+		return newError(GenericMasterErrorCode, ChangesTrimmedCode, fmt.Sprintf("Changes of collection %s after revision %d are no longer kept, the watcher did not read them in time", w.collName, w.after))
+	}
+
+	file, e := os.Open(path)
+
+	if e != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to open change log %s: %s", path, e.Error()))
+	}
+
+	_ = w.file.Close()
+
+	w.file = file
+	w.reader = bufio.NewReader(file)
+	w.pending = nil
+	w.generation++
+
+	return nil
+}
+
+func (w *Watcher) matches(event *ChangeEvent) bool {
+	if w.stages == nil || event.Type == DeleteChange {
+		return true
+	}
+
+	v, e := fastjson.ParseBytes(event.Data)
+
+	return e == nil && matchesStages(v, w.stages)
+}
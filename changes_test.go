@@ -0,0 +1,328 @@
+package rose
+
+import (
+	"context"
+	"fmt"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+func testNextChange(w *Watcher) *ChangeEvent {
+	change, err := w.Next()
+
+	gomega.Expect(err).To(gomega.BeNil())
+
+	return change
+}
+
+var _ = GinkgoDescribe("Watch tests", func() {
+	GinkgoIt("Should watch the writes of a collection and resume after a restart", func() {
+		dir, e := ioutil.TempDir("", "rose_watch")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dir)
+
+		defer func() {
+			SetDataDir("")
+			_ = os.RemoveAll(dir)
+		}()
+
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "watch_coll")
+
+		w, err := a.Watch(context.Background(), collName)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		filtered, err := a.Watch(context.Background(), collName, WatchOptions{Query: "type:string == #type", Params: map[string]interface{}{"#type": "company"}})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Type: "user", Email: "first@gmail.com"})}, a)
+
+		_, err = a.BulkWrite(BulkWriteMetadata{CollectionName: collName, Data: []interface{}{
+			testAsJsonInterface(TestUser{Type: "company", Email: "second@gmail.com"}),
+			testAsJsonInterface(TestUser{Type: "user", Email: "third@gmail.com"}),
+		}})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		testSingleReplace(ReplaceMetadata{CollectionName: collName, ID: 1, Data: testAsJsonInterface(TestUser{Type: "company", Email: "replaced@gmail.com"})}, a)
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 3}, a)
+
+		// a delete of a document that does not exist is not a change
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 3}, a)
+
+		change := testNextChange(w)
+		gomega.Expect(change.Revision).To(gomega.Equal(uint64(1)))
+		gomega.Expect(change.Collection).To(gomega.Equal(collName))
+		gomega.Expect(change.Type).To(gomega.Equal(InsertChange))
+		gomega.Expect(change.ID).To(gomega.Equal(1))
+		gomega.Expect(string(change.Data)).To(gomega.ContainSubstring("first@gmail.com"))
+
+		gomega.Expect(testNextChange(w).ID).To(gomega.Equal(2))
+		gomega.Expect(testNextChange(w).ID).To(gomega.Equal(3))
+
+		change = testNextChange(w)
+		gomega.Expect(change.Type).To(gomega.Equal(ReplaceChange))
+		gomega.Expect(change.ID).To(gomega.Equal(1))
+		gomega.Expect(string(change.Data)).To(gomega.ContainSubstring("replaced@gmail.com"))
+
+		change = testNextChange(w)
+		gomega.Expect(change.Type).To(gomega.Equal(DeleteChange))
+		gomega.Expect(change.Revision).To(gomega.Equal(uint64(5)))
+		gomega.Expect(change.ID).To(gomega.Equal(3))
+		gomega.Expect(change.Data).To(gomega.BeEmpty())
+		gomega.Expect(w.Revision()).To(gomega.Equal(uint64(5)))
+
+		// only the changes of companies and deletes
+		gomega.Expect(testNextChange(filtered).Revision).To(gomega.Equal(uint64(2)))
+		gomega.Expect(testNextChange(filtered).Revision).To(gomega.Equal(uint64(4)))
+		gomega.Expect(testNextChange(filtered).Revision).To(gomega.Equal(uint64(5)))
+		filtered.Close()
+
+		// a watcher that waits is woken by the next write
+		next := make(chan *ChangeEvent)
+		go func() {
+			change, _ := w.Next()
+			next <- change
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "fourth@gmail.com"})}, a)
+
+		change = <-next
+		gomega.Expect(change.Revision).To(gomega.Equal(uint64(6)))
+		gomega.Expect(change.ID).To(gomega.Equal(4))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+
+		_, err = w.Next()
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(WatchClosedCode))
+		w.Close()
+
+		a = testCreateRose(false)
+
+		_, err = a.Watch(context.Background(), collName, WatchOptions{After: 7})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(InvalidUserSuppliedDataCode))
+
+		_, err = a.Watch(context.Background(), collName, WatchOptions{Query: "email:string matches #email", Params: map[string]interface{}{"#email": "gmail"}})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(InvalidUserSuppliedDataCode))
+
+		_, err = a.Watch(context.Background(), "not_exists")
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid watch request. Collection not_exists does not exist"))
+
+		w, err = a.Watch(context.Background(), collName, WatchOptions{After: 4})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		gomega.Expect(testNextChange(w).Revision).To(gomega.Equal(uint64(5)))
+		gomega.Expect(testNextChange(w).Revision).To(gomega.Equal(uint64(6)))
+
+		// revisions continue after a restart
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "fifth@gmail.com"})}, a)
+		gomega.Expect(testNextChange(w).Revision).To(gomega.Equal(uint64(7)))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		waiting, err := a.Watch(ctx, collName)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		cancel()
+
+		_, err = waiting.Next()
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(WatchClosedCode))
+		waiting.Close()
+
+		gomega.Expect(a.DropCollection(collName)).To(gomega.BeNil())
+
+		_, err = w.Next()
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(WatchClosedCode))
+		w.Close()
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+	})
+
+	GinkgoIt("Should move the change log to the old one and trim changes that are older", func() {
+		dir, e := ioutil.TempDir("", "rose_watch")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dir)
+		size := maxChangeLogSize
+		maxChangeLogSize = 1024
+
+		defer func() {
+			maxChangeLogSize = size
+			SetDataDir("")
+			_ = os.RemoveAll(dir)
+		}()
+
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "watch_coll")
+
+		w, err := a.Watch(context.Background(), collName)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		for i := 0; i < 10; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		// the watcher follows the log after it was moved
+		for i := 1; i <= 10; i++ {
+			gomega.Expect(testNextChange(w).Revision).To(gomega.Equal(uint64(i)))
+		}
+
+		for i := 10; i < 60; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		// the watcher reads the rest of the log it has open, the log was moved more than once since then
+		for err == nil {
+			_, err = w.Next()
+		}
+
+		gomega.Expect(err.GetCode()).To(gomega.Equal(ChangesTrimmedCode))
+		gomega.Expect(w.Revision()).To(gomega.BeNumerically("<", 59))
+		w.Close()
+
+		trimmed, err := a.Watch(context.Background(), collName, WatchOptions{After: 1})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		_, err = trimmed.Next()
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(ChangesTrimmedCode))
+		trimmed.Close()
+
+		kept, err := a.Watch(context.Background(), collName, WatchOptions{After: 59})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(testNextChange(kept).Revision).To(gomega.Equal(uint64(60)))
+		kept.Close()
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+	})
+
+	GinkgoIt("Should send a delete of every truncated document to watchers", func() {
+		dir, e := ioutil.TempDir("", "rose_watch")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dir)
+
+		defer func() {
+			SetDataDir("")
+			_ = os.RemoveAll(dir)
+		}()
+
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "watch_coll")
+
+		testMultipleConcurrentInsert(2, testAsJsonInterface(TestUser{Email: "old@gmail.com"}), a, collName)
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 1}, a)
+
+		w, err := a.Watch(context.Background(), collName, WatchOptions{After: 3})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		gomega.Expect(a.TruncateCollection(collName)).To(gomega.BeNil())
+
+		// IDs start again, the insert of ID 1 follows the deletes of the old documents
+		res := testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "new@gmail.com"})}, a)
+		gomega.Expect(res.ID).To(gomega.Equal(1))
+
+		resumed, err := a.Watch(context.Background(), collName, WatchOptions{After: 3})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		change := testNextChange(resumed)
+		gomega.Expect(change.Type).To(gomega.Equal(DeleteChange))
+		gomega.Expect(change.ID).To(gomega.Equal(2))
+		gomega.Expect(change.Revision).To(gomega.Equal(uint64(4)))
+
+		change = testNextChange(resumed)
+		gomega.Expect(change.Type).To(gomega.Equal(InsertChange))
+		gomega.Expect(change.ID).To(gomega.Equal(1))
+		gomega.Expect(change.Revision).To(gomega.Equal(uint64(5)))
+		resumed.Close()
+
+		// a watcher of the truncated collection ends once it has read the log
+		gomega.Expect(testNextChange(w).Revision).To(gomega.Equal(uint64(4)))
+		gomega.Expect(testNextChange(w).Revision).To(gomega.Equal(uint64(5)))
+
+		_, err = w.Next()
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(WatchClosedCode))
+		w.Close()
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+	})
+
+	GinkgoIt("Should keep a write whose change cannot be saved and end watchers at the missing change", func() {
+		dir, e := ioutil.TempDir("", "rose_watch")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dir)
+
+		defer func() {
+			SetDataDir("")
+			_ = os.RemoveAll(dir)
+		}()
+
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "watch_coll")
+
+		w, err := a.Watch(context.Background(), collName)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "first@gmail.com"})}, a)
+
+		// appends fail while the change log is closed
+		l := a.Databases[collName].changes
+		l.Lock()
+		gomega.Expect(l.file.Close()).To(gomega.BeNil())
+		l.Unlock()
+
+		res := testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "second@gmail.com"})}, a)
+		gomega.Expect(res.Status).To(gomega.Equal(OkResultStatus))
+
+		user := TestUser{}
+		testSingleRead(ReadMetadata{CollectionName: collName, ID: res.ID, Data: &user}, a)
+		gomega.Expect(user.Email).To(gomega.Equal("second@gmail.com"))
+
+		l.Lock()
+		file, err := createFile(changeLogPath(l.dir), os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+		gomega.Expect(err).To(gomega.BeNil())
+		l.file = file
+		l.Unlock()
+
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "third@gmail.com"})}, a)
+
+		gomega.Expect(testNextChange(w).Revision).To(gomega.Equal(uint64(1)))
+
+		_, err = w.Next()
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(ChangesTrimmedCode))
+		gomega.Expect(err.Error()).To(gomega.Equal("Changes of collection watch_coll after revision 1 could not be saved, watch it again after revision 2"))
+		w.Close()
+
+		w, err = a.Watch(context.Background(), collName, WatchOptions{After: 2})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		change := testNextChange(w)
+		gomega.Expect(change.Revision).To(gomega.Equal(uint64(3)))
+		gomega.Expect(change.ID).To(gomega.Equal(3))
+		w.Close()
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+	})
+})
@@ -0,0 +1,427 @@
+/**
+Package client talks to a Rose server started with rose serve or server.New. Its methods mirror the ones of rose.Rose
+and return the same results and errors, so a service switches between an embedded and a remote database by its constructor:
+
+	c := client.New("http://127.0.0.1:7070", client.Options{Timeout: 5 * time.Second, Retries: 2})
+	res, err := c.WithContext(ctx).Write(rose.WriteMetadata{CollectionName: "users", Data: `{"email": "first@gmail.com"}`})
+
+Errors returned by the server keep their master code and code. A request that does not reach the server
+returns an error with SystemMasterErrorCode and OperatingSystemCode.
+*/
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"rose/rose"
+	"strings"
+	"time"
+)
+
+const defaultRetryBackoff = 100 * time.Millisecond
+
+type Options struct {
+	// client that sends the requests, http.DefaultClient by default
+	HTTPClient *http.Client
+	// time limit of every attempt of a request, no limit by default
+	Timeout time.Duration
+	/**
+	Number of times a request is repeated after a 503 response, which the server sends while an index is being built
+	or it runs out of file descriptors. Requests that do not change data (Read, ReadBy, Query) and the ones that can be
+	repeated safely (Replace, Delete) are also repeated after a transport error.
+	 */
+	Retries int
+	// wait before the first repeated attempt, doubled for every next one. 100ms by default
+	RetryBackoff time.Duration
+	// API token of a user of a server that requires authentication, sent as a bearer token
+	Token string
+	// user name and password sent with HTTP basic authentication when there is no Token
+	Username string
+	Password string
+}
+
+// implemented by the query builder that rose.NewQueryBuilder() returns
+type QueryBuilder interface {
+	Collection() string
+	Query() string
+	Params() map[string]interface{}
+}
+
+type Client struct {
+	baseURL string
+	options Options
+	ctx context.Context
+}
+
+type remoteError struct {
+	MasterCode int `json:"masterCode"`
+	Code int `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *remoteError) Error() string {
+	return e.Message
+}
+
+func (e *remoteError) GetCode() int {
+	return e.Code
+}
+
+func (e *remoteError) GetMasterCode() int {
+	return e.MasterCode
+}
+
+func (e *remoteError) JSON() []uint8 {
+	b, _ := json.Marshal(e)
+
+	return b
+}
+
+type remoteDocument struct {
+	ID int `json:"id"`
+	Data json.RawMessage `json:"data"`
+	Score float64 `json:"score"`
+	Distance float64 `json:"distance"`
+}
+
+type request struct {
+	method string
+	path string
+	body []uint8
+	// the request can be sent again after a transport error without writing the same data twice
+	idempotent bool
+}
+
+func New(baseURL string, options ...Options) *Client {
+	opts := Options{}
+	if len(options) > 0 {
+		opts = options[0]
+	}
+
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = defaultRetryBackoff
+	}
+
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		options: opts,
+		ctx: context.Background(),
+	}
+}
+
+// returns a copy of the client whose requests are canceled together with ctx
+func (c *Client) WithContext(ctx context.Context) *Client {
+	cp := *c
+	cp.ctx = ctx
+
+	return &cp
+}
+
+func (c *Client) Write(m rose.WriteMetadata) (*rose.AppResult, rose.Error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	body, err := documentBody(m.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &rose.AppResult{}
+	if _, err := c.do(request{method: http.MethodPost, path: collectionPath(m.CollectionName, "documents"), body: body}, res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (c *Client) BulkWrite(m rose.BulkWriteMetadata) (*rose.BulkAppResult, rose.Error) {
+	docs := make([]json.RawMessage, 0, len(m.Data))
+	for _, d := range m.Data {
+		body, err := documentBody(d)
+		if err != nil {
+			return nil, err
+		}
+
+		docs = append(docs, body)
+	}
+
+	body, err := marshal(docs)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &rose.BulkAppResult{}
+	if _, err := c.do(request{method: http.MethodPost, path: collectionPath(m.CollectionName, "documents", "bulk"), body: body}, res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// reads a document into m.Data. A document that does not exist is returned with NotFoundResultStatus, the same as with rose.Rose
+func (c *Client) Read(m rose.ReadMetadata) (*rose.AppResult, rose.Error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	doc := remoteDocument{}
+	found, err := c.do(request{method: http.MethodGet, path: collectionPath(m.CollectionName, "documents", fmt.Sprintf("%d", m.ID)), idempotent: true}, &doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return notFound(m.ID, rose.ReadMethodType), nil
+	}
+
+	if e := json.Unmarshal(doc.Data, m.Data); e != nil {
+		return nil, &remoteError{MasterCode: rose.SystemMasterErrorCode, Code: rose.UnmarshalFailCode, Message: fmt.Sprintf("Cannot unmarshal JSON string. The underlying error is: %s", e.Error())}
+	}
+
+	return &rose.AppResult{
+		ID: m.ID,
+		Method: rose.ReadMethodType,
+		Status: rose.FoundResultStatus,
+	}, nil
+}
+
+func (c *Client) ReadBy(m rose.ReadByMetadata) (*rose.AppReadResult, rose.Error) {
+	m.Data = nil
+
+	body, err := marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &rose.AppReadResult{
+		Method: rose.ReadByMethodType,
+		Status: rose.OkResultStatus,
+	}
+
+	if _, err := c.do(request{method: http.MethodPost, path: collectionPath(m.CollectionName, "readBy"), body: body, idempotent: true}, &res.Data); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (c *Client) Delete(m rose.DeleteMetadata) (*rose.AppResult, rose.Error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	res := &rose.AppResult{}
+	found, err := c.do(request{method: http.MethodDelete, path: collectionPath(m.CollectionName, "documents", fmt.Sprintf("%d", m.ID)), idempotent: true}, res)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return notFound(m.ID, rose.DeleteMethodType), nil
+	}
+
+	return res, nil
+}
+
+// replaces a document. Unlike rose.Rose, a document that does not exist is returned with NotFoundResultStatus
+func (c *Client) Replace(m rose.ReplaceMetadata) (*rose.AppResult, rose.Error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	body, err := documentBody(m.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &rose.AppResult{}
+	found, err := c.do(request{method: http.MethodPut, path: collectionPath(m.CollectionName, "documents", fmt.Sprintf("%d", m.ID)), body: body, idempotent: true}, res)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return notFound(m.ID, rose.ReplaceMethodType), nil
+	}
+
+	return res, nil
+}
+
+/**
+Runs a query built with rose.NewQueryBuilder(). The query is validated by If before it is sent
+and executed by the server, so results are the same as the ones of rose.Rose.
+*/
+func (c *Client) Query(qb QueryBuilder) ([]rose.QueryResult, rose.Error) {
+	params := make(map[string]string)
+	for name, value := range qb.Params() {
+		params[name] = fmt.Sprintf("%v", value)
+	}
+
+	body, err := marshal(map[string]interface{}{
+		"query": qb.Query(),
+		"params": params,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]remoteDocument, 0)
+	if _, err := c.do(request{method: http.MethodPost, path: collectionPath(qb.Collection(), "query"), body: body, idempotent: true}, &docs); err != nil {
+		return nil, err
+	}
+
+	results := make([]rose.QueryResult, 0, len(docs))
+	for _, d := range docs {
+		results = append(results, rose.QueryResult{
+			ID: d.ID,
+			Data: []uint8(d.Data),
+			Score: d.Score,
+			Distance: d.Distance,
+		})
+	}
+
+	return results, nil
+}
+
+/**
+Sends a request and decodes a successful response into v. Returns false without an error if the server
+did not find the document. A 503 response, and a transport error of an idempotent request, is retried
+up to Options.Retries times.
+*/
+func (c *Client) do(req request, v interface{}) (bool, rose.Error) {
+	backoff := c.options.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		status, body, e := c.send(req)
+
+		retry := attempt < c.options.Retries && c.ctx.Err() == nil &&
+			((e != nil && req.idempotent) || (e == nil && status == http.StatusServiceUnavailable))
+
+		if retry {
+			select {
+			case <-time.After(backoff):
+			case <-c.ctx.Done():
+			}
+
+			backoff *= 2
+
+			continue
+		}
+
+		if e != nil {
+			return false, &remoteError{MasterCode: rose.SystemMasterErrorCode, Code: rose.OperatingSystemCode, Message: fmt.Sprintf("Request to Rose server failed: %s", e.Error())}
+		}
+
+		if status >= 300 {
+			remote := &remoteError{}
+			if e := json.Unmarshal(body, remote); e != nil || remote.Message == "" {
+				return false, &remoteError{MasterCode: rose.SystemMasterErrorCode, Code: rose.UnmarshalFailCode, Message: fmt.Sprintf("Rose server responded with status %d and an unexpected body: %s", status, string(body))}
+			}
+
+			if status == http.StatusNotFound && remote.Code == rose.DocumentNotFoundCode {
+				return false, nil
+			}
+
+			return false, remote
+		}
+
+		if v != nil && len(body) > 0 {
+			if e := json.Unmarshal(body, v); e != nil {
+				return false, &remoteError{MasterCode: rose.SystemMasterErrorCode, Code: rose.UnmarshalFailCode, Message: fmt.Sprintf("Cannot unmarshal response of Rose server. The underlying error is: %s", e.Error())}
+			}
+		}
+
+		return true, nil
+	}
+}
+
+// sends a single attempt of a request, limited by Options.Timeout
+func (c *Client) send(req request) (int, []uint8, error) {
+	ctx := c.ctx
+	if c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+
+	r, e := http.NewRequestWithContext(ctx, req.method, c.baseURL+req.path, bytes.NewReader(req.body))
+	if e != nil {
+		return 0, nil, e
+	}
+
+	r.Header.Set("Content-Type", "application/json")
+
+	if c.options.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+c.options.Token)
+	} else if c.options.Username != "" {
+		r.SetBasicAuth(c.options.Username, c.options.Password)
+	}
+
+	res, e := c.options.HTTPClient.Do(r)
+	if e != nil {
+		return 0, nil, e
+	}
+
+	defer res.Body.Close()
+
+	body, e := ioutil.ReadAll(res.Body)
+	if e != nil {
+		return 0, nil, e
+	}
+
+	return res.StatusCode, body, nil
+}
+
+func collectionPath(collName string, segments ...string) string {
+	path := "/collections/" + url.PathEscape(collName)
+
+	for _, s := range segments {
+		path += "/" + url.PathEscape(s)
+	}
+
+	return path
+}
+
+// documents are JSON strings, the same as with rose.Rose
+func documentBody(data interface{}) (json.RawMessage, rose.Error) {
+	if s, ok := data.(string); ok {
+		return json.RawMessage(s), nil
+	}
+
+	b, err := marshal(data)
+
+	return json.RawMessage(b), err
+}
+
+func marshal(v interface{}) ([]uint8, rose.Error) {
+	b, e := json.Marshal(v)
+
+	if e != nil {
+		return nil, &remoteError{MasterCode: rose.ValidationMasterErrorCode, Code: rose.DataConversionCode, Message: fmt.Sprintf("Cannot marshal request to Rose server. The underlying error is: %s", e.Error())}
+	}
+
+	return b, nil
+}
+
+func notFound(id int, method string) *rose.AppResult {
+	return &rose.AppResult{
+		ID: id,
+		Method: method,
+		Status: rose.NotFoundResultStatus,
+		Reason: fmt.Sprintf("Rose: Entry with ID %d not found", id),
+	}
+}
@@ -0,0 +1,183 @@
+package client
+
+import (
+	"context"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"rose/rose"
+	"rose/rose/server"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	Email string `json:"email"`
+	Type string `json:"type"`
+	Age int `json:"age"`
+}
+
+func testServe(t *testing.T) (*rose.Rose, *httptest.Server, func()) {
+	g := gomega.NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "rose_client")
+	g.Expect(err).To(gomega.BeNil())
+
+	rose.SetDataDir(dir)
+
+	r, roseErr := rose.New(false)
+	g.Expect(roseErr).To(gomega.BeNil())
+	g.Expect(r.NewCollection("users")).To(gomega.BeNil())
+	g.Expect(r.NewIndex("users", "age", "int")).To(gomega.BeNil())
+
+	ts := httptest.NewServer(server.New(r))
+
+	return r, ts, func() {
+		ts.Close()
+		g.Expect(r.Shutdown()).To(gomega.BeNil())
+		rose.SetDataDir("")
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestClient(t *testing.T) {
+	g := gomega.NewWithT(t)
+
+	r, ts, done := testServe(t)
+	defer done()
+
+	c := New(ts.URL)
+
+	res, err := c.Write(rose.WriteMetadata{CollectionName: "users", Data: `{"email": "first@gmail.com", "type": "user", "age": 20}`})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(*res).To(gomega.Equal(rose.AppResult{ID: 1, Method: rose.WriteMethodType, Status: rose.OkResultStatus}))
+
+	bulk, err := c.BulkWrite(rose.BulkWriteMetadata{CollectionName: "users", Data: []interface{}{
+		`{"email": "second@gmail.com", "type": "company", "age": 30}`,
+		testUser{Email: "third@gmail.com", Type: "user", Age: 40},
+	}})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(bulk.WrittenIDs).To(gomega.Equal("2,3"))
+
+	remote := testUser{}
+	res, err = c.Read(rose.ReadMetadata{CollectionName: "users", ID: 3, Data: &remote})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(res.Status).To(gomega.Equal(rose.FoundResultStatus))
+
+	embedded := testUser{}
+	_, err = r.Read(rose.ReadMetadata{CollectionName: "users", ID: 3, Data: &embedded})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(remote).To(gomega.Equal(embedded))
+
+	res, err = c.Read(rose.ReadMetadata{CollectionName: "users", ID: 10, Data: &remote})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(res.Status).To(gomega.Equal(rose.NotFoundResultStatus))
+
+	_, err = c.Read(rose.ReadMetadata{CollectionName: "not_exists", ID: 1, Data: &remote})
+	g.Expect(err).To(gomega.Not(gomega.BeNil()))
+	g.Expect(err.GetMasterCode()).To(gomega.Equal(rose.GenericMasterErrorCode))
+	g.Expect(err.GetCode()).To(gomega.Equal(rose.InvalidUserSuppliedDataCode))
+	g.Expect(err.Error()).To(gomega.Equal("Invalid read request. Collection not_exists does not exist"))
+
+	readBy, err := c.ReadBy(rose.ReadByMetadata{CollectionName: "users", Field: "age", Value: 30, DataType: "int"})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(len(readBy.Data)).To(gomega.Equal(1))
+	g.Expect(readBy.Data[0].ID).To(gomega.Equal(2))
+	g.Expect(readBy.Data[0].Data.(map[string]interface{})["email"]).To(gomega.Equal("second@gmail.com"))
+
+	res, err = c.Replace(rose.ReplaceMetadata{CollectionName: "users", ID: 2, Data: `{"email": "replaced@gmail.com", "type": "user", "age": 31}`})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(res.Status).To(gomega.Equal(rose.ReplacedResultStatus))
+
+	res, err = c.Replace(rose.ReplaceMetadata{CollectionName: "users", ID: 10, Data: `{"email": "none@gmail.com", "age": 1}`})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(res.Status).To(gomega.Equal(rose.NotFoundResultStatus))
+
+	qb := rose.NewQueryBuilder()
+	g.Expect(qb.If("users", "type:string == #type && age:int > #age", map[string]interface{}{"#type": "user", "#age": "25"})).To(gomega.BeNil())
+
+	remoteResults, err := c.Query(qb)
+	g.Expect(err).To(gomega.BeNil())
+
+	embeddedResults, err := r.Query(qb)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(len(remoteResults)).To(gomega.Equal(2))
+	g.Expect(len(embeddedResults)).To(gomega.Equal(2))
+
+	// the server sends documents as compacted JSON
+	for i, res := range remoteResults {
+		g.Expect(res.ID).To(gomega.Equal(embeddedResults[i].ID))
+		g.Expect(res.Data).To(gomega.MatchJSON(embeddedResults[i].Data))
+	}
+
+	res, err = c.Delete(rose.DeleteMetadata{CollectionName: "users", ID: 1})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(res.Status).To(gomega.Equal(rose.DeletedResultStatus))
+
+	res, err = c.Delete(rose.DeleteMetadata{CollectionName: "users", ID: 1})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(res.Status).To(gomega.Equal(rose.NotFoundResultStatus))
+
+	// validated before it is sent
+	_, err = c.Write(rose.WriteMetadata{CollectionName: "", Data: `{}`})
+	g.Expect(err).To(gomega.Not(gomega.BeNil()))
+	g.Expect(err.GetCode()).To(gomega.Equal(rose.InvalidUserSuppliedDataCode))
+}
+
+func TestClientRetriesAndTimeouts(t *testing.T) {
+	g := gomega.NewWithT(t)
+
+	_, ts, done := testServe(t)
+	defer done()
+
+	var attempts int32
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]uint8(`{"masterCode": 5, "code": 16, "message": "Index is being built"}`))
+
+			return
+		}
+
+		http.Redirect(w, r, ts.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer unavailable.Close()
+
+	c := New(unavailable.URL, Options{Retries: 2, RetryBackoff: time.Millisecond})
+
+	res, err := c.Write(rose.WriteMetadata{CollectionName: "users", Data: `{"email": "first@gmail.com", "age": 20}`})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(res.ID).To(gomega.Equal(1))
+	g.Expect(atomic.LoadInt32(&attempts)).To(gomega.Equal(int32(3)))
+
+	atomic.StoreInt32(&attempts, 0)
+	c = New(unavailable.URL, Options{Retries: 1, RetryBackoff: time.Millisecond})
+
+	_, err = c.Write(rose.WriteMetadata{CollectionName: "users", Data: `{"email": "second@gmail.com", "age": 30}`})
+	g.Expect(err).To(gomega.Not(gomega.BeNil()))
+	g.Expect(err.GetCode()).To(gomega.Equal(rose.IndexBuildingCode))
+	g.Expect(err.Error()).To(gomega.Equal("Index is being built"))
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	data := testUser{}
+
+	c = New(slow.URL, Options{Timeout: 20 * time.Millisecond})
+	_, err = c.Read(rose.ReadMetadata{CollectionName: "users", ID: 1, Data: &data})
+	g.Expect(err).To(gomega.Not(gomega.BeNil()))
+	g.Expect(err.GetMasterCode()).To(gomega.Equal(rose.SystemMasterErrorCode))
+	g.Expect(err.GetCode()).To(gomega.Equal(rose.OperatingSystemCode))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = New(ts.URL).WithContext(ctx).Read(rose.ReadMetadata{CollectionName: "users", ID: 1, Data: &data})
+	g.Expect(err).To(gomega.Not(gomega.BeNil()))
+	g.Expect(err.Error()).To(gomega.ContainSubstring("context canceled"))
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"rose/rose"
+	"strconv"
+)
+
+func commands() map[string]command {
+	return map[string]command{
+		"collections": {
+			usage:       "collections",
+			description: "lists all collections",
+			run:         collectionsCommand,
+		},
+		"stats": {
+			usage:       "stats <coll>",
+			description: "prints statistics of a collection",
+			run:         statsCommand,
+		},
+		"get": {
+			usage:       "get <coll> <id>",
+			description: "prints a single document",
+			run:         getCommand,
+		},
+		"query": {
+			usage:       "query <coll> '<query>'",
+			description: "prints every document that matches the query, one per line",
+			run:         queryCommand,
+		},
+		"indexes": {
+			usage:       "indexes <coll>",
+			description: "lists the indexes of a collection",
+			run:         indexesCommand,
+		},
+		"compact": {
+			usage:       "compact <coll>",
+			description: "removes deleted and replaced documents from the blocks of a collection",
+			run:         compactCommand,
+		},
+		"export": {
+			usage:       "export [-format ndjson|csv] [-o file] <coll>",
+			description: "exports a collection to a file or stdout",
+			run:         exportCommand,
+		},
+		"fsck": {
+			usage:       "fsck [-repair]",
+			description: "checks every block and index definition while the database is not open",
+			offline:     true,
+			run:         fsckCommand,
+		},
+		"shell": {
+			usage:       "shell [-history file] [-no-color] [coll]",
+			description: "starts an interactive shell that runs queries",
+			run:         shellCommand,
+		},
+		"users": {
+			usage:       "users list|add|grant|passwd|token|revoke|remove ...",
+			description: "manages the users of serve -auth, run users help for details",
+			run:         usersCommand,
+		},
+		"serve": {
+			usage:       "serve [-addr host:port] [-auth]",
+			description: "serves the database over HTTP with JSON bodies until interrupted",
+			run:         serveCommand,
+		},
+		"import": {
+			usage:       "import [-format ndjson|csv] [-preserve-ids] <coll> [file]",
+			description: "imports documents from a file or stdin",
+			run:         importCommand,
+		},
+	}
+}
+
+func collectionsCommand(c *cli, args []string) error {
+	if err := expectArgs(args, 0); err != nil {
+		return err
+	}
+
+	for _, name := range c.rose.ListCollections() {
+		fmt.Fprintln(c.stdout, name)
+	}
+
+	return nil
+}
+
+func statsCommand(c *cli, args []string) error {
+	if err := expectArgs(args, 1); err != nil {
+		return err
+	}
+
+	stats, err := c.rose.Stats(args[0])
+
+	if err != nil {
+		return err
+	}
+
+	return c.printJSON(stats)
+}
+
+func getCommand(c *cli, args []string) error {
+	if err := expectArgs(args, 2); err != nil {
+		return err
+	}
+
+	id, e := strconv.Atoi(args[1])
+
+	if e != nil {
+		return fmt.Errorf("invalid ID %s, ID must be an integer", args[1])
+	}
+
+	var doc json.RawMessage
+	res, err := c.rose.Read(rose.ReadMetadata{CollectionName: args[0], ID: id, Data: &doc})
+
+	if err != nil {
+		return err
+	}
+
+	if res.Status == rose.NotFoundResultStatus {
+		return fmt.Errorf("document with ID %d not found in collection %s", id, args[0])
+	}
+
+	fmt.Fprintln(c.stdout, string(doc))
+
+	return nil
+}
+
+func queryCommand(c *cli, args []string) error {
+	if err := expectArgs(args, 2); err != nil {
+		return err
+	}
+
+	qb := rose.NewQueryBuilder()
+
+	if err := qb.If(args[0], args[1], map[string]interface{}{}); err != nil {
+		return err
+	}
+
+	results, err := c.rose.Query(qb)
+
+	if err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		fmt.Fprintf(c.stdout, "{\"id\":%d,\"data\":%s}\n", r.ID, r.Data)
+	}
+
+	return nil
+}
+
+func indexesCommand(c *cli, args []string) error {
+	if err := expectArgs(args, 1); err != nil {
+		return err
+	}
+
+	indexes, err := c.rose.ListIndexes(args[0])
+
+	if err != nil {
+		return err
+	}
+
+	return c.printJSON(indexes)
+}
+
+func compactCommand(c *cli, args []string) error {
+	if err := expectArgs(args, 1); err != nil {
+		return err
+	}
+
+	res, err := c.rose.Compact(args[0])
+
+	if err != nil {
+		return err
+	}
+
+	return c.printJSON(res)
+}
+
+func exportCommand(c *cli, args []string) error {
+	flags := c.flagSet("export")
+	format := flags.String("format", string(rose.NDJSONFormat), "ndjson or csv")
+	output := flags.String("o", "", "file to export into, stdout by default")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := expectArgs(flags.Args(), 1); err != nil {
+		return err
+	}
+
+	w := c.stdout
+
+	if *output != "" {
+		f, e := os.Create(*output)
+
+		if e != nil {
+			return e
+		}
+
+		defer f.Close()
+
+		w = f
+	}
+
+	res, err := c.rose.Export(flags.Arg(0), w, rose.DataFormat(*format))
+
+	if err != nil {
+		return err
+	}
+
+	if *output != "" {
+		fmt.Fprintf(c.stdout, "exported %d documents into %s\n", res.Documents, *output)
+	}
+
+	return nil
+}
+
+func importCommand(c *cli, args []string) error {
+	flags := c.flagSet("import")
+	format := flags.String("format", string(rose.NDJSONFormat), "ndjson or csv")
+	preserveIds := flags.Bool("preserve-ids", false, "keep the IDs of the imported documents")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 && flags.NArg() != 2 {
+		return fmt.Errorf("expected a collection and an optional file, %d arguments given", flags.NArg())
+	}
+
+	r := c.stdin
+
+	if flags.NArg() == 2 {
+		f, e := os.Open(flags.Arg(1))
+
+		if e != nil {
+			return e
+		}
+
+		defer f.Close()
+
+		r = f
+	}
+
+	res, err := c.rose.Import(flags.Arg(0), r, rose.DataFormat(*format), rose.ImportOptions{PreserveIDs: *preserveIds})
+
+	if res != nil {
+		for _, lineErr := range res.Errors {
+			fmt.Fprintf(c.stderr, "line %d: %s\n", lineErr.Line, lineErr.Message)
+		}
+
+		fmt.Fprintf(c.stdout, "imported %d documents, %d failed\n", res.Imported, res.Failed)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if res.Failed > 0 {
+		return errors.New("some documents were not imported")
+	}
+
+	return nil
+}
+
+func fsckCommand(c *cli, args []string) error {
+	flags := c.flagSet("fsck")
+	repair := flags.Bool("repair", false, "quarantines the lines that have a problem and rebuilds the indexes")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := expectArgs(flags.Args(), 0); err != nil {
+		return err
+	}
+
+	report, err := rose.Fsck(rose.FsckOptions{Repair: *repair})
+
+	if err != nil {
+		return err
+	}
+
+	for _, p := range report.Problems {
+		location := p.Collection
+		if p.Block != "" {
+			location = fmt.Sprintf("%s/%s@%d", p.Collection, p.Block, p.Offset)
+		}
+
+		status := ""
+		if p.Repaired {
+			status = " (repaired)"
+		}
+
+		fmt.Fprintf(c.stdout, "%s: %s: %s%s\n", location, p.Kind, p.Message, status)
+	}
+
+	fmt.Fprintf(c.stdout, "checked %d collections, %d blocks, %d documents, found %d problems\n", report.Collections, report.Blocks, report.Documents, len(report.Problems))
+
+	if report.QuarantineDir != "" {
+		fmt.Fprintf(c.stdout, "removed lines are in %s\n", report.QuarantineDir)
+	}
+
+	if !report.Healthy() {
+		return errors.New("database has problems, run fsck -repair to repair them")
+	}
+
+	return nil
+}
+
+func (c *cli) flagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+
+	return flags
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	b, e := json.MarshalIndent(v, "", "  ")
+
+	if e != nil {
+		return e
+	}
+
+	_, e = fmt.Fprintln(c.stdout, string(b))
+
+	return e
+}
+
+func expectArgs(args []string, n int) error {
+	if len(args) != n {
+		return fmt.Errorf("expected %d arguments, %d given", n, len(args))
+	}
+
+	return nil
+}
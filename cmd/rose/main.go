@@ -0,0 +1,138 @@
+/**
+rose is a command-line tool for inspecting and administering a Rose database. It opens the database through the public
+Rose API, so it takes the same locks as the library and refuses to open a data directory that another process uses.
+
+	rose [-data-dir dir] <command> [arguments]
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"rose/rose"
+	"sort"
+)
+
+type cli struct {
+	rose *rose.Rose
+	stdin io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+type command struct {
+	usage string
+	description string
+	// the command works on the data directory itself, which must not be opened
+	offline bool
+	run func(c *cli, args []string) error
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// runs a command and returns the exit code of the process
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("rose", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dataDir := flags.String("data-dir", "", "directory of the database, .rose_db in the home directory by default")
+	flags.Usage = func() {
+		printUsage(flags, stderr)
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		printUsage(flags, stderr)
+
+		return 2
+	}
+
+	name := flags.Arg(0)
+	cmd, ok := commands()[name]
+
+	if !ok {
+		fmt.Fprintf(stderr, "rose: unknown command %s\n\n", name)
+		printUsage(flags, stderr)
+
+		return 2
+	}
+
+	if *dataDir != "" {
+		if _, err := os.Stat(*dataDir); err != nil {
+			fmt.Fprintf(stderr, "rose: data directory %s does not exist\n", *dataDir)
+
+			return 1
+		}
+
+		rose.SetDataDir(*dataDir)
+	}
+
+	c := &cli{
+		stdin: stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	if cmd.offline {
+		if err := cmd.run(c, flags.Args()[1:]); err != nil {
+			fmt.Fprintf(stderr, "rose %s: %s\n", name, err.Error())
+
+			return 1
+		}
+
+		return 0
+	}
+
+	r, roseErr := rose.New(false)
+
+	if roseErr != nil {
+		fmt.Fprintf(stderr, "rose: %s\n", roseErr.Error())
+
+		return 1
+	}
+
+	c.rose = r
+
+	code := 0
+	if err := cmd.run(c, flags.Args()[1:]); err != nil {
+		fmt.Fprintf(stderr, "rose %s: %s\n", name, err.Error())
+
+		code = 1
+	}
+
+	if err := r.Shutdown(); err != nil {
+		fmt.Fprintf(stderr, "rose: %s\n", err.Error())
+
+		code = 1
+	}
+
+	return code
+}
+
+func printUsage(flags *flag.FlagSet, w io.Writer) {
+	fmt.Fprintln(w, "Usage: rose [-data-dir dir] <command> [arguments]")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Commands:")
+
+	cmds := commands()
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-50s %s\n", cmds[name].usage, cmds[name].description)
+	}
+
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Flags:")
+	flags.PrintDefaults()
+}
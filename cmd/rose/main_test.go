@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"rose/rose"
+	"strings"
+	"testing"
+)
+
+func testRun(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCommands(t *testing.T) {
+	g := gomega.NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "rose_cli")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	code, _, stderr := testRun("", "-data-dir", dir+"/not_exists", "collections")
+	g.Expect(code).To(gomega.Equal(1))
+	g.Expect(stderr).To(gomega.ContainSubstring("does not exist"))
+
+	code, _, stderr = testRun("", "-data-dir", dir, "unknown")
+	g.Expect(code).To(gomega.Equal(2))
+	g.Expect(stderr).To(gomega.ContainSubstring("rose: unknown command unknown"))
+
+	// collections are created through the library, the CLI only administers them
+	rose.SetDataDir(dir)
+	r, roseErr := rose.New(false)
+	g.Expect(roseErr).To(gomega.BeNil())
+	g.Expect(r.NewCollection("users")).To(gomega.BeNil())
+	g.Expect(r.Shutdown()).To(gomega.BeNil())
+
+	ndjson := "{\"id\": 1, \"data\": {\"email\": \"first@gmail.com\", \"type\": \"user\"}}\n" +
+		"{\"id\": 2, \"data\": {\"email\": \"second@gmail.com\", \"type\": \"company\"}}\n" +
+		"{\"id\": 3, \"data\": {\"email\": \"third@gmail.com\", \"type\": \"user\"}}\n" +
+		"not json\n"
+
+	code, stdout, stderr := testRun(ndjson, "-data-dir", dir, "import", "-preserve-ids", "users")
+	g.Expect(code).To(gomega.Equal(1))
+	g.Expect(stdout).To(gomega.Equal("imported 3 documents, 1 failed\n"))
+	g.Expect(stderr).To(gomega.ContainSubstring("line 4: Data must be a JSON byte array"))
+
+	code, stdout, _ = testRun("", "-data-dir", dir, "collections")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(stdout).To(gomega.Equal("users\n"))
+
+	code, stdout, _ = testRun("", "-data-dir", dir, "get", "users", "2")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(stdout).To(gomega.Equal("{\"email\":\"second@gmail.com\",\"type\":\"company\"}\n"))
+
+	code, _, stderr = testRun("", "-data-dir", dir, "get", "users", "10")
+	g.Expect(code).To(gomega.Equal(1))
+	g.Expect(stderr).To(gomega.Equal("rose get: document with ID 10 not found in collection users\n"))
+
+	code, stdout, _ = testRun("", "-data-dir", dir, "query", "users", "type:string == user")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(strings.Count(stdout, "\n")).To(gomega.Equal(2))
+	g.Expect(stdout).To(gomega.ContainSubstring("first@gmail.com"))
+	g.Expect(stdout).To(gomega.ContainSubstring("third@gmail.com"))
+
+	code, stdout, _ = testRun("", "-data-dir", dir, "stats", "users")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(stdout).To(gomega.ContainSubstring("\"documents\": 3"))
+
+	code, stdout, _ = testRun("", "-data-dir", dir, "indexes", "users")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(stdout).To(gomega.Equal("[]\n"))
+
+	code, stdout, _ = testRun("", "-data-dir", dir, "compact", "users")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(stdout).To(gomega.ContainSubstring("\"compactedBlocks\": 0"))
+
+	code, stdout, _ = testRun("", "-data-dir", dir, "export", "-format", "csv", "users")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(strings.Split(stdout, "\n")[0]).To(gomega.Equal("id,data"))
+	g.Expect(strings.Count(stdout, "\n")).To(gomega.Equal(4))
+
+	code, _, stderr = testRun("", "-data-dir", dir, "stats")
+	g.Expect(code).To(gomega.Equal(1))
+	g.Expect(stderr).To(gomega.Equal("rose stats: expected 1 arguments, 0 given\n"))
+
+	code, _, stderr = testRun("", "-data-dir", dir, "serve", "-addr", "not an address")
+	g.Expect(code).To(gomega.Equal(1))
+	g.Expect(stderr).To(gomega.HavePrefix("rose serve: listen tcp"))
+
+	code, stdout, _ = testRun("", "-data-dir", dir, "fsck")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(stdout).To(gomega.Equal("checked 1 collections, 1 blocks, 3 documents, found 0 problems\n"))
+
+	f, err := os.OpenFile(dir+"/db/users/block_0.rose", os.O_APPEND|os.O_WRONLY, 0666)
+	g.Expect(err).To(gomega.BeNil())
+	_, err = f.WriteString("garbage\n")
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(f.Close()).To(gomega.BeNil())
+
+	code, stdout, stderr = testRun("", "-data-dir", dir, "fsck")
+	g.Expect(code).To(gomega.Equal(1))
+	g.Expect(stdout).To(gomega.ContainSubstring("users/block_0.rose@"))
+	g.Expect(stdout).To(gomega.ContainSubstring(": malformed_line: Line must hold an ID and a document separated by the delimiter\n"))
+	g.Expect(stderr).To(gomega.Equal("rose fsck: database has problems, run fsck -repair to repair them\n"))
+
+	code, stdout, _ = testRun("", "-data-dir", dir, "fsck", "-repair")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(stdout).To(gomega.ContainSubstring("(repaired)\n"))
+	g.Expect(stdout).To(gomega.ContainSubstring("removed lines are in " + dir + "/quarantine\n"))
+}
+
+func TestShell(t *testing.T) {
+	g := gomega.NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "rose_shell")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	rose.SetDataDir(dir)
+	r, roseErr := rose.New(false)
+	g.Expect(roseErr).To(gomega.BeNil())
+	g.Expect(r.NewCollection("users")).To(gomega.BeNil())
+	g.Expect(r.NewIndex("users", "type", "string")).To(gomega.BeNil())
+
+	for _, data := range []string{
+		`{"email": "first@gmail.com", "type": "user", "age": 20}`,
+		`{"email": "second@gmail.com", "type": "company", "age": 30}`,
+		`{"email": "third@gmail.com", "type": "user", "age": 40.5}`,
+	} {
+		_, roseErr = r.Write(rose.WriteMetadata{CollectionName: "users", Data: data})
+		g.Expect(roseErr).To(gomega.BeNil())
+	}
+
+	g.Expect(r.Shutdown()).To(gomega.BeNil())
+
+	history := dir + "/history"
+	input := "type:string == user\n" +
+		".use users\n" +
+		".param type user\n" +
+		".param #email \"second@gmail.com\"\n" +
+		".params\n" +
+		"type:string == #type\n" +
+		"email:string == #email\n" +
+		"age:int >\n" +
+		".explain type:string == #type\n" +
+		".explain age:int > 10\n" +
+		".schema\n" +
+		"!6\n" +
+		".unknown\n"
+
+	code, stdout, stderr := testRun(input, "-data-dir", dir, "shell", "-history", history, "-no-color")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(stderr).To(gomega.Equal(""))
+
+	g.Expect(stdout).To(gomega.ContainSubstring("error: no collection is used, choose one with .use <coll>"))
+	g.Expect(stdout).To(gomega.ContainSubstring("#email = \"second@gmail.com\"\n#type = \"user\"\n"))
+	g.Expect(stdout).To(gomega.ContainSubstring("{\n  \"id\": 1,\n  \"data\": {\n    \"email\": \"first@gmail.com\",\n    \"type\": \"user\",\n    \"age\": 20\n  }\n}\n"))
+	g.Expect(stdout).To(gomega.MatchRegexp(`2 results in \S+\n`))
+	g.Expect(stdout).To(gomega.MatchRegexp(`1 result in \S+\n`))
+	g.Expect(stdout).To(gomega.ContainSubstring("error: Unable to process query. Condition 'age:int >' is incomplete"))
+	g.Expect(stdout).To(gomega.ContainSubstring("\"strategy\": \"index\",\n  \"index\": \"type\""))
+	g.Expect(stdout).To(gomega.ContainSubstring("\"strategy\": \"scan\""))
+	g.Expect(stdout).To(gomega.ContainSubstring("\"name\": \"age\",\n      \"types\": {\n        \"float\": 1,\n        \"int\": 2\n      }"))
+	g.Expect(stdout).To(gomega.ContainSubstring("\"sampled\": 3"))
+	g.Expect(stdout).To(gomega.ContainSubstring("error: unknown command .unknown"))
+	g.Expect(strings.Count(stdout, "2 results in")).To(gomega.Equal(2))
+
+	// the history is kept between sessions
+	code, stdout, _ = testRun(".history\n!2\n.exit\n.params\n", "-data-dir", dir, "shell", "-history", history, "-no-color")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(stdout).To(gomega.ContainSubstring("    2  .use users\n"))
+	g.Expect(stdout).To(gomega.ContainSubstring("   12  type:string == #type\n"))
+	g.Expect(stdout).To(gomega.HaveSuffix("rose:users> "))
+}
+
+func TestUsers(t *testing.T) {
+	g := gomega.NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "rose_users")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	code, _, stderr := testRun("", "-data-dir", dir, "users", "add", "-password", "secret", "alice", "*=admin", "orders=write")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(stderr).To(gomega.Equal(""))
+
+	code, _, stderr = testRun("", "-data-dir", dir, "users", "add", "bob", "orders")
+	g.Expect(code).To(gomega.Equal(1))
+	g.Expect(stderr).To(gomega.Equal("rose users: invalid permission orders, permissions must be in coll=role format\n"))
+
+	code, _, _ = testRun("", "-data-dir", dir, "users", "add", "bob", "orders=read")
+	g.Expect(code).To(gomega.Equal(0))
+
+	code, stdout, _ := testRun("", "-data-dir", dir, "users", "token", "bob")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(stdout).To(gomega.MatchRegexp(`^[0-9a-f]{8}\.[0-9a-f]{48}\n$`))
+
+	code, _, _ = testRun("new secret\n", "-data-dir", dir, "users", "passwd", "bob")
+	g.Expect(code).To(gomega.Equal(0))
+
+	code, _, _ = testRun("", "-data-dir", dir, "users", "grant", "bob", "orders=write")
+	g.Expect(code).To(gomega.Equal(0))
+
+	code, stdout, _ = testRun("", "-data-dir", dir, "users", "list")
+	g.Expect(code).To(gomega.Equal(0))
+	g.Expect(stdout).To(gomega.ContainSubstring("\"name\": \"alice\",\n    \"permissions\": {\n      \"*\": \"admin\",\n      \"orders\": \"write\"\n    }"))
+	g.Expect(stdout).To(gomega.ContainSubstring("\"name\": \"bob\",\n    \"permissions\": {\n      \"orders\": \"write\"\n    }"))
+	g.Expect(stdout).To(gomega.Not(gomega.ContainSubstring("hash")))
+
+	code, _, _ = testRun("", "-data-dir", dir, "users", "remove", "bob")
+	g.Expect(code).To(gomega.Equal(0))
+
+	code, _, stderr = testRun("", "-data-dir", dir, "users", "remove", "bob")
+	g.Expect(code).To(gomega.Equal(1))
+	g.Expect(stderr).To(gomega.Equal("rose users: User bob does not exist\n"))
+
+	code, _, stderr = testRun("", "-data-dir", dir, "users", "unknown")
+	g.Expect(code).To(gomega.Equal(1))
+	g.Expect(stderr).To(gomega.HaveSuffix("rose users: unknown users command unknown\n"))
+}
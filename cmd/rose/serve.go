@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"rose/rose/server"
+	"syscall"
+	"time"
+)
+
+// time that requests in flight get to finish after an interrupt
+const shutdownTimeout = 10 * time.Second
+
+func serveCommand(c *cli, args []string) error {
+	flags := c.flagSet("serve")
+	addr := flags.String("addr", "127.0.0.1:7070", "address to listen on")
+	auth := flags.Bool("auth", false, "requires requests to authenticate as a user, see the users command")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := expectArgs(flags.Args(), 0); err != nil {
+		return err
+	}
+
+	options := server.Options{}
+
+	if *auth {
+		users, err := server.NewUsers(c.rose)
+
+		if err != nil {
+			return err
+		}
+
+		if len(users.List()) == 0 {
+			fmt.Fprintln(c.stderr, "warning: there are no users, add one with rose users add")
+		}
+
+		options.Users = users
+	}
+
+	listener, e := net.Listen("tcp", *addr)
+
+	if e != nil {
+		return e
+	}
+
+	srv := &http.Server{
+		Handler:           server.New(c.rose, options),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+
+	fmt.Fprintf(c.stdout, "listening on http://%s\n", listener.Addr().String())
+
+	select {
+	case e := <-served:
+		return e
+	case <-interrupt:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return srv.Shutdown(ctx)
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/valyala/fastjson"
+	"io"
+	"os"
+	"path/filepath"
+	"rose/rose"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the history file keeps at most this many entries, older ones are dropped when the shell starts
+const maxHistory = 1000
+
+// number of documents that .schema reads to find the fields of a collection
+const schemaSampleSize = 100
+
+var errSampleFull = errors.New("sample is full")
+
+type shell struct {
+	c *cli
+	in *bufio.Scanner
+	coll string
+	params map[string]interface{}
+	history []string
+	historyFile string
+	colors jsonColors
+	quit bool
+}
+
+type jsonColors struct {
+	key func(a ...interface{}) string
+	str func(a ...interface{}) string
+	num func(a ...interface{}) string
+	literal func(a ...interface{}) string
+	info func(a ...interface{}) string
+	err func(a ...interface{}) string
+}
+
+type metaCommand struct {
+	usage string
+	description string
+	run func(s *shell, args string) error
+}
+
+func metaCommands() map[string]metaCommand {
+	return map[string]metaCommand{
+		".use": {
+			usage: ".use <coll>",
+			description: "runs the next queries on a collection",
+			run: (*shell).useCommand,
+		},
+		".param": {
+			usage: ".param <name> [value]",
+			description: "binds a value to #name, a name without a value is unbound",
+			run: (*shell).paramCommand,
+		},
+		".params": {
+			usage: ".params",
+			description: "lists the bound parameters",
+			run: (*shell).paramsCommand,
+		},
+		".explain": {
+			usage: ".explain <query>",
+			description: "shows how a query would be executed without running it",
+			run: (*shell).explainCommand,
+		},
+		".schema": {
+			usage: ".schema [coll]",
+			description: "shows the indexes and the fields of a collection",
+			run: (*shell).schemaCommand,
+		},
+		".history": {
+			usage: ".history",
+			description: "lists the previous lines, !n runs line n again and !! the last one",
+			run: (*shell).historyCommand,
+		},
+		".help": {
+			usage: ".help",
+			description: "shows this help",
+			run: (*shell).helpCommand,
+		},
+		".exit": {
+			usage: ".exit",
+			description: "leaves the shell, same as end of input",
+			run: (*shell).exitCommand,
+		},
+	}
+}
+
+func shellCommand(c *cli, args []string) error {
+	flags := c.flagSet("shell")
+	historyFile := flags.String("history", defaultHistoryFile(), "file that keeps the history between sessions, none if empty")
+	noColor := flags.Bool("no-color", false, "prints JSON without colors")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() > 1 {
+		return fmt.Errorf("expected an optional collection, %d arguments given", flags.NArg())
+	}
+
+	if *noColor {
+		color.NoColor = true
+	}
+
+	in := bufio.NewScanner(c.stdin)
+	in.Buffer(make([]uint8, 0, 64*1024), 1024*1024)
+
+	s := &shell{
+		c: c,
+		in: in,
+		params: make(map[string]interface{}),
+		historyFile: *historyFile,
+		colors: newJSONColors(),
+	}
+
+	if flags.NArg() == 1 {
+		if err := s.useCommand(flags.Arg(0)); err != nil {
+			return err
+		}
+	}
+
+	s.loadHistory()
+
+	return s.run()
+}
+
+func newJSONColors() jsonColors {
+	return jsonColors{
+		key: color.New(color.FgBlue, color.Bold).SprintFunc(),
+		str: color.New(color.FgGreen).SprintFunc(),
+		num: color.New(color.FgCyan).SprintFunc(),
+		literal: color.New(color.FgMagenta).SprintFunc(),
+		info: color.New(color.Faint).SprintFunc(),
+		err: color.New(color.FgRed).SprintFunc(),
+	}
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".rose_shell_history")
+}
+
+func (s *shell) run() error {
+	fmt.Fprintln(s.c.stdout, "Rose shell. Type .help for help, .exit to leave.")
+
+	for !s.quit {
+		s.prompt()
+
+		if !s.in.Scan() {
+			fmt.Fprintln(s.c.stdout)
+
+			break
+		}
+
+		line := strings.TrimSpace(s.in.Text())
+
+		if line == "" {
+			continue
+		}
+
+		line, err := s.expandHistory(line)
+
+		if err != nil {
+			s.printError(err)
+
+			continue
+		}
+
+		s.addHistory(line)
+
+		if err := s.exec(line); err != nil {
+			s.printError(err)
+		}
+	}
+
+	return s.in.Err()
+}
+
+func (s *shell) prompt() {
+	if s.coll == "" {
+		fmt.Fprint(s.c.stdout, "rose> ")
+
+		return
+	}
+
+	fmt.Fprintf(s.c.stdout, "rose:%s> ", s.coll)
+}
+
+func (s *shell) exec(line string) error {
+	if !strings.HasPrefix(line, ".") {
+		return s.queryCommand(line)
+	}
+
+	name, args := line, ""
+	if i := strings.IndexAny(line, " \t"); i != -1 {
+		name, args = line[:i], strings.TrimSpace(line[i+1:])
+	}
+
+	cmd, ok := metaCommands()[name]
+
+	if !ok {
+		return fmt.Errorf("unknown command %s, type .help for the list of commands", name)
+	}
+
+	return cmd.run(s, args)
+}
+
+func (s *shell) printError(err error) {
+	fmt.Fprintln(s.c.stdout, s.colors.err("error: "+err.Error()))
+}
+
+func (s *shell) requireCollection() error {
+	if s.coll == "" {
+		return errors.New("no collection is used, choose one with .use <coll>")
+	}
+
+	return nil
+}
+
+func (s *shell) queryCommand(query string) error {
+	if err := s.requireCollection(); err != nil {
+		return err
+	}
+
+	qb := rose.NewQueryBuilder()
+
+	if err := qb.If(s.coll, query, s.params); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	results, err := s.c.rose.Query(qb)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		doc := fmt.Sprintf("{\"id\":%d,\"data\":%s}", r.ID, r.Data)
+
+		if r.Score != 0 {
+			doc = fmt.Sprintf("{\"id\":%d,\"score\":%g,\"data\":%s}", r.ID, r.Score, r.Data)
+		} else if r.Distance != 0 {
+			doc = fmt.Sprintf("{\"id\":%d,\"distance\":%g,\"data\":%s}", r.ID, r.Distance, r.Data)
+		}
+
+		if err := s.printJSON([]uint8(doc)); err != nil {
+			return err
+		}
+	}
+
+	noun := "results"
+	if len(results) == 1 {
+		noun = "result"
+	}
+
+	fmt.Fprintln(s.c.stdout, s.colors.info(fmt.Sprintf("%d %s in %s", len(results), noun, formatDuration(elapsed))))
+
+	return nil
+}
+
+func (s *shell) useCommand(args string) error {
+	if args == "" || strings.ContainsAny(args, " \t") {
+		return errors.New("expected a collection, .use <coll>")
+	}
+
+	for _, name := range s.c.rose.ListCollections() {
+		if name == args {
+			s.coll = args
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("collection %s does not exist", args)
+}
+
+/**
+Binds a parameter that queries refer to as #name. A value in double quotes is unquoted as a JSON string, which is the
+only way to bind a value with spaces. Every other value is bound as it is written since a query converts it to the
+type of its field.
+*/
+func (s *shell) paramCommand(args string) error {
+	if args == "" {
+		return errors.New("expected a parameter name, .param <name> [value]")
+	}
+
+	name, value := args, ""
+	if i := strings.IndexAny(args, " \t"); i != -1 {
+		name, value = args[:i], strings.TrimSpace(args[i+1:])
+	}
+
+	if !strings.HasPrefix(name, "#") {
+		name = "#" + name
+	}
+
+	if value == "" {
+		delete(s.params, name)
+
+		return nil
+	}
+
+	if strings.HasPrefix(value, "\"") {
+		var unquoted string
+
+		if err := json.Unmarshal([]uint8(value), &unquoted); err != nil {
+			return fmt.Errorf("invalid quoted value %s", value)
+		}
+
+		value = unquoted
+	}
+
+	s.params[name] = value
+
+	return nil
+}
+
+func (s *shell) paramsCommand(args string) error {
+	names := make([]string, 0, len(s.params))
+	for name := range s.params {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(s.c.stdout, "%s = %s\n", name, strconv.Quote(fmt.Sprint(s.params[name])))
+	}
+
+	return nil
+}
+
+func (s *shell) explainCommand(args string) error {
+	if err := s.requireCollection(); err != nil {
+		return err
+	}
+
+	qb := rose.NewQueryBuilder()
+
+	if err := qb.If(s.coll, args, s.params); err != nil {
+		return err
+	}
+
+	ex, err := s.c.rose.Explain(qb)
+
+	if err != nil {
+		return err
+	}
+
+	b, e := json.Marshal(ex)
+
+	if e != nil {
+		return e
+	}
+
+	return s.printJSON(b)
+}
+
+type fieldSchema struct {
+	Name string `json:"name"`
+	// query types of the values of the field, e.i. string or int, with the number of sampled documents that hold each
+	Types map[string]int `json:"types"`
+}
+
+type collectionSchema struct {
+	Collection string `json:"collection"`
+	Documents int `json:"documents"`
+	Indexes []rose.IndexInfo `json:"indexes"`
+	// number of documents that the fields are found in
+	Sampled int `json:"sampled"`
+	Fields []fieldSchema `json:"fields"`
+}
+
+func (s *shell) schemaCommand(args string) error {
+	coll := args
+
+	if coll == "" {
+		if err := s.requireCollection(); err != nil {
+			return err
+		}
+
+		coll = s.coll
+	}
+
+	stats, err := s.c.rose.Stats(coll)
+
+	if err != nil {
+		return err
+	}
+
+	sampler := &schemaSampler{fields: make(map[string]map[string]int)}
+
+	if _, err := s.c.rose.Export(coll, sampler, rose.NDJSONFormat); err != nil && !sampler.full() {
+		return err
+	}
+
+	schema := collectionSchema{
+		Collection: coll,
+		Documents: stats.Documents,
+		Indexes: stats.Indexes,
+		Sampled: sampler.sampled,
+		Fields: make([]fieldSchema, 0, len(sampler.fields)),
+	}
+
+	for name, types := range sampler.fields {
+		schema.Fields = append(schema.Fields, fieldSchema{Name: name, Types: types})
+	}
+
+	sort.Slice(schema.Fields, func(i, j int) bool {
+		return schema.Fields[i].Name < schema.Fields[j].Name
+	})
+
+	b, e := json.Marshal(schema)
+
+	if e != nil {
+		return e
+	}
+
+	return s.printJSON(b)
+}
+
+/**
+Collects the top level fields of the first schemaSampleSize documents that Export writes. Once the sample is full,
+Write returns errSampleFull which stops the export.
+*/
+type schemaSampler struct {
+	buf []uint8
+	parser fastjson.Parser
+	sampled int
+	fields map[string]map[string]int
+}
+
+func (ss *schemaSampler) full() bool {
+	return ss.sampled >= schemaSampleSize
+}
+
+func (ss *schemaSampler) Write(p []uint8) (int, error) {
+	ss.buf = append(ss.buf, p...)
+
+	for !ss.full() {
+		i := bytes.IndexByte(ss.buf, '\n')
+
+		if i == -1 {
+			break
+		}
+
+		ss.sample(ss.buf[:i])
+		ss.buf = ss.buf[i+1:]
+	}
+
+	if ss.full() {
+		return 0, errSampleFull
+	}
+
+	return len(p), nil
+}
+
+func (ss *schemaSampler) sample(line []uint8) {
+	v, err := ss.parser.ParseBytes(line)
+
+	if err != nil {
+		return
+	}
+
+	o, err := v.Get("data").Object()
+
+	if err != nil {
+		return
+	}
+
+	ss.sampled++
+
+	o.Visit(func(key []uint8, v *fastjson.Value) {
+		types, ok := ss.fields[string(key)]
+
+		if !ok {
+			types = make(map[string]int)
+			ss.fields[string(key)] = types
+		}
+
+		types[valueType(v)]++
+	})
+}
+
+// returns the query type of a JSON value, or its JSON type if a query cannot compare it
+func valueType(v *fastjson.Value) string {
+	switch v.Type() {
+	case fastjson.TypeString:
+		return "string"
+	case fastjson.TypeNumber:
+		if _, err := v.Int(); err == nil {
+			return "int"
+		}
+
+		return "float"
+	case fastjson.TypeTrue, fastjson.TypeFalse:
+		return "bool"
+	case fastjson.TypeObject:
+		if v.Exists("lat") && v.Exists("lng") {
+			return "geo"
+		}
+
+		return "object"
+	case fastjson.TypeArray:
+		return "array"
+	}
+
+	return "null"
+}
+
+func (s *shell) historyCommand(args string) error {
+	for i, line := range s.history {
+		fmt.Fprintf(s.c.stdout, "%5d  %s\n", i+1, line)
+	}
+
+	return nil
+}
+
+func (s *shell) helpCommand(args string) error {
+	fmt.Fprintln(s.c.stdout, "Every line that does not start with a dot is a query on the used collection, e.i.")
+	fmt.Fprintln(s.c.stdout, "  type:string == user && age:int > #age")
+	fmt.Fprintln(s.c.stdout, "")
+	fmt.Fprintln(s.c.stdout, "Commands:")
+
+	cmds := metaCommands()
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(s.c.stdout, "  %-25s %s\n", cmds[name].usage, cmds[name].description)
+	}
+
+	return nil
+}
+
+func (s *shell) exitCommand(args string) error {
+	s.quit = true
+
+	return nil
+}
+
+// replaces !! with the last line of the history and !n with line n
+func (s *shell) expandHistory(line string) (string, error) {
+	if !strings.HasPrefix(line, "!") {
+		return line, nil
+	}
+
+	n := len(s.history)
+
+	if line != "!!" {
+		i, err := strconv.Atoi(line[1:])
+
+		if err != nil {
+			return "", fmt.Errorf("invalid history reference %s, expected !n or !!", line)
+		}
+
+		n = i
+	}
+
+	if n < 1 || n > len(s.history) {
+		return "", fmt.Errorf("history does not have line %s", line[1:])
+	}
+
+	expanded := s.history[n-1]
+	fmt.Fprintln(s.c.stdout, expanded)
+
+	return expanded, nil
+}
+
+func (s *shell) loadHistory() {
+	if s.historyFile == "" {
+		return
+	}
+
+	f, err := os.Open(s.historyFile)
+
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]uint8, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			s.history = append(s.history, line)
+		}
+	}
+
+	if len(s.history) > maxHistory {
+		s.history = s.history[len(s.history)-maxHistory:]
+	}
+}
+
+// a history file that cannot be written to does not stop the shell, the history is then kept only for this session
+func (s *shell) addHistory(line string) {
+	s.history = append(s.history, line)
+
+	if s.historyFile == "" {
+		return
+	}
+
+	f, err := os.OpenFile(s.historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	fmt.Fprintln(f, line)
+}
+
+func (s *shell) printJSON(b []uint8) error {
+	v, err := fastjson.ParseBytes(b)
+
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	s.writeJSON(&sb, v, "")
+	fmt.Fprintln(s.c.stdout, sb.String())
+
+	return nil
+}
+
+// writes a JSON value indented by two spaces, keys are kept in the order of the document
+func (s *shell) writeJSON(w io.Writer, v *fastjson.Value, indent string) {
+	inner := indent + "  "
+
+	switch v.Type() {
+	case fastjson.TypeObject:
+		o, _ := v.Object()
+
+		if o.Len() == 0 {
+			fmt.Fprint(w, "{}")
+
+			return
+		}
+
+		fmt.Fprintln(w, "{")
+
+		i := 0
+		o.Visit(func(key []uint8, val *fastjson.Value) {
+			fmt.Fprintf(w, "%s%s: ", inner, s.colors.key(strconv.Quote(string(key))))
+			s.writeJSON(w, val, inner)
+
+			i++
+			if i < o.Len() {
+				fmt.Fprint(w, ",")
+			}
+
+			fmt.Fprintln(w)
+		})
+
+		fmt.Fprint(w, indent+"}")
+	case fastjson.TypeArray:
+		a, _ := v.Array()
+
+		if len(a) == 0 {
+			fmt.Fprint(w, "[]")
+
+			return
+		}
+
+		fmt.Fprintln(w, "[")
+
+		for i, val := range a {
+			fmt.Fprint(w, inner)
+			s.writeJSON(w, val, inner)
+
+			if i < len(a)-1 {
+				fmt.Fprint(w, ",")
+			}
+
+			fmt.Fprintln(w)
+		}
+
+		fmt.Fprint(w, indent+"]")
+	case fastjson.TypeString:
+		fmt.Fprint(w, s.colors.str(string(v.MarshalTo(nil))))
+	case fastjson.TypeNumber:
+		fmt.Fprint(w, s.colors.num(string(v.MarshalTo(nil))))
+	default:
+		fmt.Fprint(w, s.colors.literal(string(v.MarshalTo(nil))))
+	}
+}
+
+func formatDuration(d time.Duration) string {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond).String()
+	}
+
+	return d.Round(10 * time.Microsecond).String()
+}
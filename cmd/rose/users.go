@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"rose/rose/server"
+	"strings"
+)
+
+const usersUsage = `Usage: rose users <command> [arguments]
+
+Commands:
+  list                                      lists users with their permissions and token IDs
+  add [-password p] <name> [coll=role ...]  adds a user, roles are read, write and admin, * is every collection
+  grant <name> [coll=role ...]              replaces the permissions of a user
+  passwd <name>                             sets the password of a user to the first line of stdin, an empty line removes it
+  token <name>                              creates an API token, it is printed only once
+  revoke <name> <token id>                  revokes a token
+  remove <name>                             removes a user`
+
+func usersCommand(c *cli, args []string) error {
+	if len(args) == 0 || args[0] == "help" {
+		fmt.Fprintln(c.stderr, usersUsage)
+
+		if len(args) == 0 {
+			return errors.New("expected a users command")
+		}
+
+		return nil
+	}
+
+	users, err := server.NewUsers(c.rose)
+
+	if err != nil {
+		return err
+	}
+
+	args, sub := args[1:], args[0]
+
+	switch sub {
+	case "list":
+		if err := expectArgs(args, 0); err != nil {
+			return err
+		}
+
+		return c.printJSON(users.List())
+	case "add":
+		flags := c.flagSet("users add")
+		password := flags.String("password", "", "password of the user, the user can only use tokens without one")
+
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+
+		if flags.NArg() < 1 {
+			return errors.New("expected a user name and optional permissions")
+		}
+
+		permissions, e := parsePermissions(flags.Args()[1:])
+		if e != nil {
+			return e
+		}
+
+		if err := users.Add(flags.Arg(0), *password, permissions); err != nil {
+			return err
+		}
+	case "grant":
+		if len(args) < 1 {
+			return errors.New("expected a user name and permissions")
+		}
+
+		permissions, e := parsePermissions(args[1:])
+		if e != nil {
+			return e
+		}
+
+		if err := users.SetPermissions(args[0], permissions); err != nil {
+			return err
+		}
+	case "passwd":
+		if err := expectArgs(args, 1); err != nil {
+			return err
+		}
+
+		password, e := bufio.NewReader(c.stdin).ReadString('\n')
+		if e != nil && e != io.EOF {
+			return e
+		}
+
+		if err := users.SetPassword(args[0], strings.TrimRight(password, "\r\n")); err != nil {
+			return err
+		}
+	case "token":
+		if err := expectArgs(args, 1); err != nil {
+			return err
+		}
+
+		token, err := users.NewToken(args[0])
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(c.stdout, token)
+	case "revoke":
+		if err := expectArgs(args, 2); err != nil {
+			return err
+		}
+
+		if err := users.RevokeToken(args[0], args[1]); err != nil {
+			return err
+		}
+	case "remove":
+		if err := expectArgs(args, 1); err != nil {
+			return err
+		}
+
+		if err := users.Remove(args[0]); err != nil {
+			return err
+		}
+	default:
+		fmt.Fprintln(c.stderr, usersUsage)
+
+		return fmt.Errorf("unknown users command %s", sub)
+	}
+
+	return nil
+}
+
+// parses coll=role arguments
+func parsePermissions(args []string) (server.Permissions, error) {
+	permissions := server.Permissions{}
+
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid permission %s, permissions must be in coll=role format", arg)
+		}
+
+		permissions[parts[0]] = server.Role(parts[1])
+	}
+
+	return permissions, nil
+}
@@ -0,0 +1,180 @@
+package rose
+
+import (
+	"sync"
+	"time"
+)
+
+// CompactResult describes the work done by Rose.Compact
+type CompactResult struct {
+	CompactedBlocks   int   `json:"compactedBlocks"`
+	RemovedTombstones int   `json:"removedTombstones"`
+	ReclaimedBytes    int64 `json:"reclaimedBytes"`
+}
+
+// CompactorOptions configures the background compactor started with Rose.StartCompactor
+type CompactorOptions struct {
+	// how often every collection is checked
+	Interval time.Duration
+	// a block is compacted when tombstones make at least this part of its lines, from 0 to 1
+	MinTombstoneRatio float64
+}
+
+type compactor struct {
+	stop chan bool
+	done sync.WaitGroup
+}
+
+/**
+Compacts a single block and moves the primary and field index entries of its documents to their new offsets.
+The drivers are reloaded since their handles point to the block that was replaced. Returns false if the block is
+locked by another process, the block is then left as it is. The caller must hold the lock
+*/
+func (d *db) compactBlock(blockId uint16) (int64, bool, Error) {
+	offsets, reclaimed, err := defragmentBlock(blockId, d.Name)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	if offsets == nil {
+		return 0, false, nil
+	}
+
+	d.remapOffsets(blockId, offsets)
+
+	if err := d.reloadDrivers(); err != nil {
+		return 0, false, err
+	}
+
+	d.resetBlockTracker(blockId)
+
+	return reclaimed, true, nil
+}
+
+// moves index entries of documents in a block to new offsets. The caller must hold the lock
+func (d *db) remapOffsets(blockId uint16, offsets map[int]int64) {
+	for id, offset := range offsets {
+		if _, ok := d.PrimaryIndex[id]; ok {
+			d.PrimaryIndex[id] = offset
+		}
+	}
+
+	for _, fi := range d.FieldIndex {
+		for i := range fi.Index {
+			entry := &fi.Index[i]
+
+			if entry.removed || entry.BlockId != blockId {
+				continue
+			}
+
+			if offset, ok := offsets[entry.ID]; ok {
+				entry.Pos = offset
+			}
+		}
+	}
+}
+
+func (d *db) reloadDrivers() Error {
+	if err := d.WriteDriver.reload(); err != nil {
+		return err
+	}
+
+	if err := d.ReadDriver.reload(); err != nil {
+		return err
+	}
+
+	return d.DeleteDriver.reload()
+}
+
+/**
+Returns the blocks whose tombstones make at least minRatio of their lines. A block that has tombstones is always
+returned when minRatio is 0. The caller must hold the lock
+*/
+func (d *db) blocksToCompact(minRatio float64) []uint16 {
+	live := make(map[uint16]int)
+	for id := range d.PrimaryIndex {
+		live[d.getBlockId(id)]++
+	}
+
+	blocks := make([]uint16, 0)
+	for blockId, track := range d.BlockTracker {
+		tombstones := float64(track[2])
+
+		if tombstones == 0 {
+			continue
+		}
+
+		if tombstones/(tombstones+float64(live[blockId])) >= minRatio {
+			blocks = append(blocks, blockId)
+		}
+	}
+
+	return blocks
+}
+
+/**
+Compacts every block of a collection that has tombstones. The lock is held for one block at a time, so other
+operations go on between blocks. If the collection is closed while it is compacted, the remaining blocks are skipped.
+*/
+func (d *db) compact(minRatio float64) (*CompactResult, Error) {
+	result := &CompactResult{}
+
+	d.RLock()
+	blocks := d.blocksToCompact(minRatio)
+	d.RUnlock()
+
+	for _, blockId := range blocks {
+		d.Lock()
+
+		if d.closing {
+			d.Unlock()
+
+			return result, nil
+		}
+
+		tombstones := int(d.BlockTracker[blockId][2])
+		reclaimed, compacted, err := d.compactBlock(blockId)
+
+		d.Unlock()
+
+		if err != nil {
+			return result, err
+		}
+
+		// a block locked by another process is compacted on the next run
+		if !compacted {
+			continue
+		}
+
+		result.CompactedBlocks++
+		result.RemovedTombstones += tombstones
+		result.ReclaimedBytes += reclaimed
+	}
+
+	return result, nil
+}
+
+// checks every collection in intervals and compacts blocks with enough tombstones until the compactor is stopped
+func (c *compactor) run(a *Rose, opts CompactorOptions) {
+	defer c.done.Done()
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			a.collLock.RLock()
+
+			for _, d := range a.Databases {
+				// errors are retried on the next run, the old block stays intact
+				_, _ = d.compact(opts.MinTombstoneRatio)
+			}
+
+			a.collLock.RUnlock()
+		}
+	}
+}
@@ -4,9 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/valyala/fastjson"
+	"math"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type dbReadResult struct {
@@ -21,15 +25,29 @@ type db struct {
 	FieldIndexKeys []string
 
 	AutoIncrementCounter int
-	BlockTracker map[uint16][2]uint16
+	// [0] counts writes, [1] counts replaces since the last defragmentation and [2] counts tombstones,
+	// lines of deleted or replaced documents that are still in the block
+	BlockTracker map[uint16][3]uint16
 	DocCount map[uint16]int
 	Name string
 	Balancer *balancer
 	sync.RWMutex
+	// background index builds that Shutdown waits for
+	indexBuilds sync.WaitGroup
+	closing bool
 
 	WriteDriver *fsDriver
 	ReadDriver *fsDriver
 	DeleteDriver *fsDriver
+
+	// writes of the collection for watchers
+	changes *changeLog
+	// JSON Schema that written documents must match, set with Rose.SetSchema
+	schema *jsonSchema
+	// options that the collection was created with, see Rose.NewCollection
+	options CollectionOptions
+	// number of documents in every block that has any, kept on writes and deletes for capped collections
+	liveDocs map[uint16]int
 }
 
 func newDb(write *fsDriver, read *fsDriver, delete *fsDriver, name string, blockNum uint16) *db {
@@ -47,18 +65,84 @@ func newDb(write *fsDriver, read *fsDriver, delete *fsDriver, name string, block
 	return d
 }
 
-// data interface{} is string
-func (d *db) Write(data interface{}) (int, int, Error) {
+// data interface{} is string. hooks are the before hooks of the document, nil if there are none.
+// The returned string is the error of a capped collection that could not drop its oldest blocks, see enforceCapAfterWrite()
+func (d *db) Write(data interface{}, hooks lockedHooks) (int, int, string, Error) {
 	d.Lock()
+	defer d.Unlock()
+
+	if hooks != nil {
+		hooked, err := hooks(nil, data)
+
+		if err != nil {
+			return 0, 0, "", err
+		}
+
+		data = hooked
+	}
 
 	id := d.AutoIncrementCounter
-	d.AutoIncrementCounter += 1
 
-	// check if the entry already exists
+	if err := d.writeWithoutLock(id, data); err != nil {
+		return 0, 0, "", err
+	}
+
+	d.logChanges(ChangeEvent{Type: InsertChange, ID: id, Data: json.RawMessage(data.(string))})
+
+	return NormalExecutionStatus, id, d.enforceCapAfterWrite(), nil
+}
+
+/**
+Writes a document under the given ID instead of the next one. Used by Import to keep the IDs of exported documents.
+Blocks up to the block of the ID are created if they do not exist since every block below the last one is expected to exist.
+The returned string is the error of a capped collection that could not drop its oldest blocks, see enforceCapAfterWrite()
+*/
+func (d *db) WriteWithId(id int, data interface{}) (string, Error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if id < 1 || id/blockMark > math.MaxUint16 {
+		return "", newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Invalid ID %d. ID must be a positive integer", id))
+	}
+
 	if _, ok := d.PrimaryIndex[id]; ok {
-		d.Unlock()
+		return "", newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Document with ID %d already exists", id))
+	}
+
+	if err := d.createBlocksUpTo(d.getBlockId(id)); err != nil {
+		return "", err
+	}
+
+	if err := d.writeWithoutLock(id, data); err != nil {
+		return "", err
+	}
+
+	d.logChanges(ChangeEvent{Type: InsertChange, ID: id, Data: json.RawMessage(data.(string))})
+
+	return d.enforceCapAfterWrite(), nil
+}
+
+func (d *db) writeWithoutLock(id int, data interface{}) Error {
+	idxVal := []uint8(data.(string))
+	if err := d.validateSchema(idxVal); err != nil {
+		return err
+	}
 
-		return 0, 0, newError(DbIntegrityMasterErrorCode, IndexNotExistsCode, fmt.Sprintf( "ID integrity validation. Duplicate ID %d found. This should not happen. Try this write again", id))
+	if err := d.validateFieldIndex(idxVal); err != nil {
+		return err
+	}
+
+	if err := d.validateUniqueIndex(id, idxVal); err != nil {
+		return err
+	}
+
+	if id >= d.AutoIncrementCounter {
+		d.AutoIncrementCounter = id + 1
+	}
+
+	// check if the entry already exists
+	if _, ok := d.PrimaryIndex[id]; ok {
+		return newError(DbIntegrityMasterErrorCode, IndexNotExistsCode, fmt.Sprintf( "ID integrity validation. Duplicate ID %d found. This should not happen. Try this write again", id))
 	}
 
 	mapId := d.getBlockId(id)
@@ -66,26 +150,22 @@ func (d *db) Write(data interface{}) (int, int, Error) {
 	bytesWritten, size, err := d.saveOnFs(id, data, mapId)
 
 	if err != nil {
-		return 0, 0, err
+		return err
 	}
 
 	offset := size - bytesWritten
 
 	d.PrimaryIndex[id] = offset
+	d.liveDocs[mapId]++
 
-	idxVal := []uint8(data.(string))
-	if err := d.validateFieldIndex(idxVal); err != nil {
-		return 0, 0, err
-	}
-
-	if err := d.writeFieldIndexWithoutLock(offset, idxVal, mapId); err != nil {
-		return 0, 0, err
+	if err := d.writeFieldIndexWithoutLock(id, offset, idxVal, mapId); err != nil {
+		return err
 	}
 
 	track, ok := d.BlockTracker[mapId]
 
 	if !ok {
-		t := [2]uint16{}
+		t := [3]uint16{}
 
 		track = t
 	}
@@ -100,19 +180,72 @@ func (d *db) Write(data interface{}) (int, int, Error) {
 		b.reSpawnIfNeeded(uint16(bLen))
 	}(len(d.BlockTracker), d.Balancer)
 
-	d.Unlock()
+	return nil
+}
+
+// creates the blocks that do not exist up to and including blockId. The caller must hold the lock
+func (d *db) createBlocksUpTo(blockId uint16) Error {
+	collDir := fmt.Sprintf("%s/%s", roseDbDir(), d.Name)
+
+	for i := 0; i <= int(blockId); i++ {
+		fileName := roseBlockFile(uint16(i), collDir)
+
+		if _, e := os.Stat(fileName); !os.IsNotExist(e) {
+			continue
+		}
 
-	return NormalExecutionStatus, id, nil
+		file, err := createFile(fileName, os.O_RDWR|os.O_CREATE)
+
+		if err != nil {
+			return err
+		}
+
+		if err := closeFile(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (d *db) BulkWrite(data []interface{}) (int, string, Error) {
+// hooks run for every document before any of them is validated or written, nil if there are none.
+// The second returned string is the error of a capped collection that could not drop its oldest blocks, see enforceCapAfterWrite()
+func (d *db) BulkWrite(data []interface{}, hooks lockedHooks) (int, string, string, Error) {
 	d.Lock()
 
 	if len(data) == 0 {
-		return NormalExecutionStatus, "", nil
+		d.Unlock()
+
+		return NormalExecutionStatus, "", "", nil
+	}
+
+	if hooks != nil {
+		hooked := make([]interface{}, 0, len(data))
+		for _, v := range data {
+			h, err := hooks(nil, v)
+
+			if err != nil {
+				d.Unlock()
+
+				return 0, "", "", err
+			}
+
+			hooked = append(hooked, h)
+		}
+
+		data = hooked
+	}
+
+	// every document is validated before anything is written so that a failed bulk write does not leave
+	// half of the documents on the filesystem
+	if err := d.validateBulk(data); err != nil {
+		d.Unlock()
+
+		return 0, "", "", err
 	}
 
 	written := ""
+	changes := make([]ChangeEvent, 0, len(data))
 	for _, v := range data {
 		id := d.AutoIncrementCounter
 		d.AutoIncrementCounter += 1
@@ -121,7 +254,7 @@ func (d *db) BulkWrite(data []interface{}) (int, string, Error) {
 		if _, ok := d.PrimaryIndex[id]; ok {
 			d.Unlock()
 
-			return 0, "", newError(DbIntegrityMasterErrorCode, IndexNotExistsCode, fmt.Sprintf( "ID integrity validation. Duplicate ID %d found. This should not happen. Try this write again", id))
+			return 0, "", "", newError(DbIntegrityMasterErrorCode, IndexNotExistsCode, fmt.Sprintf( "ID integrity validation. Duplicate ID %d found. This should not happen. Try this write again", id))
 		}
 
 		mapId := d.getBlockId(id)
@@ -129,17 +262,30 @@ func (d *db) BulkWrite(data []interface{}) (int, string, Error) {
 		bytesWritten, size, err := d.saveOnFs(id, v, mapId)
 
 		if err != nil {
-			return 0, "", err
+			// the documents before this one are written
+			d.logChanges(changes...)
+			d.Unlock()
+
+			return 0, "", "", err
 		}
 
 		offset := size - bytesWritten
 
 		d.PrimaryIndex[id] = offset
+		d.liveDocs[mapId]++
+		changes = append(changes, ChangeEvent{Type: InsertChange, ID: id, Data: json.RawMessage(v.(string))})
+
+		if err := d.writeFieldIndexWithoutLock(id, offset, []uint8(v.(string)), mapId); err != nil {
+			d.logChanges(changes...)
+			d.Unlock()
+
+			return 0, "", "", err
+		}
 
 		track, ok := d.BlockTracker[mapId]
 
 		if !ok {
-			t := [2]uint16{}
+			t := [3]uint16{}
 
 			track = t
 		}
@@ -148,21 +294,28 @@ func (d *db) BulkWrite(data []interface{}) (int, string, Error) {
 
 		d.BlockTracker[mapId] = track
 
+		d.incrementDocCount(mapId)
+
 		written += fmt.Sprintf("%d,", id)
 	}
 
 	written = strings.TrimRight(written, ",")
 
+	d.logChanges(changes...)
+
+	capErr := d.enforceCapAfterWrite()
+
 	go func(bLen int, b *balancer) {
 		b.reSpawnIfNeeded(uint16(bLen))
 	}(len(d.BlockTracker), d.Balancer)
 
 	d.Unlock()
 
-	return NormalExecutionStatus, written, nil
+	return NormalExecutionStatus, written, capErr, nil
 }
 
-func (d *db) Delete(id int) (bool, Error) {
+// hooks are the before hooks of the document, they run only if it exists. nil if there are none
+func (d *db) Delete(id int, hooks lockedHooks) (bool, Error) {
 	d.Lock()
 
 	blockId := d.getBlockId(id)
@@ -175,7 +328,24 @@ func (d *db) Delete(id int) (bool, Error) {
 		return false, nil
 	}
 
+	if hooks != nil {
+		old, err := d.readRawWithoutLock(id)
+
+		if err == nil {
+			_, err = hooks(old, nil)
+		}
+
+		if err != nil {
+			d.Unlock()
+
+			return false, err
+		}
+	}
+
 	delete(d.PrimaryIndex, id)
+	d.decrementLiveDocs(blockId)
+
+	d.removeFieldIndexWithoutLock(id)
 
 	err := d.deleteFromFs(id, blockId, idx)
 
@@ -185,6 +355,10 @@ func (d *db) Delete(id int) (bool, Error) {
 		return false, err
 	}
 
+	d.increaseTombstones(blockId, 1)
+
+	d.logChanges(ChangeEvent{Type: DeleteChange, ID: id})
+
 	d.Unlock()
 
 	return true, nil
@@ -195,7 +369,8 @@ func (d *db) ReadStrategic(id int, data interface{}) (*dbReadResult, Error) {
 
 	index, ok := d.PrimaryIndex[id]
 
-	if !ok {
+	// an expired document is not found even if the reaper has not deleted it yet
+	if !ok || d.expired(id, time.Now()) {
 		d.Unlock()
 
 		return nil, nil
@@ -226,98 +401,97 @@ func (d *db) ReadStrategic(id int, data interface{}) (*dbReadResult, Error) {
 func (d *db) ReadBy(m ReadByMetadata) ([]*dbReadResult, Error) {
 	d.Lock()
 
-	fieldIndex := d.FieldIndex[m.Field]
-
-	if fieldIndex.DataType != m.DataType {
-		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Invalid data type. You provided %s but the index is a %s data type", string(m.DataType), string(fieldIndex.DataType)))
-	}
+	lookup := m.lookupFields()
+	names := make([]string, 0, len(lookup))
+	prefix := make([]interface{}, 0, len(lookup))
 
-	var p fastjson.Parser
-	results := make([]*dbReadResult, 0)
+	for _, f := range lookup {
+		value := f.Value
 
-	from := paginate(m.Pagination.Page)
+		if f.DataType == dateIndexType || f.DataType == dateTimeIndexType {
+			if s, ok := value.(string); ok {
+				t, ok := parseDate(s)
 
-	found := 0
-	for i := from; i <= len(fieldIndex.Index) && found < m.Pagination.Limit; i++ {
-		idx := fieldIndex.Index[i]
+				if !ok {
+					d.Unlock()
 
-		b, err := d.ReadDriver.ReadStrategic(idx.Pos, idx.BlockId)
+					return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Invalid readBy method 'value' for field '%s'. Dates must be in YYYY-MM-DD, YYYY-MM-DD HH:MM:SS or RFC 3339 format", f.Field))
+				}
 
-		if err != nil {
-			return nil, err
+				value = t
+			}
 		}
 
-		v, e := p.ParseBytes(b.val)
+		names = append(names, f.Field)
+		prefix = append(prefix, value)
+	}
 
-		if e != nil {
-			return nil, newError(DbIntegrityMasterErrorCode, UnmarshalFailCode, fmt.Sprintf("Unable to parse JSON from an already saved value. Be sure that what you saved is a JSON construct: %s", e.Error()))
-		}
+	fieldIndex := d.findFieldIndex(names)
 
-		if v.Exists(m.Field) {
-			if m.DataType == stringIndexType && string(v.GetStringBytes(m.Field)) == m.Value.(string) {
-				var data interface{}
-				e := json.Unmarshal(b.val, &data)
+	if fieldIndex == nil {
+		d.Unlock()
 
-				if e != nil {
-					return nil, newError(SystemMasterErrorCode, UnmarshalFailCode, fmt.Sprintf("Cannot unmarshal JSON string. This can be a bug with Rose or an invalid document. Try deleting and write the document again. The underlying error is: %s", e.Error()))
-				}
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Invalid readBy method. There is no index that starts with fields %s", strings.Join(names, ", ")))
+	}
 
-				results = append(results, &dbReadResult{
-					ID:     b.id,
-					Result: data,
-				})
+	for i, f := range lookup {
+		if fieldIndex.Fields[i].DataType != f.DataType {
+			d.Unlock()
 
-				found++
-			}
+			return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Invalid data type. You provided %s but the index is a %s data type", string(f.DataType), string(fieldIndex.Fields[i].DataType)))
+		}
+	}
 
-			if m.DataType == intIndexType && v.GetInt(m.Field) == m.Value.(int) {
-				var data interface{}
-				e := json.Unmarshal(b.val, &data)
+	if !fieldIndex.Complete {
+		d.Unlock()
 
-				if e != nil {
-					return nil, newError(SystemMasterErrorCode, UnmarshalFailCode, fmt.Sprintf("Cannot unmarshal JSON string. This can be a bug with Rose or an invalid document. Try deleting and write the document again. The underlying error is: %s", e.Error()))
-				}
+		return nil, newError(ValidationMasterErrorCode, IndexBuildingCode, fmt.Sprintf("Invalid readBy method. Index '%s' is being built (%d of %d blocks done) and can be used once it is complete", indexName(fieldIndex.Fields), fieldIndex.BuiltBlocks, fieldIndex.TotalBlocks))
+	}
 
-				results = append(results, &dbReadResult{
-					ID:     b.id,
-					Result: data,
-				})
+	results := make([]*dbReadResult, 0)
 
-				found++
-			}
+	from := paginate(m.Pagination.Page)
 
-			if m.DataType == floatIndexType && v.GetFloat64(m.Field) == m.Value.(float64) {
-				var data interface{}
-				e := json.Unmarshal(b.val, &data)
+	now := time.Now()
+	skipped := 0
+	for _, idx := range fieldIndex.Index {
+		if len(results) == m.Pagination.Limit {
+			break
+		}
 
-				if e != nil {
-					return nil, newError(SystemMasterErrorCode, UnmarshalFailCode, fmt.Sprintf("Cannot unmarshal JSON string. This can be a bug with Rose or an invalid document. Try deleting and write the document again. The underlying error is: %s", e.Error()))
-				}
+		if idx.removed || !fieldIndex.matchesPrefix(idx.Value, prefix) || d.expired(idx.ID, now) {
+			continue
+		}
 
-				results = append(results, &dbReadResult{
-					ID:     b.id,
-					Result: data,
-				})
+		if skipped < from {
+			skipped++
 
-				found++
-			}
+			continue
+		}
 
-			if m.DataType == boolIndexType && v.GetBool(m.Field) == m.Value.(bool) {
-				var data interface{}
-				e := json.Unmarshal(b.val, &data)
+		b, err := d.ReadDriver.ReadStrategic(idx.Pos, idx.BlockId)
 
-				if e != nil {
-					return nil, newError(SystemMasterErrorCode, UnmarshalFailCode, fmt.Sprintf("Cannot unmarshal JSON string. This can be a bug with Rose or an invalid document. Try deleting and write the document again. The underlying error is: %s", e.Error()))
-				}
+		if err != nil {
+			d.Unlock()
+
+			return nil, err
+		}
 
-				results = append(results, &dbReadResult{
-					ID:     b.id,
-					Result: data,
-				})
+		if b == nil {
+			continue
+		}
 
-				found++
-			}
+		var data interface{}
+		if e := json.Unmarshal(b.val, &data); e != nil {
+			d.Unlock()
+
+			return nil, newError(SystemMasterErrorCode, UnmarshalFailCode, fmt.Sprintf("Cannot unmarshal JSON string. This can be a bug with Rose or an invalid document. Try deleting and write the document again. The underlying error is: %s", e.Error()))
 		}
+
+		results = append(results, &dbReadResult{
+			ID:     b.id,
+			Result: data,
+		})
 	}
 
 	d.Unlock()
@@ -325,19 +499,87 @@ func (d *db) ReadBy(m ReadByMetadata) ([]*dbReadResult, Error) {
 	return results, nil
 }
 
+/**
+Returns the index that can serve a lookup on these fields. The fields must be a prefix of the index fields.
+Complete indexes are preferred over the ones that are still being built. Among those, an index with exactly these
+fields is preferred, otherwise the shortest compound index is used. A partial index only holds the documents that
+match its filter and is never used.
+*/
+func (d *db) findFieldIndex(fields []string) *fieldIndex {
+	var found *fieldIndex
+
+	for _, idx := range d.FieldIndex {
+		if !idx.hasPrefix(fields) || idx.filter != nil {
+			continue
+		}
+
+		if found == nil || (idx.Complete && !found.Complete) {
+			found = idx
+
+			continue
+		}
+
+		if idx.Complete != found.Complete {
+			continue
+		}
+
+		if len(idx.Fields) < len(found.Fields) || (len(idx.Fields) == len(found.Fields) && indexName(idx.Fields) < indexName(found.Fields)) {
+			found = idx
+		}
+	}
+
+	return found
+}
+
 /**
     1. Delete the document with the specified ID
     2. Write the new document into the same block
     3. Replace the previous index with the new one
+
+Returns false if the document does not exist, hooks only run if it exists. The returned string is the error of a capped
+collection that could not drop its oldest blocks, see enforceCapAfterWrite()
  */
-func (d *db) Replace(id int, data interface{}) Error {
+func (d *db) Replace(id int, data interface{}, hooks lockedHooks) (bool, string, Error) {
 	d.Lock()
 	_, ok := d.PrimaryIndex[id]
 
 	if !ok {
 		d.Unlock()
 
-		return nil
+		return false, "", nil
+	}
+
+	if hooks != nil {
+		old, err := d.readRawWithoutLock(id)
+
+		if err == nil {
+			data, err = hooks(old, data)
+		}
+
+		if err != nil {
+			d.Unlock()
+
+			return false, "", err
+		}
+	}
+
+	idxVal := []uint8(data.(string))
+	if err := d.validateSchema(idxVal); err != nil {
+		d.Unlock()
+
+		return false, "", err
+	}
+
+	if err := d.validateFieldIndex(idxVal); err != nil {
+		d.Unlock()
+
+		return false, "", err
+	}
+
+	if err := d.validateUniqueIndex(id, idxVal); err != nil {
+		d.Unlock()
+
+		return false, "", err
 	}
 
 	blockId := d.getBlockId(id)
@@ -345,69 +587,112 @@ func (d *db) Replace(id int, data interface{}) Error {
 	if err := d.unlockedDelete(id, blockId); err != nil {
 		d.Unlock()
 
-		return err
+		return false, "", err
 	}
 
+	d.increaseTombstones(blockId, 1)
+
 	if err := d.unlockedWrite(id, data, blockId); err != nil {
 		d.Unlock()
 
-		return err
+		return false, "", err
 	}
 
-	track := d.increaseBlockTracker(blockId)
+	d.removeFieldIndexWithoutLock(id)
 
-	if track == defragmentMark {
-		indexes, err := d.tryDefragmentation(blockId)
+	if err := d.writeFieldIndexWithoutLock(id, d.PrimaryIndex[id], idxVal, blockId); err != nil {
+		d.Unlock()
 
-		if err != nil {
-			d.Unlock()
+		return false, "", err
+	}
 
-			return err
-		}
+	d.logChanges(ChangeEvent{Type: ReplaceChange, ID: id, Data: json.RawMessage(idxVal)})
 
-		for i, index := range indexes {
-			d.PrimaryIndex[i] = index
-		}
+	track := d.increaseBlockTracker(blockId)
 
-		if err := d.WriteDriver.reload(); err != nil {
+	// a block that is locked by another process is not defragmented and is tried again on the next replace
+	if track >= defragmentMark {
+		if _, _, err := d.compactBlock(blockId); err != nil {
 			d.Unlock()
 
-			return err
+			return false, "", err
 		}
+	}
 
-		if err := d.ReadDriver.reload(); err != nil {
-			d.Unlock()
+	// a replace makes a block larger
+	capErr := d.enforceCapAfterWrite()
 
-			return err
+	d.Unlock()
+
+	return true, capErr, nil
+}
+
+func (d *db)  Query(singleQuery *singleQuery) ([]QueryResult, Error) {
+	d.Lock()
+
+	searches, err := d.textSearches(singleQuery)
+
+	if err != nil {
+		d.Unlock()
+
+		return nil, err
+	}
+
+	plan := d.planQuery(singleQuery)
+
+	if plan.Index != nil {
+		results, err := d.queryWithIndex(plan, singleQuery)
+
+		if err == nil && len(searches) > 0 {
+			rankResults(results, searches)
 		}
 
-		if err := d.DeleteDriver.reload(); err != nil {
-			d.Unlock()
+		d.Unlock()
 
-			return err
+		if near := nearCondition(singleQuery); err == nil && near != nil {
+			sortByDistance(results, near)
 		}
 
-		d.resetBlockTracker(blockId)
+		return results, err
 	}
 
 	d.Unlock()
 
-	return nil
-}
-
-func (d *db)  Query(singleQuery *singleQuery) ([]QueryResult, Error) {
 	ch := make(chan *queueResponse)
 
-	return d.Balancer.Push(&balancerRequest{
+	results, err := d.Balancer.Push(&balancerRequest{
 		CollName: singleQuery.collName,
 		BlockNum: uint16(d.AutoIncrementCounter / blockMark + 1),
 		OperationStages: singleQuery.stages,
 		Response: ch,
 	})
+
+	if err == nil {
+		results = d.hideExpired(results)
+	}
+
+	if err == nil && len(searches) > 0 {
+		d.RLock()
+		rankResults(results, searches)
+		d.RUnlock()
+	}
+
+	if near := nearCondition(singleQuery); err == nil && near != nil {
+		sortByDistance(results, near)
+	}
+
+	return results, err
 }
 
 // shutdown does not do anything for now until I decide what to do with multiple drivers
 func (d *db) Shutdown() [3]Error {
+	// index builds stop before reading their next block
+	d.Lock()
+	d.closing = true
+	d.Unlock()
+
+	d.indexBuilds.Wait()
+
 	d.init()
 
 	d.Balancer.Close()
@@ -426,6 +711,12 @@ func (d *db) Shutdown() [3]Error {
 		errors[2] = err
 	}
 
+	if d.changes != nil {
+		if err := d.changes.close(); err != nil && errors[0] == nil {
+			errors[0] = err
+		}
+	}
+
 	return errors
 }
 
@@ -440,14 +731,26 @@ func (d *db) writeIndex(id int, offset int64) Error {
 	}
 
 	d.PrimaryIndex[id] = offset
+	d.liveDocs[d.getBlockId(id)]++
 
-	d.AutoIncrementCounter += 1
+	// IDs can have gaps after deletes and imports, the next ID must be above every saved one
+	if id >= d.AutoIncrementCounter {
+		d.AutoIncrementCounter = id + 1
+	}
 
 	d.Unlock()
 
 	return nil
 }
 
+func (d *db) validateSchema(val []uint8) Error {
+	if d.schema == nil {
+		return nil
+	}
+
+	return d.schema.check(d.Name, val)
+}
+
 func (d *db) validateFieldIndex(val []uint8) Error {
 	var p fastjson.Parser
 
@@ -457,9 +760,98 @@ func (d *db) validateFieldIndex(val []uint8) Error {
 		return newError(SystemMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Cannot write index. Data is unparsable. This might be a bug but if it is not, change your data: %s", pErr.Error()))
 	}
 
-	for _, fieldName := range d.FieldIndexKeys {
-		if !pVal.Exists(fieldName) {
-			return newError(SystemMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Cannot write index. Field name '%s' does not exist on provided JSON object. If you created an index on a JSON structure on a certain field and its data type, that field must exists with the correct underlying data type", fieldName))
+	for _, fieldIndex := range d.FieldIndex {
+		// documents that are not held by a sparse or a partial index do not need its fields
+		if fieldIndex.Sparse || !fieldIndex.filters(pVal) {
+			continue
+		}
+
+		for _, f := range fieldIndex.Fields {
+			if !pVal.Exists(f.Name) {
+				return newError(SystemMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Cannot write index. Field name '%s' does not exist on provided JSON object. If you created an index on a JSON structure on a certain field and its data type, that field must exists with the correct underlying data type", f.Name))
+			}
+
+			if !isIndexableValue(pVal, f) && f.DataType == textIndexType {
+				return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Cannot write index. Field name '%s' is indexed as text and must be a string", f.Name))
+			}
+
+			if !isIndexableValue(pVal, f) && f.DataType == geoIndexType {
+				return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Cannot write index. Field name '%s' is indexed as geo and must be an object with numeric 'lat' between -90 and 90 and 'lng' between -180 and 180", f.Name))
+			}
+
+			if !isIndexableValue(pVal, f) {
+				return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Cannot write index. Field name '%s' is indexed as %s and must be a string in YYYY-MM-DD, YYYY-MM-DD HH:MM:SS or RFC 3339 format", f.Name, f.DataType))
+			}
+		}
+	}
+
+	return nil
+}
+
+// validates that the document does not hold a value that another document already holds in a unique index.
+// id is the ID of the document that is written so that a replace does not conflict with itself
+func (d *db) validateUniqueIndex(id int, val []uint8) Error {
+	var p fastjson.Parser
+
+	pVal, pErr := p.ParseBytes(val)
+
+	if pErr != nil {
+		return newError(SystemMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Cannot write index. Data is unparsable. This might be a bug but if it is not, change your data: %s", pErr.Error()))
+	}
+
+	for name, fieldIndex := range d.FieldIndex {
+		if !fieldIndex.Unique || !fieldIndex.covers(pVal) {
+			continue
+		}
+
+		value := fieldIndex.extract(pVal)
+
+		if owner, ok := fieldIndex.Owner(value); ok && owner != id {
+			return newDuplicateKeyError(name, value, owner)
+		}
+	}
+
+	return nil
+}
+
+// validates every document of a bulk write, including unique values that repeat inside the bulk itself
+func (d *db) validateBulk(data []interface{}) Error {
+	var p fastjson.Parser
+	seen := make(map[string]map[interface{}]bool)
+
+	for _, v := range data {
+		val := []uint8(v.(string))
+
+		if err := d.validateSchema(val); err != nil {
+			return err
+		}
+
+		if err := d.validateFieldIndex(val); err != nil {
+			return err
+		}
+
+		if err := d.validateUniqueIndex(0, val); err != nil {
+			return err
+		}
+
+		pVal, _ := p.ParseBytes(val)
+
+		for name, fieldIndex := range d.FieldIndex {
+			if !fieldIndex.Unique || !fieldIndex.covers(pVal) {
+				continue
+			}
+
+			if _, ok := seen[name]; !ok {
+				seen[name] = make(map[interface{}]bool)
+			}
+
+			value := fieldIndex.extract(pVal)
+
+			if seen[name][fieldIndex.key(value)] {
+				return newError(ValidationMasterErrorCode, DuplicateKeyCode, fmt.Sprintf("Duplicate key error. Value '%v' for unique index '%s' is given more than once in this bulk write", value, name))
+			}
+
+			seen[name][fieldIndex.key(value)] = true
 		}
 	}
 
@@ -467,69 +859,396 @@ func (d *db) validateFieldIndex(val []uint8) Error {
 }
 
 // no need to handle error since the index is validate with ::validateFieldIndex()
-func (d *db) writeFieldIndexWithoutLock(offset int64, val []uint8, blockId uint16) Error {
+func (d *db) writeFieldIndexWithoutLock(id int, offset int64, val []uint8, blockId uint16) Error {
 	var p fastjson.Parser
 
 	pVal, _ := p.ParseBytes(val)
 
-	for fieldName, fieldIndex := range d.FieldIndex {
-		var idxVal interface{}
-		if fieldIndex.DataType == stringIndexType {
-			idxVal = pVal.GetStringBytes(fieldName)
-		} else if fieldIndex.DataType == intIndexType {
-			idxVal = pVal.GetInt(fieldName)
-		} else if fieldIndex.DataType == floatIndexType {
-			idxVal = pVal.GetFloat64(fieldName)
-		} else if fieldIndex.DataType == boolIndexType {
-			idxVal = pVal.GetBool(fieldName)
+	for _, fieldIndex := range d.FieldIndex {
+		if fieldIndex.covers(pVal) {
+			fieldIndex.Add(id, offset, fieldIndex.extract(pVal), blockId)
 		}
-
-		fieldIndex.Add(offset, idxVal, blockId)
 	}
 
 	return nil
 }
 
+func (d *db) removeFieldIndexWithoutLock(id int) {
+	for _, fieldIndex := range d.FieldIndex {
+		fieldIndex.Remove(id)
+	}
+}
+
 // Only used from boot, do not use after boot when public methods have their own locks
-func (d *db) writeFieldIndexWithLock(fieldName string, dType indexDataType, offset int64, val []uint8, id int) Error {
+func (d *db) writeFieldIndexWithLock(fsi *fsIndex, offset int64, val []uint8, id int) Error {
 	d.Lock()
 
 	var p fastjson.Parser
 
-	idx := d.createFieldIndex(fieldName, dType)
+	idx := d.createFieldIndex(fsi.fields(), fsi.Options)
 
 	v, err := p.ParseBytes(val)
 
 	if err != nil {
+		d.Unlock()
+
 		return newError(SystemMasterErrorCode, UnmarshalFailCode, fmt.Sprintf("Unable to parse document: %s", err.Error()))
 	}
 
-	var idxVal interface{}
-	if dType == stringIndexType {
-		idxVal = v.GetStringBytes(fieldName)
-	} else if dType == intIndexType {
-		idxVal = v.GetInt(fieldName)
-	} else if dType == floatIndexType {
-		idxVal = v.GetFloat64(fieldName)
-	} else if dType == boolIndexType {
-		idxVal = v.GetBool(fieldName)
+	if idx.covers(v) {
+		idx.Add(id, offset, idx.extract(v), d.getBlockId(id))
 	}
 
-	idx.Add(offset, idxVal, d.getBlockId(id))
-
 	d.Unlock()
 
 	return nil
 }
 
-func (d *db) createFieldIndex(fieldName string, dType indexDataType) *fieldIndex {
-	if idx, ok := d.FieldIndex[fieldName]; ok {
+func (d *db) createFieldIndex(fields []IndexField, options IndexOptions) *fieldIndex {
+	name := indexName(fields)
+
+	for _, f := range fields {
+		if !hasString(d.FieldIndexKeys, f.Name) {
+			d.FieldIndexKeys = append(d.FieldIndexKeys, f.Name)
+		}
+	}
+
+	if idx, ok := d.FieldIndex[name]; ok {
 		return idx
 	}
 
-	d.FieldIndex[fieldName] = newFieldIndex(dType)
+	d.FieldIndex[name] = newFieldIndex(fields, options)
+
+	return d.FieldIndex[name]
+}
+
+// returns information about every index, sorted by name. The caller must hold the lock
+func (d *db) indexInfos() []IndexInfo {
+	infos := make([]IndexInfo, 0, len(d.FieldIndex))
+	for name, idx := range d.FieldIndex {
+		types := make([]string, 0, len(idx.Fields))
+		for _, f := range idx.Fields {
+			types = append(types, string(f.DataType))
+		}
+
+		info := IndexInfo{
+			Name: name,
+			Fields: idx.Fields,
+			Type: strings.Join(types, ","),
+			Options: idx.Options,
+			Entries: idx.Len(),
+			MemoryBytes: idx.memoryUsage(),
+			Complete: idx.Complete,
+			Progress: idx.progress(),
+		}
+
+		if idx.BuildError != nil {
+			info.BuildError = idx.BuildError.Error()
+		}
+
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+}
+
+func (d *db) stats() (*CollectionStats, Error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	collDir := fmt.Sprintf("%s/%s", roseDbDir(), d.Name)
+	blocks, err := listBlocks(collDir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &CollectionStats{
+		Name: d.Name,
+		Documents: len(d.PrimaryIndex),
+		Blocks: len(blocks),
+		Tombstones: make(map[uint16]int),
+		Indexes: d.indexInfos(),
+		Options: d.options,
+	}
+
+	for blockId, track := range d.BlockTracker {
+		if track[2] > 0 {
+			stats.Tombstones[blockId] = int(track[2])
+			stats.TotalTombstones += int(track[2])
+		}
+	}
+
+	for _, blockId := range blocks {
+		file, err := createFile(roseBlockFile(blockId, collDir), os.O_RDONLY)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stat, e := file.Stat()
+
+		if e != nil {
+			_ = file.Close()
+
+			return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to read block file with underlying error: %s", e.Error()))
+		}
+
+		reader := NewLineReader(file)
+
+		for {
+			_, _, err := reader.Read()
+
+			if err != nil && err.GetCode() == EOFCode {
+				break
+			}
+
+			if err != nil {
+				_ = file.Close()
+
+				return nil, err
+			}
+		}
+
+		stats.TotalBytes += stat.Size()
+		stats.LiveBytes += stat.Size() - reader.deletedBytes
+
+		if err := closeFile(file); err != nil {
+			return nil, err
+		}
+	}
+
+	if stats.TotalBytes > 0 {
+		stats.Fragmentation = 1 - float64(stats.LiveBytes) / float64(stats.TotalBytes)
+	}
+
+	for _, info := range stats.Indexes {
+		stats.IndexBytes += info.MemoryBytes
+	}
+
+	d.Balancer.RLock()
+	stats.Workers = int(d.Balancer.Count)
+	d.Balancer.RUnlock()
+
+	return stats, nil
+}
+
+// removes an index and the fields that only this index used. The caller must hold the lock
+func (d *db) dropFieldIndex(name string) {
+	delete(d.FieldIndex, name)
+
+	keys := make([]string, 0, len(d.FieldIndexKeys))
+	for _, idx := range d.FieldIndex {
+		for _, f := range idx.Fields {
+			if !hasString(keys, f.Name) {
+				keys = append(keys, f.Name)
+			}
+		}
+	}
+
+	d.FieldIndexKeys = keys
+}
+
+/**
+Creates a unique index from all the documents that are already saved. If any of the documents share
+the same value, the index is not created and the error lists every conflicting value with the IDs
+of the documents that hold it.
+*/
+func (d *db) createUniqueFieldIndex(fields []IndexField, options IndexOptions) Error {
+	d.Lock()
+
+	name := indexName(fields)
+
+	if _, ok := d.FieldIndex[name]; ok {
+		d.Unlock()
+
+		return nil
+	}
+
+	idx := newFieldIndex(fields, options)
+	holders := make(map[interface{}][]int)
+	values := make([]interface{}, 0)
+	var p fastjson.Parser
+
+	err := d.scanBlocks(func(offset int64, data *lineReaderData) Error {
+		v, e := p.ParseBytes(data.val)
+
+		if e != nil {
+			return newError(DbIntegrityMasterErrorCode, UnmarshalFailCode, fmt.Sprintf("Unable to parse JSON from an already saved value. Be sure that what you saved is a JSON construct: %s", e.Error()))
+		}
+
+		if !idx.covers(v) {
+			return nil
+		}
+
+		value := idx.extract(v)
+
+		if _, ok := holders[idx.key(value)]; !ok {
+			values = append(values, value)
+		}
+
+		holders[idx.key(value)] = append(holders[idx.key(value)], data.id)
+
+		idx.Add(data.id, offset, value, d.getBlockId(data.id))
+
+		return nil
+	})
+
+	if err != nil {
+		d.Unlock()
+
+		return err
+	}
+
+	conflicts := make([]string, 0)
+	for _, value := range values {
+		ids := holders[idx.key(value)]
+
+		if len(ids) > 1 {
+			sort.Ints(ids)
+
+			conflicts = append(conflicts, fmt.Sprintf("'%v' (IDs %s)", value, joinInts(ids, ", ")))
+		}
+	}
+
+	if len(conflicts) != 0 {
+		d.Unlock()
+
+		return newError(ValidationMasterErrorCode, DuplicateKeyCode, fmt.Sprintf("Unable to create unique index on field '%s'. Existing documents hold duplicate values: %s", name, strings.Join(conflicts, "; ")))
+	}
+
+	idx.Complete = true
+	d.FieldIndex[name] = idx
+
+	d.Unlock()
+
+	return nil
+}
+
+/**
+Iterates over every document that is saved on the filesystem, block by block. Deleted documents are skipped.
+The caller must hold the lock so that nothing is written while the blocks are read.
+*/
+func (d *db) scanBlocks(fn func(offset int64, data *lineReaderData) Error) Error {
+	collDir := fmt.Sprintf("%s/%s", roseDbDir(), d.Name)
+	blocks, err := listBlocks(collDir)
+
+	if err != nil {
+		return err
+	}
+
+	for _, blockId := range blocks {
+		if err := d.scanBlock(collDir, blockId, fn); err != nil {
+			return err
+		}
+	}
 
-	return d.FieldIndex[fieldName]
+	return nil
+}
+
+// calls fn for every document of a single block. The caller must hold the lock
+func (d *db) scanBlock(collDir string, blockId uint16, fn func(offset int64, data *lineReaderData) Error) Error {
+	file, err := createFile(roseBlockFile(blockId, collDir), os.O_RDONLY)
+
+	if err != nil {
+		return err
+	}
+
+	reader := NewLineReader(file)
+
+	for {
+		offset, val, err := reader.Read()
+
+		if err != nil && err.GetCode() == EOFCode {
+			break
+		}
+
+		if err == nil && val == nil {
+			err = newError(DbIntegrityMasterErrorCode, BlockCorruptedCode, "Database integrity violation. Invalid row encountered while reading a block")
+		}
+
+		if err == nil {
+			err = fn(offset, val)
+		}
+
+		if err != nil {
+			if fsErr := closeFile(file); fsErr != nil {
+				return fsErr
+			}
+
+			return err
+		}
+	}
+
+	return closeFile(file)
+}
+
+/**
+Builds an index from the documents that are already saved, one block at a time. The lock is held only while
+a single block is read, so writes go on while the index is built and update it the same way they update
+a complete index. Documents that a write has already put into the index are skipped when their block is read.
+The build stops if the index is dropped or the collection shuts down.
+*/
+func (d *db) buildFieldIndex(idx *fieldIndex, blocks []uint16) {
+	defer d.indexBuilds.Done()
+
+	collDir := fmt.Sprintf("%s/%s", roseDbDir(), d.Name)
+	name := indexName(idx.Fields)
+	var p fastjson.Parser
+
+	for _, blockId := range blocks {
+		d.Lock()
+
+		if d.closing || d.FieldIndex[name] != idx {
+			d.Unlock()
+
+			return
+		}
+
+		indexed := make(map[int]bool)
+		for _, entry := range idx.Index {
+			if !entry.removed && entry.BlockId == blockId {
+				indexed[entry.ID] = true
+			}
+		}
+
+		err := d.scanBlock(collDir, blockId, func(offset int64, data *lineReaderData) Error {
+			if indexed[data.id] {
+				return nil
+			}
+
+			v, e := p.ParseBytes(data.val)
+
+			if e != nil {
+				return newError(DbIntegrityMasterErrorCode, UnmarshalFailCode, fmt.Sprintf("Unable to parse JSON from an already saved value. Be sure that what you saved is a JSON construct: %s", e.Error()))
+			}
+
+			if idx.covers(v) {
+				idx.Add(data.id, offset, idx.extract(v), blockId)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			idx.BuildError = err
+			d.Unlock()
+
+			return
+		}
+
+		idx.BuiltBlocks++
+
+		d.Unlock()
+	}
+
+	d.Lock()
+	idx.Complete = true
+	d.Unlock()
 }
 
 func (d *db) writeOnDefragmentation(id int, v []uint8, mapIdx uint16) Error {
@@ -597,16 +1316,6 @@ func (d *db) getBlockId(id int) uint16 {
 	return uint16(id / blockMark)
 }
 
-func (d *db) tryDefragmentation(blockId uint16) (map[int]int64, Error) {
-	indexes, err := defragmentBlock(blockId, d.Name)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return indexes, nil
-}
-
 func (d *db) increaseBlockTracker(blockId uint16) uint16 {
 	track, _ := d.BlockTracker[blockId]
 
@@ -617,9 +1326,19 @@ func (d *db) increaseBlockTracker(blockId uint16) uint16 {
 	return track[1]
 }
 
+// defragmentation removes every tombstone of a block
 func (d *db) resetBlockTracker(blockId uint16) {
 	track, _ := d.BlockTracker[blockId]
 	track[1] = 0
+	track[2] = 0
+
+	d.BlockTracker[blockId] = track
+}
+
+func (d *db) increaseTombstones(blockId uint16, n int) {
+	track, _ := d.BlockTracker[blockId]
+
+	track[2] += uint16(n)
 
 	d.BlockTracker[blockId] = track
 }
@@ -636,11 +1355,34 @@ func (d *db) incrementDocCount(mapId uint16) {
 	}
 }
 
+// a block without documents is removed so that it is not counted by enforceCap
+func (d *db) decrementLiveDocs(blockId uint16) {
+	d.liveDocs[blockId]--
+
+	if d.liveDocs[blockId] <= 0 {
+		delete(d.liveDocs, blockId)
+	}
+}
+
+/**
+Appends changes to the change log of the collection. The caller must hold the lock. The documents are already written
+or deleted, so a change that cannot be appended does not fail the operation. Watchers end with ChangesTrimmedCode
+when they reach it.
+*/
+func (d *db) logChanges(changes ...ChangeEvent) {
+	if d.changes == nil || len(changes) == 0 {
+		return
+	}
+
+	_ = d.changes.append(changes...)
+}
+
 func (d *db) init() {
 	d.PrimaryIndex = make(map[int]int64)
 	d.AutoIncrementCounter = 1
-	d.BlockTracker = make(map[uint16][2]uint16)
+	d.BlockTracker = make(map[uint16][3]uint16)
 	d.DocCount = make(map[uint16]int)
+	d.liveDocs = make(map[uint16]int)
 	d.FieldIndex = make(map[string]*fieldIndex)
 	d.FieldIndexKeys = make([]string, 0)
 }
@@ -1,34 +1,62 @@
 package rose
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/juju/fslock"
-	"io/ioutil"
 	"os"
 )
 
-func defragmentBlock(blockId uint16, collName string) (map[int]int64, Error) {
+/**
+Removes deleted and replaced documents from a block. Lines that hold documents are streamed into a temporary file next to the block
+which is synced and renamed over the block, so a crash at any point leaves either the old or the new block, never a partially
+written one. Returns the new offset of every document in the block and the number of bytes that were removed.
+
+If the block is locked by another process, the block is not touched and nil offsets are returned without an error.
+*/
+func defragmentBlock(blockId uint16, collName string) (map[int]int64, int64, Error) {
 	collDir := fmt.Sprintf("%s/%s", roseDbDir(), collName)
 	origFileName := roseBlockFile(blockId, collDir)
+	tmpFileName := fmt.Sprintf("%s.tmp", origFileName)
 
 	l := fslock.New(origFileName)
 
-	e := l.TryLock()
-	if e != nil {
-		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to lock file %s with underlying message: %s", origFileName, e.Error()))
+	if e := l.TryLock(); e != nil {
+		return nil, 0, nil
 	}
 
-	origFile, err := createFile(origFileName, os.O_RDWR)
+	defer func() {
+		_ = l.Unlock()
+	}()
+
+	origFile, err := createFile(origFileName, os.O_RDONLY)
 
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	tmpFile, err := createFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+
+	if err != nil {
+		_ = origFile.Close()
+
+		return nil, 0, err
+	}
+
+	// removes the temporary file on every error, the original block stays as it was
+	fail := func(err Error) (map[int]int64, int64, Error) {
+		_ = origFile.Close()
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFileName)
+
+		return nil, 0, err
 	}
 
 	reader := NewLineReader(origFile)
+	writer := bufio.NewWriter(tmpFile)
 
-	dataToWrite := ""
-	indexes := make(map[int]int64)
-	var index int64 = 0
+	offsets := make(map[int]int64)
+	var offset int64 = 0
 	for {
 		_, val, err := reader.Read()
 
@@ -37,65 +65,52 @@ func defragmentBlock(blockId uint16, collName string) (map[int]int64, Error) {
 		}
 
 		if err != nil {
-			e = l.Unlock()
-			if e != nil {
-				return nil, newError(SystemMasterErrorCode, FsPermissionsCode,  fmt.Sprintf("Unable to lock file %s with underlying message: %s", origFileName, e.Error()))
-			}
-
-			fsErr := closeFile(origFile)
-
-			if fsErr != nil {
-				return nil, fsErr
-			}
-
-			return nil, newError(DbIntegrityMasterErrorCode, BlockCorruptedCode, fmt.Sprintf("Database integrity violation while defragmenting with underlying message: %s", err.Error()))
+			return fail(newError(DbIntegrityMasterErrorCode, BlockCorruptedCode, fmt.Sprintf("Database integrity violation while defragmenting block %s with underlying message: %s", origFileName, err.Error())))
 		}
 
 		if val == nil {
-			e = l.Unlock()
-			if e != nil {
-				return nil, newError(SystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to lock file %s with underlying message: %s", origFileName, e.Error()))
-			}
-
-			fsErr := closeFile(origFile)
+			return fail(newError(DbIntegrityMasterErrorCode, BlockCorruptedCode, fmt.Sprintf("Database integrity violation while defragmenting block %s. Invalid row encountered", origFileName)))
+		}
 
-			if fsErr != nil {
-				return nil, fsErr
-			}
+		line := prepareData(val.id, string(val.val))
 
-			return nil, newError(SystemMasterErrorCode, FsPermissionsCode, "Database integrity violation while defragmenting. Invalid row encountered")
+		if _, e := writer.Write(line); e != nil {
+			return fail(newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to write into %s with underlying message: %s", tmpFileName, e.Error())))
 		}
 
-		d := string(prepareData(val.id, string(val.val)))
-		dataToWrite += d
-		indexes[val.id] = index
-		index += int64(len(d))
+		offsets[val.id] = offset
+		offset += int64(len(line))
 	}
 
-	e = ioutil.WriteFile(origFileName, []uint8(dataToWrite), 0666)
+	if e := writer.Flush(); e != nil {
+		return fail(newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to write into %s with underlying message: %s", tmpFileName, e.Error())))
+	}
 
-	if e != nil {
-		e = l.Unlock()
-		if e != nil {
-			return nil, newError(SystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to lock file %s with underlying message: %s", origFileName, e.Error()))
-		}
+	if e := tmpFile.Sync(); e != nil {
+		return fail(newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to sync %s with underlying message: %s", tmpFileName, e.Error())))
+	}
 
-		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Could not convert string to int during defragmentation with underlying message: %s", e.Error()))
+	if e := tmpFile.Close(); e != nil {
+		return fail(newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to close %s with underlying message: %s", tmpFileName, e.Error())))
 	}
 
 	if err := closeFile(origFile); err != nil {
-		e = l.Unlock()
-		if e != nil {
-			return nil, newError(SystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to unlock file %s with underlying message: %s", origFileName, e.Error()))
-		}
+		_ = os.Remove(tmpFileName)
+
+		return nil, 0, err
+	}
+
+	if e := os.Rename(tmpFileName, origFileName); e != nil {
+		_ = os.Remove(tmpFileName)
 
-		return nil, err
+		return nil, 0, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to replace block %s with underlying message: %s", origFileName, e.Error()))
 	}
 
-	e = l.Unlock()
-	if e != nil {
-		return nil, newError(SystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to unlock file %s with underlying message: %s", origFileName, e.Error()))
+	// the rename is durable only after the directory is synced
+	if dir, e := os.Open(collDir); e == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
 	}
 
-	return indexes, nil
-}
\ No newline at end of file
+	return offsets, reader.deletedBytes, nil
+}
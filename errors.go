@@ -2,6 +2,7 @@ package rose
 
 import (
 	"encoding/json"
+	"fmt"
 )
 
 type masterCode int
@@ -44,6 +45,10 @@ func newError(m masterCode, c code, msg string) Error {
 	}
 }
 
+func newDuplicateKeyError(fieldName string, value interface{}, owner int) Error {
+	return newError(ValidationMasterErrorCode, DuplicateKeyCode, fmt.Sprintf("Duplicate key error. Unique index '%s' already holds value '%v' in document with ID %d", fieldName, value, owner))
+}
+
 func errToJson(e Error) []uint8 {
 	j := map[string]interface{}{
 		"masterCode": e.GetMasterCode(),
@@ -0,0 +1,403 @@
+package rose
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"github.com/valyala/fastjson"
+	"io"
+	"sort"
+	"strconv"
+)
+
+type DataFormat string
+
+// every line is {"id": .., "data": ..} where data is the document
+const NDJSONFormat DataFormat = "ndjson"
+// a header with id and data columns, data is the document as JSON
+const CSVFormat DataFormat = "csv"
+
+// at most this many line errors are kept in ImportResult.Errors, every failed line is still counted in Failed
+const maxImportErrors = 1000
+
+type ExportResult struct {
+	Documents int `json:"documents"`
+}
+
+type ImportOptions struct {
+	// documents keep the IDs they are imported with. A line without an ID or with an ID that already exists fails.
+	// Without it, every document gets the next ID of the collection
+	PreserveIDs bool
+}
+
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Failed int `json:"failed"`
+	Errors []ImportLineError `json:"errors"`
+}
+
+type ImportLineError struct {
+	// line in NDJSON, record in CSV where the header is record 1
+	Line int `json:"line"`
+	Message string `json:"message"`
+}
+
+// a document that is exported or imported
+type dataRecord struct {
+	id int
+	data []uint8
+}
+
+func (f DataFormat) isValid() bool {
+	return f == NDJSONFormat || f == CSVFormat
+}
+
+/**
+Exports every document of a collection into w, ordered by ID within a block. Documents are read one block at a time
+and written after the block is released, so memory use is bound by the size of a block and writes are not held back
+while w is written to.
+
+A document that is written while the collection is exported is exported only if its block was not read yet.
+*/
+func (a *Rose) Export(collName string, w io.Writer, format DataFormat) (*ExportResult, Error) {
+	if !format.isValid() {
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid export request. Format must be either %s or %s, %s given", NDJSONFormat, CSVFormat, format))
+	}
+
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
+	db, ok := a.Databases[collName]
+
+	if !ok {
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid export request. Collection %s does not exist", collName))
+	}
+
+	buf := bufio.NewWriter(w)
+	var csvWriter *csv.Writer
+
+	if format == CSVFormat {
+		csvWriter = csv.NewWriter(buf)
+
+		if e := csvWriter.Write([]string{"id", "data"}); e != nil {
+			return nil, exportWriteError(e)
+		}
+	}
+
+	result := &ExportResult{}
+
+	err := db.exportBlocks(func(records []dataRecord) Error {
+		for _, r := range records {
+			var e error
+
+			if format == CSVFormat {
+				e = csvWriter.Write([]string{strconv.Itoa(r.id), string(r.data)})
+			} else {
+				_, e = fmt.Fprintf(buf, "{\"id\":%d,\"data\":%s}\n", r.id, r.data)
+			}
+
+			if e != nil {
+				return exportWriteError(e)
+			}
+
+			result.Documents++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+
+		if e := csvWriter.Error(); e != nil {
+			return nil, exportWriteError(e)
+		}
+	}
+
+	if e := buf.Flush(); e != nil {
+		return nil, exportWriteError(e)
+	}
+
+	return result, nil
+}
+
+/**
+Imports documents from r into a collection. Every line is validated the same way as a Write and a line that fails
+does not stop the import; its error is reported in ImportResult with its line number.
+
+NDJSON lines are in the format that Export writes. A line that is not an object with only id and data fields is
+imported as the document itself. CSV must have a header with a data column and can have an id column.
+
+If r cannot be read, the import stops and the error is returned together with the result of the lines before it.
+
+Hooks of the collection do not run for imported documents, watchers receive an insert change for every one of them.
+*/
+func (a *Rose) Import(collName string, r io.Reader, format DataFormat, options ...ImportOptions) (*ImportResult, Error) {
+	if !format.isValid() {
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid import request. Format must be either %s or %s, %s given", NDJSONFormat, CSVFormat, format))
+	}
+
+	opts := ImportOptions{}
+	if len(options) > 0 {
+		opts = options[0]
+	}
+
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
+	db, ok := a.Databases[collName]
+
+	if !ok {
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid import request. Collection %s does not exist", collName))
+	}
+
+	im := &importer{
+		db: db,
+		collName: collName,
+		opts: opts,
+		result: &ImportResult{
+			Errors: make([]ImportLineError, 0),
+		},
+	}
+
+	if format == CSVFormat {
+		return im.result, im.importCSV(r)
+	}
+
+	return im.result, im.importNDJSON(r)
+}
+
+type importer struct {
+	db *db
+	collName string
+	opts ImportOptions
+	result *ImportResult
+}
+
+func (im *importer) write(line int, id int, data string) {
+	m := WriteMetadata{CollectionName: im.collName, Data: data}
+
+	if err := m.Validate(); err != nil {
+		im.fail(line, err)
+
+		return
+	}
+
+	if err := validateData(m.Data); err != nil {
+		im.fail(line, err)
+
+		return
+	}
+
+	// a capped collection that cannot drop its oldest blocks tries again on the next line, the line is imported anyway
+	var err Error
+	if !im.opts.PreserveIDs {
+		_, _, _, err = im.db.Write(m.Data, nil)
+	} else if id == 0 {
+		err = newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, "Validation error. IDs are preserved but the line does not have an ID")
+	} else {
+		_, err = im.db.WriteWithId(id, m.Data)
+	}
+
+	if err != nil {
+		im.fail(line, err)
+
+		return
+	}
+
+	im.result.Imported++
+}
+
+func (im *importer) fail(line int, err Error) {
+	im.result.Failed++
+
+	if len(im.result.Errors) < maxImportErrors {
+		im.result.Errors = append(im.result.Errors, ImportLineError{Line: line, Message: err.Error()})
+	}
+}
+
+func (im *importer) importNDJSON(r io.Reader) Error {
+	scanner := bufio.NewScanner(r)
+	// a document can be as large as maxValSize, the id and data fields around it are small
+	scanner.Buffer(make([]uint8, 0, 64*1024), maxValSize+1024)
+
+	var p fastjson.Parser
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		b := scanner.Bytes()
+
+		if len(b) == 0 {
+			continue
+		}
+
+		v, e := p.ParseBytes(b)
+
+		if e != nil {
+			im.write(line, 0, string(b))
+
+			continue
+		}
+
+		id, data, ok := exportedRecord(v)
+
+		if !ok {
+			im.write(line, 0, string(b))
+
+			continue
+		}
+
+		im.write(line, id, data)
+	}
+
+	if e := scanner.Err(); e != nil {
+		return newError(GenericMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Import stopped after line %d. Unable to read the next line with underlying message: %s", line, e.Error()))
+	}
+
+	return nil
+}
+
+// returns the ID and the document of a line that is in the format that Export writes
+func exportedRecord(v *fastjson.Value) (int, string, bool) {
+	o, e := v.Object()
+
+	if e != nil || o.Get("data") == nil {
+		return 0, "", false
+	}
+
+	onlyExported := true
+	o.Visit(func(key []uint8, _ *fastjson.Value) {
+		if string(key) != "id" && string(key) != "data" {
+			onlyExported = false
+		}
+	})
+
+	if !onlyExported {
+		return 0, "", false
+	}
+
+	id := 0
+	if idVal := o.Get("id"); idVal != nil {
+		i, e := idVal.Int()
+
+		if e != nil {
+			return 0, "", false
+		}
+
+		id = i
+	}
+
+	return id, string(o.Get("data").MarshalTo(nil)), true
+}
+
+func (im *importer) importCSV(r io.Reader) Error {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+
+	header, e := reader.Read()
+
+	if e != nil {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid CSV import. Unable to read the header with underlying message: %s", e.Error()))
+	}
+
+	// the header is overwritten by the next record since records are reused
+	columns := len(header)
+	idCol, dataCol := -1, -1
+	for i, name := range header {
+		if name == "id" {
+			idCol = i
+		} else if name == "data" {
+			dataCol = i
+		}
+	}
+
+	if dataCol == -1 {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, "Invalid CSV import. Header must have a data column")
+	}
+
+	line := 1
+	for {
+		record, e := reader.Read()
+		line++
+
+		if e == io.EOF {
+			return nil
+		}
+
+		if pe, ok := e.(*csv.ParseError); ok && pe.Err == csv.ErrFieldCount {
+			im.fail(line, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Record has %d fields but the header has %d", len(record), columns)))
+
+			continue
+		}
+
+		if e != nil {
+			return newError(GenericMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Import stopped at record %d. Unable to read it with underlying message: %s", line, e.Error()))
+		}
+
+		id := 0
+		if idCol != -1 && record[idCol] != "" {
+			i, e := strconv.Atoi(record[idCol])
+
+			if e != nil {
+				im.fail(line, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Invalid ID '%s'. ID must be a positive integer", record[idCol])))
+
+				continue
+			}
+
+			id = i
+		}
+
+		im.write(line, id, record[dataCol])
+	}
+}
+
+/**
+Passes the documents of every block to fn, one block at a time. A block is read while the collection is locked and
+fn is called after it is released.
+*/
+func (d *db) exportBlocks(fn func(records []dataRecord) Error) Error {
+	collDir := fmt.Sprintf("%s/%s", roseDbDir(), d.Name)
+
+	d.RLock()
+	blocks, err := listBlocks(collDir)
+	d.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	for _, blockId := range blocks {
+		records := make([]dataRecord, 0)
+
+		d.RLock()
+		err := d.scanBlock(collDir, blockId, func(offset int64, data *lineReaderData) Error {
+			records = append(records, dataRecord{id: data.id, data: data.val})
+
+			return nil
+		})
+		d.RUnlock()
+
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(records, func(i, j int) bool {
+			return records[i].id < records[j].id
+		})
+
+		if err := fn(records); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func exportWriteError(e error) Error {
+	return newError(GenericMasterErrorCode, OperatingSystemCode, fmt.Sprintf("Export failed. Unable to write with underlying message: %s", e.Error()))
+}
@@ -0,0 +1,191 @@
+package rose
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"strings"
+)
+
+var _ = GinkgoDescribe("Export and import tests", func() {
+	GinkgoIt("Should export a collection as NDJSON and import it with preserved IDs", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "export_coll")
+		importColl := testCreateCollection(a, "import_coll")
+
+		for i := 0; i < 10; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 2}, a)
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 5}, a)
+
+		var buf bytes.Buffer
+		res, err := a.Export(collName, &buf, NDJSONFormat)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(res.Documents).To(gomega.Equal(8))
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		gomega.Expect(len(lines)).To(gomega.Equal(8))
+		gomega.Expect(lines[0]).To(gomega.HavePrefix("{\"id\":1,\"data\":{"))
+		gomega.Expect(lines[1]).To(gomega.HavePrefix("{\"id\":3,\"data\":{"))
+
+		imported, err := a.Import(importColl, bytes.NewReader(buf.Bytes()), NDJSONFormat, ImportOptions{PreserveIDs: true})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(imported.Imported).To(gomega.Equal(8))
+		gomega.Expect(imported.Failed).To(gomega.Equal(0))
+
+		for _, id := range []int{1, 3, 4, 6, 7, 8, 9, 10} {
+			u := TestUser{}
+			gomega.Expect(testSingleRead(ReadMetadata{ID: id, Data: &u, CollectionName: importColl}, a).Status).To(gomega.Equal(FoundResultStatus))
+			gomega.Expect(u.Email).To(gomega.Equal(fmt.Sprintf("%d@gmail.com", id-1)))
+		}
+
+		gomega.Expect(testSingleRead(ReadMetadata{ID: 2, Data: &TestUser{}, CollectionName: importColl}, a).Status).To(gomega.Equal(NotFoundResultStatus))
+
+		// every ID already exists
+		imported, err = a.Import(importColl, bytes.NewReader(buf.Bytes()), NDJSONFormat, ImportOptions{PreserveIDs: true})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(imported.Imported).To(gomega.Equal(0))
+		gomega.Expect(imported.Failed).To(gomega.Equal(8))
+		gomega.Expect(imported.Errors[0]).To(gomega.Equal(ImportLineError{Line: 1, Message: "Validation error. Document with ID 1 already exists"}))
+
+		// without preserved IDs, documents get the next IDs
+		imported, err = a.Import(importColl, bytes.NewReader(buf.Bytes()), NDJSONFormat)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(imported.Imported).To(gomega.Equal(8))
+
+		u := TestUser{}
+		gomega.Expect(testSingleRead(ReadMetadata{ID: 11, Data: &u, CollectionName: importColl}, a).Status).To(gomega.Equal(FoundResultStatus))
+		gomega.Expect(u.Email).To(gomega.Equal("0@gmail.com"))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should export and import CSV and report errors per line", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "csv_coll")
+		importColl := testCreateCollection(a, "csv_import_coll")
+
+		for i := 0; i < 5; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		var buf bytes.Buffer
+		res, err := a.Export(collName, &buf, CSVFormat)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(res.Documents).To(gomega.Equal(5))
+		gomega.Expect(buf.String()).To(gomega.HavePrefix("id,data\n1,\"{\"\"type\"\":"))
+
+		imported, err := a.Import(importColl, bytes.NewReader(buf.Bytes()), CSVFormat, ImportOptions{PreserveIDs: true})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(imported.Imported).To(gomega.Equal(5))
+
+		u := TestUser{}
+		gomega.Expect(testSingleRead(ReadMetadata{ID: 5, Data: &u, CollectionName: importColl}, a).Status).To(gomega.Equal(FoundResultStatus))
+		gomega.Expect(u.Email).To(gomega.Equal("4@gmail.com"))
+
+		csvData := "data,id\n" +
+			"\"{\"\"name\"\": \"\"first\"\"}\",\n" +
+			"not json,\n" +
+			"\"{}\",abc\n" +
+			"\"{}\"\n" +
+			"\"{\"\"name\"\": \"\"last\"\"}\",\n"
+
+		imported, err = a.Import(importColl, strings.NewReader(csvData), CSVFormat)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(imported.Imported).To(gomega.Equal(2))
+		gomega.Expect(imported.Failed).To(gomega.Equal(3))
+		gomega.Expect(imported.Errors).To(gomega.Equal([]ImportLineError{
+			{Line: 3, Message: "Data must be a JSON byte array"},
+			{Line: 4, Message: "Validation error. Invalid ID 'abc'. ID must be a positive integer"},
+			{Line: 5, Message: "Validation error. Record has 1 fields but the header has 2"},
+		}))
+
+		_, err = a.Import(importColl, strings.NewReader("id\n1\n"), CSVFormat)
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid CSV import. Header must have a data column"))
+
+		_, err = a.Export(collName, &buf, DataFormat("xml"))
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid export request. Format must be either ndjson or csv, xml given"))
+
+		_, err = a.Import("not_exists", strings.NewReader(""), NDJSONFormat)
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid import request. Collection not_exists does not exist"))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should import plain NDJSON documents and IDs beyond the first block", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "ndjson_coll")
+
+		ndjson := "{\"email\": \"plain@gmail.com\", \"type\": \"user\"}\n" +
+			"\n" +
+			"{broken\n" +
+			fmt.Sprintf("{\"id\": %d, \"data\": {\"email\": \"far@gmail.com\", \"type\": \"user\"}}\n", blockMark*2+5)
+
+		imported, err := a.Import(collName, strings.NewReader(ndjson), NDJSONFormat, ImportOptions{PreserveIDs: true})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(imported.Imported).To(gomega.Equal(1))
+		gomega.Expect(imported.Errors).To(gomega.Equal([]ImportLineError{
+			{Line: 1, Message: "Validation error. IDs are preserved but the line does not have an ID"},
+			{Line: 3, Message: "Data must be a JSON byte array"},
+		}))
+
+		imported, err = a.Import(collName, strings.NewReader(ndjson), NDJSONFormat)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(imported.Imported).To(gomega.Equal(2))
+
+		qb := NewQueryBuilder()
+		qb.If(collName, "type:string == user", map[string]interface{}{})
+
+		results, err := a.Query(qb)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(results)).To(gomega.Equal(3))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		a = testCreateRose(false)
+
+		// the next ID is above the highest imported one after restart
+		res := testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "next@gmail.com", Type: "user"})}, a)
+		gomega.Expect(res.ID).To(gomega.Equal(blockMark*2 + 8))
+
+		results, err = a.Query(qb)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(results)).To(gomega.Equal(4))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+})
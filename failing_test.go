@@ -355,7 +355,7 @@ var _ = GinkgoDescribe("Successfully failing tests", func() {
 		})
 
 		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
-		gomega.Expect(err.Error()).To(gomega.Equal("Validation error. Invalid readBy method 'dataType'. 'dataType' is an invalid data type. Valid data types are int, float, string and bool"))
+		gomega.Expect(err.Error()).To(gomega.Equal("Validation error. Invalid readBy method 'dataType'. 'dataType' is an invalid data type. Valid data types are int, float, string, bool, date and date_time"))
 
 		if err := a.Shutdown(); err != nil {
 			testRemoveFileSystemDb(roseDir())
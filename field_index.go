@@ -1,38 +1,396 @@
 package rose
 
 import (
+	"fmt"
+	"github.com/valyala/fastjson"
 	"sort"
+	"strings"
+	"time"
 )
 
+// IndexField is a single typed field of an index. A compound index is made of multiple fields and the order
+// of the fields matters since only a prefix of them can be used in a lookup
+type IndexField struct {
+	Name string `json:"name"`
+	DataType indexDataType `json:"dataType"`
+}
+
+// least number of removed entries before an index drops them in a single pass
+const minIndexCompaction = 1024
+// number of entries that can be added to an index before they are merged into its sorted entries, see seek()
+const maxUnsortedEntries = 1024
+
 type specificIndex struct {
+	ID int
 	Pos int64
+	// a single value for single field indexes, []interface{} with a value for every field for compound indexes
 	Value interface{}
 	BlockId uint16
+	// removed entries stay in place until the index is compacted and are skipped by every reader
+	removed bool
 }
 
 type fieldIndex struct {
+	// data type of the first field of the index
 	DataType indexDataType
+	Fields []IndexField
+	Unique bool
+	Sparse bool
+	Options IndexOptions
+	// an index is complete when it holds every document of the collection. Only complete indexes are used by queries
+	Complete bool
+	// progress of an index that is built from the documents that are already saved
+	BuiltBlocks int
+	TotalBlocks int
+	// error that stopped the build. An index that failed to build is never complete
+	BuildError Error
 	Index[]specificIndex
+	// maps the ID of a document to the position of its entry in Index
+	positions map[int]int
+	// number of removed entries that Index still holds
+	removed int
+	// positions of the entries of Index before merged, ordered by their values. Kept up to date by seek(), entries
+	// that were added after them are checked one by one
+	sorted []int
+	merged int
+	// only used by unique indexes, maps an indexed value to the ID of the document that holds it
+	keys map[interface{}]int
+	// only used by partial indexes, documents that do not match it are not indexed
+	filter *singleQuery
+	// only used by text indexes
+	text *textIndex
+	// only used by geo indexes
+	geo *geoIndex
+	// only used by TTL indexes, maps the ID of a document to the time it expires at
+	expires map[int]time.Time
 }
 
-func newFieldIndex(dataType indexDataType) *fieldIndex {
-	return &fieldIndex{
-		DataType: dataType,
+func newFieldIndex(fields []IndexField, options IndexOptions) *fieldIndex {
+	fi := &fieldIndex{
+		DataType: fields[0].DataType,
+		Fields: fields,
+		Unique: options.Unique,
+		Sparse: options.Sparse,
+		Options: options,
 		Index: make([]specificIndex, 0),
+		positions: make(map[int]int),
+	}
+
+	if options.Unique {
+		fi.keys = make(map[interface{}]int)
+	}
+
+	if options.TTL {
+		fi.expires = make(map[int]time.Time)
+	}
+
+	if fi.DataType == textIndexType {
+		fi.text = newTextIndex()
+	} else if fi.DataType == geoIndexType {
+		fi.geo = newGeoIndex()
 	}
+
+	// the filter is validated when the index is created
+	if options.Filter != "" {
+		query, _ := validateQuery(options.Filter, options.FilterParams)
+
+		fi.filter = newSingleQuery("", query, options.FilterParams)
+	}
+
+	return fi
 }
 
-func (fi *fieldIndex) Add(pos int64, value interface{}, blockId uint16) {
+func (fi *fieldIndex) Add(id int, pos int64, value interface{}, blockId uint16) {
 	fi.Index = append(fi.Index, specificIndex{
+		ID: id,
 		Pos:   pos,
 		Value: value,
 		BlockId: blockId,
 	})
+
+	fi.positions[id] = len(fi.Index) - 1
+
+	if fi.Unique {
+		fi.keys[fi.key(value)] = id
+	}
+
+	if fi.text != nil {
+		fi.text.add(id, value.([]string))
+	} else if fi.geo != nil {
+		fi.geo.add(id, value.(geoPoint))
+	}
+
+	if fi.expires != nil {
+		fi.expires[id] = value.(time.Time).Add(time.Duration(fi.Options.ExpireAfter) * time.Second)
+	}
+}
+
+// Remove removes the entry of a document with this ID. The entry is only marked as removed so the cost
+// does not depend on the size of the index. Order of the other entries is preserved since readBy pagination depends on it
+func (fi *fieldIndex) Remove(id int) {
+	p, ok := fi.positions[id]
+
+	if !ok {
+		return
+	}
+
+	fi.forget(fi.Index[p])
+
+	fi.Index[p].removed = true
+	delete(fi.positions, id)
+
+	fi.removed++
+
+	// removed entries are dropped once they are at least half of the index, which keeps the cost of a single Remove constant
+	if fi.removed >= minIndexCompaction && fi.removed * 2 >= len(fi.Index) {
+		fi.compact()
+	}
+}
+
+// Len returns the number of entries in the index that are not removed
+func (fi *fieldIndex) Len() int {
+	return len(fi.Index) - fi.removed
+}
+
+// drops removed entries in a single pass. Order of the other entries is preserved
+func (fi *fieldIndex) compact() {
+	kept := fi.Index[:0]
+
+	for _, idx := range fi.Index {
+		if !idx.removed {
+			kept = append(kept, idx)
+		}
+	}
+
+	// entries after the kept ones would otherwise hold their values in memory
+	for i := len(kept); i < len(fi.Index); i++ {
+		fi.Index[i] = specificIndex{}
+	}
+
+	fi.Index = kept
+
+	fi.findPositions()
+}
+
+// finds the position of every entry after entries were moved. The position of an ID that has more entries is the last one.
+// Sorted positions are sorted again by the next seek()
+func (fi *fieldIndex) findPositions() {
+	fi.positions = make(map[int]int, len(fi.Index))
+
+	for i, idx := range fi.Index {
+		fi.positions[idx.ID] = i
+	}
+
+	fi.removed = 0
+	fi.sorted = nil
+	fi.merged = 0
+}
+
+/**
+Returns the positions of the entries whose first values are equal to prefix and whose next value satisfies every range
+condition, in the order of Index. The sorted entries are searched with a binary search for the first and the last one that
+match, only the entries that were added since they were sorted are checked one by one. Removed entries are not returned.
+Text and geo indexes are not sorted. The caller must hold the lock of the collection since entries are sorted here.
+*/
+func (fi *fieldIndex) seek(prefix []interface{}, conds []*singleCondition) []int {
+	fi.sortEntries()
+
+	field := len(prefix)
+	bounds := make([]interface{}, 0, len(conds))
+	for _, cond := range conds {
+		v, _ := conditionIndexValue(cond, fi.Fields[field].DataType)
+		bounds = append(bounds, v)
+	}
+
+	// true for entries that are ordered before the matching ones
+	before := func(p int) bool {
+		values := fi.values(fi.Index[p].Value)
+
+		if c := comparePrefix(values, prefix); c != 0 {
+			return c < 0
+		}
+
+		for i, cond := range conds {
+			c := compareIndexValues(values[field], bounds[i])
+
+			if (cond.comparisonType == more && c <= 0) || (cond.comparisonType == moreEqual && c < 0) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	// true for entries that are ordered after the matching ones
+	after := func(p int) bool {
+		values := fi.values(fi.Index[p].Value)
+
+		if c := comparePrefix(values, prefix); c != 0 {
+			return c > 0
+		}
+
+		for i, cond := range conds {
+			c := compareIndexValues(values[field], bounds[i])
+
+			if (cond.comparisonType == less && c >= 0) || (cond.comparisonType == lessEqual && c > 0) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	start := sort.Search(len(fi.sorted), func(i int) bool {
+		return !before(fi.sorted[i])
+	})
+
+	end := start + sort.Search(len(fi.sorted) - start, func(i int) bool {
+		return after(fi.sorted[start + i])
+	})
+
+	positions := make([]int, 0, end - start)
+	for _, p := range fi.sorted[start:end] {
+		if !fi.Index[p].removed {
+			positions = append(positions, p)
+		}
+	}
+
+	for p := fi.merged; p < len(fi.Index); p++ {
+		idx := fi.Index[p]
+
+		if idx.removed || !fi.matchesPrefix(idx.Value, prefix) {
+			continue
+		}
+
+		if len(conds) > 0 && !fi.matchesRange(idx.Value, field, conds) {
+			continue
+		}
+
+		positions = append(positions, p)
+	}
+
+	sort.Ints(positions)
+
+	return positions
+}
+
+// merges the entries that were added since the last merge into the sorted entries once there are too many of them to check one by one
+func (fi *fieldIndex) sortEntries() {
+	if len(fi.Index) - fi.merged <= maxUnsortedEntries {
+		return
+	}
+
+	added := make([]int, 0, len(fi.Index) - fi.merged)
+	for p := fi.merged; p < len(fi.Index); p++ {
+		if !fi.Index[p].removed {
+			added = append(added, p)
+		}
+	}
+
+	sort.Slice(added, func(i, j int) bool {
+		return fi.orderedBefore(added[i], added[j])
+	})
+
+	sorted := make([]int, 0, len(fi.sorted) + len(added))
+	i, j := 0, 0
+	for i < len(fi.sorted) || j < len(added) {
+		if i < len(fi.sorted) && fi.Index[fi.sorted[i]].removed {
+			i++
+		} else if j == len(added) || (i < len(fi.sorted) && fi.orderedBefore(fi.sorted[i], added[j])) {
+			sorted = append(sorted, fi.sorted[i])
+			i++
+		} else {
+			sorted = append(sorted, added[j])
+			j++
+		}
+	}
+
+	fi.sorted = sorted
+	fi.merged = len(fi.Index)
+}
+
+// returns true if the entry at position p is ordered before the one at position q. Entries with equal values are in order of Index
+func (fi *fieldIndex) orderedBefore(p int, q int) bool {
+	if c := comparePrefix(fi.values(fi.Index[p].Value), fi.values(fi.Index[q].Value)); c != 0 {
+		return c < 0
+	}
+
+	return p < q
+}
+
+// RemoveBlock removes the entries of every document in a block in a single pass. Order of the other entries is preserved
+func (fi *fieldIndex) RemoveBlock(blockId uint16) {
+	kept := fi.Index[:0]
+
+	for _, idx := range fi.Index {
+		if idx.removed {
+			continue
+		}
+
+		if idx.BlockId == blockId {
+			fi.forget(idx)
+
+			continue
+		}
+
+		kept = append(kept, idx)
+	}
+
+	for i := len(kept); i < len(fi.Index); i++ {
+		fi.Index[i] = specificIndex{}
+	}
+
+	fi.Index = kept
+
+	fi.findPositions()
+}
+
+// removes an entry from the unique keys, text, geo and TTL lookups of the index
+func (fi *fieldIndex) forget(idx specificIndex) {
+	if fi.Unique {
+		if owner, ok := fi.keys[fi.key(idx.Value)]; ok && owner == idx.ID {
+			delete(fi.keys, fi.key(idx.Value))
+		}
+	}
+
+	if fi.text != nil {
+		fi.text.remove(idx.ID, idx.Value.([]string))
+	} else if fi.geo != nil {
+		fi.geo.remove(idx.ID, idx.Value.(geoPoint))
+	}
+
+	if fi.expires != nil {
+		delete(fi.expires, idx.ID)
+	}
+}
+
+// Owner returns the ID of the document that holds this value. Only unique indexes keep track of owners
+func (fi *fieldIndex) Owner(value interface{}) (int, bool) {
+	if !fi.Unique {
+		return 0, false
+	}
+
+	id, ok := fi.keys[fi.key(value)]
+
+	return id, ok
+}
+
+// Expired returns true if the document with this ID has expired by now. Only TTL indexes keep track of expiry
+func (fi *fieldIndex) Expired(id int, now time.Time) bool {
+	if fi.expires == nil {
+		return false
+	}
+
+	t, ok := fi.expires[id]
+
+	return ok && !now.Before(t)
 }
 
 // Sort sorts index in place, which means that on next usage, it is already sorted based on previous direction (asc, desc)
 // Boolean indexes cannot be sorted
 func (fi *fieldIndex) Sort(direction sortType) {
+	fi.compact()
+
 	sort.Slice(fi.Index, func(i, j int) bool {
 		if direction == sortAsc {
 			if fi.DataType == intIndexType {
@@ -57,4 +415,367 @@ func (fi *fieldIndex) Sort(direction sortType) {
 		// defaults to int but it will never come to this
 		return fi.Index[i].Value.(int) < fi.Index[j].Value.(int)
 	})
+
+	fi.findPositions()
+}
+
+// progress returns the part of the saved blocks that the index holds, from 0 to 1
+func (fi *fieldIndex) progress() float64 {
+	if fi.Complete || fi.TotalBlocks == 0 {
+		return 1
+	}
+
+	return float64(fi.BuiltBlocks) / float64(fi.TotalBlocks)
+}
+
+// memoryUsage approximates the number of bytes that the index entries hold in memory
+func (fi *fieldIndex) memoryUsage() uint64 {
+	// ID, position, interface header and block ID of a single entry
+	var entrySize uint64 = 40
+	var size uint64
+
+	for _, idx := range fi.Index {
+		size += entrySize
+
+		if idx.removed {
+			continue
+		}
+
+		for _, v := range fi.values(idx.Value) {
+			size += indexValueSize(v)
+		}
+
+		if fi.isCompound() {
+			// slice header and an interface header for every value
+			size += 24 + uint64(len(fi.Fields)) * 16
+		}
+	}
+
+	// ID, position and an approximation of map bucket overhead
+	size += uint64(len(fi.positions)) * 48
+	size += uint64(cap(fi.sorted)) * 8
+
+	if fi.Unique {
+		// key, owner ID and an approximation of map bucket overhead
+		size += uint64(len(fi.keys)) * 48
+	}
+
+	if fi.expires != nil {
+		// ID, expiry time and an approximation of map bucket overhead
+		size += uint64(len(fi.expires)) * 48
+	}
+
+	if fi.text != nil {
+		size += fi.text.memoryUsage()
+	} else if fi.geo != nil {
+		size += fi.geo.memoryUsage()
+	}
+
+	return size
+}
+
+func indexValueSize(v interface{}) uint64 {
+	switch t := v.(type) {
+	case string:
+		return uint64(len(t))
+	case time.Time:
+		return 24
+	case geoPoint:
+		return 16
+	case []string:
+		size := uint64(0)
+		for _, s := range t {
+			size += uint64(len(s)) + 16
+		}
+
+		return size + 24
+	}
+
+	return 8
+}
+
+func (fi *fieldIndex) isCompound() bool {
+	return len(fi.Fields) > 1
+}
+
+// exists returns true if every field of the index exists in the document with a value that can be indexed
+func (fi *fieldIndex) exists(v *fastjson.Value) bool {
+	for _, f := range fi.Fields {
+		if !v.Exists(f.Name) || !isIndexableValue(v, f) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// filters returns true if the document matches the filter of a partial index. Every document matches an index without a filter
+func (fi *fieldIndex) filters(v *fastjson.Value) bool {
+	if fi.filter == nil {
+		return true
+	}
+
+	return matchesStages(v, fi.filter.stages)
+}
+
+// covers returns true if the document is held by this index
+func (fi *fieldIndex) covers(v *fastjson.Value) bool {
+	return fi.filters(v) && fi.exists(v)
+}
+
+/**
+A partial index holds only the documents that match its filter, so it can be used for a query only if the query
+requires every condition of the filter. This is true if every filter condition is also a condition of the query.
+*/
+func (fi *fieldIndex) servesConditions(conds []*singleCondition) bool {
+	if fi.filter == nil {
+		return true
+	}
+
+	for node := fi.filter.opNode; node != nil; node = node.next {
+		if node.nextOp == "||" {
+			return false
+		}
+
+		found := false
+		for _, c := range conds {
+			if c.field == node.cond.field && c.dataType == node.cond.dataType && c.comparisonType == node.cond.comparisonType && fmt.Sprint(c.value) == fmt.Sprint(node.cond.value) {
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// extract returns the value that this index holds for a document
+func (fi *fieldIndex) extract(v *fastjson.Value) interface{} {
+	if !fi.isCompound() {
+		return extractIndexValue(v, fi.Fields[0].Name, fi.DataType)
+	}
+
+	values := make([]interface{}, 0, len(fi.Fields))
+	for _, f := range fi.Fields {
+		values = append(values, extractIndexValue(v, f.Name, f.DataType))
+	}
+
+	return values
+}
+
+// values returns the value of an index entry as a list with one value for every field
+func (fi *fieldIndex) values(value interface{}) []interface{} {
+	if !fi.isCompound() {
+		return []interface{}{value}
+	}
+
+	return value.([]interface{})
+}
+
+// matchesPrefix returns true if the first len(prefix) values of an entry are equal to prefix
+func (fi *fieldIndex) matchesPrefix(value interface{}, prefix []interface{}) bool {
+	values := fi.values(value)
+
+	if len(prefix) > len(values) {
+		return false
+	}
+
+	for i, p := range prefix {
+		if compareIndexValues(values[i], p) != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesRange returns true if the value of an index field satisfies every range condition
+func (fi *fieldIndex) matchesRange(value interface{}, field int, conds []*singleCondition) bool {
+	v := fi.values(value)[field]
+
+	for _, cond := range conds {
+		condValue, _ := conditionIndexValue(cond, fi.Fields[field].DataType)
+		c := compareIndexValues(v, condValue)
+
+		if cond.comparisonType == less && c >= 0 {
+			return false
+		} else if cond.comparisonType == lessEqual && c > 0 {
+			return false
+		} else if cond.comparisonType == more && c <= 0 {
+			return false
+		} else if cond.comparisonType == moreEqual && c < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasPrefix returns true if the given fields are the first fields of this index, in the same order
+func (fi *fieldIndex) hasPrefix(fields []string) bool {
+	if len(fields) > len(fi.Fields) {
+		return false
+	}
+
+	for i, f := range fields {
+		if fi.Fields[i].Name != f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compound values are slices which cannot be used as map keys, and dates are equal only if they are the same instant
+func (fi *fieldIndex) key(value interface{}) interface{} {
+	if !fi.isCompound() {
+		return indexKeyValue(value)
+	}
+
+	values := make([]interface{}, 0, len(fi.Fields))
+	for _, v := range value.([]interface{}) {
+		values = append(values, indexKeyValue(v))
+	}
+
+	return fmt.Sprintf("%#v", values)
+}
+
+func indexKeyValue(value interface{}) interface{} {
+	if t, ok := value.(time.Time); ok {
+		return t.UnixNano()
+	}
+
+	return value
+}
+
+// compares two values of the same index data type. Returns 0 if they are equal, -1 if a is less than b, 1 if a is greater than b.
+// Values that cannot be ordered (booleans and values of different types) are either equal or 1
+func compareIndexValues(a interface{}, b interface{}) int {
+	switch av := a.(type) {
+	case int:
+		if bv, ok := b.(int); ok {
+			if av < bv {
+				return -1
+			} else if av > bv {
+				return 1
+			}
+
+			return 0
+		}
+	case float64:
+		if bv, ok := b.(float64); ok {
+			if av < bv {
+				return -1
+			} else if av > bv {
+				return 1
+			}
+
+			return 0
+		}
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv)
+		}
+	case time.Time:
+		if bv, ok := b.(time.Time); ok {
+			if av.Before(bv) {
+				return -1
+			} else if av.After(bv) {
+				return 1
+			}
+
+			return 0
+		}
+	}
+
+	if a == b {
+		return 0
+	}
+
+	return 1
+}
+
+// compares the first len(prefix) values with prefix, value by value. Booleans are ordered false before true
+func comparePrefix(values []interface{}, prefix []interface{}) int {
+	for i, p := range prefix {
+		if a, ok := values[i].(bool); ok {
+			if b, ok := p.(bool); ok && a != b {
+				if !a {
+					return -1
+				}
+
+				return 1
+			}
+		}
+
+		if c := compareIndexValues(values[i], p); c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// a date field is indexable only if it holds a string in one of the formats that parseDate() accepts,
+// a text field only if it holds a string and a geo field only if it holds a valid {"lat": .., "lng": ..} object
+func isIndexableValue(v *fastjson.Value, f IndexField) bool {
+	if f.DataType == textIndexType {
+		return v.Get(f.Name).Type() == fastjson.TypeString
+	}
+
+	if f.DataType == geoIndexType {
+		_, ok := geoPointFromValue(v.Get(f.Name))
+
+		return ok
+	}
+
+	if f.DataType != dateIndexType && f.DataType != dateTimeIndexType {
+		return true
+	}
+
+	_, ok := parseDate(string(v.GetStringBytes(f.Name)))
+
+	return ok
+}
+
+// extracts the value of a field from a parsed document in a form that can be stored in a field index.
+// Strings are copied since fastjson returns bytes that belong to the parser
+func extractIndexValue(v *fastjson.Value, fieldName string, dType indexDataType) interface{} {
+	if dType == stringIndexType {
+		return string(v.GetStringBytes(fieldName))
+	} else if dType == intIndexType {
+		return v.GetInt(fieldName)
+	} else if dType == floatIndexType {
+		return v.GetFloat64(fieldName)
+	} else if dType == boolIndexType {
+		return v.GetBool(fieldName)
+	} else if dType == dateIndexType || dType == dateTimeIndexType {
+		t, _ := parseDate(string(v.GetStringBytes(fieldName)))
+
+		return t
+	} else if dType == textIndexType {
+		return analyzeText(string(v.GetStringBytes(fieldName)))
+	} else if dType == geoIndexType {
+		p, _ := geoPointFromValue(v.Get(fieldName))
+
+		return p
+	}
+
+	return nil
+}
+
+// name of an index is its field name, or all field names separated by a comma for compound indexes
+func indexName(fields []IndexField) string {
+	names := make([]string, 0, len(fields))
+
+	for _, f := range fields {
+		names = append(names, f.Name)
+	}
+
+	return strings.Join(names, ",")
 }
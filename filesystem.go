@@ -2,8 +2,13 @@ package rose
 
 import (
 	"fmt"
+	"github.com/juju/fslock"
+	"io/ioutil"
 	"os"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
 )
 
 func createDbIfNotExists(output bool) (bool, Error) {
@@ -108,18 +113,195 @@ func userHomeDir() string {
 	return os.Getenv("HOME")
 }
 
+// set with SetDataDir(), .rose_db in the user home directory if empty
+var dataDir string
+
+/**
+SetDataDir changes the directory where Rose keeps its data, which is .rose_db in the user home directory by default.
+It must be called before New() and applies to every Rose created after it, as well as to Restore().
+*/
+func SetDataDir(dir string) {
+	dataDir = strings.TrimRight(dir, "/")
+}
+
 func roseDir() string {
+	if dataDir != "" {
+		return dataDir
+	}
+
 	return fmt.Sprintf("%s/.rose_db", userHomeDir())
 }
 
 func roseDbDir() string {
-	return fmt.Sprintf("%s/.rose_db/db", userHomeDir())
+	return fmt.Sprintf("%s/db", roseDir())
+}
+
+func roseChangesDir() string {
+	return fmt.Sprintf("%s/%s", roseDir(), changesDir)
+}
+
+func roseLockFile() string {
+	return fmt.Sprintf("%s/rose.lock", roseDir())
+}
+
+// data directories locked by this process with the number of Rose instances that use each of them
+var dataDirLocks = make(map[string]*dataDirLock)
+var dataDirLocksMutex sync.Mutex
+
+type dataDirLock struct {
+	lock *fslock.Lock
+	count int
+}
+
+/**
+Locks the data directory so that no other process can open it. Documents are written without locking the blocks
+between processes, so two processes that open the same directory would corrupt it. Rose instances in the same process
+share the lock and the directory is unlocked when the last of them calls unlockDataDir().
+*/
+func lockDataDir() (string, Error) {
+	dataDirLocksMutex.Lock()
+	defer dataDirLocksMutex.Unlock()
+
+	dir := roseDir()
+
+	if l, ok := dataDirLocks[dir]; ok {
+		l.count++
+
+		return dir, nil
+	}
+
+	l := fslock.New(roseLockFile())
+
+	if e := l.TryLock(); e != nil {
+		return "", newError(SystemMasterErrorCode, AppInvalidUsageCode, fmt.Sprintf("Unable to open the database in %s. It is used by another process", dir))
+	}
+
+	dataDirLocks[dir] = &dataDirLock{lock: l, count: 1}
+
+	return dir, nil
+}
+
+func unlockDataDir(dir string) Error {
+	dataDirLocksMutex.Lock()
+	defer dataDirLocksMutex.Unlock()
+
+	l, ok := dataDirLocks[dir]
+
+	if !ok {
+		return nil
+	}
+
+	l.count--
+
+	if l.count > 0 {
+		return nil
+	}
+
+	delete(dataDirLocks, dir)
+
+	if e := l.lock.Unlock(); e != nil {
+		return newError(SystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to unlock the data directory %s with underlying message: %s", dir, e.Error()))
+	}
+
+	return nil
+}
+
+// Locks the data directory like lockDataDir() but fails if a Rose in this process already uses it
+func lockDataDirExclusively() (string, Error) {
+	dataDirLocksMutex.Lock()
+	_, used := dataDirLocks[roseDir()]
+	dataDirLocksMutex.Unlock()
+
+	if used {
+		return "", newError(SystemMasterErrorCode, AppInvalidUsageCode, fmt.Sprintf("Unable to lock the database in %s. It is open in this process", roseDir()))
+	}
+
+	return lockDataDir()
+}
+
+/**
+Replaces the content of a file with a write into a temporary file next to it that is renamed over it, so a crash leaves
+either the old or the new file, never a partially written one.
+*/
+func replaceFile(fileName string, content []uint8) Error {
+	tmp := fmt.Sprintf("%s.tmp", fileName)
+
+	f, err := createFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+
+	if err != nil {
+		return err
+	}
+
+	if _, e := f.Write(content); e != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to write file %s: %s", tmp, e.Error()))
+	}
+
+	if e := f.Sync(); e != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to sync file %s: %s", tmp, e.Error()))
+	}
+
+	if err := closeFile(f); err != nil {
+		return err
+	}
+
+	if e := os.Rename(tmp, fileName); e != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to replace file %s: %s", fileName, e.Error()))
+	}
+
+	return nil
 }
 
 func roseBlockFile(block uint16, dbDir string) string {
 	return fmt.Sprintf("%s/block_%d.rose", dbDir, block)
 }
 
+// Returns the IDs of all blocks in a collection directory, sorted in ascending order
+func listBlocks(collDir string) ([]uint16, Error) {
+	files, err := ioutil.ReadDir(collDir)
+
+	if err != nil {
+		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Could not read %s directory. This is probably a permissions problem with underlying message: %s", collDir, err.Error()))
+	}
+
+	blocks := make([]uint16, 0)
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		blockId, ok := blockIdFromFileName(f.Name())
+
+		if !ok {
+			continue
+		}
+
+		blocks = append(blocks, blockId)
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i] < blocks[j]
+	})
+
+	return blocks, nil
+}
+
+// returns the ID of a block from its file name. Only exact block_{id}.rose names are blocks
+func blockIdFromFileName(name string) (uint16, bool) {
+	var blockId uint16
+
+	if _, err := fmt.Sscanf(name, "block_%d.rose", &blockId); err != nil || name != fmt.Sprintf("block_%d.rose", blockId) {
+		return 0, false
+	}
+
+	return blockId, true
+}
+
 func roseIndexLocation() string {
 	return fmt.Sprintf("%s/%s", roseDir(), "/indexes.rose")
 }
\ No newline at end of file
@@ -1,10 +1,12 @@
 package rose
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 )
 
 type indexDataType string
@@ -13,11 +15,38 @@ const stringIndexType indexDataType = "string"
 const intIndexType indexDataType = "int"
 const floatIndexType indexDataType = "float"
 const boolIndexType indexDataType = "bool"
+const dateIndexType indexDataType = "date"
+const dateTimeIndexType indexDataType = "date_time"
+// full-text index on a string field, used by the matches operator in queries
+const textIndexType indexDataType = "text"
+// geohash grid over a {"lat": .., "lng": ..} field, used by the near and within operators in queries
+const geoIndexType indexDataType = "geo"
+
+// IndexOptions are optional index properties. An index without any options is persisted without them so
+// that indexes.rose stays readable by older versions of Rose
+type IndexOptions struct {
+	Unique bool `json:"unique,omitempty"`
+	// documents that do not have every field of a sparse index are not indexed instead of being rejected
+	Sparse bool `json:"sparse,omitempty"`
+	// only documents that match this query are indexed (partial index), e.i. "archived:bool == false".
+	// FilterParams are the #params of the filter, the same as in NewQueryBuilder().If()
+	Filter string `json:"filter,omitempty"`
+	FilterParams map[string]interface{} `json:"filterParams,omitempty"`
+	// documents expire ExpireAfter seconds after the date of the indexed field (TTL index). With ExpireAfter 0,
+	// the field holds the expiry of the document itself. Expired documents are hidden and deleted by the reaper
+	TTL bool `json:"ttl,omitempty"`
+	ExpireAfter int64 `json:"expireAfter,omitempty"`
+}
+
+func (o IndexOptions) isEmpty() bool {
+	return !o.Unique && !o.Sparse && o.Filter == "" && !o.TTL && o.ExpireAfter == 0
+}
 
 type fsIndex struct {
 	Name string
 	Field string
 	DataType indexDataType
+	Options IndexOptions
 	processable boolean
 }
 
@@ -26,12 +55,90 @@ func (fsi fsIndex) validate() Error {
 		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Index field name cannot be an empty string"))
 	}
 
+	names := strings.Split(fsi.Field, ",")
+	types := strings.Split(string(fsi.DataType), ",")
+
+	if len(names) != len(types) {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Index %s has %d fields but %d data types", fsi.Field, len(names), len(types)))
+	}
+
+	for _, name := range names {
+		if name == "" {
+			return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Index field name cannot be an empty string"))
+		}
+	}
+
+	for _, t := range types {
+		if indexDataType(t) == textIndexType && (len(types) > 1 || fsi.Options.Unique) {
+			return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Text index %s cannot be unique or part of a compound index", fsi.Field))
+		}
+
+		if indexDataType(t) == geoIndexType && (len(types) > 1 || fsi.Options.Unique) {
+			return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Geo index %s cannot be unique or part of a compound index", fsi.Field))
+		}
+	}
+
+	if fsi.Options.TTL && len(types) > 1 {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. TTL index %s cannot be a compound index", fsi.Field))
+	}
+
+	if fsi.Options.TTL && indexDataType(types[0]) != dateIndexType && indexDataType(types[0]) != dateTimeIndexType {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. TTL index %s must be a date or date_time index", fsi.Field))
+	}
+
+	if fsi.Options.ExpireAfter < 0 {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. ExpireAfter of index %s cannot be negative", fsi.Field))
+	}
+
+	if fsi.Options.ExpireAfter != 0 && !fsi.Options.TTL {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. ExpireAfter of index %s is only valid for a TTL index", fsi.Field))
+	}
+
+	if fsi.Options.Filter != "" {
+		if _, err := validateQuery(fsi.Options.Filter, fsi.Options.FilterParams); err != nil {
+			return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Invalid partial index filter: %s", err.Error()))
+		}
+	}
+
 	return nil
 }
 
+// fields returns every field of the index. Compound indexes are saved with field names and data types
+// separated with a comma, in order of the index fields
+func (fsi fsIndex) fields() []IndexField {
+	names := strings.Split(fsi.Field, ",")
+	types := strings.Split(string(fsi.DataType), ",")
+
+	fields := make([]IndexField, 0, len(names))
+	for i, name := range names {
+		fields = append(fields, IndexField{
+			Name:     name,
+			DataType: indexDataType(types[i]),
+		})
+	}
+
+	return fields
+}
+
+func newFsIndex(collName string, fields []IndexField, options IndexOptions) fsIndex {
+	types := make([]string, 0, len(fields))
+
+	for _, f := range fields {
+		types = append(types, string(f.DataType))
+	}
+
+	return fsIndex{
+		Name:     collName,
+		Field:    indexName(fields),
+		DataType: indexDataType(strings.Join(types, ",")),
+		Options:  options,
+	}
+}
+
 type indexFsHandler struct {
 	file *os.File
 	indexes []*fsIndex
+	sync.Mutex
 }
 
 func newIndexHandler() (*indexFsHandler, Error) {
@@ -60,16 +167,26 @@ func newIndexHandler() (*indexFsHandler, Error) {
 }
 
 func (ih *indexFsHandler) Add(fsi fsIndex) Error {
+	ih.Lock()
+	defer ih.Unlock()
+
 	if err := fsi.validate(); err != nil {
 		return err
 	}
 
-	d := fmt.Sprintf("%s%s%s%s%s\n", fsi.Name, delim, fsi.Field, delim, fsi.DataType)
+	d, err := fsi.line()
 
-	if ok := ih.exists(fsi.Name, fsi.Field); !ok {
-		if _, err := ih.file.Write([]uint8(d)); err != nil {
-			return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("A system error occurred and Rose cannot be booted. Cannot create write index to filesystem: %s", err.Error()))
-		}
+	if err != nil {
+		return err
+	}
+
+	// an index is kept once, both in indexes.rose and in memory
+	if ih.exists(fsi.Name, fsi.Field) {
+		return nil
+	}
+
+	if _, err := ih.file.Write([]uint8(d)); err != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("A system error occurred and Rose cannot be booted. Cannot create write index to filesystem: %s", err.Error()))
 	}
 
 	ih.indexes = append(ih.indexes, &fsi)
@@ -77,9 +194,133 @@ func (ih *indexFsHandler) Add(fsi fsIndex) Error {
 	return nil
 }
 
+// Remove removes an index from indexes.rose
+func (ih *indexFsHandler) Remove(collName string, fieldName string) Error {
+	return ih.update(func(idx *fsIndex) *fsIndex {
+		if idx.Name == collName && idx.Field == fieldName {
+			return nil
+		}
+
+		return idx
+	})
+}
+
+// RemoveCollection removes every index of a collection from indexes.rose
+func (ih *indexFsHandler) RemoveCollection(collName string) Error {
+	return ih.update(func(idx *fsIndex) *fsIndex {
+		if idx.Name == collName {
+			return nil
+		}
+
+		return idx
+	})
+}
+
+// RenameCollection moves every index of a collection to its new name in indexes.rose
+func (ih *indexFsHandler) RenameCollection(collName string, newName string) Error {
+	return ih.update(func(idx *fsIndex) *fsIndex {
+		if idx.Name != collName {
+			return idx
+		}
+
+		renamed := *idx
+		renamed.Name = newName
+
+		return &renamed
+	})
+}
+
+/**
+Passes every index to fn and saves the indexes that it returns, in order. If fn returns nil, the index is removed.
+indexes.rose is rewritten into a temporary file that replaces it with a rename, so a crash leaves either the old or
+the new file, never a partially written one.
+*/
+func (ih *indexFsHandler) update(fn func(idx *fsIndex) *fsIndex) Error {
+	ih.Lock()
+	defer ih.Unlock()
+
+	remaining := make([]*fsIndex, 0, len(ih.indexes))
+	content := ""
+
+	for _, idx := range ih.indexes {
+		idx = fn(idx)
+
+		if idx == nil {
+			continue
+		}
+
+		line, err := idx.line()
+
+		if err != nil {
+			return err
+		}
+
+		content += line
+
+		remaining = append(remaining, idx)
+	}
+
+	if err := ih.rewrite(content); err != nil {
+		return err
+	}
+
+	ih.indexes = remaining
+
+	return nil
+}
+
+func (ih *indexFsHandler) rewrite(content string) Error {
+	location := roseIndexLocation()
+
+	if err := replaceFile(location, []uint8(content)); err != nil {
+		return err
+	}
+
+	// the old handle points to the file that was replaced
+	if e := ih.file.Close(); e != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to close index file: %s", e.Error()))
+	}
+
+	file, err := createFile(location, os.O_RDWR|os.O_APPEND)
+
+	if err != nil {
+		return err
+	}
+
+	ih.file = file
+
+	return nil
+}
+
+// CollectionContent returns the lines of indexes.rose that belong to a collection
+func (ih *indexFsHandler) CollectionContent(collName string) (string, Error) {
+	ih.Lock()
+	defer ih.Unlock()
+
+	content := ""
+	for _, idx := range ih.indexes {
+		if idx.Name != collName {
+			continue
+		}
+
+		line, err := idx.line()
+
+		if err != nil {
+			return "", err
+		}
+
+		content += line
+	}
+
+	return content, nil
+}
+
 // this function is only to be used at boot, it loads all indexes into memory for ease of use, it must not be used
 // in other operations
 func (ih *indexFsHandler) Find(collName string) ([]*fsIndex, Error) {
+	ih.Lock()
+	defer ih.Unlock()
+
 	if len(ih.indexes) == 0 {
 		return nil, nil
 	}
@@ -121,7 +362,7 @@ func (ih *indexFsHandler) init(indexes []uint8) Error {
 		if a != "" {
 			t := strings.Split(a, delim)
 
-			if len(t) != 3 {
+			if len(t) != 3 && len(t) != 4 {
 				return newError(SystemMasterErrorCode, MalformedIndexCode, fmt.Sprintf("A system error occurred and Rose cannot be booted. Found malformed index value -> %s", a))
 			}
 
@@ -132,6 +373,17 @@ func (ih *indexFsHandler) init(indexes []uint8) Error {
 				processable: true,
 			}
 
+			if len(t) == 4 {
+				if err := json.Unmarshal([]uint8(t[3]), &fsi.Options); err != nil {
+					return newError(SystemMasterErrorCode, MalformedIndexCode, fmt.Sprintf("A system error occurred and Rose cannot be booted. Found malformed index options -> %s", a))
+				}
+			}
+
+			// older versions could write the same index more than once
+			if ih.exists(fsi.Name, fsi.Field) {
+				continue
+			}
+
 			ih.indexes = append(ih.indexes, &fsi)
 		}
 	}
@@ -149,4 +401,17 @@ func (ih *indexFsHandler) exists(collName string, fieldName string) bool {
 	return false
 }
 
+// line returns the representation of this index in indexes.rose
+func (fsi fsIndex) line() (string, Error) {
+	if fsi.Options.isEmpty() {
+		return fmt.Sprintf("%s%s%s%s%s\n", fsi.Name, delim, fsi.Field, delim, fsi.DataType), nil
+	}
+
+	opts, err := json.Marshal(fsi.Options)
 
+	if err != nil {
+		return "", newError(SystemMasterErrorCode, MalformedIndexCode, fmt.Sprintf("Unable to serialize index options: %s", err.Error()))
+	}
+
+	return fmt.Sprintf("%s%s%s%s%s%s%s\n", fsi.Name, delim, fsi.Field, delim, fsi.DataType, delim, string(opts)), nil
+}
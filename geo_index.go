@@ -0,0 +1,391 @@
+package rose
+
+import (
+	"fmt"
+	"github.com/valyala/fastjson"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// precision of the geohash cells that a geo index is made of. A cell of 5 characters is about 4.9km x 4.9km
+const geoHashPrecision = 5
+// if an area needs more cells than this, every entry of the index is checked instead
+const geoMaxCells = 4096
+const earthRadiusMeters = 6371000.0
+
+const geoHashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+type geoPoint struct {
+	Lat float64
+	Lng float64
+}
+
+// bounding box that is searched in a geo index
+type geoArea struct {
+	MinLat float64
+	MinLng float64
+	MaxLat float64
+	MaxLng float64
+}
+
+/**
+A geo index puts every point into a geohash cell. A search reads only the cells that cover the searched
+area and returns the documents in them, which are then checked against the exact area.
+*/
+type geoIndex struct {
+	// geohash -> document ID -> point
+	cells map[string]map[int]geoPoint
+}
+
+func newGeoIndex() *geoIndex {
+	return &geoIndex{
+		cells: make(map[string]map[int]geoPoint),
+	}
+}
+
+func (gi *geoIndex) add(id int, p geoPoint) {
+	hash := geoHash(p, geoHashPrecision)
+
+	if _, ok := gi.cells[hash]; !ok {
+		gi.cells[hash] = make(map[int]geoPoint)
+	}
+
+	gi.cells[hash][id] = p
+}
+
+func (gi *geoIndex) remove(id int, p geoPoint) {
+	hash := geoHash(p, geoHashPrecision)
+
+	delete(gi.cells[hash], id)
+
+	if len(gi.cells[hash]) == 0 {
+		delete(gi.cells, hash)
+	}
+}
+
+// candidates returns the IDs of documents whose points are inside the area, in ascending order
+func (gi *geoIndex) candidates(area geoArea) []int {
+	ids := make([]int, 0)
+
+	collect := func(cell map[int]geoPoint) {
+		for id, p := range cell {
+			if area.contains(p) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	hashes := geoHashesCovering(area, geoHashPrecision)
+
+	if hashes == nil {
+		for _, cell := range gi.cells {
+			collect(cell)
+		}
+	} else {
+		for _, hash := range hashes {
+			collect(gi.cells[hash])
+		}
+	}
+
+	sort.Ints(ids)
+
+	return ids
+}
+
+func (gi *geoIndex) memoryUsage() uint64 {
+	var size uint64
+
+	for hash, cell := range gi.cells {
+		// hash, map header and a document ID with its point for every document
+		size += uint64(len(hash)) + 48 + uint64(len(cell))*24
+	}
+
+	return size
+}
+
+func (a geoArea) contains(p geoPoint) bool {
+	return p.Lat >= a.MinLat && p.Lat <= a.MaxLat && p.Lng >= a.MinLng && p.Lng <= a.MaxLng
+}
+
+// geoHash encodes a point into a geohash of the given number of characters
+func geoHash(p geoPoint, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLng, maxLng := -180.0, 180.0
+
+	var sb strings.Builder
+	bit, ch := 0, 0
+	even := true
+
+	for sb.Len() < precision {
+		if even {
+			mid := (minLng + maxLng) / 2
+			if p.Lng >= mid {
+				ch |= 1 << uint(4-bit)
+				minLng = mid
+			} else {
+				maxLng = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if p.Lat >= mid {
+				ch |= 1 << uint(4-bit)
+				minLat = mid
+			} else {
+				maxLat = mid
+			}
+		}
+
+		even = !even
+
+		if bit < 4 {
+			bit++
+		} else {
+			sb.WriteByte(geoHashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+
+	return sb.String()
+}
+
+// geoHashesCovering returns every geohash cell that overlaps the area, or nil if there are more than geoMaxCells of them
+func geoHashesCovering(area geoArea, precision int) []string {
+	bits := precision * 5
+	lngBits := (bits + 1) / 2
+	latBits := bits / 2
+
+	latStep := 180 / math.Pow(2, float64(latBits))
+	lngStep := 360 / math.Pow(2, float64(lngBits))
+
+	latCells := math.Ceil((area.MaxLat-area.MinLat)/latStep) + 1
+	lngCells := math.Ceil((area.MaxLng-area.MinLng)/lngStep) + 1
+
+	if latCells*lngCells > geoMaxCells {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	hashes := make([]string, 0)
+
+	for i := 0; ; i++ {
+		lat := math.Min(area.MinLat+float64(i)*latStep, area.MaxLat)
+
+		for j := 0; ; j++ {
+			lng := math.Min(area.MinLng+float64(j)*lngStep, area.MaxLng)
+			hash := geoHash(geoPoint{Lat: lat, Lng: lng}, precision)
+
+			if !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+
+			if lng == area.MaxLng {
+				break
+			}
+		}
+
+		if lat == area.MaxLat {
+			break
+		}
+	}
+
+	return hashes
+}
+
+// geoDistance returns the distance between two points in meters
+func geoDistance(a geoPoint, b geoPoint) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := (b.Lat - a.Lat) * math.Pi / 180
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// circleArea returns the bounding box of a circle. Circles that reach a pole or cross the antimeridian cover every longitude
+func circleArea(center geoPoint, meters float64) geoArea {
+	dLat := meters / earthRadiusMeters * 180 / math.Pi
+
+	area := geoArea{
+		MinLat: math.Max(-90, center.Lat-dLat),
+		MaxLat: math.Min(90, center.Lat+dLat),
+		MinLng: -180,
+		MaxLng: 180,
+	}
+
+	if area.MinLat == -90 || area.MaxLat == 90 {
+		return area
+	}
+
+	dLng := dLat / math.Cos(center.Lat*math.Pi/180)
+
+	if center.Lng-dLng >= -180 && center.Lng+dLng <= 180 {
+		area.MinLng = center.Lng - dLng
+		area.MaxLng = center.Lng + dLng
+	}
+
+	return area
+}
+
+// geoPointFromValue reads a {"lat": .., "lng": ..} object. Both coordinates must be numbers within their ranges
+func geoPointFromValue(v *fastjson.Value) (geoPoint, bool) {
+	if v == nil || v.Type() != fastjson.TypeObject {
+		return geoPoint{}, false
+	}
+
+	lat := v.Get("lat")
+	lng := v.Get("lng")
+
+	if lat == nil || lng == nil || lat.Type() != fastjson.TypeNumber || lng.Type() != fastjson.TypeNumber {
+		return geoPoint{}, false
+	}
+
+	p := geoPoint{Lat: lat.GetFloat64(), Lng: lng.GetFloat64()}
+
+	if p.Lat < -90 || p.Lat > 90 || p.Lng < -180 || p.Lng > 180 {
+		return geoPoint{}, false
+	}
+
+	return p, true
+}
+
+/**
+Near returns the value of a near condition in a query. A document matches the condition if the point in its
+geo field is at most the given number of meters away from lat and lng, e.i.
+
+	qb.If("shops", "location:geo near #near", map[string]interface{}{"#near": rose.Near(45.81, 15.98, 2000)})
+*/
+func Near(lat float64, lng float64, meters float64) string {
+	return fmt.Sprintf("%s,%s,%s", formatGeoFloat(lat), formatGeoFloat(lng), formatGeoFloat(meters))
+}
+
+/**
+Within returns the value of a within condition in a query. A document matches the condition if the point in its
+geo field is inside the box, e.i.
+
+	qb.If("shops", "location:geo within #box", map[string]interface{}{"#box": rose.Within(45.7, 15.8, 45.9, 16.1)})
+*/
+func Within(minLat float64, minLng float64, maxLat float64, maxLng float64) string {
+	return fmt.Sprintf("%s,%s,%s,%s", formatGeoFloat(minLat), formatGeoFloat(minLng), formatGeoFloat(maxLat), formatGeoFloat(maxLng))
+}
+
+func formatGeoFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func parseGeoFloats(s string, n int) ([]float64, bool) {
+	parts := strings.Split(s, ",")
+
+	if len(parts) != n {
+		return nil, false
+	}
+
+	floats := make([]float64, 0, n)
+	for _, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+
+		if err != nil {
+			return nil, false
+		}
+
+		floats = append(floats, f)
+	}
+
+	return floats, true
+}
+
+// parseGeoNear parses the value of a near condition into its center and radius in meters
+func parseGeoNear(s string) (geoPoint, float64, bool) {
+	f, ok := parseGeoFloats(s, 3)
+
+	if !ok || f[0] < -90 || f[0] > 90 || f[1] < -180 || f[1] > 180 || f[2] < 0 {
+		return geoPoint{}, 0, false
+	}
+
+	return geoPoint{Lat: f[0], Lng: f[1]}, f[2], true
+}
+
+// parseGeoBox parses the value of a within condition
+func parseGeoBox(s string) (geoArea, bool) {
+	f, ok := parseGeoFloats(s, 4)
+
+	if !ok {
+		return geoArea{}, false
+	}
+
+	area := geoArea{MinLat: f[0], MinLng: f[1], MaxLat: f[2], MaxLng: f[3]}
+
+	if area.MinLat < -90 || area.MaxLat > 90 || area.MinLng < -180 || area.MaxLng > 180 || area.MinLat > area.MaxLat || area.MinLng > area.MaxLng {
+		return geoArea{}, false
+	}
+
+	return area, true
+}
+
+// conditionGeoArea returns the bounding box of a near or within condition
+func conditionGeoArea(cond *singleCondition) (geoArea, bool) {
+	s, ok := cond.value.(string)
+
+	if !ok {
+		return geoArea{}, false
+	}
+
+	if cond.comparisonType == geoNear {
+		center, meters, ok := parseGeoNear(s)
+
+		return circleArea(center, meters), ok
+	}
+
+	return parseGeoBox(s)
+}
+
+// matchesGeo returns true if a point satisfies a near or within condition
+func matchesGeo(p geoPoint, cond *singleCondition) bool {
+	s, ok := cond.value.(string)
+
+	if !ok {
+		return false
+	}
+
+	if cond.comparisonType == geoNear {
+		center, meters, ok := parseGeoNear(s)
+
+		return ok && geoDistance(center, p) <= meters
+	} else if cond.comparisonType == geoWithin {
+		area, ok := parseGeoBox(s)
+
+		return ok && area.contains(p)
+	}
+
+	return false
+}
+
+// sorts the results of a query with a near condition by the distance from its center, closest first
+func sortByDistance(results []QueryResult, cond *singleCondition) {
+	center, _, _ := parseGeoNear(cond.value.(string))
+	var p fastjson.Parser
+
+	for i := range results {
+		v, err := p.ParseBytes(results[i].Data)
+
+		if err != nil {
+			continue
+		}
+
+		if point, ok := geoPointFromValue(v.Get(cond.field)); ok {
+			results[i].Distance = geoDistance(center, point)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Distance != results[j].Distance {
+			return results[i].Distance < results[j].Distance
+		}
+
+		return results[i].ID < results[j].ID
+	})
+}
@@ -0,0 +1,218 @@
+package rose
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/**
+HookEvent is the document that an operation changes, as given to the hooks of a collection. Write hooks run for
+inserts and replaces, delete hooks for deletes. Before hooks can change New, the document that is written is the
+one that the last before hook leaves.
+*/
+type HookEvent struct {
+	Collection string
+	Type ChangeType
+	// zero in before hooks of inserts, the ID is assigned when the document is written
+	ID int
+	// the document before the operation, nil for inserts
+	Old json.RawMessage
+	// the document after the operation, nil for deletes
+	New json.RawMessage
+}
+
+/**
+Hook runs inside Write, BulkWrite, Replace and Delete. An error of a before hook aborts the operation before anything
+is written and is returned by it. An error that is not a rose Error is returned with HookAbortedCode.
+
+Before hooks run while the collection is locked, so Old is the document that the operation replaces or deletes and
+no other write of the collection happens in between. They must not call Rose, use after hooks for that.
+
+After hooks run once the operation is done and outside of the locks of Rose, so they can read and write other
+collections. A write hook that writes to its own collection runs its hooks again. An error of an after hook does not
+fail the operation since the document is already written or deleted, the after hooks that follow it do not run and
+its message is returned in the HookError of the result.
+
+Import does not run hooks.
+*/
+type Hook func(e *HookEvent) error
+
+type hookKind int
+
+const (
+	beforeWriteHook hookKind = iota
+	afterWriteHook
+	beforeDeleteHook
+	afterDeleteHook
+)
+
+// hooks of every collection by collection name. Hooks stay registered when their collection is dropped or renamed
+type hookRegistry struct {
+	hooks map[string]map[hookKind][]Hook
+	sync.RWMutex
+}
+
+// runs before an insert or a replace of a document in a collection, in the order hooks were registered
+func (a *Rose) OnBeforeWrite(collName string, hook Hook) {
+	a.hooks.add(collName, beforeWriteHook, hook)
+}
+
+// runs after a document is inserted or replaced in a collection
+func (a *Rose) OnAfterWrite(collName string, hook Hook) {
+	a.hooks.add(collName, afterWriteHook, hook)
+}
+
+// runs before a document that exists is deleted from a collection
+func (a *Rose) OnBeforeDelete(collName string, hook Hook) {
+	a.hooks.add(collName, beforeDeleteHook, hook)
+}
+
+// runs after a document is deleted from a collection
+func (a *Rose) OnAfterDelete(collName string, hook Hook) {
+	a.hooks.add(collName, afterDeleteHook, hook)
+}
+
+// removes every hook of a collection
+func (a *Rose) RemoveHooks(collName string) {
+	a.hooks.Lock()
+	defer a.hooks.Unlock()
+
+	delete(a.hooks.hooks, collName)
+}
+
+func (h *hookRegistry) add(collName string, kind hookKind, hook Hook) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.hooks == nil {
+		h.hooks = make(map[string]map[hookKind][]Hook)
+	}
+
+	if h.hooks[collName] == nil {
+		h.hooks[collName] = make(map[hookKind][]Hook)
+	}
+
+	h.hooks[collName][kind] = append(h.hooks[collName][kind], hook)
+}
+
+// returns a copy so that hooks can be registered while others run
+func (h *hookRegistry) get(collName string, kinds ...hookKind) []Hook {
+	h.RLock()
+	defer h.RUnlock()
+
+	hooks := make([]Hook, 0)
+	for _, kind := range kinds {
+		hooks = append(hooks, h.hooks[collName][kind]...)
+	}
+
+	return hooks
+}
+
+func (h *hookRegistry) has(collName string, kinds ...hookKind) bool {
+	return len(h.get(collName, kinds...)) > 0
+}
+
+func (h *hookRegistry) run(kind hookKind, e *HookEvent) Error {
+	for _, hook := range h.get(e.Collection, kind) {
+		if err := hook(e); err != nil {
+			return hookError(e, err)
+		}
+	}
+
+	return nil
+}
+
+/**
+Runs the before hooks of an operation on a single document under the lock of its collection. It is only called for a
+document that exists when the document is replaced or deleted. old is the document that is replaced or deleted and
+data is the document that is written; the document that the before hooks leave is returned.
+*/
+type lockedHooks func(old json.RawMessage, data interface{}) (interface{}, Error)
+
+// sets Old and New of e and runs the before write hooks
+func (h *hookRegistry) beforeWrite(e *HookEvent) lockedHooks {
+	return func(old json.RawMessage, data interface{}) (interface{}, Error) {
+		e.Old = old
+		e.New = json.RawMessage(data.(string))
+
+		return h.runBeforeWrite(e)
+	}
+}
+
+// sets Old of e and runs the before delete hooks
+func (h *hookRegistry) beforeDelete(e *HookEvent) lockedHooks {
+	return func(old json.RawMessage, data interface{}) (interface{}, Error) {
+		e.Old = old
+
+		return nil, h.run(beforeDeleteHook, e)
+	}
+}
+
+// runs the after hooks of an operation that is done. Their error does not fail it, its message is returned instead
+func (h *hookRegistry) runAfter(kind hookKind, e *HookEvent) string {
+	if err := h.run(kind, e); err != nil {
+		return err.Error()
+	}
+
+	return ""
+}
+
+// runs the before write hooks and validates the document that they leave
+func (h *hookRegistry) runBeforeWrite(e *HookEvent) (string, Error) {
+	if err := h.run(beforeWriteHook, e); err != nil {
+		return "", err
+	}
+
+	data := string(e.New)
+
+	if err := validateData(data); err != nil {
+		return "", err
+	}
+
+	if !json.Valid(e.New) {
+		return "", newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Write to collection %s aborted. A hook changed the document into invalid JSON", e.Collection))
+	}
+
+	return data, nil
+}
+
+func hookError(e *HookEvent, err error) Error {
+	if roseErr, ok := err.(Error); ok {
+		return roseErr
+	}
+
+	return newError(ValidationMasterErrorCode, HookAbortedCode, fmt.Sprintf("Operation on document with ID %d of collection %s aborted by a hook: %s", e.ID, e.Collection, err.Error()))
+}
+
+// reads the JSON of a document as it is stored, for the hooks of replaces and deletes. The caller must hold the lock
+func (d *db) readRawWithoutLock(id int) (json.RawMessage, Error) {
+	b, err := d.ReadDriver.ReadStrategic(d.PrimaryIndex[id], d.getBlockId(id))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the index points at an empty or torn line
+	if b == nil {
+		return nil, newError(DbIntegrityMasterErrorCode, DocumentNotFoundCode, fmt.Sprintf("Document with ID %d of collection %s cannot be read from its block for its hooks. Verify the collection to find the problem", id, d.Name))
+	}
+
+	return append(json.RawMessage{}, bytes.TrimRight(b.val, "\n")...), nil
+}
+
+// IDs of a BulkWrite result in the order of the written documents
+func writtenIds(written string) []int {
+	ids := make([]int, 0)
+
+	for _, s := range strings.Split(written, ",") {
+		if id, e := strconv.Atoi(s); e == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
@@ -0,0 +1,213 @@
+package rose
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var _ = GinkgoDescribe("Hook tests", func() {
+	GinkgoIt("Should run write and delete hooks with the old and new document", func() {
+		dir, e := ioutil.TempDir("", "rose_hooks")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dir)
+
+		defer func() {
+			SetDataDir("")
+			_ = os.RemoveAll(dir)
+		}()
+
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "hooks_coll")
+		counters := testCreateCollection(a, "hooks_counters")
+
+		counter := testSingleConcurrentInsert(WriteMetadata{CollectionName: counters, Data: `{"count":0}`}, a)
+
+		// updates the document with the number of users in another collection
+		count := func(diff int) error {
+			c := map[string]int{}
+			if _, err := a.Read(ReadMetadata{CollectionName: counters, ID: counter.ID, Data: &c}); err != nil {
+				return err
+			}
+
+			_, err := a.Replace(ReplaceMetadata{CollectionName: counters, ID: counter.ID, Data: fmt.Sprintf(`{"count":%d}`, c["count"] + diff)})
+
+			return err
+		}
+
+		events := make([]HookEvent, 0)
+
+		a.OnBeforeWrite(collName, func(e *HookEvent) error {
+			doc := map[string]interface{}{}
+			if err := json.Unmarshal(e.New, &doc); err != nil {
+				return err
+			}
+
+			if doc["email"] == "" {
+				return errors.New("email is required")
+			}
+
+			doc["updatedAt"] = "2021-01-01"
+			e.New, _ = json.Marshal(doc)
+
+			return nil
+		})
+
+		a.OnAfterWrite(collName, func(e *HookEvent) error {
+			events = append(events, *e)
+
+			if e.Type == InsertChange {
+				return count(1)
+			}
+
+			return nil
+		})
+
+		a.OnBeforeDelete(collName, func(e *HookEvent) error {
+			if strings.Contains(string(e.Old), `"email":"admin@gmail.com"`) {
+				return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, "Admin cannot be deleted")
+			}
+
+			return nil
+		})
+
+		a.OnAfterDelete(collName, func(e *HookEvent) error {
+			events = append(events, *e)
+
+			return count(-1)
+		})
+
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "admin@gmail.com"})}, a)
+
+		_, err := a.BulkWrite(BulkWriteMetadata{CollectionName: collName, Data: []interface{}{
+			testAsJsonInterface(TestUser{Email: "first@gmail.com"}),
+			testAsJsonInterface(TestUser{Email: "second@gmail.com"}),
+		}})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		user := TestUser{}
+		testSingleRead(ReadMetadata{CollectionName: collName, ID: 2, Data: &user}, a)
+		gomega.Expect(user.Email).To(gomega.Equal("first@gmail.com"))
+		gomega.Expect(user.UpdatedAt).To(gomega.Equal("2021-01-01"))
+
+		gomega.Expect(len(events)).To(gomega.Equal(3))
+		gomega.Expect(events[2].ID).To(gomega.Equal(3))
+		gomega.Expect(events[2].Old).To(gomega.BeNil())
+		gomega.Expect(string(events[2].New)).To(gomega.ContainSubstring("second@gmail.com"))
+
+		// a rejected write writes nothing, not even the documents of a bulk write that were accepted
+		_, err = a.Write(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{})})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetMasterCode()).To(gomega.Equal(ValidationMasterErrorCode))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(HookAbortedCode))
+		gomega.Expect(err.Error()).To(gomega.Equal("Operation on document with ID 0 of collection hooks_coll aborted by a hook: email is required"))
+
+		_, err = a.BulkWrite(BulkWriteMetadata{CollectionName: collName, Data: []interface{}{
+			testAsJsonInterface(TestUser{Email: "third@gmail.com"}),
+			testAsJsonInterface(TestUser{}),
+		}})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(HookAbortedCode))
+
+		_, err = a.Replace(ReplaceMetadata{CollectionName: collName, ID: 2, Data: testAsJsonInterface(TestUser{})})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(HookAbortedCode))
+
+		gomega.Expect(len(a.Databases[collName].PrimaryIndex)).To(gomega.Equal(3))
+
+		testSingleReplace(ReplaceMetadata{CollectionName: collName, ID: 2, Data: testAsJsonInterface(TestUser{Email: "replaced@gmail.com"})}, a)
+
+		replaced := events[len(events) - 1]
+		gomega.Expect(replaced.Type).To(gomega.Equal(ReplaceChange))
+		gomega.Expect(replaced.ID).To(gomega.Equal(2))
+		gomega.Expect(string(replaced.Old)).To(gomega.ContainSubstring("first@gmail.com"))
+		gomega.Expect(string(replaced.New)).To(gomega.ContainSubstring("replaced@gmail.com"))
+
+		res, err := a.Delete(DeleteMetadata{CollectionName: collName, ID: 1})
+		gomega.Expect(res).To(gomega.BeNil())
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(InvalidUserSuppliedDataCode))
+		gomega.Expect(err.Error()).To(gomega.Equal("Admin cannot be deleted"))
+
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 3}, a)
+
+		deleted := events[len(events) - 1]
+		gomega.Expect(deleted.Type).To(gomega.Equal(DeleteChange))
+		gomega.Expect(deleted.ID).To(gomega.Equal(3))
+		gomega.Expect(string(deleted.Old)).To(gomega.ContainSubstring("second@gmail.com"))
+		gomega.Expect(deleted.New).To(gomega.BeNil())
+
+		// hooks do not run for documents that do not exist
+		n := len(events)
+		res, err = a.Delete(DeleteMetadata{CollectionName: collName, ID: 3})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(res.Status).To(gomega.Equal(NotFoundResultStatus))
+		gomega.Expect(len(events)).To(gomega.Equal(n))
+
+		c := map[string]int{}
+		testSingleRead(ReadMetadata{CollectionName: counters, ID: counter.ID, Data: &c}, a)
+		gomega.Expect(c["count"]).To(gomega.Equal(2))
+
+		a.RemoveHooks(collName)
+		a.OnBeforeWrite(collName, func(e *HookEvent) error {
+			e.New = json.RawMessage("not json")
+
+			return nil
+		})
+
+		_, err = a.Write(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{})})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(InvalidUserSuppliedDataCode))
+
+		// a document whose line cannot be read is not given to hooks
+		d := a.Databases[collName]
+		d.Lock()
+		offset := d.PrimaryIndex[2]
+		d.PrimaryIndex[2] = 1 << 20
+		d.Unlock()
+
+		_, err = a.Replace(ReplaceMetadata{CollectionName: collName, ID: 2, Data: testAsJsonInterface(TestUser{Email: "torn@gmail.com"})})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(DocumentNotFoundCode))
+
+		d.Lock()
+		d.PrimaryIndex[2] = offset
+		d.Unlock()
+
+		// an error of an after hook does not fail a write that is done
+		a.RemoveHooks(collName)
+		a.OnAfterWrite(collName, func(e *HookEvent) error {
+			return errors.New("counter is not available")
+		})
+
+		written, err := a.Write(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "after@gmail.com"})})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(written.Status).To(gomega.Equal(OkResultStatus))
+		gomega.Expect(written.HookError).To(gomega.Equal(fmt.Sprintf("Operation on document with ID %d of collection hooks_coll aborted by a hook: counter is not available", written.ID)))
+		testSingleRead(ReadMetadata{CollectionName: collName, ID: written.ID, Data: &user}, a)
+
+		bulk, err := a.BulkWrite(BulkWriteMetadata{CollectionName: collName, Data: []interface{}{testAsJsonInterface(TestUser{Email: "bulk@gmail.com"})}})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(bulk.HookError).To(gomega.ContainSubstring("counter is not available"))
+
+		// after hooks do not run for a replace of a document that does not exist
+		replacedMissing, err := a.Replace(ReplaceMetadata{CollectionName: collName, ID: 1000, Data: testAsJsonInterface(TestUser{Email: "missing@gmail.com"})})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(replacedMissing.HookError).To(gomega.BeEmpty())
+
+		a.RemoveHooks(collName)
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{})}, a)
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 1}, a)
+		gomega.Expect(len(events)).To(gomega.Equal(n))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+	})
+})
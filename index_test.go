@@ -6,6 +6,7 @@ import (
 	"github.com/onsi/gomega"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
 var _ = GinkgoDescribe("Index tests", func() {
@@ -286,5 +287,938 @@ var _ = GinkgoDescribe("Index tests", func() {
 
 		testRemoveFileSystemDb(roseDir())
 	})
-})
 
+	GinkgoIt("Should reject writes that duplicate a value of a unique index", func() {
+		a := testCreateRose(false)
+
+		collName := testCreateCollection(a, "coll")
+
+		err := a.NewIndex(collName, "email", stringIndexType, IndexOptions{Unique: true})
+
+		gomega.Expect(err).To(gomega.BeNil())
+
+		res := testSingleConcurrentInsert(WriteMetadata{
+			CollectionName: collName,
+			Data:           testAsJsonInterface(TestUser{Type: "user", Email: "mario@gmail.com"}),
+		}, a)
+
+		gomega.Expect(res.Status).To(gomega.Equal(OkResultStatus))
+
+		_, err = a.Write(WriteMetadata{
+			CollectionName: collName,
+			Data:           testAsJsonInterface(TestUser{Type: "company", Email: "mario@gmail.com"}),
+		})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetMasterCode()).To(gomega.Equal(ValidationMasterErrorCode))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(DuplicateKeyCode))
+		gomega.Expect(err.Error()).To(gomega.Equal(fmt.Sprintf("Duplicate key error. Unique index 'email' already holds value 'mario@gmail.com' in document with ID %d", res.ID)))
+
+		deleted := testSingleDelete(DeleteMetadata{CollectionName: collName, ID: res.ID}, a)
+
+		gomega.Expect(deleted.Status).To(gomega.Equal(DeletedResultStatus))
+
+		res = testSingleConcurrentInsert(WriteMetadata{
+			CollectionName: collName,
+			Data:           testAsJsonInterface(TestUser{Type: "company", Email: "mario@gmail.com"}),
+		}, a)
+
+		gomega.Expect(res.Status).To(gomega.Equal(OkResultStatus))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should reject bulk writes and replaces that duplicate a value of a unique index", func() {
+		a := testCreateRose(false)
+
+		collName := testCreateCollection(a, "coll")
+
+		err := a.NewIndex(collName, "email", stringIndexType, IndexOptions{Unique: true})
+
+		gomega.Expect(err).To(gomega.BeNil())
+
+		_, err = a.BulkWrite(BulkWriteMetadata{
+			CollectionName: collName,
+			Data: []interface{}{
+				testAsJsonInterface(TestUser{Email: "mario@gmail.com"}),
+				testAsJsonInterface(TestUser{Email: "mile@gmail.com"}),
+			},
+		})
+
+		gomega.Expect(err).To(gomega.BeNil())
+
+		_, err = a.BulkWrite(BulkWriteMetadata{
+			CollectionName: collName,
+			Data: []interface{}{
+				testAsJsonInterface(TestUser{Email: "zdravko@gmail.com"}),
+				testAsJsonInterface(TestUser{Email: "zdravko@gmail.com"}),
+			},
+		})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(DuplicateKeyCode))
+
+		_, err = a.BulkWrite(BulkWriteMetadata{
+			CollectionName: collName,
+			Data: []interface{}{
+				testAsJsonInterface(TestUser{Email: "zdravko@gmail.com"}),
+				testAsJsonInterface(TestUser{Email: "mile@gmail.com"}),
+			},
+		})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(DuplicateKeyCode))
+
+		// nothing from the failed bulk writes is written
+		gomega.Expect(len(a.Databases[collName].PrimaryIndex)).To(gomega.Equal(2))
+
+		_, err = a.Replace(ReplaceMetadata{
+			CollectionName: collName,
+			ID:             1,
+			Data:           testAsJsonInterface(TestUser{Email: "mile@gmail.com"}),
+		})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(DuplicateKeyCode))
+
+		res := testSingleReplace(ReplaceMetadata{
+			CollectionName: collName,
+			ID:             1,
+			Data:           testAsJsonInterface(TestUser{Type: "user", Email: "mario@gmail.com"}),
+		}, a)
+
+		gomega.Expect(res.Status).To(gomega.Equal(ReplacedResultStatus))
+
+		res = testSingleReplace(ReplaceMetadata{
+			CollectionName: collName,
+			ID:             1,
+			Data:           testAsJsonInterface(TestUser{Type: "user", Email: "zdravko@gmail.com"}),
+		}, a)
+
+		gomega.Expect(res.Status).To(gomega.Equal(ReplacedResultStatus))
+
+		res = testSingleConcurrentInsert(WriteMetadata{
+			CollectionName: collName,
+			Data:           testAsJsonInterface(TestUser{Email: "mario@gmail.com"}),
+		}, a)
+
+		gomega.Expect(res.Status).To(gomega.Equal(OkResultStatus))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should fail to create a unique index if existing documents hold duplicate values", func() {
+		a := testCreateRose(false)
+
+		collName := testCreateCollection(a, "coll")
+
+		emails := []string{"mario@gmail.com", "mile@gmail.com", "mario@gmail.com", "zdravko@gmail.com", "mile@gmail.com"}
+
+		for _, email := range emails {
+			testSingleConcurrentInsert(WriteMetadata{
+				CollectionName: collName,
+				Data:           testAsJsonInterface(TestUser{Email: email}),
+			}, a)
+		}
+
+		err := a.NewIndex(collName, "email", stringIndexType, IndexOptions{Unique: true})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(DuplicateKeyCode))
+		gomega.Expect(err.Error()).To(gomega.Equal("Unable to create unique index on field 'email'. Existing documents hold duplicate values: 'mario@gmail.com' (IDs 1, 3); 'mile@gmail.com' (IDs 2, 5)"))
+
+		_, ok := a.Databases[collName].FieldIndex["email"]
+
+		gomega.Expect(ok).To(gomega.BeFalse())
+
+		b, e := ioutil.ReadFile(roseIndexLocation())
+
+		gomega.Expect(e).To(gomega.BeNil())
+		gomega.Expect(string(b)).To(gomega.Equal(""))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should keep enforcing a unique index after restart", func() {
+		a := testCreateRose(false)
+
+		collName := testCreateCollection(a, "coll")
+
+		err := a.NewIndex(collName, "email", stringIndexType, IndexOptions{Unique: true})
+
+		gomega.Expect(err).To(gomega.BeNil())
+
+		testSingleConcurrentInsert(WriteMetadata{
+			CollectionName: collName,
+			Data:           testAsJsonInterface(TestUser{Email: "mario@gmail.com"}),
+		}, a)
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		a = testCreateRose(false)
+
+		gomega.Expect(a.Databases[collName].FieldIndex["email"].Unique).To(gomega.BeTrue())
+
+		_, err = a.Write(WriteMetadata{
+			CollectionName: collName,
+			Data:           testAsJsonInterface(TestUser{Email: "mario@gmail.com"}),
+		})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(DuplicateKeyCode))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should create a compound index and readBy any prefix of it, also after restart", func() {
+		a := testCreateRose(false)
+
+		collName := testCreateCollection(a, "coll")
+
+		err := a.NewCompoundIndex(collName, []IndexField{
+			{Name: "tenantId", DataType: stringIndexType},
+			{Name: "status", DataType: stringIndexType},
+		})
+
+		gomega.Expect(err).To(gomega.BeNil())
+
+		b, e := ioutil.ReadFile(roseIndexLocation())
+
+		gomega.Expect(e).To(gomega.BeNil())
+		gomega.Expect(string(b)).To(gomega.Equal(fmt.Sprintf("%s%s%s%s%s\n", collName, delim, "tenantId,status", delim, "string,string")))
+
+		n := 300
+		statuses := []string{"open", "closed", "pending"}
+
+		for i := 0; i < n; i++ {
+			testSingleConcurrentInsert(WriteMetadata{
+				CollectionName: collName,
+				Data: testAsJsonInterface(map[string]interface{}{
+					"tenantId": fmt.Sprintf("tenant_%d", i % 2),
+					"status":   statuses[i % 3],
+					"num":      i,
+				}),
+			}, a)
+		}
+
+		for restart := 0; restart < 2; restart++ {
+			res, err := a.ReadBy(ReadByMetadata{
+				CollectionName: collName,
+				Field:          "tenantId",
+				Value:          "tenant_1",
+				DataType:       stringIndexType,
+				Pagination:     Pagination{Page: 1, Limit: n},
+			})
+
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(len(res.Data)).To(gomega.Equal(n / 2))
+
+			res, err = a.ReadBy(ReadByMetadata{
+				CollectionName: collName,
+				Field:          "tenantId",
+				Value:          "tenant_1",
+				DataType:       stringIndexType,
+				Fields:         []ReadByField{{Field: "status", Value: "closed", DataType: stringIndexType}},
+				Pagination:     Pagination{Page: 1, Limit: n},
+			})
+
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(len(res.Data)).To(gomega.Equal(n / 6))
+
+			for _, d := range res.Data {
+				doc := d.Data.(map[string]interface{})
+
+				gomega.Expect(doc["tenantId"]).To(gomega.Equal("tenant_1"))
+				gomega.Expect(doc["status"]).To(gomega.Equal("closed"))
+			}
+
+			if err := a.Shutdown(); err != nil {
+				ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+				return
+			}
+
+			a = testCreateRose(false)
+
+			idx, ok := a.Databases[collName].FieldIndex["tenantId,status"]
+
+			gomega.Expect(ok).To(gomega.BeTrue())
+			gomega.Expect(len(idx.Fields)).To(gomega.Equal(2))
+			gomega.Expect(len(idx.Index)).To(gomega.Equal(n))
+		}
+
+		_, err = a.ReadBy(ReadByMetadata{
+			CollectionName: collName,
+			Field:          "status",
+			Value:          "closed",
+			DataType:       stringIndexType,
+		})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Validation error. Invalid readBy method. There is no index that starts with fields status"))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should skip documents without the field of a sparse index", func() {
+		a := testCreateRose(false)
+
+		collName := testCreateCollection(a, "coll")
+
+		err := a.NewIndex(collName, "nickname", stringIndexType, IndexOptions{Sparse: true, Unique: true})
+
+		gomega.Expect(err).To(gomega.BeNil())
+
+		for i := 0; i < 10; i++ {
+			doc := map[string]interface{}{"num": i}
+
+			if i % 2 == 0 {
+				doc["nickname"] = fmt.Sprintf("nick_%d", i)
+			}
+
+			res := testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(doc)}, a)
+
+			gomega.Expect(res.Status).To(gomega.Equal(OkResultStatus))
+		}
+
+		gomega.Expect(len(a.Databases[collName].FieldIndex["nickname"].Index)).To(gomega.Equal(5))
+
+		res, err := a.ReadBy(ReadByMetadata{
+			CollectionName: collName,
+			Field:          "nickname",
+			Value:          "nick_4",
+			DataType:       stringIndexType,
+		})
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(res.Data)).To(gomega.Equal(1))
+		gomega.Expect(res.Data[0].ID).To(gomega.Equal(5))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should index only documents that match the filter of a partial index", func() {
+		a := testCreateRose(false)
+
+		collName := testCreateCollection(a, "coll")
+
+		options := IndexOptions{Filter: "archived:bool == #archived", FilterParams: map[string]interface{}{"#archived": "false"}}
+		err := a.NewIndex(collName, "status", stringIndexType, options)
+
+		gomega.Expect(err).To(gomega.BeNil())
+
+		_, err = a.Write(WriteMetadata{
+			CollectionName: collName,
+			Data:           testAsJsonInterface(map[string]interface{}{"archived": false}),
+		})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+
+		for i := 0; i < 20; i++ {
+			doc := map[string]interface{}{"archived": i % 2 == 0}
+
+			if i % 4 != 0 {
+				doc["status"] = "open"
+			}
+
+			res := testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(doc)}, a)
+
+			gomega.Expect(res.Status).To(gomega.Equal(OkResultStatus))
+		}
+
+		gomega.Expect(len(a.Databases[collName].FieldIndex["status"].Index)).To(gomega.Equal(10))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		a = testCreateRose(false)
+
+		m := a.Databases[collName]
+
+		gomega.Expect(len(m.FieldIndex["status"].Index)).To(gomega.Equal(10))
+
+		qb := NewQueryBuilder()
+		err = qb.If(collName, "status:string == open && archived:bool == #archived", map[string]interface{}{"#archived": "false"})
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(m.planQuery(qb.query).IndexName).To(gomega.Equal("status"))
+
+		results, err := a.Query(qb)
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(results)).To(gomega.Equal(10))
+
+		qb = NewQueryBuilder()
+		err = qb.If(collName, "status:string == open", map[string]interface{}{})
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(m.planQuery(qb.query).Index).To(gomega.BeNil())
+
+		results, err = a.Query(qb)
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(results)).To(gomega.Equal(15))
+
+		err = a.NewIndex(collName, "other", stringIndexType, IndexOptions{Filter: "archived:invalid == false"})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(InvalidUserSuppliedDataCode))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should not read by a partial index that does not hold every document", func() {
+		a := testCreateRose(false)
+
+		collName := testCreateCollection(a, "coll")
+
+		options := IndexOptions{Filter: "archived:bool == #archived", FilterParams: map[string]interface{}{"#archived": "false"}}
+		gomega.Expect(a.NewIndex(collName, "email", stringIndexType, options)).To(gomega.BeNil())
+
+		res := testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: `{"email":"a@b.c","archived":true}`}, a)
+
+		_, err := a.ReadBy(ReadByMetadata{CollectionName: collName, Field: "email", Value: "a@b.c", DataType: stringIndexType})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(InvalidUserSuppliedDataCode))
+
+		// an index that is not partial is used instead
+		gomega.Expect(a.NewCompoundIndex(collName, []IndexField{{Name: "email", DataType: stringIndexType}, {Name: "archived", DataType: boolIndexType}})).To(gomega.BeNil())
+
+		// the index is built in the background
+		a.Databases[collName].indexBuilds.Wait()
+
+		readBy, err := a.ReadBy(ReadByMetadata{CollectionName: collName, Field: "email", Value: "a@b.c", DataType: stringIndexType})
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(readBy.Data)).To(gomega.Equal(1))
+		gomega.Expect(readBy.Data[0].ID).To(gomega.Equal(res.ID))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should create a date_time index and use it for range queries", func() {
+		a := testCreateRose(false)
+
+		collName := testCreateCollection(a, "coll")
+
+		err := a.NewIndex(collName, "createdAt", dateTimeIndexType)
+
+		gomega.Expect(err).To(gomega.BeNil())
+
+		_, err = a.Write(WriteMetadata{
+			CollectionName: collName,
+			Data:           testAsJsonInterface(TestUser{CreatedAt: "yesterday"}),
+		})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Cannot write index. Field name 'createdAt' is indexed as date_time and must be a string in YYYY-MM-DD, YYYY-MM-DD HH:MM:SS or RFC 3339 format"))
+
+		for day := 1; day <= 20; day++ {
+			createdAt := fmt.Sprintf("2021-01-%02d 10:00:00", day)
+
+			// the same instant, written with a timezone
+			if day % 2 == 0 {
+				createdAt = fmt.Sprintf("2021-01-%02dT12:00:00+02:00", day)
+			}
+
+			res := testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{CreatedAt: createdAt})}, a)
+
+			gomega.Expect(res.Status).To(gomega.Equal(OkResultStatus))
+		}
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		a = testCreateRose(false)
+
+		qb := NewQueryBuilder()
+		err = qb.If(collName, "createdAt:date_time >= #from && createdAt:date_time < #to", map[string]interface{}{
+			"#from": "2021-01-05 10:00:00",
+			"#to":   "2021-01-12T10:00:00Z",
+		})
+
+		gomega.Expect(err).To(gomega.BeNil())
+
+		plan := a.Databases[collName].planQuery(qb.query)
+
+		gomega.Expect(plan.IndexName).To(gomega.Equal("createdAt"))
+		gomega.Expect(len(plan.Range)).To(gomega.Equal(2))
+
+		results, err := a.Query(qb)
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(results)).To(gomega.Equal(7))
+
+		for _, r := range results {
+			gomega.Expect(r.ID).To(gomega.And(gomega.BeNumerically(">=", 5), gomega.BeNumerically("<", 12)))
+		}
+
+		res, err := a.ReadBy(ReadByMetadata{
+			CollectionName: collName,
+			Field:          "createdAt",
+			Value:          "2021-01-04T05:00:00-05:00",
+			DataType:       dateTimeIndexType,
+		})
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(res.Data)).To(gomega.Equal(1))
+		gomega.Expect(res.Data[0].ID).To(gomega.Equal(4))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should list indexes and drop an index, also after restart", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "drop_index_coll")
+
+		err := a.NewIndex(collName, "email", stringIndexType, IndexOptions{Unique: true})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		err = a.NewCompoundIndex(collName, []IndexField{{Name: "type", DataType: stringIndexType}, {Name: "randomNum", DataType: intIndexType}})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		for i := 0; i < 10; i++ {
+			res := testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{
+				Type:      "user",
+				Email:     fmt.Sprintf("user%d@gmail.com", i),
+				RandomNum: i,
+			})}, a)
+
+			gomega.Expect(res.Status).To(gomega.Equal(OkResultStatus))
+		}
+
+		infos, err := a.ListIndexes(collName)
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(infos)).To(gomega.Equal(2))
+		gomega.Expect(infos[0].Name).To(gomega.Equal("email"))
+		gomega.Expect(infos[0].Type).To(gomega.Equal("string"))
+		gomega.Expect(infos[0].Options.Unique).To(gomega.BeTrue())
+		gomega.Expect(infos[0].Entries).To(gomega.Equal(10))
+		gomega.Expect(infos[0].MemoryBytes).To(gomega.BeNumerically(">", 0))
+		gomega.Expect(infos[1].Name).To(gomega.Equal("type,randomNum"))
+		gomega.Expect(infos[1].Type).To(gomega.Equal("string,int"))
+		gomega.Expect(len(infos[1].Fields)).To(gomega.Equal(2))
+		gomega.Expect(infos[1].Entries).To(gomega.Equal(10))
+
+		err = a.DropIndex(collName, "email")
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(a.Databases[collName].FieldIndexKeys).To(gomega.ConsistOf("type", "randomNum"))
+
+		err = a.DropIndex(collName, "email")
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(IndexNotExistsCode))
+		gomega.Expect(err.Error()).To(gomega.Equal(fmt.Sprintf("Invalid index request. Index 'email' does not exist in collection %s", collName)))
+
+		// the unique index is not enforced any more
+		res := testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Type: "user", Email: "user1@gmail.com"})}, a)
+		gomega.Expect(res.Status).To(gomega.Equal(OkResultStatus))
+
+		b, e := ioutil.ReadFile(roseIndexLocation())
+
+		gomega.Expect(e).To(gomega.BeNil())
+		gomega.Expect(string(b)).To(gomega.Not(gomega.ContainSubstring("email")))
+		gomega.Expect(string(b)).To(gomega.ContainSubstring("type,randomNum"))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		a = testCreateRose(false)
+
+		infos, err = a.ListIndexes(collName)
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(infos)).To(gomega.Equal(1))
+		gomega.Expect(infos[0].Name).To(gomega.Equal("type,randomNum"))
+		gomega.Expect(infos[0].Entries).To(gomega.Equal(11))
+
+		_, err = a.ReadBy(ReadByMetadata{
+			CollectionName: collName,
+			Field:          "email",
+			Value:          "user1@gmail.com",
+			DataType:       stringIndexType,
+		})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+
+		err = a.DropIndex(collName, "type,randomNum")
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(a.Databases[collName].FieldIndex)).To(gomega.Equal(0))
+		gomega.Expect(len(a.Databases[collName].FieldIndexKeys)).To(gomega.Equal(0))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should build an index from existing documents while writes continue", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "online_index_coll")
+
+		n := 8000
+		for i := 0; i < n; i++ {
+			t := "user"
+			if i%2 == 0 {
+				t = "admin"
+			}
+
+			_, err := a.Write(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Type: t, RandomNum: i})})
+
+			gomega.Expect(err).To(gomega.BeNil())
+		}
+
+		err := a.NewIndex(collName, "type", stringIndexType)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		// writes that happen during the build are indexed by the writes themselves
+		done := make(chan bool)
+		go func() {
+			defer ginkgo.GinkgoRecover()
+
+			for i := 0; i < 100; i++ {
+				_, err := a.Write(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Type: "admin", RandomNum: n + i})})
+
+				gomega.Expect(err).To(gomega.BeNil())
+			}
+
+			done <- true
+		}()
+
+		<-done
+
+		gomega.Eventually(func() bool {
+			infos, err := a.ListIndexes(collName)
+
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(infos[0].BuildError).To(gomega.BeEmpty())
+
+			return infos[0].Complete
+		}, "10s", "10ms").Should(gomega.BeTrue())
+
+		infos, err := a.ListIndexes(collName)
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(infos[0].Progress).To(gomega.Equal(float64(1)))
+		gomega.Expect(infos[0].Entries).To(gomega.Equal(n + 100))
+
+		res, err := a.ReadBy(ReadByMetadata{
+			CollectionName: collName,
+			Field:          "type",
+			Value:          "admin",
+			DataType:       stringIndexType,
+			Pagination:     Pagination{Page: 1, Limit: n},
+		})
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(res.Data)).To(gomega.Equal(n/2 + 100))
+
+		qb := NewQueryBuilder()
+		err = qb.If(collName, "type:string == #type && randomNum:int >= #num", map[string]interface{}{
+			"#type": "admin",
+			"#num":  "7990",
+		})
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(a.Databases[collName].planQuery(qb.query).IndexName).To(gomega.Equal("type"))
+
+		results, err := a.Query(qb)
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(results)).To(gomega.Equal(105))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should not use an index for readBy and queries while it is being built", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "building_index_coll")
+
+		testMultipleConcurrentInsert(10, testAsJsonInterface(TestUser{Type: "user"}), a, collName)
+
+		// simulates a build that has not read any block yet
+		d := a.Databases[collName]
+		d.Lock()
+		idx := d.createFieldIndex([]IndexField{{Name: "type", DataType: stringIndexType}}, IndexOptions{})
+		idx.TotalBlocks = 1
+		d.Unlock()
+
+		_, err := a.ReadBy(ReadByMetadata{
+			CollectionName: collName,
+			Field:          "type",
+			Value:          "user",
+			DataType:       stringIndexType,
+		})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(IndexBuildingCode))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid readBy method. Index 'type' is being built (0 of 1 blocks done) and can be used once it is complete"))
+
+		qb := NewQueryBuilder()
+		err = qb.If(collName, "type:string == #type", map[string]interface{}{"#type": "user"})
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(d.planQuery(qb.query).Index).To(gomega.BeNil())
+
+		results, err := a.Query(qb)
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(results)).To(gomega.Equal(10))
+
+		infos, err := a.ListIndexes(collName)
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(infos[0].Complete).To(gomega.BeFalse())
+		gomega.Expect(infos[0].Progress).To(gomega.Equal(float64(0)))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should keep the indexes of a collection whose name ends another collection name after an index is dropped", func() {
+		dir, e := ioutil.TempDir("", "rose_index_names")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dir)
+
+		defer func() {
+			SetDataDir("")
+			_ = os.RemoveAll(dir)
+		}()
+
+		a := testCreateRose(false)
+		users := testCreateCollection(a, "users")
+		admins := testCreateCollection(a, "admin_users")
+
+		gomega.Expect(a.NewIndex(admins, "email", stringIndexType, IndexOptions{Unique: true})).To(gomega.BeNil())
+		gomega.Expect(a.NewIndex(users, "email", stringIndexType, IndexOptions{Unique: true})).To(gomega.BeNil())
+		gomega.Expect(a.NewIndex(admins, "age", intIndexType)).To(gomega.BeNil())
+
+		// adding an index that exists does not add it twice
+		gomega.Expect(a.NewIndex(users, "email", stringIndexType, IndexOptions{Unique: true})).To(gomega.BeNil())
+
+		gomega.Expect(a.DropIndex(admins, "age")).To(gomega.BeNil())
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+
+		a = testCreateRose(false)
+
+		for _, collName := range []string{users, admins} {
+			indexes, err := a.ListIndexes(collName)
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(len(indexes)).To(gomega.Equal(1))
+			gomega.Expect(indexes[0].Name).To(gomega.Equal("email"))
+			gomega.Expect(indexes[0].Options.Unique).To(gomega.BeTrue())
+		}
+
+		b, e := ioutil.ReadFile(roseIndexLocation())
+		gomega.Expect(e).To(gomega.BeNil())
+		gomega.Expect(strings.Count(string(b), "\n")).To(gomega.Equal(2))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+	})
+
+	GinkgoIt("Should find the results of range queries in the sorted entries of an index", func() {
+		dir, e := ioutil.TempDir("", "rose_sorted_index")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dir)
+
+		defer func() {
+			SetDataDir("")
+			_ = os.RemoveAll(dir)
+		}()
+
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "sorted_coll")
+
+		gomega.Expect(a.NewCompoundIndex(collName, []IndexField{{Name: "type", DataType: stringIndexType}, {Name: "randomNum", DataType: intIndexType}})).To(gomega.BeNil())
+
+		types := []string{"a", "b"}
+		nums := make(map[int]int)
+
+		data := make([]interface{}, 0)
+		for id := 1; id <= 3 * maxUnsortedEntries; id++ {
+			nums[id] = (id * 37) % 50
+			data = append(data, testAsJsonInterface(TestUser{Type: types[id % 2], RandomNum: nums[id]}))
+		}
+
+		_, err := a.BulkWrite(BulkWriteMetadata{CollectionName: collName, Data: data})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		for id := 7; id <= 3 * maxUnsortedEntries; id += 7 {
+			testSingleDelete(DeleteMetadata{CollectionName: collName, ID: id}, a)
+			delete(nums, id)
+		}
+
+		for id := 11; id <= 3 * maxUnsortedEntries; id += 11 {
+			if _, ok := nums[id]; ok {
+				testSingleReplace(ReplaceMetadata{CollectionName: collName, ID: id, Data: testAsJsonInterface(TestUser{Type: types[id % 2], RandomNum: 15})}, a)
+				nums[id] = 15
+			}
+		}
+
+		expected := func(from int, to int) []int {
+			ids := make([]int, 0)
+			for id := 1; id <= 3 * maxUnsortedEntries + 10; id++ {
+				if num, ok := nums[id]; ok && id % 2 == 0 && num >= from && num < to {
+					ids = append(ids, id)
+				}
+			}
+
+			return ids
+		}
+
+		query := func(from int, to int) []int {
+			qb := NewQueryBuilder()
+			gomega.Expect(qb.If(collName, "type:string == #type && randomNum:int >= #from && randomNum:int < #to", map[string]interface{}{"#type": "a", "#from": fmt.Sprint(from), "#to": fmt.Sprint(to)})).To(gomega.BeNil())
+
+			gomega.Expect(a.Databases[collName].planQuery(qb.query).Range).To(gomega.HaveLen(2))
+
+			results, err := a.Query(qb)
+			gomega.Expect(err).To(gomega.BeNil())
+
+			ids := make([]int, 0, len(results))
+			for _, r := range results {
+				ids = append(ids, r.ID)
+			}
+
+			return ids
+		}
+
+		gomega.Expect(query(10, 20)).To(gomega.ConsistOf(expected(10, 20)))
+		gomega.Expect(query(0, 1)).To(gomega.ConsistOf(expected(0, 1)))
+		gomega.Expect(query(20, 10)).To(gomega.BeEmpty())
+
+		idx := a.Databases[collName].FieldIndex["type,randomNum"]
+		gomega.Expect(idx.merged).To(gomega.Equal(len(idx.Index)))
+		gomega.Expect(len(idx.sorted)).To(gomega.Equal(idx.Len()))
+
+		// documents that were written after the entries were sorted are found too
+		for id := 3 * maxUnsortedEntries + 1; id <= 3 * maxUnsortedEntries + 10; id++ {
+			res := testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Type: types[id % 2], RandomNum: 12})}, a)
+			gomega.Expect(res.ID).To(gomega.Equal(id))
+			nums[id] = 12
+		}
+
+		gomega.Expect(query(10, 20)).To(gomega.ConsistOf(expected(10, 20)))
+		gomega.Expect(idx.merged).To(gomega.Equal(len(idx.Index) - 10))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+	})
+})
@@ -407,4 +407,58 @@ var _ = GinkgoDescribe("Internal Memory DB tests", func() {
 
 		testRemoveFileSystemDb(roseDir())
 	})
+
+	GinkgoIt("Should remove field index entries by their position and keep the order of the others", func() {
+		fi := newFieldIndex([]IndexField{{Name: "num", DataType: intIndexType}}, IndexOptions{Unique: true})
+
+		n := 3 * minIndexCompaction
+		for id := 1; id <= n; id++ {
+			fi.Add(id, int64(id), id, 0)
+		}
+
+		// removed entries stay in place until they are half of the index
+		for id := 1; id < n / 2; id += 2 {
+			fi.Remove(id)
+		}
+
+		gomega.Expect(len(fi.Index)).To(gomega.Equal(n))
+		gomega.Expect(fi.Len()).To(gomega.Equal(n - n / 4))
+
+		// every other entry, which compacts the index
+		for id := n / 2 + 1; id <= n; id += 2 {
+			fi.Remove(id)
+		}
+
+		gomega.Expect(len(fi.Index)).To(gomega.Equal(n / 2))
+		gomega.Expect(fi.Len()).To(gomega.Equal(n / 2))
+		gomega.Expect(len(fi.positions)).To(gomega.Equal(n / 2))
+
+		for i, idx := range fi.Index {
+			gomega.Expect(idx.removed).To(gomega.BeFalse())
+			gomega.Expect(idx.ID).To(gomega.Equal(2 * (i + 1)))
+		}
+
+		_, ok := fi.Owner(1)
+		gomega.Expect(ok).To(gomega.BeFalse())
+
+		// an entry that is added again is found at its new position
+		fi.Remove(2)
+		fi.Add(2, 2, 2, 0)
+		fi.Remove(4)
+		fi.Remove(2)
+		fi.Remove(n + 1)
+
+		gomega.Expect(fi.Len()).To(gomega.Equal(n / 2 - 2))
+
+		live := make([]int, 0)
+		for _, idx := range fi.Index {
+			if !idx.removed {
+				live = append(live, idx.ID)
+			}
+		}
+
+		gomega.Expect(len(live)).To(gomega.Equal(n / 2 - 2))
+		gomega.Expect(live[0]).To(gomega.Equal(6))
+		gomega.Expect(live[len(live) - 1]).To(gomega.Equal(n))
+	})
 })
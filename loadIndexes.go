@@ -50,6 +50,13 @@ func loadAllIndexes(dbs map[string]*db) Error {
 			return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Could not read %s directory. This is probably a permissions problem with underlynging message: %s", roseDbDir(), fsErr.Error()))
 		}
 
+		blockFiles := make([]os.FileInfo, 0, len(files))
+		for _, f := range files {
+			if _, ok := blockIdFromFileName(f.Name()); ok && !f.IsDir() {
+				blockFiles = append(blockFiles, f)
+			}
+		}
+
 		limit, err := getOpenFileHandleLimit()
 
 		if err != nil {
@@ -65,14 +72,13 @@ func loadAllIndexes(dbs map[string]*db) Error {
 
 		if indexes != nil {
 			for _, fsi := range indexes {
-				if !hasString(db.FieldIndexKeys, fsi.Field) {
-					db.FieldIndexKeys = append(db.FieldIndexKeys, fsi.Field)
-				}
+				// every document is written into the index below, before boot is done
+				db.createFieldIndex(fsi.fields(), fsi.Options).Complete = true
 			}
 		}
 
 		// Creates as many batches as there are files, 50 files per batch
-		batch := createFileInfoBatch(files, limit)
+		batch := createFileInfoBatch(blockFiles, limit)
 
 		/**
 		Every batch has a sender goroutine that sends a single
@@ -148,7 +154,7 @@ func loadSingleFile(f os.FileInfo, m *db, collName string, indexes []*fsIndex) E
 				return fsErr
 			}
 
-			return newError(DbIntegrityMasterErrorCode, BlockCorruptedCode, "Database integrity violation. Cannot populate database. Invalid row encountered. This is an error ")
+			return newError(DbIntegrityMasterErrorCode, BlockCorruptedCode, fmt.Sprintf("Database integrity violation. Cannot populate database. Invalid row encountered in %s. Fsck finds and repairs it", db))
 		}
 
 		err = m.writeIndex(val.id, offset)
@@ -156,7 +162,7 @@ func loadSingleFile(f os.FileInfo, m *db, collName string, indexes []*fsIndex) E
 		// write all indexes into memory in the specified database based on the collection name
 		if indexes != nil {
 			for _, fsi := range indexes {
-				if err := m.writeFieldIndexWithLock(fsi.Field, fsi.DataType, offset, val.val, val.id); err != nil {
+				if err := m.writeFieldIndexWithLock(fsi, offset, val.val, val.id); err != nil {
 					return err
 				}
 			}
@@ -173,6 +179,13 @@ func loadSingleFile(f os.FileInfo, m *db, collName string, indexes []*fsIndex) E
 		}
 	}
 
+	// tombstones are not tracked on disk, they are counted from the deleted lines that the reader skipped
+	if blockId, ok := blockIdFromFileName(f.Name()); ok && reader.deleted > 0 {
+		m.Lock()
+		m.increaseTombstones(blockId, reader.deleted)
+		m.Unlock()
+	}
+
 	fsErr := closeFile(file)
 
 	if fsErr != nil {
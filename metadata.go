@@ -16,6 +16,12 @@ type Pagination struct {
 	Limit int
 }
 
+type ReadByField struct {
+	Field string `json:"field"`
+	Value interface{} `json:"value"`
+	DataType indexDataType `json:"dataType"`
+}
+
 type ReadByMetadata struct {
 	CollectionName string `json:"collectionName"`
 	Field string `json:"field"`
@@ -24,6 +30,8 @@ type ReadByMetadata struct {
 	Pagination Pagination
 	DataType indexDataType `json:"dataType"`
 	Sort sortType
+	// Fields that follow Field in a compound index, in the same order as in the index
+	Fields []ReadByField `json:"fields"`
 }
 
 type BulkWriteMetadata struct {
@@ -88,12 +96,37 @@ func (m ReadByMetadata) Validate(idxKeys []string) Error {
 	}
 
 	if !isIndexDataType(string(m.DataType)) {
-		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, "Validation error. Invalid readBy method 'dataType'. 'dataType' is an invalid data type. Valid data types are int, float, string and bool")
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, "Validation error. Invalid readBy method 'dataType'. 'dataType' is an invalid data type. Valid data types are int, float, string, bool, date and date_time")
+	}
+
+	for _, f := range m.Fields {
+		if f.Field == "" {
+			return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, "Validation error. Invalid readBy method. 'field' is empty. 'field' must be a non empty string")
+		}
+
+		if f.Value == nil {
+			return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Invalid readBy method 'value' for field '%s'. 'value' must be a non nil value that corresponds to 'dataType'", f.Field))
+		}
+
+		if !isIndexDataType(string(f.DataType)) {
+			return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Validation error. Invalid readBy method 'dataType' for field '%s'. Valid data types are int, float, string, bool, date and date_time", f.Field))
+		}
 	}
 
 	return nil
 }
 
+// returns Field together with Fields, in order of a compound index
+func (m ReadByMetadata) lookupFields() []ReadByField {
+	fields := []ReadByField{{
+		Field:    m.Field,
+		Value:    m.Value,
+		DataType: m.DataType,
+	}}
+
+	return append(fields, m.Fields...)
+}
+
 func (m ReplaceMetadata) Validate() Error {
 	if m.CollectionName == "" {
 		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, "Validation error. Invalid collection name. Collection name cannot be an empty string")
@@ -18,6 +18,10 @@ type queryBuilder struct {
 	built bool
 	query *singleQuery
 	conds []string
+	// the arguments of If, kept so that a query can be sent to a remote server
+	collName string
+	rawQuery string
+	params map[string]interface{}
 }
 
 var comparisonOperators = []string{
@@ -27,6 +31,9 @@ var comparisonOperators = []string{
 	">=",
 	"<",
 	">",
+	"matches",
+	"near",
+	"within",
 }
 
 var conditionalOperators = []string{
@@ -41,6 +48,7 @@ var fieldDataTypes = []dataType {
 	floatType,
 	dateTimeType,
 	dateType,
+	geoType,
 }
 
 func isComparisonOperator(given string) bool {
@@ -85,10 +93,28 @@ func (qb *queryBuilder) If(collName string, query string, params map[string]inte
 	}
 
 	qb.query = newSingleQuery(collName, query, params)
+	qb.collName = collName
+	qb.rawQuery = query
+	qb.params = params
 
 	return nil
 }
 
+// collection of the query given to If
+func (qb *queryBuilder) Collection() string {
+	return qb.collName
+}
+
+// query given to If, after validation
+func (qb *queryBuilder) Query() string {
+	return qb.rawQuery
+}
+
+// #params given to If
+func (qb *queryBuilder) Params() map[string]interface{} {
+	return qb.params
+}
+
 func validateQueryField(f string) Error {
 	d := strings.Split(f, ":")
 
@@ -127,6 +153,10 @@ func validateQuery(query string, params map[string]interface{}) (string, Error)
 			continue
 		}
 
+		if i + 2 >= len(split) || split[i + 2] == "" {
+			return "", newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Unable to process query. Condition '%s' is incomplete. Conditions must be in field:index_type operator value format", strings.Join(split[i:], " ")))
+		}
+
 		a := split[i]
 		b := split[i + 1]
 
@@ -138,6 +168,17 @@ func validateQuery(query string, params map[string]interface{}) (string, Error)
 			return "", newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Unable to process query. Invalid comparison operator given. Comparison operators are %v", comparisonOperators))
 		}
 
+		if b == "matches" && strings.Split(a, ":")[1] != string(stringType) {
+			return "", newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Unable to process query. Operator 'matches' can only be used on string fields, %s given", a))
+		}
+
+		isGeoOperator := b == "near" || b == "within"
+		isGeoField := strings.Split(a, ":")[1] == string(geoType)
+
+		if isGeoOperator != isGeoField {
+			return "", newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Unable to process query. Operators 'near' and 'within' can only be used on geo fields and geo fields can only be compared with them, %s %s given", a, b))
+		}
+
 		c := split[i + 2]
 
 		if c[0:1] == "#" {
@@ -156,11 +197,43 @@ func validateQuery(query string, params map[string]interface{}) (string, Error)
 			}
 		}
 
+		if isGeoOperator {
+			if err := validateGeoValue(b, c, params); err != nil {
+				return "", err
+			}
+		}
+
 		i += 3
 
 		grouped = true
 	}
 
+	if !grouped {
+		return "", newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Unable to process query. Query cannot end with conditional operator %s", split[len(split) - 1]))
+	}
+
 	return resolved, nil
 }
 
+
+func validateGeoValue(op string, value string, params map[string]interface{}) Error {
+	if value[0:1] == "#" {
+		p, ok := params[value].(string)
+
+		if !ok {
+			return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Unable to process query. Parameter %s of a %s condition must be a string", value, op))
+		}
+
+		value = p
+	}
+
+	if op == "near" {
+		if _, _, ok := parseGeoNear(value); !ok {
+			return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Unable to process query. Invalid near value '%s'. It must be lat,lng,meters as returned by Near()", value))
+		}
+	} else if _, ok := parseGeoBox(value); !ok {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Unable to process query. Invalid within value '%s'. It must be minLat,minLng,maxLat,maxLng as returned by Within()", value))
+	}
+
+	return nil
+}
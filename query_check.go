@@ -12,13 +12,16 @@ type queryCheck struct {
 }
 
 func (c queryCheck) Check() {
-	stages := c.item.OperationStages
-
-	queueResponse := &queueResponse{
-		ID:   c.found.id,
-		Body: c.found.val,
+	if matchesStages(c.v, c.item.OperationStages) {
+		c.item.Response<- &queueResponse{
+			ID:   c.found.id,
+			Body: c.found.val,
+		}
 	}
+}
 
+// matchesStages returns true if a document satisfies the conditions of a query
+func matchesStages(v *fastjson.Value, stages map[int]*operatorStages) bool {
 	oneOperatorOnly := false
 	if len(stages) == 1 && len(stages[0].Nodes) == 1 {
 		oneOperatorOnly = true
@@ -39,104 +42,99 @@ func (c queryCheck) Check() {
 			cond := node.cond
 			success := false
 
-			if c.v.Exists(cond.field) {
+			if v.Exists(cond.field) {
 				if cond.dataType == stringType {
-					convRes := string(c.v.GetStringBytes(cond.field))
+					convRes := string(v.GetStringBytes(cond.field))
 					convValue := cond.value.(string)
 
 					if str(convRes).compare(convValue, cond.comparisonType) {
 						if oneOperatorOnly {
-							c.item.Response<- queueResponse
-
-							return
+							return true
 						}
 
 						stageResults++
 						success = true
 					}
 				} else if cond.dataType == boolType {
-					convRes := c.v.GetBool(cond.field)
+					convRes := v.GetBool(cond.field)
 					convValue, _ := strconv.ParseBool(cond.value.(string))
 
 					if boolean(convRes).compare(convValue, cond.comparisonType) {
 						if oneOperatorOnly {
-							c.item.Response<- queueResponse
-
-							return
+							return true
 						}
 
 						stageResults++
 						success = true
 					}
 				} else if cond.dataType == intType {
-					convRes := c.v.GetInt(cond.field)
+					convRes := v.GetInt(cond.field)
 					convValue, _ := strconv.Atoi(cond.value.(string))
 
 					if integer(convRes).compare(convValue, cond.comparisonType) {
 						if oneOperatorOnly {
-							c.item.Response<- queueResponse
-
-							return
+							return true
 						}
 
 						stageResults++
 						success = true
 					}
 				} else if (cond.dataType == floatType) {
-					convRes := c.v.GetFloat64(cond.field)
+					convRes := v.GetFloat64(cond.field)
 					convValue, _ := strconv.ParseFloat(cond.value.(string), 64)
 
 					if floating(convRes).compare(convValue, cond.comparisonType) {
 						if oneOperatorOnly {
-							c.item.Response<- queueResponse
+							return true
+						}
 
-							return
+						stageResults++
+						success = true
+					}
+				} else if cond.dataType == geoType {
+					if p, ok := geoPointFromValue(v.Get(cond.field)); ok && matchesGeo(p, cond) {
+						if oneOperatorOnly {
+							return true
 						}
 
 						stageResults++
 						success = true
 					}
 				}  else if (cond.dataType == dateType) {
-					convRes := c.v.GetStringBytes(cond.field)
+					convRes := v.GetStringBytes(cond.field)
 
 					dateFieldVal := getDateFromString(string(convRes))
 					dateUserVal := getDateFromString(cond.value.(string))
 
 					if dateTime(dateFieldVal).compare(dateUserVal, cond.comparisonType) {
 						if oneOperatorOnly {
-							c.item.Response<- queueResponse
-
-							return
+							return true
 						}
 
 						stageResults++
 						success = true
 					}
 				} else if (cond.dataType == dateTimeType) {
-					convRes := c.v.GetStringBytes(cond.field)
+					convRes := v.GetStringBytes(cond.field)
 
 					dateFieldVal := getDateFromString(string(convRes))
 					dateUserVal := getDateFromString(cond.value.(string))
 
 					if date(dateFieldVal).compare(dateUserVal, cond.comparisonType) {
 						if oneOperatorOnly {
-							c.item.Response<- queueResponse
-
-							return
+							return true
 						}
 
 						stageResults++
 						success = true
 					}
 				} else {
-					convRes := string(c.v.GetStringBytes(cond.field))
+					convRes := string(v.GetStringBytes(cond.field))
 					convValue := cond.value.(string)
 
 					if str(convRes).compare(convValue, cond.comparisonType) {
 						if oneOperatorOnly {
-							c.item.Response<- queueResponse
-
-							return
+							return true
 						}
 
 						stageResults++
@@ -161,9 +159,9 @@ func (c queryCheck) Check() {
 
 	for _, ok := range fullResults {
 		if ok {
-			c.item.Response<- queueResponse
-
-			return
+			return true
 		}
 	}
+
+	return false
 }
\ No newline at end of file
@@ -0,0 +1,385 @@
+package rose
+
+import (
+	"fmt"
+	"github.com/valyala/fastjson"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/**
+A query plan decides how a query is executed. Without an index, every block of a collection is scanned
+by the balancer workers. With an index, only the documents that the index points to are read and
+checked against the whole query.
+*/
+type queryPlan struct {
+	Index *fieldIndex
+	IndexName string
+	// values of the equality conditions, in order of the index fields
+	Prefix []interface{}
+	// range conditions (<, <=, >, >=) on the index field that follows the prefix
+	Range []*singleCondition
+	// analyzed terms of a matches condition if the plan uses a text index
+	Terms []string
+	// bounding box of a near or within condition if the plan uses a geo index
+	Area geoArea
+}
+
+type QueryStrategy string
+
+// documents are read through a field index, only the ones that the index points to are checked against the query
+const IndexQueryStrategy QueryStrategy = "index"
+// documents are read through a text index, only the ones that hold one of the searched terms are checked
+const TextIndexQueryStrategy QueryStrategy = "text"
+// documents are read through a geo index, only the ones in the searched area are checked
+const GeoIndexQueryStrategy QueryStrategy = "geo"
+// every block of the collection is scanned by the balancer workers
+const ScanQueryStrategy QueryStrategy = "scan"
+
+// QueryExplanation describes how a query would be executed, as returned by Explain
+type QueryExplanation struct {
+	Collection string `json:"collection"`
+	Strategy QueryStrategy `json:"strategy"`
+	// name of the index that the query uses, empty if the collection is scanned
+	Index string `json:"index,omitempty"`
+	// fields of the index that are compared with ==, in order of the index fields
+	EqualityFields []string `json:"equalityFields,omitempty"`
+	// field of the index that is compared with <, <=, > or >=
+	RangeField string `json:"rangeField,omitempty"`
+	// analyzed terms of the matches condition that the text index is searched with
+	Terms []string `json:"terms,omitempty"`
+	// number of blocks that are scanned, 0 if the query uses an index
+	Blocks int `json:"blocks"`
+	// results are scored with BM25 and sorted by score
+	Ranked bool `json:"ranked"`
+	// results are sorted by distance from the center of the first near condition
+	SortedByDistance bool `json:"sortedByDistance"`
+}
+
+// a matches condition of a query with the text index that ranks its results
+type textSearch struct {
+	Index *fieldIndex
+	Terms []string
+}
+
+/**
+An index can be used only if every condition of the query must be true, which means that the query cannot
+have a || operator. An index is usable if its leading fields are compared with == in the query, optionally
+followed by a field that is compared with <, <=, > or >=. From all usable indexes, the one that covers the most
+fields is chosen. Sparse indexes can always be used since a comparison requires the field to exist, partial
+indexes only if the query has every condition of the filter. A text index of a matches condition and a geo index
+of a near or within condition are preferred over every other index since they read only the documents that hold one
+of the searched terms or are in the searched area.
+*/
+func (d *db) planQuery(q *singleQuery) *queryPlan {
+	plan := &queryPlan{}
+
+	conds := make([]*singleCondition, 0)
+	equalities := make(map[string]*singleCondition)
+	ranges := make(map[string][]*singleCondition)
+	for node := q.opNode; node != nil; node = node.next {
+		if node.nextOp == "||" {
+			return &queryPlan{}
+		}
+
+		conds = append(conds, node.cond)
+
+		if node.cond.comparisonType == textMatch {
+			if idx, ok := d.FieldIndex[node.cond.field]; ok && idx.text != nil && idx.Complete && idx.servesConditions(conds) {
+				plan.Index = idx
+				plan.IndexName = node.cond.field
+				plan.Terms = analyzeText(fmt.Sprint(node.cond.value))
+			}
+		} else if node.cond.comparisonType == geoNear || node.cond.comparisonType == geoWithin {
+			idx, ok := d.FieldIndex[node.cond.field]
+
+			if area, valid := conditionGeoArea(node.cond); valid && ok && idx.geo != nil && idx.Complete && idx.servesConditions(conds) && plan.Index == nil {
+				plan.Index = idx
+				plan.IndexName = node.cond.field
+				plan.Area = area
+			}
+		} else if node.cond.comparisonType == equality {
+			equalities[node.cond.field] = node.cond
+		} else if node.cond.comparisonType != inequality {
+			ranges[node.cond.field] = append(ranges[node.cond.field], node.cond)
+		}
+	}
+
+	if plan.Index != nil {
+		return plan
+	}
+
+	names := make([]string, 0, len(d.FieldIndex))
+	for name := range d.FieldIndex {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	covered := 0
+	for _, name := range names {
+		idx := d.FieldIndex[name]
+
+		if !idx.Complete || !idx.servesConditions(conds) {
+			continue
+		}
+
+		prefix := make([]interface{}, 0)
+
+		for _, f := range idx.Fields {
+			cond, ok := equalities[f.Name]
+
+			if !ok {
+				break
+			}
+
+			value, ok := conditionIndexValue(cond, f.DataType)
+
+			if !ok {
+				break
+			}
+
+			prefix = append(prefix, value)
+		}
+
+		rangeConds := make([]*singleCondition, 0)
+		if len(prefix) < len(idx.Fields) {
+			f := idx.Fields[len(prefix)]
+
+			for _, cond := range ranges[f.Name] {
+				if _, ok := conditionIndexValue(cond, f.DataType); ok && isRangeIndexType(f.DataType) {
+					rangeConds = append(rangeConds, cond)
+				}
+			}
+		}
+
+		c := len(prefix)
+		if len(rangeConds) > 0 {
+			c++
+		}
+
+		if c == 0 || c < covered {
+			continue
+		}
+
+		if c == covered && len(idx.Fields) >= len(plan.Index.Fields) {
+			continue
+		}
+
+		covered = c
+		plan.Index = idx
+		plan.IndexName = name
+		plan.Prefix = prefix
+		plan.Range = rangeConds
+	}
+
+	return plan
+}
+
+/**
+Reads every document that the index of the plan points to and checks it against the whole query. The equality and range
+conditions of the plan are found with a binary search in the sorted entries of the index, see fieldIndex.seek().
+The caller must hold the lock
+*/
+func (d *db) queryWithIndex(plan *queryPlan, q *singleQuery) ([]QueryResult, Error) {
+	var p fastjson.Parser
+	results := make([]QueryResult, 0)
+
+	var positions []int
+	if plan.Index.text != nil || plan.Index.geo != nil {
+		var ids []int
+
+		if plan.Index.text != nil {
+			ids = plan.Index.text.candidates(plan.Terms)
+		} else {
+			ids = plan.Index.geo.candidates(plan.Area)
+		}
+
+		candidates := make(map[int]bool)
+		for _, id := range ids {
+			candidates[id] = true
+		}
+
+		for i, idx := range plan.Index.Index {
+			if !idx.removed && candidates[idx.ID] {
+				positions = append(positions, i)
+			}
+		}
+	} else {
+		positions = plan.Index.seek(plan.Prefix, plan.Range)
+	}
+
+	now := time.Now()
+	for _, i := range positions {
+		idx := plan.Index.Index[i]
+
+		if d.expired(idx.ID, now) {
+			continue
+		}
+
+		b, err := d.ReadDriver.ReadStrategic(idx.Pos, idx.BlockId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if b == nil {
+			continue
+		}
+
+		v, e := p.ParseBytes(b.val)
+
+		if e != nil {
+			return nil, newError(DbIntegrityMasterErrorCode, BlockCorruptedCode, fmt.Sprintf("Query resulted in an error: %s", e.Error()))
+		}
+
+		if matchesStages(v, q.stages) {
+			results = append(results, QueryResult{
+				ID:   b.id,
+				Data: b.val,
+			})
+		}
+	}
+
+	return results, nil
+}
+
+// Describes the plan of a query without running it. The caller must hold the lock
+func (d *db) explain(q *singleQuery) (*QueryExplanation, Error) {
+	searches, err := d.textSearches(q)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ex := &QueryExplanation{
+		Collection: q.collName,
+		Strategy: ScanQueryStrategy,
+		Ranked: len(searches) > 0,
+		SortedByDistance: nearCondition(q) != nil,
+	}
+
+	plan := d.planQuery(q)
+
+	if plan.Index == nil {
+		ex.Blocks = d.AutoIncrementCounter / blockMark + 1
+
+		return ex, nil
+	}
+
+	ex.Index = plan.IndexName
+
+	if plan.Index.text != nil {
+		ex.Strategy = TextIndexQueryStrategy
+		ex.Terms = plan.Terms
+	} else if plan.Index.geo != nil {
+		ex.Strategy = GeoIndexQueryStrategy
+	} else {
+		ex.Strategy = IndexQueryStrategy
+
+		for i := range plan.Prefix {
+			ex.EqualityFields = append(ex.EqualityFields, plan.Index.Fields[i].Name)
+		}
+
+		if len(plan.Range) > 0 {
+			ex.RangeField = plan.Index.Fields[len(plan.Prefix)].Name
+		}
+	}
+
+	return ex, nil
+}
+
+/**
+Returns a text search for every matches condition of a query. Every field that is searched must have a complete text index
+since ranking needs the term frequencies that only the index holds. The caller must hold the lock
+*/
+func (d *db) textSearches(q *singleQuery) ([]textSearch, Error) {
+	searches := make([]textSearch, 0)
+
+	for node := q.opNode; node != nil; node = node.next {
+		if node.cond.comparisonType != textMatch {
+			continue
+		}
+
+		idx, ok := d.FieldIndex[node.cond.field]
+
+		if !ok || idx.text == nil {
+			return nil, newError(ValidationMasterErrorCode, IndexNotExistsCode, fmt.Sprintf("Unable to process query. Operator 'matches' on field '%s' requires a text index on that field", node.cond.field))
+		}
+
+		if !idx.Complete {
+			return nil, newError(ValidationMasterErrorCode, IndexBuildingCode, fmt.Sprintf("Unable to process query. Text index '%s' is being built (%d of %d blocks done) and can be used once it is complete", node.cond.field, idx.BuiltBlocks, idx.TotalBlocks))
+		}
+
+		searches = append(searches, textSearch{
+			Index: idx,
+			Terms: analyzeText(fmt.Sprint(node.cond.value)),
+		})
+	}
+
+	return searches, nil
+}
+
+// returns the first near condition of a query, whose center is used to sort the results by distance
+func nearCondition(q *singleQuery) *singleCondition {
+	for node := q.opNode; node != nil; node = node.next {
+		if node.cond.comparisonType == geoNear {
+			return node.cond
+		}
+	}
+
+	return nil
+}
+
+// scores every result with BM25 and sorts them from the highest score. Results with the same score are sorted by ID.
+// The caller must hold the lock
+func rankResults(results []QueryResult, searches []textSearch) {
+	for i := range results {
+		for _, s := range searches {
+			results[i].Score += s.Index.text.score(results[i].ID, s.Terms)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+
+		return results[i].ID < results[j].ID
+	})
+}
+
+// converts the value of a query condition into the value that an index of this data type holds
+func conditionIndexValue(cond *singleCondition, dType indexDataType) (interface{}, bool) {
+	s, ok := cond.value.(string)
+
+	if !ok {
+		return nil, false
+	}
+
+	if dType == stringIndexType && cond.dataType == stringType {
+		return s, true
+	} else if dType == intIndexType && cond.dataType == intType {
+		v, err := strconv.Atoi(s)
+
+		return v, err == nil
+	} else if dType == floatIndexType && cond.dataType == floatType {
+		v, err := strconv.ParseFloat(s, 64)
+
+		return v, err == nil
+	} else if dType == boolIndexType && cond.dataType == boolType {
+		v, err := strconv.ParseBool(s)
+
+		return v, err == nil
+	} else if (dType == dateIndexType && cond.dataType == dateType) || (dType == dateTimeIndexType && cond.dataType == dateTimeType) {
+		return parseDate(s)
+	}
+
+	return nil, false
+}
+
+// strings are not used for ranges since string comparison in queries is not the same as in the index
+func isRangeIndexType(dType indexDataType) bool {
+	return dType == intIndexType || dType == floatIndexType || dType == dateIndexType || dType == dateTimeIndexType
+}
@@ -527,4 +527,380 @@ var _ = GinkgoDescribe("Query tests", func() {
 
 		testRemoveFileSystemDb(roseDir())
 	})
+
+	GinkgoIt("Should use a compound index prefix for a query and return the same results as a full scan", func() {
+		r := testCreateRose(false)
+		collName := testCreateCollection(r, "coll_name")
+
+		err := r.NewCompoundIndex(collName, []IndexField{
+			{Name: "tenantId", DataType: stringIndexType},
+			{Name: "status", DataType: stringIndexType},
+			{Name: "num", DataType: intIndexType},
+		})
+
+		gomega.Expect(err).To(gomega.BeNil())
+
+		n := 600
+		statuses := []string{"open", "closed", "pending"}
+
+		for i := 0; i < n; i++ {
+			testSingleConcurrentInsert(WriteMetadata{
+				CollectionName: collName,
+				Data: testAsJsonInterface(map[string]interface{}{
+					"tenantId": fmt.Sprintf("tenant_%d", i % 4),
+					"status":   statuses[i % 3],
+					"num":      i % 10,
+				}),
+			}, r)
+		}
+
+		m := r.Databases[collName]
+
+		qb := NewQueryBuilder()
+		err = qb.If(collName, "tenantId:string == #tenant && status:string == #status && num:int > #num", map[string]interface{}{
+			"#tenant": "tenant_2",
+			"#status": "open",
+			"#num":    "4",
+		})
+
+		gomega.Expect(err).To(gomega.BeNil())
+
+		plan := m.planQuery(qb.query)
+
+		gomega.Expect(plan.IndexName).To(gomega.Equal("tenantId,status,num"))
+		gomega.Expect(plan.Prefix).To(gomega.Equal([]interface{}{"tenant_2", "open"}))
+
+		indexed, err := r.Query(qb)
+
+		gomega.Expect(err).To(gomega.BeNil())
+
+		expected := 0
+		for i := 0; i < n; i++ {
+			if i % 4 == 2 && i % 3 == 0 && i % 10 > 4 {
+				expected++
+			}
+		}
+
+		gomega.Expect(len(indexed)).To(gomega.Equal(expected))
+
+		qb = NewQueryBuilder()
+		err = qb.If(collName, "status:string == #status || tenantId:string == #tenant", map[string]interface{}{
+			"#tenant": "tenant_2",
+			"#status": "open",
+		})
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(m.planQuery(qb.query).Index).To(gomega.BeNil())
+
+		if err := r.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should explain which index a query uses and how many blocks a scan reads", func() {
+		r := testCreateRose(false)
+		collName := testCreateCollection(r, "coll_name")
+
+		err := r.NewCompoundIndex(collName, []IndexField{
+			{Name: "tenantId", DataType: stringIndexType},
+			{Name: "num", DataType: intIndexType},
+		})
+
+		gomega.Expect(err).To(gomega.BeNil())
+
+		for i := 0; i < 10; i++ {
+			testSingleConcurrentInsert(WriteMetadata{
+				CollectionName: collName,
+				Data: testAsJsonInterface(map[string]interface{}{
+					"tenantId": fmt.Sprintf("tenant_%d", i % 2),
+					"num":      i,
+				}),
+			}, r)
+		}
+
+		qb := NewQueryBuilder()
+		err = qb.If(collName, "tenantId:string == #tenant && num:int >= 4", map[string]interface{}{"#tenant": "tenant_1"})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		ex, err := r.Explain(qb)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(*ex).To(gomega.Equal(QueryExplanation{
+			Collection: collName,
+			Strategy: IndexQueryStrategy,
+			Index: "tenantId,num",
+			EqualityFields: []string{"tenantId"},
+			RangeField: "num",
+		}))
+
+		qb = NewQueryBuilder()
+		err = qb.If(collName, "num:int >= 4 || tenantId:string == tenant_1", map[string]interface{}{})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		ex, err = r.Explain(qb)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(ex.Strategy).To(gomega.Equal(ScanQueryStrategy))
+		gomega.Expect(ex.Index).To(gomega.Equal(""))
+		gomega.Expect(ex.Blocks).To(gomega.Equal(1))
+
+		qb = NewQueryBuilder()
+		err = qb.If(collName, "tenantId:string matches tenant", map[string]interface{}{})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		_, err = r.Explain(qb)
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Unable to process query. Operator 'matches' on field 'tenantId' requires a text index on that field"))
+
+		err = qb.If(collName, "num:int >=", map[string]interface{}{})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Unable to process query. Condition 'num:int >=' is incomplete. Conditions must be in field:index_type operator value format"))
+
+		err = qb.If(collName, "num:int >= 4 &&", map[string]interface{}{})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Unable to process query. Query cannot end with conditional operator &&"))
+
+		if err := r.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should search a text index and rank results with BM25", func() {
+		r := testCreateRose(false)
+		collName := testCreateCollection(r, "text_search_coll")
+
+		type product struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+			Price       int    `json:"price"`
+		}
+
+		products := []product{
+			{Name: "Wireless headphones", Description: "Noise cancelling wireless headphones with a long battery", Price: 200},
+			{Name: "Running shoes", Description: "Light shoes for running on the road", Price: 120},
+			{Name: "Wired headphones", Description: "Headphones with a cable", Price: 30},
+			{Name: "Phone charger", Description: "Wireless charger for phones", Price: 40},
+			{Name: "Desk", Description: "A desk made of oak", Price: 300},
+		}
+
+		for _, p := range products {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(p)}, r)
+		}
+
+		// the index is built from existing documents and from writes
+		err := r.NewIndex(collName, "description", textIndexType)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(product{Name: "Sport shoes", Description: "Shoes for the gym", Price: 80})}, r)
+
+		gomega.Eventually(func() bool {
+			infos, err := r.ListIndexes(collName)
+
+			gomega.Expect(err).To(gomega.BeNil())
+
+			return infos[0].Complete
+		}, "5s", "10ms").Should(gomega.BeTrue())
+
+		qb := NewQueryBuilder()
+		err = qb.If(collName, "description:string matches #q", map[string]interface{}{"#q": "Wireless HEADPHONES"})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		plan := r.Databases[collName].planQuery(qb.query)
+		gomega.Expect(plan.IndexName).To(gomega.Equal("description"))
+		gomega.Expect(plan.Terms).To(gomega.Equal([]string{"wireless", "headphone"}))
+
+		results, err := r.Query(qb)
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(results)).To(gomega.Equal(3))
+		gomega.Expect(results[0].ID).To(gomega.Equal(1))
+		gomega.Expect(results[0].Score).To(gomega.BeNumerically(">", results[1].Score))
+		gomega.Expect(results[1].Score).To(gomega.BeNumerically(">", 0))
+
+		// stemming matches "running" and "shoes" with "run" and "shoe"
+		qb = NewQueryBuilder()
+		err = qb.If(collName, "description:string matches #q && price:int < #price", map[string]interface{}{"#q": "run shoe", "#price": "100"})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		results, err = r.Query(qb)
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(results)).To(gomega.Equal(1))
+		gomega.Expect(results[0].ID).To(gomega.Equal(6))
+
+		// a full scan with the || operator gives the same ranking
+		qb = NewQueryBuilder()
+		err = qb.If(collName, "description:string matches #q || price:int > #price", map[string]interface{}{"#q": "wireless headphones", "#price": "250"})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(r.Databases[collName].planQuery(qb.query).Index).To(gomega.BeNil())
+
+		results, err = r.Query(qb)
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(results)).To(gomega.Equal(4))
+		gomega.Expect(results[0].ID).To(gomega.Equal(1))
+		gomega.Expect(results[0].Score).To(gomega.BeNumerically(">", results[1].Score))
+		gomega.Expect(results[2].Score).To(gomega.BeNumerically(">", 0))
+		gomega.Expect(results[3].ID).To(gomega.Equal(5))
+		gomega.Expect(results[3].Score).To(gomega.Equal(float64(0)))
+
+		// deleted documents leave the index
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 1}, r)
+
+		qb = NewQueryBuilder()
+		err = qb.If(collName, "description:string matches #q", map[string]interface{}{"#q": "noise"})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		results, err = r.Query(qb)
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(results)).To(gomega.Equal(0))
+
+		qb = NewQueryBuilder()
+		err = qb.If(collName, "name:string matches #q", map[string]interface{}{"#q": "desk"})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		_, err = r.Query(qb)
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(IndexNotExistsCode))
+		gomega.Expect(err.Error()).To(gomega.Equal("Unable to process query. Operator 'matches' on field 'name' requires a text index on that field"))
+
+		qb = NewQueryBuilder()
+		err = qb.If(collName, "price:int matches #q", map[string]interface{}{"#q": "desk"})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Unable to process query. Operator 'matches' can only be used on string fields, price:int given"))
+
+		if err := r.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should find documents near a point and within a box, with and without a geo index", func() {
+		r := testCreateRose(false)
+		collName := testCreateCollection(r, "geo_coll")
+
+		type location struct {
+			Lat float64 `json:"lat"`
+			Lng float64 `json:"lng"`
+		}
+
+		type shop struct {
+			Name     string    `json:"name"`
+			Location *location `json:"location,omitempty"`
+		}
+
+		shops := []shop{
+			{Name: "far", Location: &location{Lat: 48.2, Lng: 16.37}},
+			{Name: "close", Location: &location{Lat: 45.82, Lng: 15.9819}},
+			{Name: "center", Location: &location{Lat: 45.815, Lng: 15.9819}},
+			{Name: "no location"},
+			{Name: "medium", Location: &location{Lat: 45.85, Lng: 15.9819}},
+			{Name: "outside", Location: &location{Lat: 45.9, Lng: 16.1}},
+		}
+
+		for _, s := range shops {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(s)}, r)
+		}
+
+		near := NewQueryBuilder()
+		err := near.If(collName, "location:geo near #near", map[string]interface{}{"#near": Near(45.815, 15.9819, 5000)})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		within := NewQueryBuilder()
+		err = within.If(collName, "location:geo within #box", map[string]interface{}{"#box": Within(45.8, 15.9, 45.95, 16.2)})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		assertResults := func() {
+			results, err := r.Query(near)
+
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(len(results)).To(gomega.Equal(3))
+			gomega.Expect(results[0].ID).To(gomega.Equal(3))
+			gomega.Expect(results[0].Distance).To(gomega.Equal(float64(0)))
+			gomega.Expect(results[1].ID).To(gomega.Equal(2))
+			gomega.Expect(results[1].Distance).To(gomega.BeNumerically("~", 556, 2))
+			gomega.Expect(results[2].ID).To(gomega.Equal(5))
+			gomega.Expect(results[2].Distance).To(gomega.BeNumerically("~", 3892, 5))
+
+			results, err = r.Query(within)
+
+			gomega.Expect(err).To(gomega.BeNil())
+
+			ids := make([]int, 0)
+			for _, res := range results {
+				ids = append(ids, res.ID)
+			}
+
+			gomega.Expect(ids).To(gomega.ConsistOf(2, 3, 5, 6))
+		}
+
+		// full scan
+		gomega.Expect(r.Databases[collName].planQuery(near.query).Index).To(gomega.BeNil())
+		assertResults()
+
+		err = r.NewIndex(collName, "location", geoIndexType)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		gomega.Eventually(func() bool {
+			infos, err := r.ListIndexes(collName)
+
+			gomega.Expect(err).To(gomega.BeNil())
+
+			return infos[0].Complete
+		}, "5s", "10ms").Should(gomega.BeTrue())
+
+		infos, err := r.ListIndexes(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(infos[0].Entries).To(gomega.Equal(5))
+
+		gomega.Expect(r.Databases[collName].planQuery(near.query).IndexName).To(gomega.Equal("location"))
+		gomega.Expect(r.Databases[collName].planQuery(within.query).IndexName).To(gomega.Equal("location"))
+		assertResults()
+
+		_, err = r.Write(WriteMetadata{CollectionName: collName, Data: `{"name": "invalid", "location": {"lat": 91, "lng": 0}}`})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Cannot write index. Field name 'location' is indexed as geo and must be an object with numeric 'lat' between -90 and 90 and 'lng' between -180 and 180"))
+
+		qb := NewQueryBuilder()
+		err = qb.If(collName, "location:geo == #near", map[string]interface{}{"#near": Near(45.815, 15.9819, 5000)})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Unable to process query. Operators 'near' and 'within' can only be used on geo fields and geo fields can only be compared with them, location:geo == given"))
+
+		err = qb.If(collName, "location:geo within #box", map[string]interface{}{"#box": Within(46, 15, 45, 16)})
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Unable to process query. Invalid within value '46,15,45,16'. It must be minLat,minLng,maxLat,maxLng as returned by Within()"))
+
+		gomega.Expect(geoHash(geoPoint{Lat: 57.64911, Lng: 10.40744}, 11)).To(gomega.Equal("u4pruydqqvj"))
+
+		if err := r.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
 })
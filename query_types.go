@@ -48,40 +48,45 @@ type operatorStages struct {
 	Op string
 }
 
+// a condition is always in field:type operator value format since it is validated with validateQuery()
 func (sc *singleCondition) resolveCondition(query string, params map[string]interface{}) (string, interface{}, comparisonType) {
-	for _, c := range comparisonOperators {
-		s := strings.Split(query, c)
-
-		if len(s) == 2 {
-			field := strings.TrimSpace(s[0])
-			p := strings.TrimSpace(s[1])
-			var value interface{}
-
-			if strings.Contains(p, "#") {
-				value = params[p]
-			} else {
-				value = p
-			}
+	parts := strings.Fields(query)
 
-			if c == "==" {
-				return field, value, equality
-			} else if c == "!=" {
-				return field, value, inequality
-			}  else if c == "<=" {
-				return field, value, lessEqual
-			} else if c == ">=" {
-				return field, value, moreEqual
-			} else if c == "<" {
-				return field, value, less
-			} else if  c == ">" {
-				return field, value, more
-			}
+	if len(parts) != 3 {
+		return "", "", ""
+	}
 
-			panic("Not found")
-		}
+	field := parts[0]
+	c := parts[1]
+	var value interface{}
+
+	if strings.Contains(parts[2], "#") {
+		value = params[parts[2]]
+	} else {
+		value = parts[2]
+	}
+
+	if c == "==" {
+		return field, value, equality
+	} else if c == "!=" {
+		return field, value, inequality
+	}  else if c == "<=" {
+		return field, value, lessEqual
+	} else if c == ">=" {
+		return field, value, moreEqual
+	} else if c == "<" {
+		return field, value, less
+	} else if  c == ">" {
+		return field, value, more
+	} else if c == "matches" {
+		return field, value, textMatch
+	} else if c == "near" {
+		return field, value, geoNear
+	} else if c == "within" {
+		return field, value, geoWithin
 	}
 
-	return "", "", ""
+	panic("Not found")
 }
 
 func (sc *singleCondition) getExplicitDataType(field string) (string, dataType) {
@@ -101,6 +106,8 @@ func (sc *singleCondition) getExplicitDataType(field string) (string, dataType)
 		return s[0], dateType
 	} else if t == "date_time" {
 		return s[0], dateTimeType
+	} else if t == "geo" {
+		return s[0], geoType
 	}
 
 	return field, ""
@@ -119,7 +126,7 @@ func (sq *singleQuery) createConditions(query string) []map[string]string {
 			conds = append(conds, m)
 			m = make(map[string]string)
 		} else {
-			m["query"] += p
+			m["query"] = strings.TrimSpace(m["query"] + " " + p)
 		}
 	}
 
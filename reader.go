@@ -13,6 +13,9 @@ type lineReader struct {
 	internalReader *bufio.Reader
 	off int64
 	buf []uint8
+	// number and size of deleted lines that were skipped
+	deleted int
+	deletedBytes int64
 }
 
 type offsetReader struct {
@@ -56,8 +59,10 @@ func (s *lineReader) Read() (int64, *lineReaderData, Error) {
 			return 0, nil, err
 		}
 
-		if string(s.buf[0:9]) == delMark {
+		if len(s.buf) >= len(delMark) && string(s.buf[0:len(delMark)]) == delMark {
 			s.off += int64(len(s.buf)) + 1
+			s.deleted++
+			s.deletedBytes += int64(len(s.buf)) + 1
 
 			continue
 		}
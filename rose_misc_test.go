@@ -2,10 +2,12 @@ package rose
 
 import (
 	"fmt"
+	"github.com/juju/fslock"
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
 	"io/ioutil"
 	"os"
+	"time"
 )
 
 var _ = GinkgoDescribe("Misc tests", func() {
@@ -114,4 +116,503 @@ var _ = GinkgoDescribe("Misc tests", func() {
 
 		testRemoveFileSystemDb(roseDir())
 	})
+
+	GinkgoIt("Should list, rename, truncate and drop collections", func() {
+		a := testCreateRose(false)
+
+		testCreateCollection(a, "coll_b")
+		testCreateCollection(a, "coll_a")
+		testCreateCollection(a, "coll_c")
+
+		gomega.Expect(a.ListCollections()).To(gomega.Equal([]string{"coll_a", "coll_b", "coll_c"}))
+
+		err := a.NewIndex("coll_a", "email", stringIndexType)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		err = a.NewIndex("coll_b", "email", stringIndexType)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		for i := 0; i < 10; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: "coll_a", Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: "coll_b", Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		err = a.RenameCollection("coll_a", "coll_b")
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid rename request. Collection coll_b already exists"))
+
+		err = a.RenameCollection("coll_a", "../coll")
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid rename request. Collection name '../coll' is not a valid directory name"))
+
+		// a rename that fails after the directory was moved is undone and the collection stays under its old name
+		blocker := fmt.Sprintf("%s.tmp", roseSchemaLocation())
+		gomega.Expect(os.MkdirAll(fmt.Sprintf("%s/blocker", blocker), os.ModePerm)).To(gomega.BeNil())
+
+		err = a.RenameCollection("coll_a", "coll_renamed")
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(os.RemoveAll(blocker)).To(gomega.BeNil())
+
+		gomega.Expect(a.ListCollections()).To(gomega.Equal([]string{"coll_a", "coll_b", "coll_c"}))
+
+		_, statErr := os.Stat(fmt.Sprintf("%s/%s", roseDbDir(), "coll_renamed"))
+		gomega.Expect(os.IsNotExist(statErr)).To(gomega.BeTrue())
+
+		res, err := a.ReadBy(ReadByMetadata{CollectionName: "coll_a", Field: "email", Value: "3@gmail.com", DataType: stringIndexType})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(res.Data)).To(gomega.Equal(1))
+
+		err = a.RenameCollection("coll_a", "coll_renamed")
+		gomega.Expect(err).To(gomega.BeNil())
+
+		gomega.Expect(a.ListCollections()).To(gomega.Equal([]string{"coll_b", "coll_c", "coll_renamed"}))
+
+		res, err = a.ReadBy(ReadByMetadata{
+			CollectionName: "coll_renamed",
+			Field:          "email",
+			Value:          "3@gmail.com",
+			DataType:       stringIndexType,
+		})
+
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(res.Data)).To(gomega.Equal(1))
+		gomega.Expect(res.Data[0].ID).To(gomega.Equal(4))
+
+		err = a.TruncateCollection("coll_b")
+		gomega.Expect(err).To(gomega.BeNil())
+
+		read, err := a.Read(ReadMetadata{CollectionName: "coll_b", ID: 1, Data: &TestUser{}})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(read.Status).To(gomega.Equal(NotFoundResultStatus))
+
+		w := testSingleConcurrentInsert(WriteMetadata{CollectionName: "coll_b", Data: testAsJsonInterface(TestUser{Email: "new@gmail.com"})}, a)
+		gomega.Expect(w.ID).To(gomega.Equal(1))
+
+		infos, err := a.ListIndexes("coll_b")
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(infos[0].Entries).To(gomega.Equal(1))
+		gomega.Expect(infos[0].Complete).To(gomega.BeTrue())
+
+		err = a.DropCollection("coll_c")
+		gomega.Expect(err).To(gomega.BeNil())
+
+		err = a.DropCollection("coll_c")
+
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid drop request. Collection coll_c does not exist"))
+
+		_, statErr = os.Stat(fmt.Sprintf("%s/%s", roseDbDir(), "coll_c"))
+		gomega.Expect(os.IsNotExist(statErr)).To(gomega.BeTrue())
+
+		_, err = a.Write(WriteMetadata{CollectionName: "coll_c", Data: testAsJsonInterface(TestUser{})})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+
+		err = a.DropCollection("coll_b")
+		gomega.Expect(err).To(gomega.BeNil())
+
+		b, e := ioutil.ReadFile(roseIndexLocation())
+
+		gomega.Expect(e).To(gomega.BeNil())
+		gomega.Expect(string(b)).To(gomega.ContainSubstring("coll_renamed"))
+		gomega.Expect(string(b)).To(gomega.Not(gomega.ContainSubstring("coll_a")))
+		gomega.Expect(string(b)).To(gomega.Not(gomega.ContainSubstring("coll_b")))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		a = testCreateRose(false)
+
+		gomega.Expect(a.ListCollections()).To(gomega.Equal([]string{"coll_renamed"}))
+
+		infos, err = a.ListIndexes("coll_renamed")
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(infos[0].Entries).To(gomega.Equal(10))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should drop a collection while documents are written into it", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "drop_concurrent_coll")
+
+		done := make(chan bool)
+		go func() {
+			defer ginkgo.GinkgoRecover()
+
+			for i := 0; i < 500; i++ {
+				// writes after the drop fail since the collection does not exist
+				_, err := a.Write(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "a@gmail.com"})})
+
+				if err != nil {
+					gomega.Expect(err.Error()).To(gomega.Equal(fmt.Sprintf("Invalid write request. Collection %s does not exist", collName)))
+				}
+			}
+
+			done <- true
+		}()
+
+		err := a.DropCollection(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		<-done
+
+		gomega.Expect(a.ListCollections()).To(gomega.BeEmpty())
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should return statistics of a collection, also after restart", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "stats_coll")
+
+		err := a.NewIndex(collName, "email", stringIndexType)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		for i := 0; i < 20; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		for i := 1; i <= 3; i++ {
+			testSingleDelete(DeleteMetadata{CollectionName: collName, ID: i}, a)
+		}
+
+		for i := 4; i <= 5; i++ {
+			testSingleReplace(ReplaceMetadata{CollectionName: collName, ID: i, Data: testAsJsonInterface(TestUser{Email: "replaced@gmail.com"})}, a)
+		}
+
+		assertStats := func(stats *CollectionStats) {
+			gomega.Expect(stats.Name).To(gomega.Equal(collName))
+			gomega.Expect(stats.Documents).To(gomega.Equal(17))
+			gomega.Expect(stats.Blocks).To(gomega.Equal(1))
+			gomega.Expect(stats.Tombstones).To(gomega.Equal(map[uint16]int{0: 5}))
+			gomega.Expect(stats.TotalTombstones).To(gomega.Equal(5))
+			gomega.Expect(stats.LiveBytes).To(gomega.BeNumerically("<", stats.TotalBytes))
+			gomega.Expect(stats.Fragmentation).To(gomega.BeNumerically("~", 1-float64(stats.LiveBytes)/float64(stats.TotalBytes)))
+			gomega.Expect(stats.Fragmentation).To(gomega.BeNumerically(">", 0.1))
+			gomega.Expect(len(stats.Indexes)).To(gomega.Equal(1))
+			gomega.Expect(stats.Indexes[0].Entries).To(gomega.Equal(17))
+			gomega.Expect(stats.IndexBytes).To(gomega.Equal(stats.Indexes[0].MemoryBytes))
+			gomega.Expect(stats.Workers).To(gomega.Equal(10))
+		}
+
+		stats, err := a.Stats(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		assertStats(stats)
+
+		size, err := a.Size()
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(uint64(stats.TotalBytes)).To(gomega.Equal(size))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		a = testCreateRose(false)
+
+		restarted, err := a.Stats(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		assertStats(restarted)
+		gomega.Expect(restarted.LiveBytes).To(gomega.Equal(stats.LiveBytes))
+
+		_, err = a.Stats("not_exists")
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid stats request. Collection not_exists does not exist"))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should compact a collection and keep reads and indexes valid, also after restart", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "compact_coll")
+
+		err := a.NewIndex(collName, "email", stringIndexType)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		for i := 0; i < 20; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		for i := 1; i <= 3; i++ {
+			testSingleDelete(DeleteMetadata{CollectionName: collName, ID: i}, a)
+		}
+
+		for i := 4; i <= 5; i++ {
+			testSingleReplace(ReplaceMetadata{CollectionName: collName, ID: i, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("replaced_%d@gmail.com", i)})}, a)
+		}
+
+		res, err := a.Compact(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(res.CompactedBlocks).To(gomega.Equal(1))
+		gomega.Expect(res.RemovedTombstones).To(gomega.Equal(5))
+		gomega.Expect(res.ReclaimedBytes).To(gomega.BeNumerically(">", 0))
+
+		assertCompacted := func() {
+			stats, err := a.Stats(collName)
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(stats.Documents).To(gomega.Equal(17))
+			gomega.Expect(stats.TotalTombstones).To(gomega.Equal(0))
+			gomega.Expect(stats.LiveBytes).To(gomega.Equal(stats.TotalBytes))
+
+			for i := 1; i <= 20; i++ {
+				u := TestUser{}
+				res := testSingleRead(ReadMetadata{ID: i, Data: &u, CollectionName: collName}, a)
+
+				if i <= 3 {
+					gomega.Expect(res.Status).To(gomega.Equal(NotFoundResultStatus))
+				} else if i <= 5 {
+					gomega.Expect(res.Status).To(gomega.Equal(FoundResultStatus))
+					gomega.Expect(u.Email).To(gomega.Equal(fmt.Sprintf("replaced_%d@gmail.com", i)))
+				} else {
+					gomega.Expect(res.Status).To(gomega.Equal(FoundResultStatus))
+					gomega.Expect(u.Email).To(gomega.Equal(fmt.Sprintf("%d@gmail.com", i-1)))
+				}
+			}
+
+			readBy, err := a.ReadBy(ReadByMetadata{
+				CollectionName: collName,
+				Field:          "email",
+				Value:          "15@gmail.com",
+				DataType:       stringIndexType,
+			})
+
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(len(readBy.Data)).To(gomega.Equal(1))
+			gomega.Expect(readBy.Data[0].ID).To(gomega.Equal(16))
+			gomega.Expect(readBy.Data[0].Data.(map[string]interface{})["email"]).To(gomega.Equal("15@gmail.com"))
+		}
+
+		assertCompacted()
+
+		// writes after compaction go to the end of the rewritten block
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: "after@gmail.com"})}, a)
+		u := TestUser{}
+		gomega.Expect(testSingleRead(ReadMetadata{ID: 21, Data: &u, CollectionName: collName}, a).Status).To(gomega.Equal(FoundResultStatus))
+		gomega.Expect(u.Email).To(gomega.Equal("after@gmail.com"))
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 21}, a)
+
+		res, err = a.Compact(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(res.CompactedBlocks).To(gomega.Equal(1))
+
+		res, err = a.Compact(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(res.CompactedBlocks).To(gomega.Equal(0))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		// an unfinished rewrite is removed on boot and the block stays intact
+		gomega.Expect(ioutil.WriteFile(fmt.Sprintf("%s/%s/block_0.rose.tmp", roseDbDir(), collName), []byte("partial"), 0666)).To(gomega.BeNil())
+
+		a = testCreateRose(false)
+
+		assertCompacted()
+
+		_, statErr := os.Stat(fmt.Sprintf("%s/%s/block_0.rose.tmp", roseDbDir(), collName))
+		gomega.Expect(os.IsNotExist(statErr)).To(gomega.BeTrue())
+
+		_, err = a.Compact("not_exists")
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid compact request. Collection not_exists does not exist"))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should compact blocks in the background by tombstone ratio", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "compactor_coll")
+
+		for i := 0; i < 20; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		err := a.StartCompactor(CompactorOptions{Interval: 0})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid compactor options. Interval must be greater than 0"))
+
+		err = a.StartCompactor(CompactorOptions{Interval: 10 * time.Millisecond, MinTombstoneRatio: 0.25})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		err = a.StartCompactor(CompactorOptions{Interval: 10 * time.Millisecond, MinTombstoneRatio: 0.25})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid compactor request. Compactor is already running"))
+
+		tombstones := func() int {
+			stats, err := a.Stats(collName)
+			gomega.Expect(err).To(gomega.BeNil())
+
+			return stats.TotalTombstones
+		}
+
+		// 2 of 20 lines is below the ratio
+		for i := 1; i <= 2; i++ {
+			testSingleDelete(DeleteMetadata{CollectionName: collName, ID: i}, a)
+		}
+
+		gomega.Consistently(tombstones, 100*time.Millisecond, 10*time.Millisecond).Should(gomega.Equal(2))
+
+		for i := 3; i <= 5; i++ {
+			testSingleDelete(DeleteMetadata{CollectionName: collName, ID: i}, a)
+		}
+
+		gomega.Eventually(tombstones, time.Second, 10*time.Millisecond).Should(gomega.Equal(0))
+
+		for i := 6; i <= 20; i++ {
+			u := TestUser{}
+			res := testSingleRead(ReadMetadata{ID: i, Data: &u, CollectionName: collName}, a)
+
+			gomega.Expect(res.Status).To(gomega.Equal(FoundResultStatus))
+			gomega.Expect(u.Email).To(gomega.Equal(fmt.Sprintf("%d@gmail.com", i-1)))
+		}
+
+		a.StopCompactor()
+		a.StopCompactor()
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should defragment a block after enough replaces and keep field indexes valid", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "defragment_coll")
+
+		err := a.NewIndex(collName, "email", stringIndexType)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		for i := 0; i < 10; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		for i := 0; i < defragmentMark; i++ {
+			testSingleReplace(ReplaceMetadata{CollectionName: collName, ID: 1, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("replaced_%d@gmail.com", i)})}, a)
+		}
+
+		stats, err := a.Stats(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(stats.TotalTombstones).To(gomega.Equal(0))
+		gomega.Expect(stats.LiveBytes).To(gomega.Equal(stats.TotalBytes))
+
+		for i := 5; i <= 10; i++ {
+			res, err := a.ReadBy(ReadByMetadata{
+				CollectionName: collName,
+				Field:          "email",
+				Value:          fmt.Sprintf("%d@gmail.com", i-1),
+				DataType:       stringIndexType,
+			})
+
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(len(res.Data)).To(gomega.Equal(1))
+			gomega.Expect(res.Data[0].ID).To(gomega.Equal(i))
+			gomega.Expect(res.Data[0].Data.(map[string]interface{})["email"]).To(gomega.Equal(fmt.Sprintf("%d@gmail.com", i-1)))
+		}
+
+		u := TestUser{}
+		gomega.Expect(testSingleRead(ReadMetadata{ID: 1, Data: &u, CollectionName: collName}, a).Status).To(gomega.Equal(FoundResultStatus))
+		gomega.Expect(u.Email).To(gomega.Equal(fmt.Sprintf("replaced_%d@gmail.com", defragmentMark-1)))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should skip defragmentation of a block that is locked by another process", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "locked_coll")
+
+		for i := 0; i < 10; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 1}, a)
+
+		l := fslock.New(roseBlockFile(0, fmt.Sprintf("%s/%s", roseDbDir(), collName)))
+		gomega.Expect(l.TryLock()).To(gomega.BeNil())
+
+		res, err := a.Compact(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(res.CompactedBlocks).To(gomega.Equal(0))
+
+		// replaces that reach the defragmentation mark go on while the block is locked
+		for i := 0; i < defragmentMark+1; i++ {
+			testSingleReplace(ReplaceMetadata{CollectionName: collName, ID: 2, Data: testAsJsonInterface(TestUser{Email: "replaced@gmail.com"})}, a)
+		}
+
+		stats, err := a.Stats(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(stats.TotalTombstones).To(gomega.Equal(defragmentMark + 2))
+
+		gomega.Expect(l.Unlock()).To(gomega.BeNil())
+
+		testSingleReplace(ReplaceMetadata{CollectionName: collName, ID: 2, Data: testAsJsonInterface(TestUser{Email: "replaced@gmail.com"})}, a)
+
+		stats, err = a.Stats(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(stats.TotalTombstones).To(gomega.Equal(0))
+		gomega.Expect(stats.Documents).To(gomega.Equal(9))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
 })
@@ -0,0 +1,611 @@
+package rose
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/valyala/fastjson"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var schemaTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+// keywords that describe a schema but do not validate anything
+var schemaAnnotations = []string{"$schema", "$id", "$comment", "title", "description", "default", "examples"}
+
+// a compiled JSON Schema, see SetSchema for the keywords that it supports
+type jsonSchema struct {
+	// false schema, nothing is valid
+	never bool
+	types []string
+	required []string
+	properties map[string]*jsonSchema
+	additionalProperties *jsonSchema
+	items *jsonSchema
+	enum []interface{}
+	enumSource string
+	minimum *float64
+	maximum *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	minLength *int
+	maxLength *int
+	minItems *int
+	maxItems *int
+	pattern *regexp.Regexp
+}
+
+/**
+Attaches a JSON Schema to a collection. Every document that Write, BulkWrite, Replace and Import write afterwards must
+match it, documents that are already in the collection are not checked. A document that does not match is rejected with
+SchemaViolationCode and a message that lists every path that violates the schema. The schema is saved in .rose_db/schemas.rose.
+
+Rose supports a subset of JSON Schema draft 2020-12: type, required, properties, additionalProperties, items, enum,
+minimum, maximum, exclusiveMinimum, exclusiveMaximum, minLength, maxLength, minItems, maxItems and pattern. Patterns
+are Go regular expressions. A schema with any other keyword is rejected instead of being partially applied.
+*/
+func (a *Rose) SetSchema(collName string, schema string) Error {
+	a.collLock.Lock()
+	defer a.collLock.Unlock()
+
+	d, ok := a.Databases[collName]
+
+	if !ok {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid schema request. Collection %s does not exist", collName))
+	}
+
+	compiled, err := compileSchema([]uint8(schema))
+
+	if err != nil {
+		return err
+	}
+
+	if err := updateSchemas(func(schemas map[string]json.RawMessage) {
+		schemas[collName] = json.RawMessage(schema)
+	}); err != nil {
+		return err
+	}
+
+	d.Lock()
+	d.schema = compiled
+	d.Unlock()
+
+	return nil
+}
+
+// returns the schema of a collection as compacted JSON, an empty string if it has none
+func (a *Rose) Schema(collName string) (string, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
+	if _, ok := a.Databases[collName]; !ok {
+		return "", newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid schema request. Collection %s does not exist", collName))
+	}
+
+	schemas, err := readSchemas()
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(schemas[collName]), nil
+}
+
+func (a *Rose) RemoveSchema(collName string) Error {
+	a.collLock.Lock()
+	defer a.collLock.Unlock()
+
+	d, ok := a.Databases[collName]
+
+	if !ok {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid schema request. Collection %s does not exist", collName))
+	}
+
+	if err := removeSchema(collName); err != nil {
+		return err
+	}
+
+	d.Lock()
+	d.schema = nil
+	d.Unlock()
+
+	return nil
+}
+
+func roseSchemaLocation() string {
+	return fmt.Sprintf("%s/%s", roseDir(), "schemas.rose")
+}
+
+// schemas.rose holds a JSON object with the schema of every collection that has one
+func readSchemas() (map[string]json.RawMessage, Error) {
+	return readSchemasFile(roseSchemaLocation())
+}
+
+func readSchemasFile(location string) (map[string]json.RawMessage, Error) {
+	schemas := make(map[string]json.RawMessage)
+
+	b, e := ioutil.ReadFile(location)
+
+	if os.IsNotExist(e) {
+		return schemas, nil
+	}
+
+	if e != nil {
+		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to read %s: %s", location, e.Error()))
+	}
+
+	if e := json.Unmarshal(b, &schemas); e != nil {
+		return nil, newError(DbIntegrityMasterErrorCode, MalformedIndexCode, fmt.Sprintf("Unable to read %s. The file is malformed: %s", location, e.Error()))
+	}
+
+	return schemas, nil
+}
+
+// rewrites schemas.rose with the changes of fn. The caller must hold collLock for writing
+func updateSchemas(fn func(schemas map[string]json.RawMessage)) Error {
+	schemas, err := readSchemas()
+
+	if err != nil {
+		return err
+	}
+
+	fn(schemas)
+
+	b, e := json.Marshal(schemas)
+
+	if e != nil {
+		return newError(SystemMasterErrorCode, DataConversionCode, fmt.Sprintf("Unable to save schemas: %s", e.Error()))
+	}
+
+	return replaceFile(roseSchemaLocation(), b)
+}
+
+func removeSchema(collName string) Error {
+	return updateSchemas(func(schemas map[string]json.RawMessage) {
+		delete(schemas, collName)
+	})
+}
+
+func renameSchema(collName string, newName string) Error {
+	return updateSchemas(func(schemas map[string]json.RawMessage) {
+		if schema, ok := schemas[collName]; ok {
+			schemas[newName] = schema
+			delete(schemas, collName)
+		}
+	})
+}
+
+// compiles the saved schema of a collection, nil if it has none
+func loadSchema(collName string) (*jsonSchema, Error) {
+	schemas, err := readSchemas()
+
+	if err != nil {
+		return nil, err
+	}
+
+	schema, ok := schemas[collName]
+
+	if !ok {
+		return nil, nil
+	}
+
+	compiled, err := compileSchema(schema)
+
+	if err != nil {
+		return nil, newError(DbIntegrityMasterErrorCode, MalformedIndexCode, fmt.Sprintf("Schema of collection %s in %s is invalid: %s", collName, roseSchemaLocation(), err.Error()))
+	}
+
+	return compiled, nil
+}
+
+func compileSchema(b []uint8) (*jsonSchema, Error) {
+	var p fastjson.Parser
+
+	v, e := p.ParseBytes(b)
+
+	if e != nil {
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid schema. Schema must be valid JSON: %s", e.Error()))
+	}
+
+	return compileSchemaValue(v, "")
+}
+
+func compileSchemaValue(v *fastjson.Value, path string) (*jsonSchema, Error) {
+	invalid := func(keyword string, msg string) Error {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid schema. %s/%s %s", path, keyword, msg))
+	}
+
+	switch v.Type() {
+	case fastjson.TypeTrue:
+		return &jsonSchema{}, nil
+	case fastjson.TypeFalse:
+		return &jsonSchema{never: true}, nil
+	case fastjson.TypeObject:
+	default:
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid schema. %s must be an object or a boolean", schemaPathName(path)))
+	}
+
+	s := &jsonSchema{}
+	obj, _ := v.Object()
+
+	var err Error
+	obj.Visit(func(key []uint8, kv *fastjson.Value) {
+		if err != nil {
+			return
+		}
+
+		keyword := string(key)
+
+		switch keyword {
+		case "type":
+			s.types, err = compileSchemaTypes(kv, invalid)
+		case "required":
+			s.required, err = compileSchemaStrings(kv, func() Error { return invalid(keyword, "must be an array of strings") })
+		case "properties":
+			props, e := kv.Object()
+
+			if e != nil {
+				err = invalid(keyword, "must be an object")
+
+				return
+			}
+
+			s.properties = make(map[string]*jsonSchema)
+			props.Visit(func(name []uint8, pv *fastjson.Value) {
+				if err != nil {
+					return
+				}
+
+				s.properties[string(name)], err = compileSchemaValue(pv, fmt.Sprintf("%s/properties/%s", path, escapeSchemaPath(string(name))))
+			})
+		case "additionalProperties", "items":
+			var sub *jsonSchema
+			sub, err = compileSchemaValue(kv, fmt.Sprintf("%s/%s", path, keyword))
+
+			if keyword == "items" {
+				s.items = sub
+			} else {
+				s.additionalProperties = sub
+			}
+		case "enum":
+			values, e := kv.Array()
+
+			if e != nil || len(values) == 0 {
+				err = invalid(keyword, "must be an array with at least one value")
+
+				return
+			}
+
+			for _, ev := range values {
+				s.enum = append(s.enum, schemaValue(ev))
+			}
+
+			s.enumSource = kv.String()
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum":
+			f, e := kv.Float64()
+
+			if e != nil {
+				err = invalid(keyword, "must be a number")
+
+				return
+			}
+
+			switch keyword {
+			case "minimum":
+				s.minimum = &f
+			case "maximum":
+				s.maximum = &f
+			case "exclusiveMinimum":
+				s.exclusiveMinimum = &f
+			default:
+				s.exclusiveMaximum = &f
+			}
+		case "minLength", "maxLength", "minItems", "maxItems":
+			n, e := kv.Int()
+
+			if e != nil || n < 0 {
+				err = invalid(keyword, "must be a non-negative integer")
+
+				return
+			}
+
+			switch keyword {
+			case "minLength":
+				s.minLength = &n
+			case "maxLength":
+				s.maxLength = &n
+			case "minItems":
+				s.minItems = &n
+			default:
+				s.maxItems = &n
+			}
+		case "pattern":
+			str, e := kv.StringBytes()
+
+			if e != nil {
+				err = invalid(keyword, "must be a string")
+
+				return
+			}
+
+			re, e := regexp.Compile(string(str))
+
+			if e != nil {
+				err = invalid(keyword, fmt.Sprintf("is not a valid regular expression: %s", e.Error()))
+
+				return
+			}
+
+			s.pattern = re
+		default:
+			if !containsString(schemaAnnotations, keyword) {
+				err = invalid(keyword, "is not supported")
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func compileSchemaTypes(v *fastjson.Value, invalid func(keyword string, msg string) Error) ([]string, Error) {
+	var types []string
+
+	if v.Type() == fastjson.TypeString {
+		types = []string{string(v.GetStringBytes())}
+	} else {
+		var err Error
+		types, err = compileSchemaStrings(v, func() Error { return invalid("type", "must be a string or an array of strings") })
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, t := range types {
+		if !containsString(schemaTypes, t) {
+			return nil, invalid("type", fmt.Sprintf("holds unknown type '%s'. Types are %v", t, schemaTypes))
+		}
+	}
+
+	return types, nil
+}
+
+func compileSchemaStrings(v *fastjson.Value, invalid func() Error) ([]string, Error) {
+	values, e := v.Array()
+
+	if e != nil {
+		return nil, invalid()
+	}
+
+	strs := make([]string, 0, len(values))
+	for _, sv := range values {
+		s, e := sv.StringBytes()
+
+		if e != nil {
+			return nil, invalid()
+		}
+
+		strs = append(strs, string(s))
+	}
+
+	return strs, nil
+}
+
+// validates a document and returns an error that lists every violation
+func (s *jsonSchema) check(collName string, val []uint8) Error {
+	var p fastjson.Parser
+
+	v, e := p.ParseBytes(val)
+
+	if e != nil {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Document is not valid JSON: %s", e.Error()))
+	}
+
+	violations := make([]string, 0)
+	s.validate(v, "", &violations)
+
+	if len(violations) == 0 {
+		return nil
+	}
+
+	return newError(ValidationMasterErrorCode, SchemaViolationCode, fmt.Sprintf("Document does not match the schema of collection %s: %s", collName, strings.Join(violations, "; ")))
+}
+
+func (s *jsonSchema) validate(v *fastjson.Value, path string, violations *[]string) {
+	violate := func(path string, msg string) {
+		*violations = append(*violations, fmt.Sprintf("%s %s", schemaPathName(path), msg))
+	}
+
+	if s.never {
+		violate(path, "is not allowed")
+
+		return
+	}
+
+	if len(s.types) > 0 && !s.matchesType(v) {
+		violate(path, fmt.Sprintf("must be of type %s, %s given", strings.Join(s.types, " or "), schemaTypeOf(v)))
+
+		return
+	}
+
+	if len(s.enum) > 0 {
+		value := schemaValue(v)
+		found := false
+
+		for _, ev := range s.enum {
+			if reflect.DeepEqual(ev, value) {
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			violate(path, fmt.Sprintf("must be one of %s", s.enumSource))
+		}
+	}
+
+	switch v.Type() {
+	case fastjson.TypeNumber:
+		f := v.GetFloat64()
+
+		if s.minimum != nil && f < *s.minimum {
+			violate(path, fmt.Sprintf("must be >= %v", *s.minimum))
+		}
+
+		if s.maximum != nil && f > *s.maximum {
+			violate(path, fmt.Sprintf("must be <= %v", *s.maximum))
+		}
+
+		if s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum {
+			violate(path, fmt.Sprintf("must be > %v", *s.exclusiveMinimum))
+		}
+
+		if s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum {
+			violate(path, fmt.Sprintf("must be < %v", *s.exclusiveMaximum))
+		}
+	case fastjson.TypeString:
+		str := string(v.GetStringBytes())
+		l := utf8.RuneCountInString(str)
+
+		if s.minLength != nil && l < *s.minLength {
+			violate(path, fmt.Sprintf("must be at least %d characters long", *s.minLength))
+		}
+
+		if s.maxLength != nil && l > *s.maxLength {
+			violate(path, fmt.Sprintf("must be at most %d characters long", *s.maxLength))
+		}
+
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			violate(path, fmt.Sprintf("must match pattern %s", s.pattern.String()))
+		}
+	case fastjson.TypeArray:
+		items, _ := v.Array()
+
+		if s.minItems != nil && len(items) < *s.minItems {
+			violate(path, fmt.Sprintf("must have at least %d items", *s.minItems))
+		}
+
+		if s.maxItems != nil && len(items) > *s.maxItems {
+			violate(path, fmt.Sprintf("must have at most %d items", *s.maxItems))
+		}
+
+		if s.items != nil {
+			for i, item := range items {
+				s.items.validate(item, fmt.Sprintf("%s/%d", path, i), violations)
+			}
+		}
+	case fastjson.TypeObject:
+		obj, _ := v.Object()
+
+		for _, name := range s.required {
+			if obj.Get(name) == nil {
+				violate(fmt.Sprintf("%s/%s", path, escapeSchemaPath(name)), "is required")
+			}
+		}
+
+		// in the order of the document so that violations are listed in a stable order
+		obj.Visit(func(key []uint8, pv *fastjson.Value) {
+			name := string(key)
+			propPath := fmt.Sprintf("%s/%s", path, escapeSchemaPath(name))
+
+			if prop, ok := s.properties[name]; ok {
+				prop.validate(pv, propPath, violations)
+			} else if s.additionalProperties != nil {
+				s.additionalProperties.validate(pv, propPath, violations)
+			}
+		})
+	}
+}
+
+func (s *jsonSchema) matchesType(v *fastjson.Value) bool {
+	t := schemaTypeOf(v)
+
+	for _, st := range s.types {
+		if st == t || (st == "number" && t == "integer") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// JSON Schema type of a value. Numbers without a fraction are integers
+func schemaTypeOf(v *fastjson.Value) string {
+	switch v.Type() {
+	case fastjson.TypeObject:
+		return "object"
+	case fastjson.TypeArray:
+		return "array"
+	case fastjson.TypeString:
+		return "string"
+	case fastjson.TypeNumber:
+		if f := v.GetFloat64(); f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+
+		return "number"
+	case fastjson.TypeTrue, fastjson.TypeFalse:
+		return "boolean"
+	}
+
+	return "null"
+}
+
+// a value that can be compared with reflect.DeepEqual, numbers are float64 so that 1 and 1.0 are equal
+func schemaValue(v *fastjson.Value) interface{} {
+	var value interface{}
+	_ = json.Unmarshal(v.MarshalTo(nil), &value)
+
+	return value
+}
+
+// JSON pointer of a path, / for the document itself
+func schemaPathName(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	return path
+}
+
+func escapeSchemaPath(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the schemas of the given collections, for a backup
+func collectionSchemas(names []string) (map[string]json.RawMessage, Error) {
+	schemas, err := readSchemas()
+
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make(map[string]json.RawMessage)
+	for _, name := range names {
+		if schema, ok := schemas[name]; ok {
+			kept[name] = schema
+		}
+	}
+
+	return kept, nil
+}
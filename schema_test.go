@@ -0,0 +1,165 @@
+package rose
+
+import (
+	"context"
+	"fmt"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+)
+
+const testSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"required": ["email", "type"],
+	"properties": {
+		"email": {"type": "string", "pattern": "^[^@]+@[^@]+$", "maxLength": 30},
+		"type": {"enum": ["user", "company"]},
+		"age": {"type": "integer", "minimum": 18, "exclusiveMaximum": 150},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string", "minLength": 2}},
+		"address": {
+			"type": "object",
+			"required": ["city"],
+			"properties": {"city": {"type": "string"}},
+			"additionalProperties": false
+		}
+	}
+}`
+
+var _ = GinkgoDescribe("JSON Schema tests", func() {
+	GinkgoIt("Should validate writes against the schema of a collection and list every violation", func() {
+		dir, e := ioutil.TempDir("", "rose_schema")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dir)
+
+		defer func() {
+			SetDataDir("")
+			_ = os.RemoveAll(dir)
+		}()
+
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "schema_coll")
+
+		// written before the schema, not checked
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: `{"name": "no email"}`}, a)
+
+		gomega.Expect(a.SetSchema(collName, testSchema)).To(gomega.BeNil())
+
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: `{"email": "first@gmail.com", "type": "user", "age": 20, "tags": ["go"], "address": {"city": "Zagreb"}}`}, a)
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: `{"email": "second@gmail.com", "type": "company", "age": 30.0}`}, a)
+
+		_, err := a.Write(WriteMetadata{CollectionName: collName, Data: `{"email": "invalid", "age": 17.5, "tags": ["go", "a", "rust"], "address": {"street": "Ilica"}}`})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetMasterCode()).To(gomega.Equal(ValidationMasterErrorCode))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(SchemaViolationCode))
+		gomega.Expect(err.Error()).To(gomega.Equal("Document does not match the schema of collection schema_coll: " +
+			"/type is required; " +
+			"/email must match pattern ^[^@]+@[^@]+$; " +
+			"/age must be of type integer, number given; " +
+			"/tags must have at most 2 items; " +
+			"/tags/1 must be at least 2 characters long; " +
+			"/address/city is required; " +
+			"/address/street is not allowed"))
+
+		_, err = a.Write(WriteMetadata{CollectionName: collName, Data: `["not", "an", "object"]`})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Document does not match the schema of collection schema_coll: / must be of type object, array given"))
+
+		_, err = a.Write(WriteMetadata{CollectionName: collName, Data: `{"email": "third@gmail.com", "type": "admin", "age": 150}`})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal(`Document does not match the schema of collection schema_coll: /type must be one of ["user","company"]; /age must be < 150`))
+
+		// nothing is written if a single document of a bulk write does not match
+		_, err = a.BulkWrite(BulkWriteMetadata{CollectionName: collName, Data: []interface{}{
+			`{"email": "third@gmail.com", "type": "user"}`,
+			`{"email": "fourth@gmail.com"}`,
+		}})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(SchemaViolationCode))
+		gomega.Expect(len(a.Databases[collName].PrimaryIndex)).To(gomega.Equal(3))
+
+		_, err = a.Replace(ReplaceMetadata{CollectionName: collName, ID: 2, Data: `{"email": "first@gmail.com"}`})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Document does not match the schema of collection schema_coll: /type is required"))
+
+		testSingleReplace(ReplaceMetadata{CollectionName: collName, ID: 2, Data: `{"email": "replaced@gmail.com", "type": "company"}`}, a)
+
+		for schema, msg := range map[string]string{
+			`{"type": "text"}`: "Invalid schema. /type holds unknown type 'text'. Types are [object array string number integer boolean null]",
+			`{"properties": {"age": {"minimum": "18"}}}`: "Invalid schema. /properties/age/minimum must be a number",
+			`{"oneOf": [{"type": "string"}]}`: "Invalid schema. /oneOf is not supported",
+			`{"pattern": "("}`: "Invalid schema. /pattern is not a valid regular expression: error parsing regexp: missing closing ): `(`",
+			`[]`: "Invalid schema. / must be an object or a boolean",
+		} {
+			err = a.SetSchema(collName, schema)
+			gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+			gomega.Expect(err.GetCode()).To(gomega.Equal(InvalidUserSuppliedDataCode))
+			gomega.Expect(err.Error()).To(gomega.Equal(msg))
+		}
+
+		err = a.SetSchema("not_exists", testSchema)
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid schema request. Collection not_exists does not exist"))
+
+		// a schema is kept after a restart, a rename and a truncate
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+
+		a = testCreateRose(false)
+
+		schema, err := a.Schema(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(schema).To(gomega.MatchJSON(testSchema))
+
+		gomega.Expect(a.RenameCollection(collName, "schema_renamed")).To(gomega.BeNil())
+		collName = "schema_renamed"
+
+		gomega.Expect(a.TruncateCollection(collName)).To(gomega.BeNil())
+
+		_, err = a.Write(WriteMetadata{CollectionName: collName, Data: `{"email": "first@gmail.com"}`})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(SchemaViolationCode))
+
+		backupDir, e := ioutil.TempDir("", "rose_schema_backup")
+		gomega.Expect(e).To(gomega.BeNil())
+		defer os.RemoveAll(backupDir)
+
+		manifest, err := a.Backup(context.Background(), backupDir)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(manifest.SchemasChecksum).To(gomega.Not(gomega.BeEmpty()))
+
+		gomega.Expect(a.RemoveSchema(collName)).To(gomega.BeNil())
+
+		schema, err = a.Schema(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(schema).To(gomega.BeEmpty())
+
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: `{"email": "first@gmail.com"}`}, a)
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+
+		gomega.Expect(Restore(backupDir)).To(gomega.BeNil())
+
+		a = testCreateRose(false)
+
+		_, err = a.Write(WriteMetadata{CollectionName: collName, Data: `{"email": "first@gmail.com"}`})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.GetCode()).To(gomega.Equal(SchemaViolationCode))
+
+		gomega.Expect(a.DropCollection(collName)).To(gomega.BeNil())
+		gomega.Expect(a.NewCollection(collName)).To(gomega.BeNil())
+
+		schema, err = a.Schema(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(schema).To(gomega.BeEmpty())
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+	})
+})
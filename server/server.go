@@ -0,0 +1,1011 @@
+/**
+Package server exposes a Rose database over HTTP with JSON bodies.
+
+Every route lives under /collections:
+
+	GET    /collections                             lists collections
+	POST   /collections                             creates a collection, {"name": "users", "options": {"maxDocuments": 1000}}
+	DELETE /collections/{coll}                      drops a collection
+	POST   /collections/{coll}/rename               renames a collection, {"name": "people"}
+	POST   /collections/{coll}/truncate             removes every document of a collection
+	GET    /collections/{coll}/stats                statistics of a collection
+	POST   /collections/{coll}/compact              compacts the blocks of a collection
+	POST   /collections/{coll}/documents            writes the JSON body as a document
+	POST   /collections/{coll}/documents/bulk       writes every document of a JSON array
+	GET    /collections/{coll}/documents/{id}       reads a document
+	PUT    /collections/{coll}/documents/{id}       replaces a document with the JSON body
+	DELETE /collections/{coll}/documents/{id}       deletes a document
+	POST   /collections/{coll}/query                runs a query, {"query": "type:string == #type", "params": {"#type": "user"}}
+	POST   /collections/{coll}/explain              explains a query, same body as query
+	POST   /collections/{coll}/readBy               reads documents through an index, same fields as rose.ReadByMetadata
+	GET    /collections/{coll}/indexes              lists the indexes of a collection
+	POST   /collections/{coll}/indexes              creates an index, {"fields": [{"name": "email", "dataType": "string"}], "options": {"unique": true}}
+	DELETE /collections/{coll}/indexes/{name}       drops an index
+	GET    /collections/{coll}/schema               JSON Schema of a collection, null if it has none
+	PUT    /collections/{coll}/schema               sets the JSON Schema of a collection to the body
+	DELETE /collections/{coll}/schema               removes the JSON Schema of a collection
+
+With Options.Users every request must authenticate as a user, see Users, and the collection routes need the role
+of their collection: read to read and query, write to change documents and admin for the rest. Users are managed by
+an admin of every collection:
+
+	GET    /users                                   lists users
+	POST   /users                                   adds a user, {"name": "alice", "password": "..", "permissions": {"users": "write"}}
+	DELETE /users/{user}                            removes a user
+	PUT    /users/{user}/permissions                replaces the permissions of a user, {"users": "read", "*": "read"}
+	PUT    /users/{user}/password                   sets the password of a user, {"password": ".."}, also allowed to the user
+	POST   /users/{user}/tokens                     creates an API token, also allowed to the user
+	DELETE /users/{user}/tokens/{token}             revokes a token by its ID, also allowed to the user
+
+Errors are returned as the JSON of rose.Error and the HTTP status is derived from its codes with StatusOf.
+*/
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"rose/rose"
+	"strconv"
+	"strings"
+)
+
+// 16MB, the same as the largest document that Rose accepts with some room for the envelope of a bulk write
+const maxBodySize = 16 << 20
+
+type Server struct {
+	rose   *rose.Rose
+	users  *Users
+	routes []route
+}
+
+type Options struct {
+	// when set, requests must authenticate as one of these users and are checked against its permissions
+	Users *Users
+}
+
+type route struct {
+	method string
+	// segments of the path, {coll}, {id}, {name}, {user} and {token} match any segment
+	pattern []string
+	// role that the user needs on the {coll} of the route, or on AllCollections if the route has none.
+	// Routes without a role are open to every user and check permissions themselves
+	role   Role
+	handle func(w http.ResponseWriter, r *http.Request, params map[string]string)
+}
+
+type userContextKey struct{}
+
+// the authenticated user of a request
+type requestUser struct {
+	name        string
+	permissions Permissions
+}
+
+type documentResult struct {
+	ID       int             `json:"id"`
+	Data     json.RawMessage `json:"data"`
+	Score    float64         `json:"score,omitempty"`
+	Distance float64         `json:"distance,omitempty"`
+}
+
+type readByResult struct {
+	ID   int         `json:"id"`
+	Data interface{} `json:"data"`
+}
+
+type nameRequest struct {
+	Name string `json:"name"`
+}
+
+type collectionRequest struct {
+	Name string `json:"name"`
+	Options *rose.CollectionOptions `json:"options,omitempty"`
+}
+
+type queryRequest struct {
+	Query  string                     `json:"query"`
+	Params map[string]json.RawMessage `json:"params"`
+}
+
+type indexRequest struct {
+	Fields  []rose.IndexField `json:"fields"`
+	Options rose.IndexOptions `json:"options"`
+}
+
+// an error of the server itself, encoded the same as rose.Error
+type serverError struct {
+	MasterCode int    `json:"masterCode"`
+	Code       int    `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e serverError) Error() string {
+	return e.Message
+}
+
+func (e serverError) GetCode() int {
+	return e.Code
+}
+
+func (e serverError) GetMasterCode() int {
+	return e.MasterCode
+}
+
+func (e serverError) JSON() []uint8 {
+	b, _ := json.Marshal(e)
+
+	return b
+}
+
+func New(r *rose.Rose, options ...Options) *Server {
+	s := &Server{rose: r}
+
+	if len(options) > 0 {
+		s.users = options[0].Users
+	}
+
+	s.routes = []route{
+		{http.MethodGet, []string{"collections"}, "", s.listCollections},
+		{http.MethodPost, []string{"collections"}, "", s.newCollection},
+		{http.MethodDelete, []string{"collections", "{coll}"}, AdminRole, s.dropCollection},
+		{http.MethodPost, []string{"collections", "{coll}", "rename"}, AdminRole, s.renameCollection},
+		{http.MethodPost, []string{"collections", "{coll}", "truncate"}, AdminRole, s.truncateCollection},
+		{http.MethodGet, []string{"collections", "{coll}", "stats"}, ReadRole, s.stats},
+		{http.MethodPost, []string{"collections", "{coll}", "compact"}, AdminRole, s.compact},
+		{http.MethodPost, []string{"collections", "{coll}", "documents"}, WriteRole, s.write},
+		{http.MethodPost, []string{"collections", "{coll}", "documents", "bulk"}, WriteRole, s.bulkWrite},
+		{http.MethodGet, []string{"collections", "{coll}", "documents", "{id}"}, ReadRole, s.read},
+		{http.MethodPut, []string{"collections", "{coll}", "documents", "{id}"}, WriteRole, s.replace},
+		{http.MethodDelete, []string{"collections", "{coll}", "documents", "{id}"}, WriteRole, s.delete},
+		{http.MethodPost, []string{"collections", "{coll}", "query"}, ReadRole, s.query},
+		{http.MethodPost, []string{"collections", "{coll}", "explain"}, ReadRole, s.explain},
+		{http.MethodPost, []string{"collections", "{coll}", "readBy"}, ReadRole, s.readBy},
+		{http.MethodGet, []string{"collections", "{coll}", "indexes"}, ReadRole, s.listIndexes},
+		{http.MethodPost, []string{"collections", "{coll}", "indexes"}, AdminRole, s.newIndex},
+		{http.MethodDelete, []string{"collections", "{coll}", "indexes", "{name}"}, AdminRole, s.dropIndex},
+		{http.MethodGet, []string{"collections", "{coll}", "schema"}, ReadRole, s.schema},
+		{http.MethodPut, []string{"collections", "{coll}", "schema"}, AdminRole, s.setSchema},
+		{http.MethodDelete, []string{"collections", "{coll}", "schema"}, AdminRole, s.removeSchema},
+	}
+
+	if s.users != nil {
+		s.routes = append(s.routes,
+			route{http.MethodGet, []string{"users"}, AdminRole, s.listUsers},
+			route{http.MethodPost, []string{"users"}, AdminRole, s.addUser},
+			route{http.MethodDelete, []string{"users", "{user}"}, AdminRole, s.removeUser},
+			route{http.MethodPut, []string{"users", "{user}", "permissions"}, AdminRole, s.setPermissions},
+			route{http.MethodPut, []string{"users", "{user}", "password"}, "", s.setPassword},
+			route{http.MethodPost, []string{"users", "{user}", "tokens"}, "", s.newToken},
+			route{http.MethodDelete, []string{"users", "{user}", "tokens", "{token}"}, "", s.revokeToken},
+		)
+	}
+
+	return s
+}
+
+/**
+Routes a request by its method and path. A path that matches a route with another method
+is answered with 405 and the Allow header, a path that matches nothing with 404.
+*/
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments, ok := splitPath(r.URL.EscapedPath())
+
+	if !ok {
+		writeError(w, http.StatusBadRequest, serverError{rose.ValidationMasterErrorCode, rose.InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid path %s", r.URL.EscapedPath())})
+
+		return
+	}
+
+	allowed := make([]string, 0)
+
+	for _, rt := range s.routes {
+		params, matches := rt.match(segments)
+
+		if !matches {
+			continue
+		}
+
+		if rt.method != r.Method {
+			allowed = append(allowed, rt.method)
+
+			continue
+		}
+
+		if params["coll"] == UsersCollection {
+			writeError(w, http.StatusForbidden, usersCollectionError())
+
+			return
+		}
+
+		if s.users != nil {
+			name, permissions, authenticated := s.users.authenticate(r)
+
+			if !authenticated {
+				w.Header().Set("WWW-Authenticate", `Basic realm="rose"`)
+				writeError(w, http.StatusUnauthorized, serverError{rose.ValidationMasterErrorCode, rose.UnauthenticatedCode, "Request must authenticate with a bearer token or a user name and password"})
+
+				return
+			}
+
+			u := &requestUser{name: name, permissions: permissions}
+
+			if rt.role != "" {
+				collName, ok := params["coll"]
+				if !ok {
+					collName = AllCollections
+				}
+
+				if !u.permissions.allows(collName, rt.role) {
+					writeError(w, http.StatusForbidden, permissionDenied(u.name, rt.role, collName))
+
+					return
+				}
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, u))
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		rt.handle(w, r, params)
+
+		return
+	}
+
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, http.StatusMethodNotAllowed, serverError{rose.GenericMasterErrorCode, rose.AppInvalidUsageCode, fmt.Sprintf("Method %s is not allowed on %s", r.Method, r.URL.Path)})
+
+		return
+	}
+
+	writeError(w, http.StatusNotFound, serverError{rose.GenericMasterErrorCode, rose.AppInvalidUsageCode, fmt.Sprintf("Route %s %s does not exist", r.Method, r.URL.Path)})
+}
+
+func (rt route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.pattern) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+
+	for i, p := range rt.pattern {
+		if strings.HasPrefix(p, "{") {
+			params[strings.Trim(p, "{}")] = segments[i]
+		} else if p != segments[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+// splits an escaped path into unescaped segments so that a collection or index name can hold an escaped slash
+func splitPath(path string) ([]string, bool) {
+	segments := make([]string, 0)
+
+	for _, s := range strings.Split(strings.Trim(path, "/"), "/") {
+		if s == "" {
+			continue
+		}
+
+		unescaped, e := url.PathUnescape(s)
+
+		if e != nil {
+			return nil, false
+		}
+
+		segments = append(segments, unescaped)
+	}
+
+	return segments, true
+}
+
+/**
+Returns the HTTP status of an error returned by Rose. Application codes that describe the request
+take precedence, the rest is derived from the master code: validation and generic errors are caused by the client,
+filesystem, integrity and system errors by the server.
+*/
+func StatusOf(err rose.Error) int {
+	switch err.GetCode() {
+	case rose.InvalidUserSuppliedDataCode:
+		return http.StatusBadRequest
+	case rose.DocumentNotFoundCode, rose.IndexNotExistsCode:
+		return http.StatusNotFound
+	case rose.DuplicateKeyCode, rose.IndexExistsCode, rose.AppInvalidUsageCode:
+		return http.StatusConflict
+	case rose.UnauthenticatedCode:
+		return http.StatusUnauthorized
+	case rose.PermissionDeniedCode:
+		return http.StatusForbidden
+	case rose.IndexBuildingCode, rose.TooManyFilesOpenCode:
+		return http.StatusServiceUnavailable
+	case rose.FsPermissionsCode, rose.OperatingSystemCode, rose.ShutdownFailureCode, rose.BlockCorruptedCode, rose.MalformedIndexCode, rose.UnmarshalFailCode, rose.DataConversionCode:
+		return http.StatusInternalServerError
+	}
+
+	switch err.GetMasterCode() {
+	case rose.ValidationMasterErrorCode, rose.GenericMasterErrorCode:
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+// lists the collections that the user can read
+func (s *Server) listCollections(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	u := userOf(r)
+	names := make([]string, 0)
+
+	for _, name := range s.rose.ListCollections() {
+		if name == UsersCollection || (u != nil && !u.permissions.allows(name, ReadRole)) {
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	writeJSON(w, http.StatusOK, names)
+}
+
+func (s *Server) newCollection(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var req collectionRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	if !authorize(w, r, req.Name, AdminRole) {
+		return
+	}
+
+	options := rose.CollectionOptions{}
+	if req.Options != nil {
+		options = *req.Options
+	}
+
+	if err := s.rose.NewCollection(req.Name, options); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, req)
+}
+
+func (s *Server) dropCollection(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if err := s.rose.DropCollection(params["coll"]); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) renameCollection(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var req nameRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	if !authorize(w, r, req.Name, AdminRole) {
+		return
+	}
+
+	if err := s.rose.RenameCollection(params["coll"], req.Name); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (s *Server) truncateCollection(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if err := s.rose.TruncateCollection(params["coll"]); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	stats, err := s.rose.Stats(params["coll"])
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (s *Server) compact(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	res, err := s.rose.Compact(params["coll"])
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) write(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := s.rose.Write(rose.WriteMetadata{CollectionName: params["coll"], Data: string(body)})
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, res)
+}
+
+func (s *Server) bulkWrite(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var docs []json.RawMessage
+	if !decodeBody(w, r, &docs) {
+		return
+	}
+
+	data := make([]interface{}, 0, len(docs))
+	for _, d := range docs {
+		data = append(data, string(d))
+	}
+
+	res, err := s.rose.BulkWrite(rose.BulkWriteMetadata{CollectionName: params["coll"], Data: data})
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, res)
+}
+
+func (s *Server) read(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	id, ok := documentId(w, params)
+	if !ok {
+		return
+	}
+
+	var data json.RawMessage
+	res, err := s.rose.Read(rose.ReadMetadata{CollectionName: params["coll"], ID: id, Data: &data})
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	if res.Status == rose.NotFoundResultStatus {
+		writeNotFound(w, params["coll"], id)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, documentResult{ID: id, Data: data})
+}
+
+func (s *Server) replace(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	id, ok := documentId(w, params)
+	if !ok {
+		return
+	}
+
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	// Replace does not report a missing document, it is looked up first
+	var data json.RawMessage
+	res, err := s.rose.Read(rose.ReadMetadata{CollectionName: params["coll"], ID: id, Data: &data})
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	if res.Status == rose.NotFoundResultStatus {
+		writeNotFound(w, params["coll"], id)
+
+		return
+	}
+
+	res, err = s.rose.Replace(rose.ReplaceMetadata{CollectionName: params["coll"], ID: id, Data: string(body)})
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	res.ID = id
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	id, ok := documentId(w, params)
+	if !ok {
+		return
+	}
+
+	res, err := s.rose.Delete(rose.DeleteMetadata{CollectionName: params["coll"], ID: id})
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	if res.Status == rose.NotFoundResultStatus {
+		writeNotFound(w, params["coll"], id)
+
+		return
+	}
+
+	res.ID = id
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) query(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	query, queryParams, ok := decodeQuery(w, r)
+	if !ok {
+		return
+	}
+
+	qb := rose.NewQueryBuilder()
+
+	if err := qb.If(params["coll"], query, queryParams); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	results, err := s.rose.Query(qb)
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	docs := make([]documentResult, 0, len(results))
+	for _, res := range results {
+		docs = append(docs, documentResult{ID: res.ID, Data: res.Data, Score: res.Score, Distance: res.Distance})
+	}
+
+	writeJSON(w, http.StatusOK, docs)
+}
+
+func (s *Server) explain(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	query, queryParams, ok := decodeQuery(w, r)
+	if !ok {
+		return
+	}
+
+	qb := rose.NewQueryBuilder()
+
+	if err := qb.If(params["coll"], query, queryParams); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	explanation, err := s.rose.Explain(qb)
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, explanation)
+}
+
+/**
+The body has the fields of rose.ReadByMetadata: field, value, dataType, fields, pagination and sort.
+Numbers are decoded as int or float64 by the data type of their field since the indexes compare them by type.
+*/
+func (s *Server) readBy(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var m rose.ReadByMetadata
+	if !decodeBody(w, r, &m) {
+		return
+	}
+
+	m.CollectionName = params["coll"]
+	m.Data = nil
+
+	value, e := indexValue(m.Value, string(m.DataType))
+	if e != nil {
+		writeError(w, http.StatusBadRequest, serverError{rose.ValidationMasterErrorCode, rose.InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid readBy request. Value of field '%s' is not a valid %s", m.Field, m.DataType)})
+
+		return
+	}
+
+	m.Value = value
+
+	for i, f := range m.Fields {
+		value, e := indexValue(f.Value, string(f.DataType))
+		if e != nil {
+			writeError(w, http.StatusBadRequest, serverError{rose.ValidationMasterErrorCode, rose.InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid readBy request. Value of field '%s' is not a valid %s", f.Field, f.DataType)})
+
+			return
+		}
+
+		m.Fields[i].Value = value
+	}
+
+	res, err := s.rose.ReadBy(m)
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	docs := make([]readByResult, 0, len(res.Data))
+	for _, d := range res.Data {
+		docs = append(docs, readByResult{ID: d.ID, Data: d.Data})
+	}
+
+	writeJSON(w, http.StatusOK, docs)
+}
+
+func (s *Server) listIndexes(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	indexes, err := s.rose.ListIndexes(params["coll"])
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, indexes)
+}
+
+func (s *Server) newIndex(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var req indexRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	if err := s.rose.NewCompoundIndex(params["coll"], req.Fields, req.Options); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) dropIndex(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if err := s.rose.DropIndex(params["coll"], params["name"]); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) schema(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	schema, err := s.rose.Schema(params["coll"])
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	if schema == "" {
+		writeJSON(w, http.StatusOK, nil)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, json.RawMessage(schema))
+}
+
+func (s *Server) setSchema(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.rose.SetSchema(params["coll"], string(body)); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) removeSchema(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if err := s.rose.RemoveSchema(params["coll"]); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	writeJSON(w, http.StatusOK, s.users.List())
+}
+
+func (s *Server) addUser(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var req struct {
+		Name        string      `json:"name"`
+		Password    string      `json:"password"`
+		Permissions Permissions `json:"permissions"`
+	}
+
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	if err := s.users.Add(req.Name, req.Password, req.Permissions); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) removeUser(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if err := s.users.Remove(params["user"]); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) setPermissions(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var permissions Permissions
+	if !decodeBody(w, r, &permissions) {
+		return
+	}
+
+	if err := s.users.SetPermissions(params["user"], permissions); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) setPassword(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !authorizeUser(w, r, params["user"]) {
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	if err := s.users.SetPassword(params["user"], req.Password); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) newToken(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !authorizeUser(w, r, params["user"]) {
+		return
+	}
+
+	token, err := s.users.NewToken(params["user"])
+
+	if err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]string{
+		"id":    strings.SplitN(token, ".", 2)[0],
+		"token": token,
+	})
+}
+
+func (s *Server) revokeToken(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !authorizeUser(w, r, params["user"]) {
+		return
+	}
+
+	if err := s.users.RevokeToken(params["user"], params["token"]); err != nil {
+		writeRoseError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func userOf(r *http.Request) *requestUser {
+	u, _ := r.Context().Value(userContextKey{}).(*requestUser)
+
+	return u
+}
+
+// checks a role on a collection that is not in the path of a request, e.i. the new name of a rename
+func authorize(w http.ResponseWriter, r *http.Request, collName string, role Role) bool {
+	if collName == UsersCollection {
+		writeError(w, http.StatusForbidden, usersCollectionError())
+
+		return false
+	}
+
+	u := userOf(r)
+
+	if u != nil && !u.permissions.allows(collName, role) {
+		writeError(w, http.StatusForbidden, permissionDenied(u.name, role, collName))
+
+		return false
+	}
+
+	return true
+}
+
+// a user manages its own password and tokens, an admin of every collection the ones of every user
+func authorizeUser(w http.ResponseWriter, r *http.Request, name string) bool {
+	u := userOf(r)
+
+	if u.name != name && !u.permissions.allows(AllCollections, AdminRole) {
+		writeError(w, http.StatusForbidden, permissionDenied(u.name, AdminRole, AllCollections))
+
+		return false
+	}
+
+	return true
+}
+
+func permissionDenied(name string, role Role, collName string) serverError {
+	return serverError{rose.ValidationMasterErrorCode, rose.PermissionDeniedCode, fmt.Sprintf("Permission denied. User %s does not have the %s role on collection %s", name, role, collName)}
+}
+
+func usersCollectionError() serverError {
+	return serverError{rose.ValidationMasterErrorCode, rose.PermissionDeniedCode, fmt.Sprintf("Permission denied. Collection %s holds the users of the server and is managed through /users", UsersCollection)}
+}
+
+/**
+Decodes a {"query": .., "params": ..} body. Query params are always strings, a param
+that is given as another JSON value is passed as its JSON text so that {"#age": 20} works the same as {"#age": "20"}.
+*/
+func decodeQuery(w http.ResponseWriter, r *http.Request) (string, map[string]interface{}, bool) {
+	var req queryRequest
+	if !decodeBody(w, r, &req) {
+		return "", nil, false
+	}
+
+	params := make(map[string]interface{})
+	for name, raw := range req.Params {
+		if !strings.HasPrefix(name, "#") {
+			name = "#" + name
+		}
+
+		var s string
+		if e := json.Unmarshal(raw, &s); e == nil {
+			params[name] = s
+		} else {
+			params[name] = string(raw)
+		}
+	}
+
+	return req.Query, params, true
+}
+
+func indexValue(value interface{}, dataType string) (interface{}, error) {
+	n, ok := value.(json.Number)
+
+	if !ok {
+		return value, nil
+	}
+
+	if dataType == "int" {
+		return strconv.Atoi(n.String())
+	}
+
+	return n.Float64()
+}
+
+func documentId(w http.ResponseWriter, params map[string]string) (int, bool) {
+	id, e := strconv.Atoi(params["id"])
+
+	if e != nil {
+		writeError(w, http.StatusBadRequest, serverError{rose.ValidationMasterErrorCode, rose.InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid document ID %s. ID must be an integer", params["id"])})
+
+		return 0, false
+	}
+
+	return id, true
+}
+
+func readBody(w http.ResponseWriter, r *http.Request) ([]uint8, bool) {
+	body, e := ioutil.ReadAll(r.Body)
+
+	if e != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, serverError{rose.ValidationMasterErrorCode, rose.InvalidUserSuppliedDataCode, fmt.Sprintf("Unable to read the request body: %s", e.Error())})
+
+		return nil, false
+	}
+
+	return body, true
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, ok := readBody(w, r)
+	if !ok {
+		return false
+	}
+
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+
+	if e := d.Decode(v); e != nil {
+		writeError(w, http.StatusBadRequest, serverError{rose.ValidationMasterErrorCode, rose.InvalidUserSuppliedDataCode, fmt.Sprintf("Request body is not valid JSON: %s", e.Error())})
+
+		return false
+	}
+
+	return true
+}
+
+func writeNotFound(w http.ResponseWriter, collName string, id int) {
+	writeError(w, http.StatusNotFound, serverError{rose.GenericMasterErrorCode, rose.DocumentNotFoundCode, fmt.Sprintf("Document with ID %d not found in collection %s", id, collName)})
+}
+
+func writeRoseError(w http.ResponseWriter, err rose.Error) {
+	writeError(w, StatusOf(err), serverError{err.GetMasterCode(), err.GetCode(), err.Error()})
+}
+
+func writeError(w http.ResponseWriter, status int, err serverError) {
+	writeJSON(w, status, err)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, e := json.Marshal(v)
+
+	if e != nil {
+		status = http.StatusInternalServerError
+		b, _ = json.Marshal(serverError{rose.SystemMasterErrorCode, rose.DataConversionCode, fmt.Sprintf("Unable to encode the response: %s", e.Error())})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(b)
+	_, _ = w.Write([]uint8("\n"))
+}
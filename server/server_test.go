@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"rose/rose"
+	"strings"
+	"testing"
+)
+
+func testRequest(g *gomega.WithT, method string, url string, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	g.Expect(err).To(gomega.BeNil())
+
+	res, err := http.DefaultClient.Do(req)
+	g.Expect(err).To(gomega.BeNil())
+
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	g.Expect(err).To(gomega.BeNil())
+
+	return res.StatusCode, string(b)
+}
+
+func TestServer(t *testing.T) {
+	g := gomega.NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "rose_server")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	rose.SetDataDir(dir)
+	defer rose.SetDataDir("")
+
+	r, roseErr := rose.New(false)
+	g.Expect(roseErr).To(gomega.BeNil())
+
+	ts := httptest.NewServer(New(r))
+	defer ts.Close()
+
+	url := ts.URL + "/collections"
+
+	status, body := testRequest(g, http.MethodPost, url, `{"name": "users"}`)
+	g.Expect(status).To(gomega.Equal(http.StatusCreated))
+
+	// creating a collection that exists is not an error
+	status, body = testRequest(g, http.MethodPost, url, `{"name": "users"}`)
+	g.Expect(status).To(gomega.Equal(http.StatusCreated))
+	g.Expect(body).To(gomega.Equal("{\"name\":\"users\"}\n"))
+
+	status, body = testRequest(g, http.MethodPost, url, `{"name": "feed", "options": {"maxDocuments": -1}}`)
+	g.Expect(status).To(gomega.Equal(http.StatusBadRequest))
+	g.Expect(body).To(gomega.ContainSubstring("MaxDocuments cannot be negative"))
+
+	status, body = testRequest(g, http.MethodGet, url, "")
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+	g.Expect(body).To(gomega.Equal("[\"users\"]\n"))
+
+	status, body = testRequest(g, http.MethodPost, url+"/users/indexes", `{"fields": [{"name": "email", "dataType": "string"}], "options": {"unique": true}}`)
+	g.Expect(status).To(gomega.Equal(http.StatusCreated))
+
+	status, body = testRequest(g, http.MethodPost, url+"/users/indexes", `{"fields": [{"name": "age", "dataType": "int"}]}`)
+	g.Expect(status).To(gomega.Equal(http.StatusCreated))
+
+	status, body = testRequest(g, http.MethodPost, url+"/users/indexes", `{"fields": [{"name": "bio", "dataType": "text"}], "options": {"unique": true}}`)
+	g.Expect(status).To(gomega.Equal(http.StatusBadRequest))
+	g.Expect(body).To(gomega.ContainSubstring(`"masterCode":2`))
+
+	status, body = testRequest(g, http.MethodPost, url+"/users/documents", `{"email": "first@gmail.com", "type": "user", "age": 20}`)
+	g.Expect(status).To(gomega.Equal(http.StatusCreated))
+	g.Expect(body).To(gomega.ContainSubstring(`"id":1`))
+
+	status, body = testRequest(g, http.MethodPost, url+"/users/documents/bulk", `[{"email": "second@gmail.com", "type": "company", "age": 30}, {"email": "third@gmail.com", "type": "user", "age": 40}]`)
+	g.Expect(status).To(gomega.Equal(http.StatusCreated))
+	g.Expect(body).To(gomega.ContainSubstring(`"writtenIds":"2,3"`))
+
+	status, body = testRequest(g, http.MethodPost, url+"/users/documents", `{"email": "first@gmail.com", "age": 50}`)
+	g.Expect(status).To(gomega.Equal(http.StatusConflict))
+	g.Expect(body).To(gomega.ContainSubstring(`"code":15`))
+
+	status, body = testRequest(g, http.MethodPost, url+"/users/documents", `{"email": "fourth@gmail.com"}`)
+	g.Expect(status).To(gomega.Equal(http.StatusBadRequest))
+	g.Expect(body).To(gomega.ContainSubstring("Field name 'age' does not exist"))
+
+	status, body = testRequest(g, http.MethodGet, url+"/users/documents/2", "")
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+	g.Expect(body).To(gomega.Equal(`{"id":2,"data":{"email":"second@gmail.com","type":"company","age":30}}` + "\n"))
+
+	status, body = testRequest(g, http.MethodGet, url+"/users/documents/10", "")
+	g.Expect(status).To(gomega.Equal(http.StatusNotFound))
+	g.Expect(body).To(gomega.ContainSubstring("Document with ID 10 not found in collection users"))
+
+	status, _ = testRequest(g, http.MethodGet, url+"/users/documents/abc", "")
+	g.Expect(status).To(gomega.Equal(http.StatusBadRequest))
+
+	status, body = testRequest(g, http.MethodPut, url+"/users/documents/3", `{"email": "replaced@gmail.com", "type": "user", "age": 41}`)
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+	g.Expect(body).To(gomega.ContainSubstring(`"status":"replaced"`))
+
+	status, _ = testRequest(g, http.MethodPut, url+"/users/documents/10", `{"email": "none@gmail.com"}`)
+	g.Expect(status).To(gomega.Equal(http.StatusNotFound))
+
+	status, body = testRequest(g, http.MethodPost, url+"/users/query", `{"query": "type:string == #type && age:int > #age", "params": {"type": "user", "#age": 25}}`)
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+
+	var results []documentResult
+	g.Expect(json.Unmarshal([]uint8(body), &results)).To(gomega.BeNil())
+	g.Expect(len(results)).To(gomega.Equal(1))
+	g.Expect(results[0].ID).To(gomega.Equal(3))
+	g.Expect(string(results[0].Data)).To(gomega.ContainSubstring("replaced@gmail.com"))
+
+	status, body = testRequest(g, http.MethodPost, url+"/users/query", `{"query": "age:int >"}`)
+	g.Expect(status).To(gomega.Equal(http.StatusBadRequest))
+	g.Expect(body).To(gomega.ContainSubstring("is incomplete"))
+
+	status, body = testRequest(g, http.MethodPost, url+"/users/explain", `{"query": "age:int == #age", "params": {"#age": "20"}}`)
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+	g.Expect(body).To(gomega.ContainSubstring(`"strategy":"index"`))
+
+	status, body = testRequest(g, http.MethodPost, url+"/users/readBy", `{"field": "age", "value": 30, "dataType": "int"}`)
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+	g.Expect(body).To(gomega.ContainSubstring(`"id":2`))
+	g.Expect(body).To(gomega.ContainSubstring("second@gmail.com"))
+
+	status, _ = testRequest(g, http.MethodPost, url+"/users/readBy", `{"field": "age", "value": 30.5, "dataType": "int"}`)
+	g.Expect(status).To(gomega.Equal(http.StatusBadRequest))
+
+	status, body = testRequest(g, http.MethodDelete, url+"/users/documents/1", "")
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+	g.Expect(body).To(gomega.ContainSubstring(`"status":"deleted"`))
+
+	status, _ = testRequest(g, http.MethodDelete, url+"/users/documents/1", "")
+	g.Expect(status).To(gomega.Equal(http.StatusNotFound))
+
+	status, body = testRequest(g, http.MethodGet, url+"/users/stats", "")
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+	g.Expect(body).To(gomega.ContainSubstring(`"documents":2`))
+
+	status, body = testRequest(g, http.MethodGet, url+"/users/indexes", "")
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+	g.Expect(body).To(gomega.ContainSubstring(`"fields":[{"name":"email","dataType":"string"}]`))
+
+	status, _ = testRequest(g, http.MethodDelete, url+"/users/indexes/age", "")
+	g.Expect(status).To(gomega.Equal(http.StatusNoContent))
+
+	status, _ = testRequest(g, http.MethodDelete, url+"/users/indexes/age", "")
+	g.Expect(status).To(gomega.Equal(http.StatusNotFound))
+
+	status, body = testRequest(g, http.MethodGet, url+"/users/schema", "")
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+	g.Expect(body).To(gomega.Equal("null\n"))
+
+	status, _ = testRequest(g, http.MethodPut, url+"/users/schema", `{"type": "object", "required": ["email"], "properties": {"age": {"type": "integer"}}}`)
+	g.Expect(status).To(gomega.Equal(http.StatusNoContent))
+
+	status, body = testRequest(g, http.MethodGet, url+"/users/schema", "")
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+	g.Expect(body).To(gomega.MatchJSON(`{"type": "object", "required": ["email"], "properties": {"age": {"type": "integer"}}}`))
+
+	status, body = testRequest(g, http.MethodPost, url+"/users/documents", `{"age": "old"}`)
+	g.Expect(status).To(gomega.Equal(http.StatusBadRequest))
+	g.Expect(body).To(gomega.ContainSubstring("/email is required; /age must be of type integer, string given"))
+
+	status, _ = testRequest(g, http.MethodPut, url+"/users/schema", `{"type": "date"}`)
+	g.Expect(status).To(gomega.Equal(http.StatusBadRequest))
+
+	status, _ = testRequest(g, http.MethodDelete, url+"/users/schema", "")
+	g.Expect(status).To(gomega.Equal(http.StatusNoContent))
+
+	status, _ = testRequest(g, http.MethodPost, url+"/users/compact", "")
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+
+	status, _ = testRequest(g, http.MethodPost, url+"/users/rename", `{"name": "people"}`)
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+
+	status, _ = testRequest(g, http.MethodGet, url+"/users/stats", "")
+	g.Expect(status).To(gomega.Equal(http.StatusBadRequest))
+
+	status, _ = testRequest(g, http.MethodPost, url+"/people/truncate", "")
+	g.Expect(status).To(gomega.Equal(http.StatusNoContent))
+
+	status, body = testRequest(g, http.MethodGet, url+"/people/stats", "")
+	g.Expect(body).To(gomega.ContainSubstring(`"documents":0`))
+
+	status, _ = testRequest(g, http.MethodPost, url+"/people/documents", `not json`)
+	g.Expect(status).To(gomega.Equal(http.StatusBadRequest))
+
+	status, _ = testRequest(g, http.MethodPost, url+"/people/query", `not json`)
+	g.Expect(status).To(gomega.Equal(http.StatusBadRequest))
+
+	res, err := http.Post(url+"/people/stats", "application/json", nil)
+	g.Expect(err).To(gomega.BeNil())
+	res.Body.Close()
+	g.Expect(res.StatusCode).To(gomega.Equal(http.StatusMethodNotAllowed))
+	g.Expect(res.Header.Get("Allow")).To(gomega.Equal(http.MethodGet))
+
+	status, _ = testRequest(g, http.MethodGet, ts.URL+"/unknown", "")
+	g.Expect(status).To(gomega.Equal(http.StatusNotFound))
+
+	status, _ = testRequest(g, http.MethodDelete, url+"/people", "")
+	g.Expect(status).To(gomega.Equal(http.StatusNoContent))
+
+	status, body = testRequest(g, http.MethodGet, url, "")
+	g.Expect(body).To(gomega.Equal("[]\n"))
+
+	g.Expect(r.Shutdown()).To(gomega.BeNil())
+}
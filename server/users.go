@@ -0,0 +1,585 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"net/http"
+	"rose/rose"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// system collection that holds the users of the server. The collection routes refuse to touch it
+const UsersCollection = "_rose_users"
+
+// key of Permissions that applies to every collection
+const AllCollections = "*"
+
+// PBKDF2-HMAC-SHA256 iterations of new password hashes. Hashes keep their own count, so older ones still verify
+var passwordIterations = 600000
+const passwordSaltSize = 16
+const tokenIdSize = 4
+const tokenSecretSize = 24
+
+type Role string
+
+const ReadRole Role = "read"
+const WriteRole Role = "write"
+// an admin of a collection can also drop, rename, truncate and compact it and manage its indexes.
+// An admin of AllCollections also creates collections and manages users
+const AdminRole Role = "admin"
+
+// every role allows what the roles with a lower rank allow
+var roleRanks = map[Role]int{
+	ReadRole:  1,
+	WriteRole: 2,
+	AdminRole: 3,
+}
+
+// roles of a user by collection name or AllCollections
+type Permissions map[string]Role
+
+// UserInfo is a user as returned by List, without its password and token hashes
+type UserInfo struct {
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+	Tokens      []TokenInfo `json:"tokens"`
+}
+
+type TokenInfo struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+}
+
+type storedToken struct {
+	ID      string    `json:"id"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+type user struct {
+	// ID of the document in UsersCollection
+	docID        int
+	Name         string        `json:"name"`
+	PasswordHash string        `json:"passwordHash,omitempty"`
+	Permissions  Permissions   `json:"permissions"`
+	Tokens       []storedToken `json:"tokens"`
+}
+
+/**
+Users are the accounts that can use a server created with Options.Users. They are kept in memory and every change
+is written to the UsersCollection collection. A user authenticates with HTTP basic authentication and its password,
+or with a bearer token created by NewToken. Passwords are hashed with PBKDF2-SHA256 and tokens with SHA-256,
+neither is stored.
+
+A password that was checked with PBKDF2 is remembered as an HMAC of it and the hash of the user, so the requests of a
+user that follow are not checked with PBKDF2 again. Only a few PBKDF2 checks run at once, so that failed logins cannot
+take every CPU.
+*/
+type Users struct {
+	rose  *rose.Rose
+	lock  sync.RWMutex
+	users map[string]*user
+
+	// random key of the HMACs in verified, made for every Users
+	verifyKey []uint8
+	// HMAC of the password hash and the password that a user authenticated with. A new password changes the hash,
+	// so an HMAC of the old password no longer matches
+	verified     map[string][]uint8
+	verifiedLock sync.Mutex
+	// PBKDF2 checks that are running
+	checks chan struct{}
+}
+
+/**
+Loads the users of a database and creates UsersCollection if it does not exist. Only one Users should manage
+the users of a database, users that another Users adds are not seen until the database is opened again.
+*/
+func NewUsers(r *rose.Rose) (*Users, rose.Error) {
+	if err := r.NewCollection(UsersCollection); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if _, err := r.Export(UsersCollection, &buf, rose.NDJSONFormat); err != nil {
+		return nil, err
+	}
+
+	verifyKey := make([]uint8, sha256.Size)
+
+	if _, e := rand.Read(verifyKey); e != nil {
+		return nil, serverError{rose.SystemMasterErrorCode, rose.OperatingSystemCode, fmt.Sprintf("Unable to generate a key: %s", e.Error())}
+	}
+
+	checks := runtime.NumCPU() / 2
+	if checks < 1 {
+		checks = 1
+	}
+
+	users := &Users{
+		rose:      r,
+		users:     make(map[string]*user),
+		verifyKey: verifyKey,
+		verified:  make(map[string][]uint8),
+		checks:    make(chan struct{}, checks),
+	}
+
+	scanner := bufio.NewScanner(&buf)
+	scanner.Buffer(make([]uint8, 0, 64*1024), maxBodySize)
+
+	for scanner.Scan() {
+		var doc struct {
+			ID   int  `json:"id"`
+			Data user `json:"data"`
+		}
+
+		if e := json.Unmarshal(scanner.Bytes(), &doc); e != nil {
+			return nil, serverError{rose.DbIntegrityMasterErrorCode, rose.UnmarshalFailCode, fmt.Sprintf("Unable to load users. A document of collection %s is not a user: %s", UsersCollection, e.Error())}
+		}
+
+		u := doc.Data
+		u.docID = doc.ID
+
+		users.users[u.Name] = &u
+	}
+
+	return users, nil
+}
+
+// adds a user. A user without a password can only authenticate with a token
+func (us *Users) Add(name string, password string, permissions Permissions) rose.Error {
+	if name == "" || strings.ContainsAny(name, ":/") {
+		return serverError{rose.ValidationMasterErrorCode, rose.InvalidUserSuppliedDataCode, "Invalid user name. Name cannot be empty and cannot contain ':' or '/'"}
+	}
+
+	if err := permissions.validate(); err != nil {
+		return err
+	}
+
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	if _, ok := us.users[name]; ok {
+		return serverError{rose.ValidationMasterErrorCode, rose.DuplicateKeyCode, fmt.Sprintf("Duplicate key error. User %s already exists", name)}
+	}
+
+	u := &user{
+		Name:        name,
+		Permissions: permissions,
+		Tokens:      make([]storedToken, 0),
+	}
+
+	if u.Permissions == nil {
+		u.Permissions = Permissions{}
+	}
+
+	if password != "" {
+		hash, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+
+		u.PasswordHash = hash
+	}
+
+	return us.save(u)
+}
+
+func (us *Users) Remove(name string) rose.Error {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	u, ok := us.users[name]
+
+	if !ok {
+		return userNotFound(name)
+	}
+
+	if _, err := us.rose.Delete(rose.DeleteMetadata{CollectionName: UsersCollection, ID: u.docID}); err != nil {
+		return err
+	}
+
+	delete(us.users, name)
+	us.forgetPassword(name)
+
+	return nil
+}
+
+// replaces every permission of a user
+func (us *Users) SetPermissions(name string, permissions Permissions) rose.Error {
+	if err := permissions.validate(); err != nil {
+		return err
+	}
+
+	return us.update(name, func(u *user) rose.Error {
+		u.Permissions = permissions
+
+		if u.Permissions == nil {
+			u.Permissions = Permissions{}
+		}
+
+		return nil
+	})
+}
+
+// sets the password of a user, an empty password removes it
+func (us *Users) SetPassword(name string, password string) rose.Error {
+	hash := ""
+
+	if password != "" {
+		h, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+
+		hash = h
+	}
+
+	return us.update(name, func(u *user) rose.Error {
+		u.PasswordHash = hash
+
+		return nil
+	})
+}
+
+/**
+Creates an API token of a user. The token is returned only once, Rose keeps only its hash. The part
+of the token before the dot is its ID, which List returns and RevokeToken takes.
+*/
+func (us *Users) NewToken(name string) (string, rose.Error) {
+	id, err := randomHex(tokenIdSize)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := randomHex(tokenSecretSize)
+	if err != nil {
+		return "", err
+	}
+
+	err = us.update(name, func(u *user) rose.Error {
+		u.Tokens = append(u.Tokens, storedToken{
+			ID:      id,
+			Hash:    hashToken(secret),
+			Created: time.Now().UTC(),
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return id + "." + secret, nil
+}
+
+func (us *Users) RevokeToken(name string, id string) rose.Error {
+	return us.update(name, func(u *user) rose.Error {
+		for i, t := range u.Tokens {
+			if t.ID == id {
+				u.Tokens = append(u.Tokens[:i], u.Tokens[i+1:]...)
+
+				return nil
+			}
+		}
+
+		return serverError{rose.GenericMasterErrorCode, rose.DocumentNotFoundCode, fmt.Sprintf("User %s does not have a token with ID %s", name, id)}
+	})
+}
+
+// returns every user sorted by name
+func (us *Users) List() []UserInfo {
+	us.lock.RLock()
+	defer us.lock.RUnlock()
+
+	infos := make([]UserInfo, 0, len(us.users))
+
+	for _, u := range us.users {
+		tokens := make([]TokenInfo, 0, len(u.Tokens))
+		for _, t := range u.Tokens {
+			tokens = append(tokens, TokenInfo{ID: t.ID, Created: t.Created})
+		}
+
+		infos = append(infos, UserInfo{
+			Name:        u.Name,
+			Permissions: u.Permissions.copy(),
+			Tokens:      tokens,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+}
+
+/**
+Returns the name and permissions of the user that a request authenticates as, with an
+"Authorization: Bearer <token>" header or with HTTP basic authentication.
+*/
+func (us *Users) authenticate(r *http.Request) (string, Permissions, bool) {
+	if name, password, ok := r.BasicAuth(); ok {
+		us.lock.RLock()
+		u, exists := us.users[name]
+		us.lock.RUnlock()
+
+		if !exists || u.PasswordHash == "" {
+			// the same work as for a user with a password, so that a failed login does not tell which users exist
+			_ = us.checkPassword(password, dummyPasswordHash())
+
+			return "", nil, false
+		}
+
+		if !us.verifyPassword(u, password) {
+			return "", nil, false
+		}
+
+		return u.Name, u.Permissions.copy(), true
+	}
+
+	header := r.Header.Get("Authorization")
+
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", nil, false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(header, "Bearer "), ".", 2)
+
+	if len(parts) != 2 {
+		return "", nil, false
+	}
+
+	hash := hashToken(parts[1])
+
+	us.lock.RLock()
+	defer us.lock.RUnlock()
+
+	for _, u := range us.users {
+		for _, t := range u.Tokens {
+			if t.ID == parts[0] && subtle.ConstantTimeCompare([]uint8(t.Hash), []uint8(hash)) == 1 {
+				return u.Name, u.Permissions.copy(), true
+			}
+		}
+	}
+
+	return "", nil, false
+}
+
+// changes a copy of a user and keeps it only if it is saved
+func (us *Users) update(name string, change func(u *user) rose.Error) rose.Error {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	u, ok := us.users[name]
+
+	if !ok {
+		return userNotFound(name)
+	}
+
+	cp := *u
+	cp.Permissions = u.Permissions.copy()
+	cp.Tokens = append([]storedToken{}, u.Tokens...)
+
+	if err := change(&cp); err != nil {
+		return err
+	}
+
+	return us.save(&cp)
+}
+
+// writes a user into UsersCollection, the lock must be held
+func (us *Users) save(u *user) rose.Error {
+	b, e := json.Marshal(u)
+
+	if e != nil {
+		return serverError{rose.SystemMasterErrorCode, rose.DataConversionCode, fmt.Sprintf("Unable to encode user %s: %s", u.Name, e.Error())}
+	}
+
+	if u.docID == 0 {
+		res, err := us.rose.Write(rose.WriteMetadata{CollectionName: UsersCollection, Data: string(b)})
+		if err != nil {
+			return err
+		}
+
+		u.docID = res.ID
+	} else if _, err := us.rose.Replace(rose.ReplaceMetadata{CollectionName: UsersCollection, ID: u.docID, Data: string(b)}); err != nil {
+		return err
+	}
+
+	if old, ok := us.users[u.Name]; ok && old.PasswordHash != u.PasswordHash {
+		us.forgetPassword(u.Name)
+	}
+
+	us.users[u.Name] = u
+
+	return nil
+}
+
+// checks the password of a user with PBKDF2 only if it is not the one that the user last authenticated with
+func (us *Users) verifyPassword(u *user, password string) bool {
+	mac := hmac.New(sha256.New, us.verifyKey)
+	mac.Write([]uint8(u.PasswordHash))
+	mac.Write([]uint8{0})
+	mac.Write([]uint8(password))
+	sum := mac.Sum(nil)
+
+	us.verifiedLock.Lock()
+	verified := us.verified[u.Name]
+	us.verifiedLock.Unlock()
+
+	if verified != nil && hmac.Equal(verified, sum) {
+		return true
+	}
+
+	if !us.checkPassword(password, u.PasswordHash) {
+		return false
+	}
+
+	us.verifiedLock.Lock()
+	us.verified[u.Name] = sum
+	us.verifiedLock.Unlock()
+
+	return true
+}
+
+// checks a password with PBKDF2 once one of the checks that are running is done
+func (us *Users) checkPassword(password string, hash string) bool {
+	us.checks <- struct{}{}
+	defer func() {
+		<-us.checks
+	}()
+
+	return checkPassword(password, hash)
+}
+
+func (us *Users) forgetPassword(name string) {
+	us.verifiedLock.Lock()
+	defer us.verifiedLock.Unlock()
+
+	delete(us.verified, name)
+}
+
+func (p Permissions) validate() rose.Error {
+	for coll, role := range p {
+		if _, ok := roleRanks[role]; !ok {
+			return serverError{rose.ValidationMasterErrorCode, rose.InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid role '%s' of collection %s. Roles are %s, %s and %s", role, coll, ReadRole, WriteRole, AdminRole)}
+		}
+
+		if coll == UsersCollection {
+			return serverError{rose.ValidationMasterErrorCode, rose.InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid permissions. Collection %s cannot be granted, users are managed by an admin of every collection", UsersCollection)}
+		}
+	}
+
+	return nil
+}
+
+// the role on a collection is the highest of the one granted on it and the one granted on AllCollections
+func (p Permissions) allows(collName string, role Role) bool {
+	rank := roleRanks[p[AllCollections]]
+
+	if r := roleRanks[p[collName]]; r > rank {
+		rank = r
+	}
+
+	return rank >= roleRanks[role]
+}
+
+func (p Permissions) copy() Permissions {
+	cp := make(Permissions, len(p))
+	for coll, role := range p {
+		cp[coll] = role
+	}
+
+	return cp
+}
+
+func userNotFound(name string) rose.Error {
+	return serverError{rose.GenericMasterErrorCode, rose.DocumentNotFoundCode, fmt.Sprintf("User %s does not exist", name)}
+}
+
+// hashes a password into pbkdf2-sha256$<iterations>$<salt>$<hash>
+func hashPassword(password string) (string, rose.Error) {
+	salt := make([]uint8, passwordSaltSize)
+
+	if _, e := rand.Read(salt); e != nil {
+		return "", serverError{rose.SystemMasterErrorCode, rose.OperatingSystemCode, fmt.Sprintf("Unable to generate a salt: %s", e.Error())}
+	}
+
+	key := passwordKey(password, salt, passwordIterations)
+
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+var dummyHashOnce sync.Once
+var dummyHash string
+
+// a hash that logins of users without a password are checked against, made once with the iterations of new hashes
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashPassword("")
+	})
+
+	return dummyHash
+}
+
+func checkPassword(password string, hash string) bool {
+	parts := strings.Split(hash, "$")
+
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+
+	iterations, e := strconv.Atoi(parts[1])
+	if e != nil {
+		return false
+	}
+
+	salt, e := base64.RawStdEncoding.DecodeString(parts[2])
+	if e != nil {
+		return false
+	}
+
+	key, e := base64.RawStdEncoding.DecodeString(parts[3])
+	if e != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(passwordKey(password, salt, iterations), key) == 1
+}
+
+// PBKDF2 (RFC 8018) with HMAC-SHA256 that derives a single block of 32 bytes
+func passwordKey(password string, salt []uint8, iterations int) []uint8 {
+	return pbkdf2.Key([]uint8(password), salt, iterations, sha256.Size, sha256.New)
+}
+
+// tokens are random, so a single SHA-256 is enough to keep them from being read out of the collection
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]uint8(secret))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(size int) (string, rose.Error) {
+	b := make([]uint8, size)
+
+	if _, e := rand.Read(b); e != nil {
+		return "", serverError{rose.SystemMasterErrorCode, rose.OperatingSystemCode, fmt.Sprintf("Unable to generate a token: %s", e.Error())}
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"rose/rose"
+	"strings"
+	"testing"
+)
+
+func testAuthRequest(g *gomega.WithT, method string, url string, body string, auth func(r *http.Request)) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	g.Expect(err).To(gomega.BeNil())
+
+	if auth != nil {
+		auth(req)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	g.Expect(err).To(gomega.BeNil())
+
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	g.Expect(err).To(gomega.BeNil())
+
+	return res.StatusCode, string(b)
+}
+
+func basicAuth(name string, password string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.SetBasicAuth(name, password)
+	}
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func TestPbkdf2(t *testing.T) {
+	g := gomega.NewWithT(t)
+
+	// first block of the PBKDF2-HMAC-SHA256 test vectors of RFC 7914
+	g.Expect(hex.EncodeToString(passwordKey("passwd", []uint8("salt"), 1))).To(gomega.Equal("55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"))
+	g.Expect(hex.EncodeToString(passwordKey("Password", []uint8("NaCl"), 80000))).To(gomega.Equal("4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"))
+
+	hash, err := hashPassword("secret")
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(hash).To(gomega.HavePrefix("pbkdf2-sha256$600000$"))
+	g.Expect(checkPassword("secret", hash)).To(gomega.BeTrue())
+	g.Expect(checkPassword("Secret", hash)).To(gomega.BeFalse())
+	g.Expect(checkPassword("secret", "secret")).To(gomega.BeFalse())
+
+	// hashes made with fewer iterations are checked with their own count
+	legacy := "pbkdf2-sha256$10000$c2FsdA$" + base64.RawStdEncoding.EncodeToString(passwordKey("secret", []uint8("salt"), 10000))
+	g.Expect(checkPassword("secret", legacy)).To(gomega.BeTrue())
+	g.Expect(checkPassword("Secret", legacy)).To(gomega.BeFalse())
+}
+
+func TestVerifiedPasswords(t *testing.T) {
+	g := gomega.NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "rose_auth")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	rose.SetDataDir(dir)
+	defer rose.SetDataDir("")
+
+	r, roseErr := rose.New(false)
+	g.Expect(roseErr).To(gomega.BeNil())
+	defer r.Shutdown()
+
+	users, roseErr := NewUsers(r)
+	g.Expect(roseErr).To(gomega.BeNil())
+	g.Expect(users.Add("reader", "reader secret", Permissions{"users": ReadRole})).To(gomega.BeNil())
+
+	login := func(password string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/collections", nil)
+		req.SetBasicAuth("reader", password)
+
+		_, _, ok := users.authenticate(req)
+
+		return ok
+	}
+
+	g.Expect(login("wrong")).To(gomega.BeFalse())
+	g.Expect(users.verified).To(gomega.BeEmpty())
+
+	g.Expect(login("reader secret")).To(gomega.BeTrue())
+	g.Expect(users.verified).To(gomega.HaveKey("reader"))
+
+	// while every PBKDF2 check is taken, only the password that was verified is accepted
+	for i := 0; i < cap(users.checks); i++ {
+		users.checks <- struct{}{}
+	}
+
+	g.Expect(login("reader secret")).To(gomega.BeTrue())
+
+	for i := 0; i < cap(users.checks); i++ {
+		<-users.checks
+	}
+
+	// a new password forgets the old one
+	g.Expect(users.SetPassword("reader", "new secret")).To(gomega.BeNil())
+	g.Expect(users.verified).To(gomega.BeEmpty())
+	g.Expect(login("reader secret")).To(gomega.BeFalse())
+	g.Expect(login("new secret")).To(gomega.BeTrue())
+
+	g.Expect(users.Remove("reader")).To(gomega.BeNil())
+	g.Expect(users.verified).To(gomega.BeEmpty())
+	g.Expect(login("new secret")).To(gomega.BeFalse())
+}
+
+func TestAuth(t *testing.T) {
+	g := gomega.NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "rose_auth")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	rose.SetDataDir(dir)
+	defer rose.SetDataDir("")
+
+	r, roseErr := rose.New(false)
+	g.Expect(roseErr).To(gomega.BeNil())
+	g.Expect(r.NewCollection("users")).To(gomega.BeNil())
+	g.Expect(r.NewCollection("orders")).To(gomega.BeNil())
+
+	users, roseErr := NewUsers(r)
+	g.Expect(roseErr).To(gomega.BeNil())
+	g.Expect(users.Add("root", "root secret", Permissions{AllCollections: AdminRole})).To(gomega.BeNil())
+	g.Expect(users.Add("reader", "reader secret", Permissions{"users": ReadRole})).To(gomega.BeNil())
+
+	roseErr = users.Add("reader", "", nil)
+	g.Expect(roseErr).To(gomega.Not(gomega.BeNil()))
+	g.Expect(roseErr.GetCode()).To(gomega.Equal(rose.DuplicateKeyCode))
+
+	roseErr = users.Add("writer", "", Permissions{"users": "owner"})
+	g.Expect(roseErr).To(gomega.Not(gomega.BeNil()))
+	g.Expect(roseErr.Error()).To(gomega.ContainSubstring("Invalid role 'owner'"))
+
+	ts := httptest.NewServer(New(r, Options{Users: users}))
+	defer ts.Close()
+
+	url := ts.URL + "/collections"
+	root := basicAuth("root", "root secret")
+	reader := basicAuth("reader", "reader secret")
+
+	status, body := testAuthRequest(g, http.MethodGet, url, "", nil)
+	g.Expect(status).To(gomega.Equal(http.StatusUnauthorized))
+	g.Expect(body).To(gomega.ContainSubstring(`"code":17`))
+
+	status, _ = testAuthRequest(g, http.MethodGet, url, "", basicAuth("reader", "wrong"))
+	g.Expect(status).To(gomega.Equal(http.StatusUnauthorized))
+
+	status, body = testAuthRequest(g, http.MethodGet, url, "", root)
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+	g.Expect(body).To(gomega.Equal("[\"orders\",\"users\"]\n"))
+
+	// only the collections that a user can read are listed
+	status, body = testAuthRequest(g, http.MethodGet, url, "", reader)
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+	g.Expect(body).To(gomega.Equal("[\"users\"]\n"))
+
+	status, _ = testAuthRequest(g, http.MethodPost, url+"/users/documents", `{"email": "first@gmail.com"}`, root)
+	g.Expect(status).To(gomega.Equal(http.StatusCreated))
+
+	status, body = testAuthRequest(g, http.MethodPost, url+"/users/documents", `{"email": "second@gmail.com"}`, reader)
+	g.Expect(status).To(gomega.Equal(http.StatusForbidden))
+	g.Expect(body).To(gomega.ContainSubstring("Permission denied. User reader does not have the write role on collection users"))
+
+	status, _ = testAuthRequest(g, http.MethodGet, url+"/users/documents/1", "", reader)
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+
+	status, _ = testAuthRequest(g, http.MethodGet, url+"/orders/stats", "", reader)
+	g.Expect(status).To(gomega.Equal(http.StatusForbidden))
+
+	status, _ = testAuthRequest(g, http.MethodPost, url, `{"name": "invoices"}`, reader)
+	g.Expect(status).To(gomega.Equal(http.StatusForbidden))
+
+	// the users collection cannot be reached through the collection routes, even by an admin
+	status, _ = testAuthRequest(g, http.MethodGet, url+"/"+UsersCollection+"/documents/1", "", root)
+	g.Expect(status).To(gomega.Equal(http.StatusForbidden))
+
+	status, _ = testAuthRequest(g, http.MethodPost, url+"/orders/rename", `{"name": "`+UsersCollection+`"}`, root)
+	g.Expect(status).To(gomega.Equal(http.StatusForbidden))
+
+	status, _ = testAuthRequest(g, http.MethodGet, ts.URL+"/users", "", reader)
+	g.Expect(status).To(gomega.Equal(http.StatusForbidden))
+
+	status, _ = testAuthRequest(g, http.MethodPost, ts.URL+"/users", `{"name": "writer", "permissions": {"orders": "write"}}`, root)
+	g.Expect(status).To(gomega.Equal(http.StatusCreated))
+
+	// a user creates its own tokens but not the ones of others
+	status, _ = testAuthRequest(g, http.MethodPost, ts.URL+"/users/writer/tokens", "", reader)
+	g.Expect(status).To(gomega.Equal(http.StatusForbidden))
+
+	status, body = testAuthRequest(g, http.MethodPost, ts.URL+"/users/writer/tokens", "", root)
+	g.Expect(status).To(gomega.Equal(http.StatusCreated))
+
+	token := strings.Split(strings.Split(body, `"token":"`)[1], `"`)[0]
+	tokenId := strings.Split(token, ".")[0]
+
+	status, _ = testAuthRequest(g, http.MethodPost, url+"/orders/documents", `{"item": "book"}`, bearer(token))
+	g.Expect(status).To(gomega.Equal(http.StatusCreated))
+
+	status, _ = testAuthRequest(g, http.MethodPost, url+"/orders/documents", `{"item": "book"}`, bearer(tokenId+".wrong"))
+	g.Expect(status).To(gomega.Equal(http.StatusUnauthorized))
+
+	status, _ = testAuthRequest(g, http.MethodPost, url+"/orders/indexes", `{"fields": [{"name": "item", "dataType": "string"}]}`, bearer(token))
+	g.Expect(status).To(gomega.Equal(http.StatusForbidden))
+
+	status, body = testAuthRequest(g, http.MethodGet, ts.URL+"/users", "", root)
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+	g.Expect(body).To(gomega.ContainSubstring(`"id":"` + tokenId + `"`))
+	g.Expect(body).To(gomega.Not(gomega.ContainSubstring("pbkdf2")))
+
+	status, _ = testAuthRequest(g, http.MethodPut, ts.URL+"/users/writer/permissions", `{"orders": "read"}`, root)
+	g.Expect(status).To(gomega.Equal(http.StatusNoContent))
+
+	status, _ = testAuthRequest(g, http.MethodPost, url+"/orders/documents", `{"item": "pen"}`, bearer(token))
+	g.Expect(status).To(gomega.Equal(http.StatusForbidden))
+
+	status, _ = testAuthRequest(g, http.MethodDelete, ts.URL+"/users/writer/tokens/"+tokenId, "", bearer(token))
+	g.Expect(status).To(gomega.Equal(http.StatusNoContent))
+
+	status, _ = testAuthRequest(g, http.MethodGet, url+"/orders/stats", "", bearer(token))
+	g.Expect(status).To(gomega.Equal(http.StatusUnauthorized))
+
+	status, _ = testAuthRequest(g, http.MethodPut, ts.URL+"/users/reader/password", `{"password": "new secret"}`, reader)
+	g.Expect(status).To(gomega.Equal(http.StatusNoContent))
+
+	status, _ = testAuthRequest(g, http.MethodGet, url+"/users/stats", "", basicAuth("reader", "new secret"))
+	g.Expect(status).To(gomega.Equal(http.StatusOK))
+
+	status, _ = testAuthRequest(g, http.MethodDelete, ts.URL+"/users/writer", "", root)
+	g.Expect(status).To(gomega.Equal(http.StatusNoContent))
+
+	status, _ = testAuthRequest(g, http.MethodDelete, ts.URL+"/users/writer", "", root)
+	g.Expect(status).To(gomega.Equal(http.StatusNotFound))
+
+	// users are loaded from the users collection
+	reloaded, roseErr := NewUsers(r)
+	g.Expect(roseErr).To(gomega.BeNil())
+	g.Expect(reloaded.List()).To(gomega.Equal(users.List()))
+	g.Expect(len(reloaded.List())).To(gomega.Equal(2))
+
+	g.Expect(r.Shutdown()).To(gomega.BeNil())
+}
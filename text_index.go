@@ -0,0 +1,219 @@
+package rose
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// BM25 parameters. k1 limits how much a repeated term adds to the score, b decides how much longer
+// documents are penalized
+const bm25K1 = 1.2
+const bm25B = 0.75
+
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true,
+	"by": true, "for": true, "from": true, "has": true, "have": true, "if": true, "in": true, "into": true,
+	"is": true, "it": true, "its": true, "no": true, "not": true, "of": true, "on": true, "or": true,
+	"so": true, "such": true, "that": true, "the": true, "their": true, "then": true, "there": true,
+	"these": true, "they": true, "this": true, "to": true, "was": true, "were": true, "will": true,
+	"with": true,
+}
+
+/**
+A text index is an inverted index that maps every term to the documents that hold it, together with
+the number of times the term appears in the document. Document lengths are kept so that results
+can be ranked with BM25.
+*/
+type textIndex struct {
+	// term -> document ID -> term frequency
+	postings map[string]map[int]int
+	// document ID -> number of terms
+	lengths map[int]int
+	totalLength int
+}
+
+func newTextIndex() *textIndex {
+	return &textIndex{
+		postings: make(map[string]map[int]int),
+		lengths:  make(map[int]int),
+	}
+}
+
+func (ti *textIndex) add(id int, terms []string) {
+	for _, t := range terms {
+		if _, ok := ti.postings[t]; !ok {
+			ti.postings[t] = make(map[int]int)
+		}
+
+		ti.postings[t][id]++
+	}
+
+	ti.lengths[id] = len(terms)
+	ti.totalLength += len(terms)
+}
+
+func (ti *textIndex) remove(id int, terms []string) {
+	for _, t := range terms {
+		docs, ok := ti.postings[t]
+
+		if !ok {
+			continue
+		}
+
+		delete(docs, id)
+
+		if len(docs) == 0 {
+			delete(ti.postings, t)
+		}
+	}
+
+	ti.totalLength -= ti.lengths[id]
+	delete(ti.lengths, id)
+}
+
+// candidates returns the IDs of documents that hold at least one of the terms, in ascending order
+func (ti *textIndex) candidates(terms []string) []int {
+	found := make(map[int]bool)
+
+	for _, t := range terms {
+		for id := range ti.postings[t] {
+			found[id] = true
+		}
+	}
+
+	ids := make([]int, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+
+	return ids
+}
+
+// score returns the BM25 score of a document for the given terms
+func (ti *textIndex) score(id int, terms []string) float64 {
+	n := float64(len(ti.lengths))
+
+	if n == 0 {
+		return 0
+	}
+
+	avgLength := float64(ti.totalLength) / n
+	length := float64(ti.lengths[id])
+	score := 0.0
+
+	for _, t := range uniqueTerms(terms) {
+		docs := ti.postings[t]
+		tf := float64(docs[id])
+
+		if tf == 0 {
+			continue
+		}
+
+		df := float64(len(docs))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+
+		score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*length/avgLength))
+	}
+
+	return score
+}
+
+// memoryUsage approximates the number of bytes that the postings and document lengths hold in memory
+func (ti *textIndex) memoryUsage() uint64 {
+	var size uint64
+
+	for t, docs := range ti.postings {
+		// term, map header and a document ID with its frequency for every document
+		size += uint64(len(t)) + 48 + uint64(len(docs))*16
+	}
+
+	return size + uint64(len(ti.lengths))*16
+}
+
+/**
+Splits a text into terms. Text is split on anything that is not a letter or a number, lowercased,
+stripped of stop words and stemmed. The same analysis is done on documents and on queries, so
+"Running Shoes" matches a search for "run shoe".
+*/
+func analyzeText(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		if stopWords[w] {
+			continue
+		}
+
+		terms = append(terms, stemWord(w))
+	}
+
+	return terms
+}
+
+// stemWord removes the most common English suffixes. Short words are left as they are
+func stemWord(w string) string {
+	if len(w) <= 3 {
+		return w
+	}
+
+	if strings.HasSuffix(w, "sses") {
+		return w[:len(w)-2]
+	} else if strings.HasSuffix(w, "ies") && len(w) > 4 {
+		return w[:len(w)-3] + "y"
+	} else if strings.HasSuffix(w, "ss") || strings.HasSuffix(w, "us") {
+		return w
+	} else if strings.HasSuffix(w, "s") {
+		w = w[:len(w)-1]
+	}
+
+	for _, suffix := range []string{"ing", "ed", "ly"} {
+		if strings.HasSuffix(w, suffix) && len(w)-len(suffix) >= 3 {
+			w = w[:len(w)-len(suffix)]
+
+			// running -> runn -> run
+			if l := len(w); l >= 2 && w[l-1] == w[l-2] && w[l-1] != 'l' && w[l-1] != 's' {
+				w = w[:l-1]
+			}
+
+			return w
+		}
+	}
+
+	return w
+}
+
+func uniqueTerms(terms []string) []string {
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(terms))
+
+	for _, t := range terms {
+		if !seen[t] {
+			seen[t] = true
+			unique = append(unique, t)
+		}
+	}
+
+	return unique
+}
+
+// matchesText returns true if the text holds at least one term of the search
+func matchesText(text string, search string) bool {
+	terms := make(map[string]bool)
+	for _, t := range analyzeText(search) {
+		terms[t] = true
+	}
+
+	for _, t := range analyzeText(text) {
+		if terms[t] {
+			return true
+		}
+	}
+
+	return false
+}
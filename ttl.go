@@ -0,0 +1,205 @@
+package rose
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// interval of the reaper that is started when Rose boots
+const defaultReapInterval = time.Minute
+
+// ReaperOptions configures the background reaper started with Rose.StartReaper
+type ReaperOptions struct {
+	// how often every collection is checked for expired documents
+	Interval time.Duration
+}
+
+type reaper struct {
+	stop chan bool
+	done sync.WaitGroup
+}
+
+// returns true if a TTL index of the collection says that the document has expired. The caller must hold the lock
+func (d *db) expired(id int, now time.Time) bool {
+	for _, fi := range d.FieldIndex {
+		if fi.Expired(id, now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// returns the IDs of every expired document, sorted. The caller must hold the lock
+func (d *db) expiredIds(now time.Time) []int {
+	seen := make(map[int]bool)
+	ids := make([]int, 0)
+
+	for _, fi := range d.FieldIndex {
+		for id := range fi.expires {
+			if !seen[id] && fi.Expired(id, now) {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	sort.Ints(ids)
+
+	return ids
+}
+
+// removes expired documents from query results that were found without the lock
+func (d *db) hideExpired(results []QueryResult) []QueryResult {
+	d.RLock()
+	defer d.RUnlock()
+
+	now := time.Now()
+	visible := results[:0]
+
+	for _, r := range results {
+		if !d.expired(r.ID, now) {
+			visible = append(visible, r)
+		}
+	}
+
+	return visible
+}
+
+/**
+Deletes every expired document of a collection and returns the number of deleted documents. Documents are deleted
+with Delete, so delete hooks run and watchers receive a delete change. Expired documents are hidden from Read, ReadBy
+and Query even before they are deleted.
+ */
+func (a *Rose) Reap(collName string) (int, Error) {
+	return a.reap(collName, nil)
+}
+
+// deletes expired documents of a collection one at a time, until every one is deleted or stop is closed
+func (a *Rose) reap(collName string, stop chan bool) (int, Error) {
+	ids, err := a.expiredIds(collName)
+
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		select {
+		case <-stop:
+			return deleted, nil
+		default:
+		}
+
+		// a document that was replaced since it was found can hold a new expiry
+		if expired, err := a.expiredIds(collName, id); err != nil || len(expired) == 0 {
+			continue
+		}
+
+		res, err := a.Delete(DeleteMetadata{CollectionName: collName, ID: id})
+
+		if err != nil {
+			return deleted, err
+		}
+
+		if res.Status == DeletedResultStatus {
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// returns the expired documents of a collection, only the ones with the given IDs if there are any
+func (a *Rose) expiredIds(collName string, ids ...int) ([]int, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
+	d, ok := a.Databases[collName]
+
+	if !ok {
+		return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid reap request. Collection %s does not exist", collName))
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	now := time.Now()
+
+	if len(ids) == 0 {
+		return d.expiredIds(now), nil
+	}
+
+	expired := make([]int, 0)
+	for _, id := range ids {
+		if d.expired(id, now) {
+			expired = append(expired, id)
+		}
+	}
+
+	return expired, nil
+}
+
+/**
+Starts a background reaper that deletes the expired documents of every collection in the given interval. A reaper with
+the default interval of a minute is started when Rose boots, stop it with StopReaper to start one with another interval.
+It runs until StopReaper or Shutdown is called.
+ */
+func (a *Rose) StartReaper(opts ReaperOptions) Error {
+	if opts.Interval <= 0 {
+		return newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, "Invalid reaper options. Interval must be greater than 0")
+	}
+
+	a.reaperLock.Lock()
+	defer a.reaperLock.Unlock()
+
+	if a.reaper != nil {
+		return newError(GenericMasterErrorCode, AppInvalidUsageCode, "Invalid reaper request. Reaper is already running")
+	}
+
+	r := &reaper{stop: make(chan bool)}
+	r.done.Add(1)
+
+	go r.run(a, opts)
+
+	a.reaper = r
+
+	return nil
+}
+
+// StopReaper stops the background reaper and waits for the delete that is running to finish. It does nothing if the reaper is not running
+func (a *Rose) StopReaper() {
+	a.reaperLock.Lock()
+	defer a.reaperLock.Unlock()
+
+	if a.reaper == nil {
+		return
+	}
+
+	close(a.reaper.stop)
+	a.reaper.done.Wait()
+
+	a.reaper = nil
+}
+
+// deletes expired documents of every collection in intervals until the reaper is stopped
+func (r *reaper) run(a *Rose, opts ReaperOptions) {
+	defer r.done.Done()
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			for _, collName := range a.ListCollections() {
+				// errors are retried on the next run, documents that are not deleted stay hidden
+				_, _ = a.reap(collName, r.stop)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package rose
+
+import (
+	"context"
+	"fmt"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var _ = GinkgoDescribe("TTL tests", func() {
+	GinkgoIt("Should hide expired documents and delete them with the reaper", func() {
+		dir, e := ioutil.TempDir("", "rose_ttl")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dir)
+
+		defer func() {
+			SetDataDir("")
+			_ = os.RemoveAll(dir)
+		}()
+
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "ttl_coll")
+
+		for _, invalid := range []struct {
+			options IndexOptions
+			msg string
+		}{
+			{IndexOptions{TTL: true, ExpireAfter: -1}, "Validation error. ExpireAfter of index createdAt cannot be negative"},
+			{IndexOptions{ExpireAfter: 60}, "Validation error. ExpireAfter of index createdAt is only valid for a TTL index"},
+		} {
+			err := a.NewIndex(collName, "createdAt", dateTimeIndexType, invalid.options)
+			gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+			gomega.Expect(err.GetCode()).To(gomega.Equal(InvalidUserSuppliedDataCode))
+			gomega.Expect(err.Error()).To(gomega.Equal(invalid.msg))
+		}
+
+		err := a.NewIndex(collName, "email", stringIndexType, IndexOptions{TTL: true})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Validation error. TTL index email must be a date or date_time index"))
+
+		err = a.NewCompoundIndex(collName, []IndexField{{Name: "createdAt", DataType: dateTimeIndexType}, {Name: "type", DataType: stringIndexType}}, IndexOptions{TTL: true})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Validation error. TTL index createdAt,type cannot be a compound index"))
+
+		// documents expire an hour after createdAt or at the date of updatedAt
+		gomega.Expect(a.NewIndex(collName, "createdAt", dateTimeIndexType, IndexOptions{TTL: true, ExpireAfter: 3600})).To(gomega.BeNil())
+		gomega.Expect(a.NewIndex(collName, "updatedAt", dateTimeIndexType, IndexOptions{TTL: true, Sparse: true})).To(gomega.BeNil())
+		gomega.Expect(a.NewIndex(collName, "type", stringIndexType)).To(gomega.BeNil())
+
+		now := time.Now().UTC()
+		past := now.Add(-2 * time.Hour).Format(time.RFC3339)
+		recent := now.Add(-time.Minute).Format(time.RFC3339)
+		future := now.Add(time.Hour).Format(time.RFC3339)
+
+		// expired
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Type: "user", CreatedAt: past, UpdatedAt: future})}, a)
+		// not expired
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Type: "user", CreatedAt: recent, UpdatedAt: future})}, a)
+		// expired by its own expiry
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Type: "user", CreatedAt: recent, UpdatedAt: recent})}, a)
+
+		user := TestUser{}
+		res, err := a.Read(ReadMetadata{CollectionName: collName, ID: 1, Data: &user})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(res.Status).To(gomega.Equal(NotFoundResultStatus))
+
+		testSingleRead(ReadMetadata{CollectionName: collName, ID: 2, Data: &user}, a)
+
+		res, err = a.Read(ReadMetadata{CollectionName: collName, ID: 3, Data: &user})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(res.Status).To(gomega.Equal(NotFoundResultStatus))
+
+		readBy, err := a.ReadBy(ReadByMetadata{CollectionName: collName, Field: "type", Value: "user", DataType: stringIndexType})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(len(readBy.Data)).To(gomega.Equal(1))
+		gomega.Expect(readBy.Data[0].ID).To(gomega.Equal(2))
+
+		// with an index and with a scan of every block
+		for _, query := range []string{"type:string == #type", "email:string == #email"} {
+			qb := NewQueryBuilder()
+			gomega.Expect(qb.If(collName, query, map[string]interface{}{"#type": "user", "#email": ""})).To(gomega.BeNil())
+
+			results, err := a.Query(qb)
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(len(results)).To(gomega.Equal(1))
+			gomega.Expect(results[0].ID).To(gomega.Equal(2))
+		}
+
+		// the delete of an expired document is a change that watchers receive
+		w, err := a.Watch(context.Background(), collName, WatchOptions{After: 3})
+		gomega.Expect(err).To(gomega.BeNil())
+
+		deleted, err := a.Reap(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(deleted).To(gomega.Equal(2))
+		gomega.Expect(len(a.Databases[collName].PrimaryIndex)).To(gomega.Equal(1))
+
+		for _, id := range []int{1, 3} {
+			change := testNextChange(w)
+			gomega.Expect(change.Type).To(gomega.Equal(DeleteChange))
+			gomega.Expect(change.ID).To(gomega.Equal(id))
+		}
+
+		w.Close()
+
+		deleted, err = a.Reap(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(deleted).To(gomega.Equal(0))
+
+		_, err = a.Reap("not_exists")
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid reap request. Collection not_exists does not exist"))
+
+		// the background reaper deletes documents that expire after it started
+		gomega.Expect(a.StartReaper(ReaperOptions{Interval: time.Minute})).To(gomega.Not(gomega.BeNil()))
+
+		a.StopReaper()
+		gomega.Expect(a.StartReaper(ReaperOptions{Interval: 10 * time.Millisecond})).To(gomega.BeNil())
+
+		expiresAt := time.Now().UTC().Add(time.Second).Format(time.RFC3339Nano)
+		testSingleReplace(ReplaceMetadata{CollectionName: collName, ID: 2, Data: testAsJsonInterface(TestUser{Type: "user", CreatedAt: recent, UpdatedAt: expiresAt})}, a)
+
+		gomega.Eventually(func() int {
+			a.Databases[collName].RLock()
+			defer a.Databases[collName].RUnlock()
+
+			return len(a.Databases[collName].PrimaryIndex)
+		}, 5 * time.Second, 20 * time.Millisecond).Should(gomega.Equal(0))
+
+		// TTL options are kept after a restart
+		testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Type: "user", CreatedAt: past, UpdatedAt: future})}, a)
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+
+		a = testCreateRose(false)
+
+		res, err = a.Read(ReadMetadata{CollectionName: collName, ID: 4, Data: &user})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(res.Status).To(gomega.Equal(NotFoundResultStatus))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+	})
+})
@@ -25,6 +25,8 @@ func (s str) compare(p string, t comparisonType) bool {
 		return strings.Compare(string(s), p) == -1 || strings.Compare(string(s), p) == 0
 	} else if t == moreEqual {
 		return strings.Compare(string(s), p) == 1 || strings.Compare(string(s), p) == 0
+	} else if t == textMatch {
+		return matchesText(string(s), p)
 	}
 
 	return false
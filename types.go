@@ -22,6 +22,20 @@ const BlockCorruptedCode = 11
 const OperatingSystemCode = 12
 const MalformedIndexCode = 13
 const IndexExistsCode = 14
+const DuplicateKeyCode = 15
+const IndexBuildingCode = 16
+// a request to the server did not carry valid credentials
+const UnauthenticatedCode = 17
+// an authenticated user does not have the role that a request needs
+const PermissionDeniedCode = 18
+// a Watcher ended because its context is done or its collection was closed
+const WatchClosedCode = 19
+// a Watcher cannot continue from its cursor because the change log no longer holds the changes after it or could not save them
+const ChangesTrimmedCode = 20
+// a hook returned an error that is not a rose Error and aborted the operation
+const HookAbortedCode = 21
+// a document does not match the JSON Schema of its collection
+const SchemaViolationCode = 22
 
 // result status
 const OkResultStatus = "ok"
@@ -72,6 +86,8 @@ const floatType dataType = "float"
 const boolType dataType = "bool"
 const dateType dataType = "date"
 const dateTimeType dataType = "date_time"
+// a {"lat": .., "lng": ..} object, compared only with the near and within operators
+const geoType dataType = "geo"
 
 func (d dataType) isValid() bool {
 	return !(d != stringType && d != intType && d != floatType && d != boolType)
@@ -95,3 +111,6 @@ const less comparisonType = "less"
 const more comparisonType = "more"
 const lessEqual comparisonType = "lessEqual"
 const moreEqual comparisonType = "moreEqual"
+const textMatch comparisonType = "matches"
+const geoNear comparisonType = "near"
+const geoWithin comparisonType = "within"
@@ -204,20 +204,43 @@ func createDateFromString(parts []string) time.Time {
 }
 
 func getDateFromString(s string) time.Time {
+	t, _ := parseDate(s)
+
+	return t
+}
+
+/**
+Parses a date in YYYY-MM-DD or YYYY-MM-DD HH:MM:SS format, in which case the date is in UTC, or in RFC 3339 format
+with a timezone, in which case the date is converted to UTC. Returns false if the string is not a date in any of those formats.
+ */
+func parseDate(s string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC(), true
+	}
+
 	sp := strings.Split(s, " ")
 
-	if len(sp) == 2 {
-		t := strings.Split(sp[0], "-")
-		p := strings.Split(sp[1], ":")
+	if len(sp) > 2 {
+		return time.Time{}, false
+	}
 
-		t = append(t, p...)
+	parts := strings.Split(sp[0], "-")
+
+	if len(sp) == 2 {
+		parts = append(parts, strings.Split(sp[1], ":")...)
+	}
 
-		return createDateFromString(t)
+	if len(parts) != 3 && len(parts) != 6 {
+		return time.Time{}, false
 	}
 
-	sp = strings.Split(s,"-")
+	for _, p := range parts {
+		if _, err := strconv.Atoi(p); err != nil {
+			return time.Time{}, false
+		}
+	}
 
-	return createDateFromString(sp)
+	return createDateFromString(parts), true
 }
 
 func hasString(s []string, t string) bool {
@@ -230,6 +253,16 @@ func hasString(s []string, t string) bool {
 	return false
 }
 
+func joinInts(ints []int, sep string) string {
+	s := make([]string, 0, len(ints))
+
+	for _, i := range ints {
+		s = append(s, strconv.Itoa(i))
+	}
+
+	return strings.Join(s, sep)
+}
+
 func isIndexDataType(d string) bool {
 	if d == string(floatIndexType) {
 		return true
@@ -247,6 +280,10 @@ func isIndexDataType(d string) bool {
 		return true
 	}
 
+	if d == string(dateIndexType) || d == string(dateTimeIndexType) {
+		return true
+	}
+
 	return false
 }
 
@@ -0,0 +1,620 @@
+package rose
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/valyala/fastjson"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// directory in the data directory that Fsck moves the lines it removes from blocks into
+const quarantineDir = "quarantine"
+
+type IntegrityProblemKind string
+
+// a line of a block that Rose cannot read, e.i. a line without an ID, with an invalid document or a partially written one
+const MalformedLineProblem IntegrityProblemKind = "malformed_line"
+// a document with an ID that another line of the collection already holds
+const DuplicateIdProblem IntegrityProblemKind = "duplicate_id"
+// a document in a block other than the one that its ID belongs to, where reads do not look for it
+const MisplacedIdProblem IntegrityProblemKind = "misplaced_id"
+// an index entry that does not point at the line of its document, e.i. at a deleted document
+const StaleIndexEntryProblem IntegrityProblemKind = "stale_index_entry"
+// an index definition in indexes.rose of a collection that does not exist
+const OrphanIndexProblem IntegrityProblemKind = "orphan_index"
+// a line of indexes.rose that Rose cannot read, which stops Rose from booting
+const MalformedIndexProblem IntegrityProblemKind = "malformed_index"
+
+type IntegrityProblem struct {
+	Kind IntegrityProblemKind `json:"kind"`
+	Collection string `json:"collection"`
+	// block file and offset of the line, set for problems with a line of a block
+	Block string `json:"block,omitempty"`
+	Offset int64 `json:"offset"`
+	// ID of the document, 0 if the line does not have a valid ID
+	ID int `json:"id,omitempty"`
+	// name of the index of a stale entry or an index definition
+	Index string `json:"index,omitempty"`
+	Message string `json:"message"`
+	// fixed by Fsck with FsckOptions.Repair
+	Repaired bool `json:"repaired"`
+}
+
+type VerifyReport struct {
+	Collections int `json:"collections"`
+	Blocks int `json:"blocks"`
+	// documents that are readable, without the ones that have a problem
+	Documents int `json:"documents"`
+	Problems []IntegrityProblem `json:"problems"`
+	// directory with the lines that a repair removed from blocks, empty if nothing was removed
+	QuarantineDir string `json:"quarantineDir,omitempty"`
+}
+
+// Healthy reports whether every problem of the report is repaired
+func (r *VerifyReport) Healthy() bool {
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			return false
+		}
+	}
+
+	return true
+}
+
+type FsckOptions struct {
+	// moves the lines of blocks that have a problem into the quarantine directory and removes index definitions
+	// that have a problem, after which the database is opened to rebuild its indexes from the repaired blocks
+	Repair bool
+}
+
+// a line that is removed from its block by a repair
+type badLine struct {
+	offset int64
+	raw []uint8
+}
+
+// the result of reading every block of a collection
+type collectionCheck struct {
+	blocks int
+	documents int
+	problems []IntegrityProblem
+	// IDs of the readable documents by block and offset, used to check where index entries point at
+	documentsAt map[uint16]map[int64]int
+	tombstonesAt map[uint16]map[int64]bool
+	bad map[uint16][]badLine
+}
+
+// a line that holds a document with a valid ID
+type documentLine struct {
+	id int
+	blockId uint16
+	offset int64
+	raw []uint8
+}
+
+/**
+Verify reads every block of a collection and reports the lines that Rose cannot read, documents with duplicate IDs,
+documents in a block other than the one that their ID belongs to and index entries that do not point at their document.
+An empty collection name verifies every collection and also reports index definitions of collections that do not exist.
+
+Writes to a collection wait while it is verified. Verify does not change anything, problems are repaired with Fsck
+while the database is not open.
+*/
+func (a *Rose) Verify(collName string) (*VerifyReport, Error) {
+	a.collLock.RLock()
+	defer a.collLock.RUnlock()
+
+	names := make([]string, 0)
+
+	if collName != "" {
+		if _, ok := a.Databases[collName]; !ok {
+			return nil, newError(ValidationMasterErrorCode, InvalidUserSuppliedDataCode, fmt.Sprintf("Invalid verify request. Collection %s does not exist", collName))
+		}
+
+		names = append(names, collName)
+	} else {
+		for name := range a.Databases {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+	}
+
+	report := &VerifyReport{Problems: make([]IntegrityProblem, 0)}
+
+	for _, name := range names {
+		d := a.Databases[name]
+
+		d.RLock()
+		check, err := checkCollection(name)
+
+		if err == nil {
+			check.problems = append(check.problems, d.staleIndexEntries(check)...)
+		}
+		d.RUnlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		report.add(check)
+	}
+
+	if collName == "" {
+		a.fsIndexHandler.Lock()
+		for _, idx := range a.fsIndexHandler.indexes {
+			if _, ok := a.Databases[idx.Name]; !ok {
+				report.Problems = append(report.Problems, orphanIndexProblem(idx.Name, idx.Field))
+			}
+		}
+		a.fsIndexHandler.Unlock()
+	}
+
+	return report, nil
+}
+
+/**
+Fsck checks a data directory that is not open, the same way as Verify checks every collection. Unlike Verify, it does not
+need to boot the database, so it also finds the problems that stop Rose from booting, e.i. "Invalid row encountered".
+Index entries are not checked since indexes are held in memory and built when the database boots.
+
+With FsckOptions.Repair, every line that has a problem is moved into quarantine/<collection>/<block> in the data
+directory and index definitions that have a problem are removed from indexes.rose. Of documents with the same ID,
+the first one in the block of the ID is kept since that is the one that reads return. The database is then opened,
+which rebuilds its indexes from the repaired blocks, and closed again.
+
+Fsck fails if the data directory is used by another process or by a Rose in this process.
+*/
+func Fsck(options FsckOptions) (*VerifyReport, Error) {
+	if _, err := createDbIfNotExists(false); err != nil {
+		return nil, err
+	}
+
+	dir, err := lockDataDirExclusively()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = unlockDataDir(dir)
+	}()
+
+	// a restore that was verified but stopped while it replaced the database is finished the same as on boot
+	if err := finishRestore(); err != nil {
+		return nil, err
+	}
+
+	if err := createIndexLocationIfNotExists(); err != nil {
+		return nil, err
+	}
+
+	colls, e := ioutil.ReadDir(roseDbDir())
+
+	if e != nil {
+		return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Could not read %s directory. This is probably a permissions problem with underlying message: %s", roseDbDir(), e.Error()))
+	}
+
+	report := &VerifyReport{Problems: make([]IntegrityProblem, 0)}
+	exists := make(map[string]bool)
+
+	for _, fi := range colls {
+		if !fi.IsDir() {
+			continue
+		}
+
+		exists[fi.Name()] = true
+
+		check, err := checkCollection(fi.Name())
+
+		if err != nil {
+			return nil, err
+		}
+
+		if options.Repair && len(check.bad) > 0 {
+			if err := quarantineLines(fi.Name(), check.bad); err != nil {
+				return nil, err
+			}
+
+			for i := range check.problems {
+				check.problems[i].Repaired = true
+			}
+
+			report.QuarantineDir = fmt.Sprintf("%s/%s", roseDir(), quarantineDir)
+		}
+
+		report.add(check)
+	}
+
+	if err := checkIndexDefinitions(report, exists, options.Repair); err != nil {
+		return nil, err
+	}
+
+	if !options.Repair {
+		return report, nil
+	}
+
+	// booting rebuilds every index from the repaired blocks and fails the same way as New() would
+	r, err := open(false)
+
+	if err != nil {
+		return nil, newError(DbIntegrityMasterErrorCode, BlockCorruptedCode, fmt.Sprintf("Repair finished but the database cannot be opened with underlying message: %s", err.Error()))
+	}
+
+	return report, r.Shutdown()
+}
+
+func (r *VerifyReport) add(check *collectionCheck) {
+	r.Collections++
+	r.Blocks += check.blocks
+	r.Documents += check.documents
+	r.Problems = append(r.Problems, check.problems...)
+}
+
+func orphanIndexProblem(collName string, index string) IntegrityProblem {
+	return IntegrityProblem{
+		Kind: OrphanIndexProblem,
+		Collection: collName,
+		Index: index,
+		Message: fmt.Sprintf("Index '%s' is defined for collection %s that does not exist", index, collName),
+	}
+}
+
+/**
+Reads every block of a collection without the line reader that boot uses, which stops at the first line it cannot read.
+The caller must hold the lock of the collection if it is open.
+*/
+func checkCollection(collName string) (*collectionCheck, Error) {
+	collDir := fmt.Sprintf("%s/%s", roseDbDir(), collName)
+	blocks, err := listBlocks(collDir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	check := &collectionCheck{
+		blocks: len(blocks),
+		problems: make([]IntegrityProblem, 0),
+		documentsAt: make(map[uint16]map[int64]int),
+		tombstonesAt: make(map[uint16]map[int64]bool),
+		bad: make(map[uint16][]badLine),
+	}
+
+	lines := make([]documentLine, 0)
+	for _, blockId := range blocks {
+		check.documentsAt[blockId] = make(map[int64]int)
+		check.tombstonesAt[blockId] = make(map[int64]bool)
+
+		blockLines, err := check.readBlock(collName, collDir, blockId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		lines = append(lines, blockLines...)
+	}
+
+	// lines are in order of blocks and offsets, so the first line of an ID in its own block is the one that boot indexes
+	owners := make(map[int]documentLine)
+	for _, l := range lines {
+		if l.id / blockMark != int(l.blockId) {
+			continue
+		}
+
+		if owner, ok := owners[l.id]; ok {
+			check.fail(collName, l, DuplicateIdProblem, fmt.Sprintf("Document with ID %d is also at offset %d of %s, which is the one that reads return", l.id, owner.offset, blockFileName(owner.blockId)))
+
+			continue
+		}
+
+		owners[l.id] = l
+	}
+
+	for _, l := range lines {
+		if l.id / blockMark == int(l.blockId) {
+			continue
+		}
+
+		if owner, ok := owners[l.id]; ok {
+			check.fail(collName, l, DuplicateIdProblem, fmt.Sprintf("Document with ID %d is also at offset %d of %s, the block that the ID belongs to", l.id, owner.offset, blockFileName(owner.blockId)))
+
+			continue
+		}
+
+		check.fail(collName, l, MisplacedIdProblem, fmt.Sprintf("Document with ID %d belongs to block_%d.rose", l.id, l.id / blockMark))
+	}
+
+	check.documents = len(owners)
+
+	return check, nil
+}
+
+// reads the lines of a block and returns the ones that hold a document with a valid ID
+func (check *collectionCheck) readBlock(collName string, collDir string, blockId uint16) ([]documentLine, Error) {
+	file, err := createFile(roseBlockFile(blockId, collDir), os.O_RDONLY)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	lines := make([]documentLine, 0)
+
+	var offset int64
+	for {
+		line, e := reader.ReadBytes('\n')
+
+		if e != nil && e != io.EOF {
+			return nil, newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Reading file %s failed with message: %s", file.Name(), e.Error()))
+		}
+
+		if len(line) == 0 {
+			break
+		}
+
+		l := documentLine{blockId: blockId, offset: offset, raw: line}
+		offset += int64(len(line))
+		content := bytes.TrimSuffix(line, []uint8("\n"))
+
+		if e == io.EOF {
+			check.fail(collName, l, MalformedLineProblem, "Line does not end with a new line, it was not written completely")
+
+			break
+		}
+
+		if bytes.HasPrefix(content, []uint8(delMark)) {
+			check.tombstonesAt[blockId][l.offset] = true
+
+			continue
+		}
+
+		parts := strings.Split(string(content), delim)
+
+		if len(parts) != 2 {
+			check.fail(collName, l, MalformedLineProblem, "Line must hold an ID and a document separated by the delimiter")
+
+			continue
+		}
+
+		id, convErr := strconv.Atoi(parts[0])
+
+		if convErr != nil || id < 1 {
+			check.fail(collName, l, MalformedLineProblem, fmt.Sprintf("Line has an invalid ID '%s'. ID must be a positive integer", parts[0]))
+
+			continue
+		}
+
+		l.id = id
+
+		if fastjson.Validate(parts[1]) != nil {
+			check.fail(collName, l, MalformedLineProblem, fmt.Sprintf("Document with ID %d is not valid JSON", id))
+
+			continue
+		}
+
+		check.documentsAt[blockId][l.offset] = id
+		lines = append(lines, l)
+	}
+
+	return lines, nil
+}
+
+func (check *collectionCheck) fail(collName string, l documentLine, kind IntegrityProblemKind, msg string) {
+	check.problems = append(check.problems, IntegrityProblem{
+		Kind: kind,
+		Collection: collName,
+		Block: blockFileName(l.blockId),
+		Offset: l.offset,
+		ID: l.id,
+		Message: msg,
+	})
+
+	delete(check.documentsAt[l.blockId], l.offset)
+	check.bad[l.blockId] = append(check.bad[l.blockId], badLine{offset: l.offset, raw: l.raw})
+}
+
+// returns every entry of the primary and field indexes that does not point at the line of its document. The caller must hold the lock
+func (d *db) staleIndexEntries(check *collectionCheck) []IntegrityProblem {
+	problems := make([]IntegrityProblem, 0)
+
+	stale := func(index string, id int, blockId uint16, offset int64) {
+		if check.documentsAt[blockId][offset] == id {
+			return
+		}
+
+		msg := fmt.Sprintf("Entry of document with ID %d does not point at the start of a line", id)
+
+		if check.tombstonesAt[blockId][offset] {
+			msg = fmt.Sprintf("Entry of document with ID %d points at a deleted document", id)
+		} else if other, ok := check.documentsAt[blockId][offset]; ok {
+			msg = fmt.Sprintf("Entry of document with ID %d points at document with ID %d", id, other)
+		}
+
+		problems = append(problems, IntegrityProblem{
+			Kind: StaleIndexEntryProblem,
+			Collection: d.Name,
+			Block: blockFileName(blockId),
+			Offset: offset,
+			ID: id,
+			Index: index,
+			Message: msg,
+		})
+	}
+
+	for id, offset := range d.PrimaryIndex {
+		stale("primary", id, d.getBlockId(id), offset)
+	}
+
+	for name, idx := range d.FieldIndex {
+		for _, entry := range idx.Index {
+			if entry.removed {
+				continue
+			}
+
+			stale(name, entry.ID, entry.BlockId, entry.Pos)
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].Index != problems[j].Index {
+			return problems[i].Index < problems[j].Index
+		}
+
+		return problems[i].ID < problems[j].ID
+	})
+
+	return problems
+}
+
+/**
+Appends the bad lines of every block into the quarantine directory and rewrites the block without them. A block is
+rewritten only after its lines are synced into the quarantine, so a crash does not lose a line.
+*/
+func quarantineLines(collName string, bad map[uint16][]badLine) Error {
+	collDir := fmt.Sprintf("%s/%s", roseDbDir(), collName)
+	dstDir := fmt.Sprintf("%s/%s/%s", roseDir(), quarantineDir, collName)
+
+	if e := os.MkdirAll(dstDir, os.ModePerm); e != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to create quarantine directory %s with underlying message: %s", dstDir, e.Error()))
+	}
+
+	for blockId, lines := range bad {
+		sort.Slice(lines, func(i, j int) bool {
+			return lines[i].offset < lines[j].offset
+		})
+
+		dst, err := createFile(roseBlockFile(blockId, dstDir), os.O_RDWR|os.O_CREATE|os.O_APPEND)
+
+		if err != nil {
+			return err
+		}
+
+		removed := make(map[int64]bool)
+		for _, l := range lines {
+			removed[l.offset] = true
+
+			if !bytes.HasSuffix(l.raw, []uint8("\n")) {
+				l.raw = append(l.raw, '\n')
+			}
+
+			if _, e := dst.Write(l.raw); e != nil {
+				_ = dst.Close()
+
+				return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to write into %s with underlying message: %s", dst.Name(), e.Error()))
+			}
+		}
+
+		if e := dst.Sync(); e != nil {
+			_ = dst.Close()
+
+			return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to sync %s with underlying message: %s", dst.Name(), e.Error()))
+		}
+
+		if err := closeFile(dst); err != nil {
+			return err
+		}
+
+		if err := removeBlockLines(roseBlockFile(blockId, collDir), removed); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewrites a block without the lines that start at the given offsets
+func removeBlockLines(fileName string, removed map[int64]bool) Error {
+	b, e := ioutil.ReadFile(fileName)
+
+	if e != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to read block %s with underlying message: %s", fileName, e.Error()))
+	}
+
+	var buf bytes.Buffer
+	var offset int64
+	for len(b) > 0 {
+		end := bytes.IndexByte(b, '\n') + 1
+
+		if end == 0 {
+			end = len(b)
+		}
+
+		if !removed[offset] {
+			buf.Write(b[:end])
+		}
+
+		offset += int64(end)
+		b = b[end:]
+	}
+
+	return replaceFile(fileName, buf.Bytes())
+}
+
+// checks every line of indexes.rose, with repair the lines that have a problem are removed from it
+func checkIndexDefinitions(report *VerifyReport, collections map[string]bool, repair bool) Error {
+	location := roseIndexLocation()
+	b, e := ioutil.ReadFile(location)
+
+	if e != nil {
+		return newError(FilesystemMasterErrorCode, FsPermissionsCode, fmt.Sprintf("Unable to read index file %s with underlying message: %s", location, e.Error()))
+	}
+
+	problems := make([]IntegrityProblem, 0)
+	content := ""
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+
+		ih := &indexFsHandler{}
+		err := ih.init([]uint8(line))
+
+		if err == nil {
+			err = ih.indexes[0].validate()
+		}
+
+		if err != nil {
+			problems = append(problems, IntegrityProblem{
+				Kind: MalformedIndexProblem,
+				Collection: strings.Split(line, delim)[0],
+				Message: err.Error(),
+			})
+
+			continue
+		}
+
+		if idx := ih.indexes[0]; !collections[idx.Name] {
+			problems = append(problems, orphanIndexProblem(idx.Name, idx.Field))
+
+			continue
+		}
+
+		content += line + "\n"
+	}
+
+	if repair && len(problems) > 0 {
+		if err := replaceFile(location, []uint8(content)); err != nil {
+			return err
+		}
+
+		for i := range problems {
+			problems[i].Repaired = true
+		}
+	}
+
+	report.Problems = append(report.Problems, problems...)
+
+	return nil
+}
+
+func blockFileName(blockId uint16) string {
+	return fmt.Sprintf("block_%d.rose", blockId)
+}
@@ -0,0 +1,188 @@
+package rose
+
+import (
+	"fmt"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+)
+
+var _ = GinkgoDescribe("Verify and fsck tests", func() {
+	GinkgoIt("Should verify an open database and report stale index entries and orphan index definitions", func() {
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "verify_coll")
+
+		err := a.NewIndex(collName, "email", stringIndexType)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		for i := 0; i < 20; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		deletedOffset := a.Databases[collName].PrimaryIndex[3]
+
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 3}, a)
+		testSingleReplace(ReplaceMetadata{CollectionName: collName, ID: 4, Data: testAsJsonInterface(TestUser{Email: "replaced@gmail.com"})}, a)
+
+		report, err := a.Verify(collName)
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(report.Healthy()).To(gomega.BeTrue())
+		gomega.Expect(report.Problems).To(gomega.BeEmpty())
+		gomega.Expect(report.Collections).To(gomega.Equal(1))
+		gomega.Expect(report.Blocks).To(gomega.Equal(1))
+		gomega.Expect(report.Documents).To(gomega.Equal(19))
+
+		// the entry of document 5 points at the deleted document 3, the one of document 7 at the line of document 1
+		d := a.Databases[collName]
+		d.Lock()
+		d.PrimaryIndex[5] = deletedOffset
+		for i, entry := range d.FieldIndex["email"].Index {
+			if entry.ID == 7 {
+				d.FieldIndex["email"].Index[i].Pos = 0
+			}
+		}
+		d.Unlock()
+
+		gomega.Expect(a.fsIndexHandler.Add(newFsIndex("dropped_coll", []IndexField{{Name: "email", DataType: stringIndexType}}, IndexOptions{}))).To(gomega.BeNil())
+
+		report, err = a.Verify("")
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(report.Healthy()).To(gomega.BeFalse())
+		gomega.Expect(report.Problems).To(gomega.Equal([]IntegrityProblem{
+			{Kind: StaleIndexEntryProblem, Collection: collName, Block: "block_0.rose", Offset: 0, ID: 7, Index: "email", Message: "Entry of document with ID 7 points at document with ID 1"},
+			{Kind: StaleIndexEntryProblem, Collection: collName, Block: "block_0.rose", Offset: deletedOffset, ID: 5, Index: "primary", Message: "Entry of document with ID 5 points at a deleted document"},
+			{Kind: OrphanIndexProblem, Collection: "dropped_coll", Index: "email", Message: "Index 'email' is defined for collection dropped_coll that does not exist"},
+		}))
+
+		_, err = a.Verify("not_exists")
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.Equal("Invalid verify request. Collection not_exists does not exist"))
+
+		_, err = Fsck(FsckOptions{})
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.ContainSubstring("It is open in this process"))
+
+		if err := a.Shutdown(); err != nil {
+			testRemoveFileSystemDb(roseDir())
+
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		testRemoveFileSystemDb(roseDir())
+	})
+
+	GinkgoIt("Should find the lines that stop boot and quarantine them with a repair", func() {
+		// other tests leave databases open in the default directory, which Fsck refuses to check
+		dir, e := ioutil.TempDir("", "rose_fsck")
+		gomega.Expect(e).To(gomega.BeNil())
+
+		SetDataDir(dir)
+
+		defer func() {
+			SetDataDir("")
+			_ = os.RemoveAll(dir)
+		}()
+
+		a := testCreateRose(false)
+		collName := testCreateCollection(a, "fsck_coll")
+
+		err := a.NewIndex(collName, "email", stringIndexType)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		for i := 0; i < 10; i++ {
+			testSingleConcurrentInsert(WriteMetadata{CollectionName: collName, Data: testAsJsonInterface(TestUser{Email: fmt.Sprintf("%d@gmail.com", i)})}, a)
+		}
+
+		testSingleDelete(DeleteMetadata{CollectionName: collName, ID: 2}, a)
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+
+			return
+		}
+
+		blockFile := roseBlockFile(0, fmt.Sprintf("%s/%s", roseDbDir(), collName))
+		original, e := ioutil.ReadFile(blockFile)
+		gomega.Expect(e).To(gomega.BeNil())
+
+		lines := []string{
+			"garbage\n",
+			"1" + delim + `{"email": "duplicate@gmail.com"}` + "\n",
+			fmt.Sprintf("%d%s%s\n", blockMark + 1, delim, `{"email": "misplaced@gmail.com"}`),
+			"11" + delim + "{not json\n",
+			"12" + delim + `{"email": "trunc`,
+		}
+
+		corrupted := string(original)
+		offsets := make([]int64, 0)
+		for _, l := range lines {
+			offsets = append(offsets, int64(len(corrupted)))
+			corrupted += l
+		}
+
+		gomega.Expect(ioutil.WriteFile(blockFile, []uint8(corrupted), 0666)).To(gomega.BeNil())
+
+		indexes, e := ioutil.ReadFile(roseIndexLocation())
+		gomega.Expect(e).To(gomega.BeNil())
+		gomega.Expect(ioutil.WriteFile(roseIndexLocation(), append(indexes, []uint8("malformed\n")...), 0666)).To(gomega.BeNil())
+
+		_, err = New(false)
+		gomega.Expect(err).To(gomega.Not(gomega.BeNil()))
+		gomega.Expect(err.Error()).To(gomega.ContainSubstring("Found malformed index value"))
+
+		report, err := Fsck(FsckOptions{})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(report.Healthy()).To(gomega.BeFalse())
+		gomega.Expect(report.Documents).To(gomega.Equal(9))
+
+		gomega.Expect(report.Problems).To(gomega.Equal([]IntegrityProblem{
+			{Kind: MalformedLineProblem, Collection: collName, Block: "block_0.rose", Offset: offsets[0], Message: "Line must hold an ID and a document separated by the delimiter"},
+			{Kind: MalformedLineProblem, Collection: collName, Block: "block_0.rose", Offset: offsets[3], ID: 11, Message: "Document with ID 11 is not valid JSON"},
+			{Kind: MalformedLineProblem, Collection: collName, Block: "block_0.rose", Offset: offsets[4], Message: "Line does not end with a new line, it was not written completely"},
+			{Kind: DuplicateIdProblem, Collection: collName, Block: "block_0.rose", Offset: offsets[1], ID: 1, Message: "Document with ID 1 is also at offset 0 of block_0.rose, which is the one that reads return"},
+			{Kind: MisplacedIdProblem, Collection: collName, Block: "block_0.rose", Offset: offsets[2], ID: blockMark + 1, Message: fmt.Sprintf("Document with ID %d belongs to block_1.rose", blockMark + 1)},
+			{Kind: MalformedIndexProblem, Collection: "malformed", Message: "A system error occurred and Rose cannot be booted. Found malformed index value -> malformed"},
+		}))
+
+		// nothing is changed without a repair
+		b, e := ioutil.ReadFile(blockFile)
+		gomega.Expect(e).To(gomega.BeNil())
+		gomega.Expect(string(b)).To(gomega.Equal(corrupted))
+
+		report, err = Fsck(FsckOptions{Repair: true})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(report.Healthy()).To(gomega.BeTrue())
+		gomega.Expect(len(report.Problems)).To(gomega.Equal(6))
+		gomega.Expect(report.QuarantineDir).To(gomega.Equal(fmt.Sprintf("%s/quarantine", roseDir())))
+
+		b, e = ioutil.ReadFile(blockFile)
+		gomega.Expect(e).To(gomega.BeNil())
+		gomega.Expect(string(b)).To(gomega.Equal(string(original)))
+
+		quarantined, e := ioutil.ReadFile(fmt.Sprintf("%s/quarantine/%s/block_0.rose", roseDir(), collName))
+		gomega.Expect(e).To(gomega.BeNil())
+		gomega.Expect(string(quarantined)).To(gomega.Equal(corrupted[len(original):] + "\n"))
+
+		report, err = Fsck(FsckOptions{})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(report.Problems).To(gomega.BeEmpty())
+
+		a = testCreateRose(false)
+
+		u := TestUser{}
+		gomega.Expect(testSingleRead(ReadMetadata{ID: 1, Data: &u, CollectionName: collName}, a).Status).To(gomega.Equal(FoundResultStatus))
+		gomega.Expect(u.Email).To(gomega.Equal("0@gmail.com"))
+
+		report, err = a.Verify("")
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(report.Problems).To(gomega.BeEmpty())
+		gomega.Expect(report.Documents).To(gomega.Equal(9))
+
+		if err := a.Shutdown(); err != nil {
+			ginkgo.Fail(fmt.Sprintf("Rose failed to shutdown with message: %s", err.Error()))
+		}
+	})
+})